@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessType is the likely technology of the access link
+type AccessType string
+
+const (
+	AccessUnknown   AccessType = "unknown"
+	AccessPPPoE     AccessType = "pppoe"
+	AccessDSLite    AccessType = "ds-lite"
+	AccessMobile    AccessType = "mobile"
+	AccessSatellite AccessType = "satellite"
+	AccessCGNAT     AccessType = "cgnat"
+)
+
+var accessNames = map[AccessType]string{
+	AccessUnknown:   "Unknown",
+	AccessPPPoE:     "PPPoE (DSL/fiber)",
+	AccessDSLite:    "DS-Lite (IPv4 over IPv6)",
+	AccessMobile:    "LTE/5G mobile",
+	AccessSatellite: "Satellite",
+	AccessCGNAT:     "Carrier-grade NAT",
+}
+
+func (a AccessType) String() string {
+	if name, ok := accessNames[a]; ok {
+		return name
+	}
+	return string(a)
+}
+
+// AccessGuess is the inferred access technology and the hints behind it
+type AccessGuess struct {
+	Type  AccessType `json:"type"`
+	Hints []string   `json:"hints,omitempty"`
+	MTU   int        `json:"mtu,omitempty"`
+	PTR   string     `json:"ptr,omitempty"`
+}
+
+// Address ranges that identify carrier setups
+var (
+	sharedAddressSpace = mustCIDR("100.64.0.0/10") // RFC 6598, CGNAT
+	dsLiteB4Range      = mustCIDR("192.0.0.0/29")  // RFC 6333 B4 element
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// PTR name fragments and what they suggest
+var ptrHints = []struct {
+	fragment string
+	access   AccessType
+}{
+	{"starlink", AccessSatellite},
+	{"sat", AccessSatellite},
+	{"pppoe", AccessPPPoE},
+	{"dsl", AccessPPPoE},
+	{"lte", AccessMobile},
+	{"mobile", AccessMobile},
+	{"4g", AccessMobile},
+	{"5g", AccessMobile},
+	{"wireless", AccessMobile},
+}
+
+// localInterface returns the interface holding ip
+func localInterface(ip string) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ifaces {
+		addrs, _ := ifaces[i].Addrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.String() == ip {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// guessAccess scores each access type from the local interface, the
+// addresses and the RTT profile of the binding probes, and the public IP's
+// reverse DNS name. Each hint adds a vote; the type with most votes wins.
+func guessAccess(result *NatResult) *AccessGuess {
+	guess := &AccessGuess{Type: AccessUnknown}
+	votes := make(map[AccessType]int)
+	hint := func(access AccessType, text string) {
+		votes[access]++
+		guess.Hints = append(guess.Hints, text)
+	}
+
+	if iface := localInterface(result.LocalIP); iface != nil {
+		guess.MTU = iface.MTU
+		switch iface.MTU {
+		case 1492:
+			hint(AccessPPPoE, "MTU 1492 leaves room for an 8-byte PPPoE header")
+		case 1460, 1452:
+			hint(AccessDSLite, "MTU "+strconv.Itoa(iface.MTU)+" matches an IPv4-in-IPv6 tunnel")
+		}
+		name := strings.ToLower(iface.Name)
+		for _, prefix := range []string{"wwan", "rmnet", "ccmni", "pdp_ip", "wwp"} {
+			if strings.HasPrefix(name, prefix) {
+				hint(AccessMobile, "interface "+iface.Name+" is a cellular modem")
+			}
+		}
+		if strings.HasPrefix(name, "ppp") {
+			hint(AccessPPPoE, "interface "+iface.Name+" is a PPP link")
+		}
+	}
+
+	if ip := net.ParseIP(result.LocalIP); ip != nil {
+		if dsLiteB4Range.Contains(ip) {
+			hint(AccessDSLite, "local address "+result.LocalIP+" is in the DS-Lite B4 range")
+		}
+		if sharedAddressSpace.Contains(ip) {
+			hint(AccessMobile, "the device itself has a carrier-shared address, as mobile networks assign")
+		}
+	}
+	if g := result.Gateway; g != nil && g.WAN != nil {
+		if ip := net.ParseIP(g.WAN.Address); ip != nil && sharedAddressSpace.Contains(ip) {
+			hint(AccessCGNAT, "the gateway's WAN address is in 100.64.0.0/10")
+		}
+	}
+
+	// Geostationary links take over half a second; mobile links are
+	// moderately slow and jittery
+	var rtts []time.Duration
+	for _, e := range result.Evidence {
+		if (e.Test == TestBinding || e.Test == TestStability) && e.Passed {
+			rtts = append(rtts, e.RTT)
+		}
+	}
+	if len(rtts) > 0 {
+		median := medianDuration(rtts)
+		lo, hi := rtts[0], rtts[0]
+		for _, rtt := range rtts {
+			lo = min(lo, rtt)
+			hi = max(hi, rtt)
+		}
+		switch {
+		case median > 480*time.Millisecond:
+			hint(AccessSatellite, "median RTT "+formatMillis(median)+" suggests a geostationary satellite")
+		case len(rtts) >= 3 && median > 30*time.Millisecond && hi-lo > median/2:
+			hint(AccessMobile, "RTT varies "+formatMillis(lo)+" to "+formatMillis(hi)+", typical of a radio link")
+		}
+	}
+
+	if result.Public != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		names, err := net.DefaultResolver.LookupAddr(ctx, result.Public.IP.String())
+		cancel()
+		if err == nil && len(names) > 0 {
+			guess.PTR = strings.TrimSuffix(names[0], ".")
+			ptr := strings.ToLower(guess.PTR)
+			for _, h := range ptrHints {
+				if strings.Contains(ptr, h.fragment) {
+					hint(h.access, "reverse DNS "+guess.PTR+" mentions "+h.fragment)
+					break
+				}
+			}
+		}
+	}
+
+	best := 0
+	for _, access := range []AccessType{AccessSatellite, AccessDSLite, AccessMobile, AccessPPPoE, AccessCGNAT} {
+		if votes[access] > best {
+			best = votes[access]
+			guess.Type = access
+		}
+	}
+	return guess
+}
+
+// accessAdvice returns traversal advice specific to an access type
+func accessAdvice(access AccessType) string {
+	switch access {
+	case AccessDSLite:
+		return "DS-Lite shares IPv4 through the carrier's AFTR; inbound IPv4 is impossible, so prefer IPv6 for direct connections."
+	case AccessMobile:
+		return "Mobile carriers usually run strict CGNAT with short UDP timeouts; send keepalives every 15-20s and keep TURN (or IPv6) available."
+	case AccessSatellite:
+		return "Satellite latency dominates; avoid relaying through distant TURN servers and expect slow ICE checks."
+	case AccessPPPoE:
+		return "PPPoE lowers the MTU to 1492; keep UDP payloads under about 1450 bytes to avoid fragmentation."
+	case AccessCGNAT:
+		return "The ISP's carrier-grade NAT sits in front of the router; port forwards on the router cannot work, so use IPv6 or a relay."
+	}
+	return ""
+}
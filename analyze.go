@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// historySample is one detection found in a history file
+type historySample struct {
+	Time   time.Time
+	Result *NatResult
+	Error  string
+}
+
+// history is everything read from the files given to analyze
+type history struct {
+	Samples  []historySample
+	Monitors []MonitorResult
+	// Undated counts results without run metadata, which cannot be
+	// placed on the timeline
+	Undated int
+}
+
+// readHistory reads a stream of JSON values as written by `watch --output
+// json` (one event per line), `detect --output json` or `monitor --output
+// json`, in any mix. Pretty-printed values may follow each other directly.
+func readHistory(r io.Reader, h *history) error {
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var probe struct {
+			Result   json.RawMessage `json:"result"`
+			Error    string          `json:"error"`
+			Mode     string          `json:"mode"`
+			Evidence json.RawMessage `json:"evidence"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return err
+		}
+
+		switch {
+		case probe.Mode != "":
+			var m MonitorResult
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			h.Monitors = append(h.Monitors, m)
+
+		case probe.Result != nil || probe.Error != "":
+			var ev WatchEvent
+			if err := json.Unmarshal(raw, &ev); err != nil {
+				return err
+			}
+			h.Samples = append(h.Samples, historySample{Time: ev.Time, Result: ev.Result, Error: ev.Error})
+
+		case probe.Evidence != nil:
+			var result NatResult
+			if err := json.Unmarshal(raw, &result); err != nil {
+				return err
+			}
+			if result.Run == nil || result.Run.Time.IsZero() {
+				h.Undated++
+				continue
+			}
+			h.Samples = append(h.Samples, historySample{Time: result.Run.Time, Result: &result})
+
+		default:
+			return errors.New("not a nat-info watch event, result or monitor timeline")
+		}
+	}
+}
+
+// Change is a property switching value between two consecutive runs
+type Change struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// SeenValue counts the runs that reported a value and when
+type SeenValue struct {
+	Value string    `json:"value"`
+	Runs  int       `json:"runs"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// HistoryAnalysis answers the usual questions about a history: how often
+// the public IP changes, which NAT types were seen and when that last
+// changed, and how long mappings lived under monitor
+type HistoryAnalysis struct {
+	Runs   int       `json:"runs"`
+	Errors int       `json:"errors"`
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+
+	PublicIPs      []SeenValue `json:"public_ips"`
+	IPChanges      []Change    `json:"ip_changes"`
+	NATTypes       []SeenValue `json:"nat_types"`
+	NATTypeChanges []Change    `json:"nat_type_changes"`
+
+	// Lifetimes are how long monitored mappings lived, sorted; Survived
+	// are monitor runs that ended with the mapping still alive
+	Lifetimes      []time.Duration `json:"lifetimes"`
+	Survived       []time.Duration `json:"survived,omitempty"`
+	LifetimeCauses map[string]int  `json:"lifetime_causes,omitempty"`
+
+	Undated int `json:"undated,omitempty"`
+}
+
+// analyzeHistory orders the samples in time and walks them once
+func analyzeHistory(h *history) HistoryAnalysis {
+	sort.SliceStable(h.Samples, func(i, j int) bool { return h.Samples[i].Time.Before(h.Samples[j].Time) })
+
+	a := HistoryAnalysis{LifetimeCauses: make(map[string]int), Undated: h.Undated}
+	ips := make(map[string]int)
+	types := make(map[string]int)
+	seen := func(index map[string]int, list *[]SeenValue, value string, t time.Time) {
+		i, ok := index[value]
+		if !ok {
+			i = len(*list)
+			index[value] = i
+			*list = append(*list, SeenValue{Value: value, First: t})
+		}
+		(*list)[i].Runs++
+		(*list)[i].Last = t
+	}
+
+	var lastIP, lastType string
+	for _, s := range h.Samples {
+		a.Runs++
+		if a.First.IsZero() {
+			a.First = s.Time
+		}
+		a.Last = s.Time
+		if s.Result == nil {
+			a.Errors++
+			continue
+		}
+
+		if ip := publicIP(s.Result); ip != "" {
+			seen(ips, &a.PublicIPs, ip, s.Time)
+			if lastIP != "" && ip != lastIP {
+				a.IPChanges = append(a.IPChanges, Change{Time: s.Time, From: lastIP, To: ip})
+			}
+			lastIP = ip
+		}
+
+		code := natTypeCodes[s.Result.Type]
+		seen(types, &a.NATTypes, code, s.Time)
+		if lastType != "" && code != lastType {
+			a.NATTypeChanges = append(a.NATTypeChanges, Change{Time: s.Time, From: lastType, To: code})
+		}
+		lastType = code
+	}
+
+	// A mapping that died lived at least until its last answer; one that
+	// is still alive at the end of the run only bounds the lifetime below
+	for _, m := range h.Monitors {
+		if m.Alive {
+			a.Survived = append(a.Survived, m.Ended.Sub(m.Started))
+			continue
+		}
+		if m.LastSuccess.IsZero() {
+			continue
+		}
+		a.Lifetimes = append(a.Lifetimes, m.LastSuccess.Sub(m.Started))
+		a.LifetimeCauses[m.Cause]++
+	}
+	sort.Slice(a.Lifetimes, func(i, j int) bool { return a.Lifetimes[i] < a.Lifetimes[j] })
+	return a
+}
+
+// ChangeInterval returns the mean time between public IP changes over the
+// span of the history, or 0 without a change
+func (a *HistoryAnalysis) ChangeInterval() time.Duration {
+	if len(a.IPChanges) == 0 {
+		return 0
+	}
+	return a.Last.Sub(a.First) / time.Duration(len(a.IPChanges))
+}
+
+// quantile returns the q-quantile of sorted durations by nearest rank
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
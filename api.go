@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// apiServer serves the watcher's state over HTTP
+type apiServer struct {
+	started time.Time
+	maxAge  time.Duration
+
+	mu          sync.Mutex
+	last        *WatchEvent
+	lastSuccess time.Time
+}
+
+// apiStatus is the body of the health endpoints
+type apiStatus struct {
+	Status           string   `json:"status"`
+	UptimeSeconds    float64  `json:"uptime_seconds"`
+	LastDetectionAge *float64 `json:"last_detection_age_seconds,omitempty"`
+	LastSuccessAge   *float64 `json:"last_success_age_seconds,omitempty"`
+	LastError        string   `json:"last_error,omitempty"`
+	MaxAgeSeconds    float64  `json:"max_age_seconds"`
+}
+
+func newAPIServer(maxAge time.Duration) *apiServer {
+	return &apiServer{started: time.Now(), maxAge: maxAge}
+}
+
+// handle records a watch event as the latest state
+func (s *apiServer) handle(ev WatchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = &ev
+	if ev.Error == "" {
+		s.lastSuccess = ev.Time
+	}
+}
+
+// status snapshots the current state. Ready means a successful detection no
+// older than maxAge.
+func (s *apiServer) status() (apiStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	st := apiStatus{
+		Status:        "ok",
+		UptimeSeconds: now.Sub(s.started).Seconds(),
+		MaxAgeSeconds: s.maxAge.Seconds(),
+	}
+	if s.last != nil {
+		age := now.Sub(s.last.Time).Seconds()
+		st.LastDetectionAge = &age
+		st.LastError = s.last.Error
+	}
+	ready := false
+	if !s.lastSuccess.IsZero() {
+		age := now.Sub(s.lastSuccess)
+		seconds := age.Seconds()
+		st.LastSuccessAge = &seconds
+		ready = age <= s.maxAge
+	}
+	return st, ready
+}
+
+func (s *apiServer) healthz(w http.ResponseWriter, r *http.Request) {
+	st, _ := s.status()
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (s *apiServer) readyz(w http.ResponseWriter, r *http.Request) {
+	st, ready := s.status()
+	code := http.StatusOK
+	if !ready {
+		st.Status = "not ready"
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, st)
+}
+
+func (s *apiServer) result(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+
+	if last == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiStatus{Status: "no detection yet"})
+		return
+	}
+	writeJSON(w, http.StatusOK, last)
+}
+
+// writeJSON sends v as a JSON response body
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listen starts serving on addr in the background
+func (s *apiServer) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/result", s.result)
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go http.Serve(ln, mux)
+	return nil
+}
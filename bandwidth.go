@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Bandwidth train frame types, answered by the responder when enabled
+const (
+	frameUpData   = 0xe1 // train, seq, padding
+	frameUpReport = 0xe2 // train, padding: ask for the tally of an upload train
+	frameUpTally  = 0xe3 // train, received, bytes, span ns, CE marks
+	frameDownReq  = 0xe4 // train, count, size, cookie: ask for a download train
+	frameDownData = 0xe5 // train, seq, padding
+)
+
+// Packet train shape. Packets go out in back-to-back bursts with a short gap
+// between them, which caps the estimate at roughly 240 Mbit/s.
+const (
+	trainPackets    = 200
+	trainSize       = 1200
+	trainBurst      = 25
+	trainBurstGap   = time.Millisecond
+	trainMaxPackets = 256
+	trainIdle       = 500 * time.Millisecond
+
+	// tallyLength is the size of an upload tally, which its request is
+	// padded to
+	tallyLength = 25
+	// maxTrainsSending bounds the download trains a responder sends at once
+	maxTrainsSending = 4
+
+	// loadDuration is how long each direction is kept busy with
+	// consecutive trains while latency is sampled
+	loadDuration = 2 * time.Second
+)
+
+// TrainResult summarizes one packet train in one direction
+type TrainResult struct {
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Bps      float64 `json:"bps"`
+	Loss     float64 `json:"loss"`
+	CE       int     `json:"ce_marks"`
+}
+
+// BandwidthResult is a rough throughput estimate to a reflector
+type BandwidthResult struct {
+	Target  string       `json:"target"`
+	Up      *TrainResult `json:"up,omitempty"`
+	Down    *TrainResult `json:"down,omitempty"`
+	Latency *LoadLatency `json:"latency,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// trainTally accumulates arrivals of one train
+type trainTally struct {
+	received    int
+	bytes       int
+	first, last time.Time
+	ce          int
+	// lastExtra counts the bytes that arrived glued by GRO to the packet
+	// stamped last; they came after it, outside the measured span
+	lastExtra int
+}
+
+// add counts one packet. Packets glued into one GRO buffer share its
+// timestamp, at.
+func (t *trainTally) add(n int, ce bool, at time.Time) {
+	if t.received == 0 {
+		t.first = at
+	}
+	if t.received > 0 && at.Equal(t.last) {
+		t.lastExtra += n
+	} else {
+		t.lastExtra = 0
+	}
+	t.last = at
+	t.received++
+	t.bytes += n
+	if ce {
+		t.ce++
+	}
+}
+
+// spanBytes is the bytes that arrived within the measured span
+func (t *trainTally) spanBytes() int {
+	return t.bytes - t.lastExtra
+}
+
+// rate is the dispersion estimate: bytes after the first packet over the
+// time they took to arrive
+func (t *trainTally) rate() float64 {
+	span := t.last.Sub(t.first)
+	if t.received < 2 || span <= 0 {
+		return 0
+	}
+	return float64(t.spanBytes()-t.bytes/t.received) * 8 / span.Seconds()
+}
+
+func (t *trainTally) result(sent int) *TrainResult {
+	r := &TrainResult{Sent: sent, Received: t.received, Bps: t.rate(), CE: t.ce}
+	if sent > 0 {
+		r.Loss = 1 - float64(t.received)/float64(sent)
+	}
+	return r
+}
+
+// putTrainFrame writes the header of a padded data frame
+func putTrainFrame(frame []byte, kind byte, train, seq uint32) {
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], train)
+	binary.BigEndian.PutUint32(frame[5:9], seq)
+}
+
+// sendTrain paces count frames in short back-to-back bursts. A burst is
+// built in one buffer and handed to the kernel in one call, segmented by
+// UDP GSO where available and as a batch otherwise.
+func sendTrain(conn *net.UDPConn, to *net.UDPAddr, kind byte, train uint32, count, size int) {
+	batch := newPacketBatch(conn, trainBurst, 0)
+	buf := make([]byte, trainBurst*size)
+	burst := make([]batchMsg, 0, trainBurst)
+	for seq := 0; seq < count; seq++ {
+		frame := buf[len(burst)*size : (len(burst)+1)*size]
+		putTrainFrame(frame, kind, train, uint32(seq))
+		burst = append(burst, batchMsg{Buf: frame, Addr: to})
+		if len(burst) == trainBurst || seq == count-1 {
+			if !sendSegmented(conn, to, buf[:len(burst)*size], size) {
+				batch.write(burst)
+			}
+			burst = burst[:0]
+			if seq < count-1 {
+				time.Sleep(trainBurstGap)
+			}
+		}
+	}
+}
+
+// bandwidthReflector is the responder side of the bandwidth probe
+type bandwidthReflector struct {
+	conn    *net.UDPConn
+	trains  map[uint32]*trainTally
+	cookies *cookieJar
+	// limit paces download trains per source and in all
+	limit   *sourceLimiter
+	sending chan struct{}
+}
+
+func newBandwidthReflector(conn *net.UDPConn, cookies *cookieJar) *bandwidthReflector {
+	return &bandwidthReflector{
+		conn:    conn,
+		trains:  make(map[uint32]*trainTally),
+		cookies: cookies,
+		limit:   &sourceLimiter{perSource: 50, burst: 50, total: 200},
+		sending: make(chan struct{}, maxTrainsSending),
+	}
+}
+
+// isBandwidthFrame reports whether a datagram belongs to the bandwidth probe
+func isBandwidthFrame(buf []byte) bool {
+	return len(buf) >= 5 && buf[0] >= frameUpData && buf[0] <= frameDownData
+}
+
+// handle processes one bandwidth frame
+func (b *bandwidthReflector) handle(buf []byte, from *net.UDPAddr, ce bool, at time.Time) {
+	train := binary.BigEndian.Uint32(buf[1:5])
+
+	switch buf[0] {
+	case frameUpData:
+		t := b.trains[train]
+		if t == nil {
+			// Forget old trains rather than grow without bound
+			if len(b.trains) >= 64 {
+				b.trains = make(map[uint32]*trainTally)
+			}
+			t = &trainTally{}
+			b.trains[train] = t
+		}
+		t.add(len(buf), ce, at)
+
+	case frameUpReport:
+		if len(buf) < tallyLength {
+			return
+		}
+		t := b.trains[train]
+		if t == nil {
+			t = &trainTally{}
+		}
+		tally := []byte{frameUpTally}
+		tally = binary.BigEndian.AppendUint32(tally, train)
+		tally = binary.BigEndian.AppendUint32(tally, uint32(t.received))
+		tally = binary.BigEndian.AppendUint32(tally, uint32(t.spanBytes()))
+		tally = binary.BigEndian.AppendUint64(tally, uint64(t.last.Sub(t.first)))
+		tally = binary.BigEndian.AppendUint32(tally, uint32(t.ce))
+		b.conn.WriteToUDP(tally, from)
+
+	case frameDownReq:
+		// A train goes only to a source that proved it receives there, and
+		// within the rate limits
+		if len(buf) < 9+cookieLength || !b.cookies.valid(buf[9:], from) || !b.limit.allow(from.IP) {
+			return
+		}
+		count := int(binary.BigEndian.Uint16(buf[5:7]))
+		size := int(binary.BigEndian.Uint16(buf[7:9]))
+		if count > trainMaxPackets {
+			count = trainMaxPackets
+		}
+		if size < 9 || size > 1400 {
+			size = trainSize
+		}
+		select {
+		case b.sending <- struct{}{}:
+		default:
+			return
+		}
+		go func() {
+			defer func() { <-b.sending }()
+			sendTrain(b.conn, from, frameDownData, train, count, size)
+		}()
+	}
+}
+
+// probeBandwidth measures a rough upload and download rate to a responder
+// started with --bandwidth, from packet-train dispersion. Each direction is
+// loaded for loadDuration while pings to pingServer, if it resolves, show
+// how much latency the load adds.
+func probeBandwidth(target, pingServer string, env *probeEnv) (result BandwidthResult) {
+	result.Target = target
+
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	enableECN(conn)
+	cookie, err := fetchCookie(conn, addr)
+	if err != nil {
+		result.Error = err.Error() + "; is it a responder started with --bandwidth?"
+		return result
+	}
+
+	var pinger *latencyPinger
+	if endpoints, err := env.resolveServer(pingServer); err == nil {
+		pinger, _ = startPinger(endpoints[0], env)
+	}
+	if pinger != nil {
+		time.Sleep(idleDuration)
+		defer func() { result.Latency = pinger.finish() }()
+		pinger.setPhase("up")
+	}
+
+	up, err := loadTrains(func() (*TrainResult, error) { return probeUpload(conn, addr) })
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Up = up
+
+	if pinger != nil {
+		pinger.setPhase("down")
+	}
+	down, err := loadTrains(func() (*TrainResult, error) { return probeDownload(conn, addr, cookie) })
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Down = down
+	return result
+}
+
+// loadTrains repeats a train probe for loadDuration and combines the
+// results: counts are summed and the rate is the mean of the trains
+func loadTrains(probe func() (*TrainResult, error)) (*TrainResult, error) {
+	total := &TrainResult{}
+	trains := 0
+	for start := time.Now(); time.Since(start) < loadDuration; {
+		t, err := probe()
+		if err != nil {
+			if trains > 0 {
+				break
+			}
+			return nil, err
+		}
+		trains++
+		total.Sent += t.Sent
+		total.Received += t.Received
+		total.CE += t.CE
+		total.Bps += t.Bps
+	}
+	total.Bps /= float64(trains)
+	total.Loss = 1 - float64(total.Received)/float64(total.Sent)
+	return total, nil
+}
+
+func newTrainID() uint32 {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return binary.BigEndian.Uint32(id)
+}
+
+// probeUpload sends a train and asks the reflector how it arrived
+func probeUpload(conn *net.UDPConn, addr *net.UDPAddr) (*TrainResult, error) {
+	train := newTrainID()
+	sendTrain(conn, addr, frameUpData, train, trainPackets, trainSize)
+
+	ask := make([]byte, tallyLength)
+	ask[0] = frameUpReport
+	binary.BigEndian.PutUint32(ask[1:5], train)
+	buf := make([]byte, 2048)
+	for attempt := 0; attempt < 3; attempt++ {
+		conn.WriteToUDP(ask, addr)
+		conn.SetReadDeadline(time.Now().Add(trainIdle))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if n < tallyLength || buf[0] != frameUpTally || binary.BigEndian.Uint32(buf[1:5]) != train {
+				continue
+			}
+			t := &trainTally{
+				received: int(binary.BigEndian.Uint32(buf[5:9])),
+				bytes:    int(binary.BigEndian.Uint32(buf[9:13])),
+				ce:       int(binary.BigEndian.Uint32(buf[21:25])),
+			}
+			t.last = t.first.Add(time.Duration(binary.BigEndian.Uint64(buf[13:21])))
+			return t.result(trainPackets), nil
+		}
+	}
+	return nil, errors.New("no upload report from " + addr.String() + "; is it a responder started with --bandwidth?")
+}
+
+// probeDownload asks the reflector for a train, showing the cookie it gave
+// this socket, and times its arrival
+func probeDownload(conn *net.UDPConn, addr *net.UDPAddr, cookie []byte) (*TrainResult, error) {
+	train := newTrainID()
+	req := binary.BigEndian.AppendUint32([]byte{frameDownReq}, train)
+	req = binary.BigEndian.AppendUint16(req, trainPackets)
+	req = binary.BigEndian.AppendUint16(req, trainSize)
+	req = append(req, cookie...)
+
+	t := &trainTally{}
+	batch := newPacketBatch(conn, batchSize, 2048)
+	for attempt := 0; attempt < 3 && t.received == 0; attempt++ {
+		conn.WriteToUDP(req, addr)
+		for t.received < trainPackets {
+			conn.SetReadDeadline(time.Now().Add(trainIdle))
+			n, err := batch.read()
+			if err != nil {
+				break
+			}
+			for _, m := range batch.msgs[:n] {
+				buf := m.Buf[:m.N]
+				if len(buf) < 9 || buf[0] != frameDownData || binary.BigEndian.Uint32(buf[1:5]) != train {
+					continue
+				}
+				tos := tosOf(m.OOB[:m.OOBN])
+				t.add(len(buf), tos >= 0 && tos&0x03 == ecnCE, arrival(m.OOB[:m.OOBN]))
+			}
+		}
+	}
+	if t.received == 0 {
+		return nil, errors.New("no download train from " + addr.String())
+	}
+	return t.result(trainPackets), nil
+}
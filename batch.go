@@ -0,0 +1,82 @@
+package main
+
+import "net"
+
+// batchSize is how many datagrams a packetBatch moves per system call
+const batchSize = 32
+
+// batchMsg is one datagram of a batch. For reads, Buf and OOB are filled
+// up to N and OOBN; for writes, all of Buf goes to Addr.
+type batchMsg struct {
+	Buf  []byte
+	N    int
+	OOB  []byte
+	OOBN int
+	Addr *net.UDPAddr
+}
+
+// packetBatch reads and writes many datagrams per system call where the
+// platform can (recvmmsg and sendmmsg on Linux) and one at a time
+// elsewhere. It is not safe for concurrent use; a socket served by one
+// reader and written by others needs a batch for each.
+type packetBatch struct {
+	conn *net.UDPConn
+	msgs []batchMsg
+	sys  batchState
+}
+
+// newPacketBatch prepares a batch of size messages on conn. With bufSize
+// set, each message gets a read buffer of that size and a control buffer
+// for the TOS byte and receive timestamp.
+func newPacketBatch(conn *net.UDPConn, size, bufSize int) *packetBatch {
+	b := &packetBatch{conn: conn, msgs: make([]batchMsg, size)}
+	if bufSize > 0 {
+		for i := range b.msgs {
+			b.msgs[i].Buf = make([]byte, bufSize)
+			b.msgs[i].OOB = make([]byte, 128)
+		}
+	}
+	b.sys.init(size)
+	return b
+}
+
+// read blocks like ReadFromUDP until at least one datagram arrives and
+// returns how many of b.msgs it filled
+func (b *packetBatch) read() (int, error) {
+	return b.sys.read(b.conn, b.msgs)
+}
+
+// write sends msgs, which need not be b.msgs. A datagram the kernel
+// refuses is skipped, like a failed WriteToUDP, and the last such error is
+// returned with the number that went out.
+func (b *packetBatch) write(msgs []batchMsg) (int, error) {
+	sent := 0
+	var lastErr error
+	for len(msgs) > 0 {
+		n, err := b.sys.write(b.conn, msgs[:min(len(msgs), len(b.msgs))])
+		sent += n
+		msgs = msgs[n:]
+		if n == 0 && err == nil {
+			break
+		}
+		if err != nil {
+			lastErr = err
+			if len(msgs) > 0 {
+				msgs = msgs[1:]
+			}
+		}
+	}
+	return sent, lastErr
+}
+
+// readOne reads a single datagram with its control messages
+func readOne(conn *net.UDPConn, m *batchMsg) error {
+	if len(m.OOB) == 0 {
+		n, from, err := conn.ReadFromUDP(m.Buf)
+		m.N, m.OOBN, m.Addr = n, 0, from
+		return err
+	}
+	n, oobn, _, from, err := conn.ReadMsgUDP(m.Buf, m.OOB)
+	m.N, m.OOBN, m.Addr = n, oobn, from
+	return err
+}
@@ -0,0 +1,120 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr: a msghdr and the byte count the kernel fills in
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// batchState holds the kernel-facing arrays, reused across calls so that
+// batching does not allocate per packet
+type batchState struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet4
+}
+
+func (s *batchState) init(size int) {
+	s.hdrs = make([]mmsghdr, size)
+	s.iovs = make([]syscall.Iovec, size)
+	s.names = make([]syscall.RawSockaddrInet4, size)
+}
+
+// prepare points the headers at msgs; the sockets are all IPv4
+func (s *batchState) prepare(msgs []batchMsg, write bool) {
+	for i := range msgs {
+		m, h := &msgs[i], &s.hdrs[i]
+		*h = mmsghdr{}
+		s.iovs[i] = syscall.Iovec{}
+		if len(m.Buf) > 0 {
+			s.iovs[i].Base = &m.Buf[0]
+			s.iovs[i].SetLen(len(m.Buf))
+		}
+		h.hdr.Iov = &s.iovs[i]
+		h.hdr.Iovlen = 1
+		h.hdr.Name = (*byte)(unsafe.Pointer(&s.names[i]))
+		h.hdr.Namelen = syscall.SizeofSockaddrInet4
+		if write {
+			s.names[i] = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+			binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&s.names[i].Port))[:], uint16(m.Addr.Port))
+			copy(s.names[i].Addr[:], m.Addr.IP.To4())
+		} else if len(m.OOB) > 0 {
+			h.hdr.Control = &m.OOB[0]
+			h.hdr.SetControllen(len(m.OOB))
+		}
+	}
+}
+
+func (s *batchState) read(conn *net.UDPConn, msgs []batchMsg) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	msgs = msgs[:min(len(msgs), len(s.hdrs))]
+	s.prepare(msgs, false)
+	var n int
+	var opErr error
+	err = raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysRecvmmsg, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(len(msgs)), syscall.MSG_DONTWAIT, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		if e != 0 {
+			opErr = e
+		}
+		n = int(r)
+		return true
+	})
+	if err == nil {
+		err = opErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		m, h, name := &msgs[i], &s.hdrs[i], &s.names[i]
+		m.N = int(h.len)
+		m.OOBN = int(h.hdr.Controllen)
+		port := (*[2]byte)(unsafe.Pointer(&name.Port))
+		m.Addr = &net.UDPAddr{IP: net.IP(append([]byte(nil), name.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}
+	}
+	return n, nil
+}
+
+func (s *batchState) write(conn *net.UDPConn, msgs []batchMsg) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	s.prepare(msgs, true)
+	var n int
+	var opErr error
+	err = raw.Write(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&s.hdrs[0])), uintptr(len(msgs)), syscall.MSG_DONTWAIT, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		if e != 0 {
+			opErr = e
+		}
+		n = int(r)
+		return true
+	})
+	if err == nil {
+		err = opErr
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
@@ -0,0 +1,26 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "net"
+
+// batchState is empty where datagrams move one system call at a time
+type batchState struct{}
+
+func (s *batchState) init(size int) {}
+
+func (s *batchState) read(conn *net.UDPConn, msgs []batchMsg) (int, error) {
+	if err := readOne(conn, &msgs[0]); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (s *batchState) write(conn *net.UDPConn, msgs []batchMsg) (int, error) {
+	for i, m := range msgs {
+		if _, err := conn.WriteToUDP(m.Buf, m.Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bundleRecorder collects the transaction log, raw packets and resolved
+// addresses of one detection run. Its methods are no-ops on a nil recorder.
+type bundleRecorder struct {
+	mu       sync.Mutex
+	started  time.Time
+	log      []string
+	packets  []bundlePacket
+	resolved []string
+	mapped   map[string]bool
+}
+
+// addrToken matches IPv4 and IPv6 address candidates for redaction; only
+// exact public IPs are replaced, so false positives are harmless
+var addrToken = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b|[0-9A-Fa-f]*:[0-9A-Fa-f:]*[0-9A-Fa-f]`)
+
+// bundleFile is one member of the archive
+type bundleFile struct{ name, body string }
+
+// bundlePacket is one datagram sent or received by makeStunRequest
+type bundlePacket struct {
+	Time   string `json:"time"`
+	Dir    string `json:"dir"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Hex    string `json:"hex"`
+}
+
+func newBundleRecorder() *bundleRecorder {
+	return &bundleRecorder{started: time.Now(), mapped: make(map[string]bool)}
+}
+
+// elapsed timestamps an entry relative to the start of the run
+func (r *bundleRecorder) elapsed() string {
+	return "+" + time.Since(r.started).Round(time.Microsecond).String()
+}
+
+// note appends a line to the transaction log
+func (r *bundleRecorder) note(s string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.log = append(r.log, r.elapsed()+" "+s)
+	r.mu.Unlock()
+}
+
+// packet records a datagram; dir is "send" or "recv"
+func (r *bundleRecorder) packet(dir string, local, remote net.Addr, buf []byte) {
+	if r == nil {
+		return
+	}
+	p := bundlePacket{Dir: dir, Local: local.String(), Remote: remote.String(), Hex: hex.EncodeToString(buf)}
+	var mapped []string
+	if dir == "recv" {
+		if msg, err := decodeStunMessage(buf); err == nil {
+			for _, attr := range msg.Attributes {
+				if !isMappedAttr(attr.Type) {
+					continue
+				}
+				xor := buf[4:20]
+				if attr.Type == AttrMappedAddress {
+					xor = nil
+				}
+				if addr := decodeAddress(attr.Value, xor); addr != nil {
+					mapped = append(mapped, addr.IP.String())
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p.Time = r.elapsed()
+	r.packets = append(r.packets, p)
+	for _, ip := range mapped {
+		r.mapped[ip] = true
+	}
+	r.log = append(r.log, p.Time+" "+dir+" "+strconv.Itoa(len(buf))+" bytes "+p.Local+" <-> "+p.Remote)
+}
+
+// resolve records the addresses a server name resolved to
+func (r *bundleRecorder) resolve(server string, endpoints []StunEndpoint, err error) {
+	if r == nil {
+		return
+	}
+	line := server + " ->"
+	if err != nil {
+		line += " error: " + err.Error()
+	}
+	for _, ep := range endpoints {
+		line += " " + ep.Addr.IP.String()
+	}
+	r.mu.Lock()
+	r.resolved = append(r.resolved, line)
+	r.mu.Unlock()
+}
+
+// isMappedAttr reports whether an attribute carries the client's reflexive
+// address: MAPPED-ADDRESS, XOR-MAPPED-ADDRESS or its pre-RFC 5389 code point
+func isMappedAttr(t uint16) bool {
+	return t == AttrMappedAddress || t == AttrXorMappedAddress || t == 0x8020
+}
+
+// redactPacket zeroes the reflexive address attributes of a response
+func redactPacket(buf []byte) {
+	if len(buf) < HeaderLength {
+		return
+	}
+	attrs := buf[HeaderLength:]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		n := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+n > len(attrs) {
+			return
+		}
+		if isMappedAttr(typ) {
+			clear(attrs[4 : 4+n])
+		}
+		attrs = attrs[min(len(attrs), 4+((n+3)&^3)):]
+	}
+}
+
+// writeBundle archives the recording, an interface and route snapshot, and
+// the final result (or the error that ended detection) as a gzipped tarball
+// at path. With redact, the public IPs seen during the run are replaced by
+// placeholders and reflexive addresses are zeroed in the raw packets.
+func writeBundle(path string, r *bundleRecorder, args []string, result *NatResult, detectErr error, redact bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if result != nil && result.Public != nil {
+		r.mapped[result.Public.IP.String()] = true
+	}
+	publicIPs := make([]string, 0, len(r.mapped))
+	for ip := range r.mapped {
+		publicIPs = append(publicIPs, ip)
+	}
+	sort.Strings(publicIPs)
+	placeholders := make(map[string]string, len(publicIPs))
+	for i, ip := range publicIPs {
+		placeholders[ip] = "<public-ip-" + strconv.Itoa(i+1) + ">"
+	}
+	// Whole addresses only, so 1.2.3.4 does not clip 11.2.3.45
+	scrub := func(s string) string {
+		return addrToken.ReplaceAllStringFunc(s, func(ip string) string {
+			if p, ok := placeholders[ip]; ok {
+				return p
+			}
+			return ip
+		})
+	}
+	if !redact {
+		scrub = func(s string) string { return s }
+	}
+
+	files := []bundleFile{
+		{"meta.txt", "nat-info " + version + "\n" +
+			"go " + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + "\n" +
+			"created " + time.Now().UTC().Format(time.RFC3339) + "\n" +
+			"args " + strings.Join(args, " ") + "\n" +
+			"redacted " + strconv.FormatBool(redact) + "\n"},
+		{"transactions.log", scrub(strings.Join(r.log, "\n")) + "\n"},
+		{"resolved.txt", strings.Join(r.resolved, "\n") + "\n"},
+		{"interfaces.txt", scrub(interfaceSnapshot())},
+	}
+
+	var packets strings.Builder
+	for _, p := range r.packets {
+		if redact && p.Dir == "recv" {
+			if buf, err := hex.DecodeString(p.Hex); err == nil {
+				redactPacket(buf)
+				p.Hex = hex.EncodeToString(buf)
+			}
+		}
+		line, _ := json.Marshal(p)
+		packets.WriteString(scrub(string(line)) + "\n")
+	}
+	files = append(files, bundleFile{"packets.jsonl", packets.String()})
+
+	if route, err := os.ReadFile("/proc/net/route"); err == nil {
+		files = append(files, bundleFile{"route.txt", string(route)})
+	}
+	if detectErr != nil {
+		files = append(files, bundleFile{"error.txt", scrub(detectErr.Error()) + "\n"})
+	}
+	if result != nil {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		files = append(files, bundleFile{"result.json", scrub(string(data)) + "\n"})
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		hdr := &tar.Header{Name: "nat-info/" + file.name, Mode: 0o644, Size: int64(len(file.body)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := tw.Write([]byte(file.body)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// interfaceSnapshot lists every interface with its flags and addresses
+func interfaceSnapshot() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	var b strings.Builder
+	for _, iface := range ifaces {
+		b.WriteString(iface.Name + " mtu " + strconv.Itoa(iface.MTU) + " " + iface.Flags.String() + "\n")
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			b.WriteString("    " + addr.String() + "\n")
+		}
+	}
+	if defaults := defaultRouteInterfaces(); len(defaults) > 0 {
+		b.WriteString("default routes via " + strings.Join(defaults, ", ") + "\n")
+	}
+	return b.String()
+}
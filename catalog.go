@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strings"
+)
+
+// textStyle is how a command writes human-readable output, read from its
+// --lang and --plain flags. JSON, CSV and every other machine-readable
+// output keep their codes and English text whatever it says.
+type textStyle struct {
+	// lang selects the catalog text is translated with; empty is English
+	lang string
+	// plain asks for text that reads well through a screen reader or over a
+	// serial console: no color, no padded columns and no drawing characters
+	plain bool
+}
+
+// styleOf returns the text style fs was parsed with
+func styleOf(fs *flag.FlagSet) textStyle {
+	lang, _ := parseLang(fs.Lookup("lang").Value.String())
+	return textStyle{lang: lang, plain: fs.Lookup("plain").Value.String() == "true"}
+}
+
+// catalogs translates user-facing messages. The English text is the key, so
+// a message missing from a catalog, or built from parts at run time, is
+// printed in English rather than not at all.
+var catalogs = map[string]map[string]string{
+	"de": catalogDE,
+}
+
+// parseLang picks a catalog from a code such as "de", "de_DE.UTF-8" or
+// "en-US"
+func parseLang(code string) (string, error) {
+	code = strings.ToLower(code)
+	if i := strings.IndexAny(code, "_-."); i >= 0 {
+		code = code[:i]
+	}
+	if code == "en" || code == "" || code == "c" || code == "posix" {
+		return "en", nil
+	}
+	if _, ok := catalogs[code]; !ok {
+		return "", errors.New("unsupported language " + code + " (expected " + strings.Join(languages(), ", ") + ")")
+	}
+	return code, nil
+}
+
+// languages lists the supported language codes
+func languages() []string {
+	out := []string{"en"}
+	for code := range catalogs {
+		out = append(out, code)
+	}
+	sort.Strings(out[1:])
+	return out
+}
+
+// tr returns msg in the style's language
+func (s textStyle) tr(msg string) string {
+	if text, ok := catalogs[s.lang][msg]; ok {
+		return text
+	}
+	return msg
+}
+
+var catalogDE = map[string]string{
+	// NAT types
+	"Unknown":                  "Unbekannt",
+	"UDP Blocked":              "UDP blockiert",
+	"Open Internet":            "Offenes Internet",
+	"Full Cone NAT":            "Full-Cone-NAT",
+	"Restricted Cone NAT":      "Restricted-Cone-NAT",
+	"Port Restricted Cone NAT": "Port-Restricted-Cone-NAT",
+	"Symmetric NAT":            "Symmetrisches NAT",
+	"Symmetric UDP Firewall":   "Symmetrische UDP-Firewall",
+
+	// Behaviors and translations
+	"Endpoint Independent":       "Endpunktunabhängig",
+	"Address Dependent":          "Adressabhängig",
+	"Address and Port Dependent": "Adress- und portabhängig",
+	"PAT (ports rewritten)":      "PAT (Ports umgeschrieben)",
+	"1:1 NAT":                    "1:1-NAT",
+	"unknown":                    "unbekannt",
+
+	// Confidence levels
+	"low":    "niedrig",
+	"medium": "mittel",
+	"high":   "hoch",
+
+	// Reasons
+	"All STUN requests failed":                             "Alle STUN-Anfragen sind fehlgeschlagen",
+	"No NAT detected":                                      "Kein NAT erkannt",
+	"Public IP/Port varies by destination":                 "Öffentliche IP/Port hängt vom Ziel ab",
+	"Endpoint Independent Mapping.":                        "Endpunktunabhängiges Mapping.",
+	"Port Preserved.":                                      "Port beibehalten.",
+	"Unsolicited inbound packets are filtered.":            "Unaufgeforderte eingehende Pakete werden gefiltert.",
+	"Public IP changes between probes to the same server.": "Die öffentliche IP wechselt zwischen Anfragen an denselben Server.",
+	"The host firewall may be dropping inbound UDP.":       "Die Firewall dieses Rechners verwirft möglicherweise eingehendes UDP.",
+	"Servers are reached through different uplinks.":       "Die Server werden über verschiedene Uplinks erreicht.",
+	"Address translated 1:1 with ports untouched.":         "Adresse wird 1:1 übersetzt, Ports bleiben unverändert.",
+	"Every unsolicited port is forwarded to this host.":    "Jeder unaufgeforderte Port wird an diesen Rechner weitergeleitet.",
+	"A middlebox rewrites or proxies STUN traffic.":        "Eine Middlebox schreibt STUN-Verkehr um oder leitet ihn über einen Proxy.",
+
+	// Report sections and labels
+	"Local network":             "Lokales Netz",
+	"Public mapping":            "Öffentliches Mapping",
+	"Behavior":                  "Verhalten",
+	"Recommendations":           "Empfehlungen",
+	"Access":                    "Anschluss",
+	"Host firewall":             "Firewall dieses Rechners",
+	"Unsolicited inbound":       "Unaufgefordert eingehend",
+	"Throughput (rough)":        "Durchsatz (grob)",
+	"Path integrity":            "Pfadintegrität",
+	"Conntrack (authoritative)": "Conntrack (maßgeblich)",
+	"Address":                   "Adresse",
+	"Confidence":                "Sicherheit",
+	"Filtering":                 "Filterung",
+	"Likely":                    "Vermutlich",
+	"Hint":                      "Hinweis",
+	"NAT Type":                  "NAT-Typ",
+	"Reason":                    "Begründung",
+	"Responses":                 "Antworten",
+	"Sample":                    "Stichprobe",
+	"Share code":                "Teilcode",
+	"Stability":                 "Stabilität",
+	"Status":                    "Status",
+	"Translation":               "Übersetzung",
+	"Warning":                   "Warnung",
+	"Exposure":                  "Angreifbarkeit",
+	"unstable":                  "instabil",
+	"policy routed":             "Policy-Routing",
+
+	// Confidence notes
+	"public IP is unstable, so mapping comparisons may mix addresses":                    "die öffentliche IP ist instabil, Mapping-Vergleiche können Adressen vermischen",
+	"servers are reached through different uplinks, so mapping comparisons may mix NATs": "die Server werden über verschiedene Uplinks erreicht, Mapping-Vergleiche können NATs vermischen",
+	"repeated bindings to the same server reported different mappings":                   "wiederholte Bindings an denselben Server meldeten verschiedene Mappings",
+	"no STUN server could be resolved":                                                   "kein STUN-Server konnte aufgelöst werden",
+	"only one STUN server was tried":                                                     "nur ein STUN-Server wurde versucht",
+	"symmetric mapping seen in a single sample only":                                     "symmetrisches Mapping nur in einer Stichprobe gesehen",
+	"address vs port dependence untested":                                                "Adress- gegenüber Portabhängigkeit nicht getestet",
+	"inbound filtering untested: no RFC3489 server reachable":                            "eingehende Filterung nicht getestet: kein RFC-3489-Server erreichbar",
+	"only one RFC3489 server reachable":                                                  "nur ein RFC-3489-Server erreichbar",
+	"filtering inferred from missing responses":                                          "Filterung aus fehlenden Antworten geschlossen",
+	"mapping samples were inconsistent":                                                  "die Mapping-Stichproben waren widersprüchlich",
+	"mapping behavior untested: no second server reachable":                              "Mapping-Verhalten nicht getestet: kein zweiter Server erreichbar",
+	"no RFC3489 server reachable, subtype assumed":                                       "kein RFC-3489-Server erreichbar, Untertyp angenommen",
+
+	// Recommendations
+	"UDP looks blocked locally: the host firewall is dropping replies before they reach nat-info. Allow established/related inbound traffic and re-run.": "UDP scheint lokal blockiert: Die Firewall dieses Rechners verwirft Antworten, bevor sie nat-info erreichen. Erlauben Sie eingehenden Verkehr zu bestehenden Verbindungen (established/related) und wiederholen Sie den Test.",
+	"STUN traffic is blocked but UDP to port 443 gets out; run TURN on UDP 443 so real-time apps can still use UDP.":                                     "STUN-Verkehr ist blockiert, aber UDP zu Port 443 kommt durch; betreiben Sie TURN auf UDP 443, damit Echtzeit-Anwendungen weiter UDP nutzen können.",
+	"Outbound UDP appears blocked by the NAT or ISP, not this host; real-time apps will need a TURN relay over TCP or TLS on port 443.":                  "Ausgehendes UDP scheint vom NAT oder Provider blockiert, nicht von diesem Rechner; Echtzeit-Anwendungen brauchen ein TURN-Relay über TCP oder TLS auf Port 443.",
+	"Outbound UDP appears blocked; real-time apps will need a TURN relay over TCP or TLS on port 443.":                                                   "Ausgehendes UDP scheint blockiert; Echtzeit-Anwendungen brauchen ein TURN-Relay über TCP oder TLS auf Port 443.",
+	"No NAT or inbound filtering: peers can reach this host directly.":                                                                                   "Kein NAT und keine eingehende Filterung: Gegenstellen erreichen diesen Rechner direkt.",
+	"This host has a public IP but a firewall drops unsolicited packets; allow your application's ports inbound to accept direct connections.":           "Dieser Rechner hat eine öffentliche IP, aber eine Firewall verwirft unaufgeforderte Pakete; geben Sie die Ports Ihrer Anwendung eingehend frei, um direkte Verbindungen anzunehmen.",
+	"Direct peer-to-peer connections should work with any peer.":                                                                                         "Direkte Peer-to-Peer-Verbindungen sollten mit jeder Gegenstelle funktionieren.",
+	"UDP hole punching works with most peers; peers behind Symmetric NAT will need a TURN relay.":                                                        "UDP-Hole-Punching funktioniert mit den meisten Gegenstellen; Gegenstellen hinter symmetrischem NAT brauchen ein TURN-Relay.",
+	"Hole punching is unreliable behind Symmetric NAT; expect to need a TURN relay.":                                                                     "Hole-Punching ist hinter symmetrischem NAT unzuverlässig; rechnen Sie mit einem TURN-Relay.",
+	"If you control the router, enabling UPnP/NAT-PMP or a port forward gives a stable public port.":                                                     "Wenn Sie den Router verwalten, ergibt UPnP/NAT-PMP oder eine Portweiterleitung einen stabilen öffentlichen Port.",
+	"The NAT type could not be determined.": "Der NAT-Typ konnte nicht bestimmt werden.",
+	"The host firewall is active, so the measured filtering may come from this machine rather than the NAT; re-run with it disabled to see the router alone.":                                                                                          "Die Firewall dieses Rechners ist aktiv, die gemessene Filterung kann also von diesem Rechner statt vom NAT stammen; wiederholen Sie den Test ohne sie, um nur den Router zu sehen.",
+	"The gateway's WAN address is not the public IP, so another NAT sits upstream (CGNAT or a modem in router mode); the behavior above is the combination of both.":                                                                                   "Die WAN-Adresse des Gateways ist nicht die öffentliche IP, davor sitzt also ein weiteres NAT (CGNAT oder ein Modem im Routermodus); das obige Verhalten ist die Kombination aus beiden.",
+	"STUN works but the QUIC probe got no answer; UDP 443 may be filtered, so HTTP/3 and TURN on UDP 443 could fall back to TCP.":                                                                                                                      "STUN funktioniert, aber die QUIC-Probe blieb unbeantwortet; UDP 443 wird eventuell gefiltert, HTTP/3 und TURN auf UDP 443 könnten auf TCP ausweichen.",
+	"Packets are lost or congestion-marked under a short burst; games and calls will stutter when this link is busy.":                                                                                                                                  "Schon bei kurzen Lastspitzen gehen Pakete verloren oder werden als überlastet markiert; Spiele und Anrufe ruckeln, wenn die Leitung ausgelastet ist.",
+	"Latency climbs sharply when the link is busy (bufferbloat); enabling SQM/fq_codel or cake on the router usually fixes lag that NAT type does not explain.":                                                                                        "Die Latenz steigt bei ausgelasteter Leitung stark an (Bufferbloat); SQM/fq_codel oder cake auf dem Router behebt meist Verzögerungen, die der NAT-Typ nicht erklärt.",
+	"The public IP changes from flow to flow (load-balanced CGNAT or multi-WAN); ICE candidates gathered from one server may not match what peers see, so keep TURN available.":                                                                        "Die öffentliche IP wechselt von Verbindung zu Verbindung (lastverteiltes CGNAT oder Multi-WAN); über einen Server gesammelte ICE-Kandidaten passen eventuell nicht zu dem, was Gegenstellen sehen, halten Sie also TURN bereit.",
+	"The router has this host in its DMZ (or maps every port to it): peers can always reach it, but so can anyone else. Keep the host firewall on, or replace the DMZ with forwards for the ports you need.":                                           "Der Router hat diesen Rechner in seiner DMZ (oder leitet jeden Port an ihn weiter): Gegenstellen erreichen ihn immer, aber auch alle anderen. Lassen Sie die Firewall des Rechners an oder ersetzen Sie die DMZ durch Weiterleitungen der benötigten Ports.",
+	"Once this host sends from a port, anyone on the internet can send to that port's mapping, not just the host it talked to. That is what makes P2P easy here, but an application listening on such a port must treat every sender as untrusted.":    "Sobald dieser Rechner von einem Port sendet, kann jeder im Internet an das Mapping dieses Ports senden, nicht nur die angesprochene Gegenstelle. Das erleichtert P2P, aber eine Anwendung auf einem solchen Port muss jedem Absender misstrauen.",
+	"Something on the path drops ECN-capable packets; QUIC stacks and L4S senders should detect this and fall back to Not-ECT.":                                                                                                                        "Etwas auf dem Pfad verwirft ECN-fähige Pakete; QUIC-Stacks und L4S-Sender sollten das erkennen und auf Not-ECT zurückfallen.",
+	"The path clears or rewrites ECN marks, so QUIC and L4S congestion control lose early congestion signals and fall back to reacting to loss.":                                                                                                       "Der Pfad löscht oder ändert ECN-Markierungen, QUIC- und L4S-Staukontrolle verlieren so frühe Stausignale und reagieren erst auf Verluste.",
+	"A middlebox rewrites STUN on the way (an ALG, transparent proxy or DPI box), so reflexive addresses may not be what peers see. Disable SIP/STUN ALGs on the router, or prefer TURN over TLS, which it cannot inspect.":                            "Eine Middlebox schreibt STUN unterwegs um (ein ALG, transparenter Proxy oder DPI-Gerät), reflexive Adressen entsprechen also eventuell nicht dem, was Gegenstellen sehen. Schalten Sie SIP/STUN-ALGs auf dem Router ab oder bevorzugen Sie TURN über TLS, das sie nicht einsehen kann.",
+	"The public IP is mapped 1:1 to this host (cloud elastic IP, DMZ or static NAT); allowing the port in the security group or upstream ACL makes it directly reachable. A port-preserving PAT with no competing flows looks the same from one host.": "Die öffentliche IP ist 1:1 auf diesen Rechner abgebildet (Cloud-Elastic-IP, DMZ oder statisches NAT); wird der Port in der Security Group oder der vorgelagerten ACL freigegeben, ist er direkt erreichbar. Ein portbewahrendes PAT ohne konkurrierende Verbindungen sieht von einem Rechner aus genauso aus.",
+	"Servers are reached through different uplinks, so each one may see a different NAT; pin detection to one path with --iface, or compare them with `nat-info paths`.":                                                                               "Die Server werden über verschiedene Uplinks erreicht, jeder sieht also eventuell ein anderes NAT; binden Sie die Erkennung mit --iface an einen Pfad oder vergleichen Sie sie mit `nat-info paths`.",
+	"Confidence is low; re-run, or add more servers with --servers.": "Die Sicherheit ist niedrig; wiederholen Sie den Test oder fügen Sie mit --servers weitere Server hinzu.",
+}
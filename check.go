@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes
+const (
+	CheckOK       = 0
+	CheckWarning  = 1
+	CheckCritical = 2
+	CheckUnknown  = 3
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// expectation is one key=value condition from --expect; a value may list
+// alternatives separated by "|"
+type expectation struct {
+	Key    string
+	Values []string
+}
+
+// expectFlag collects --expect conditions; it may be repeated and each use
+// may hold a comma-separated list
+type expectFlag []expectation
+
+func (f *expectFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, e := range *f {
+		parts[i] = e.Key + "=" + strings.Join(e.Values, "|")
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *expectFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || val == "" {
+			return errors.New("expected key=value, got " + item)
+		}
+		switch key {
+		case "type", "mapping", "filtering", "public-ip", "confidence":
+		default:
+			return errors.New("unknown expectation " + key + " (expected type, mapping, filtering, public-ip or confidence)")
+		}
+		*f = append(*f, expectation{Key: key, Values: strings.Split(val, "|")})
+	}
+	return nil
+}
+
+// actual returns the result's value for an expectation key, in the same
+// vocabulary as the JSON output
+func (e expectation) actual(r *NatResult) string {
+	switch e.Key {
+	case "type":
+		return natTypeCodes[r.Type]
+	case "mapping":
+		return behaviorCodes[r.Mapping]
+	case "filtering":
+		return behaviorCodes[r.Filtering]
+	case "public-ip":
+		return publicIP(r)
+	case "confidence":
+		return r.Confidence.String()
+	}
+	return ""
+}
+
+// checkConfig holds the thresholds for --check mode
+type checkConfig struct {
+	expect  expectFlag
+	warnRTT time.Duration
+	critRTT time.Duration
+}
+
+// primaryRTT returns the RTT of the successful primary binding transaction
+func primaryRTT(r *NatResult) (time.Duration, bool) {
+	for _, e := range r.Evidence {
+		if e.Test == TestBinding && e.Passed {
+			return e.RTT, true
+		}
+	}
+	return 0, false
+}
+
+// evaluateCheck grades a detection outcome and renders the single Nagios
+// status line, including performance data
+func evaluateCheck(result *NatResult, detectErr error, cfg checkConfig) (int, string) {
+	if detectErr != nil {
+		return CheckUnknown, "NAT UNKNOWN - " + detectErr.Error()
+	}
+
+	status := CheckOK
+	var problems []string
+	raise := func(level int, problem string) {
+		if level > status {
+			status = level
+		}
+		problems = append(problems, problem)
+	}
+
+	expectsType := false
+	for _, e := range cfg.expect {
+		if e.Key == "type" {
+			expectsType = true
+		}
+		got := e.actual(result)
+		matched := false
+		for _, want := range e.Values {
+			if got == want {
+				matched = true
+			}
+		}
+		if !matched {
+			raise(CheckCritical, "expected "+e.Key+"="+strings.Join(e.Values, "|")+", got "+got)
+		}
+	}
+	if result.Type == NATUDPBlocked && !expectsType {
+		raise(CheckCritical, "UDP blocked")
+	}
+	if v := result.Policy; v != nil {
+		for _, m := range v.Matched {
+			level := CheckWarning
+			if m.Action == "fail" {
+				level = CheckCritical
+			}
+			raise(level, "policy: "+m.describe())
+		}
+	}
+
+	rtt, haveRTT := primaryRTT(result)
+	if haveRTT {
+		switch {
+		case cfg.critRTT > 0 && rtt > cfg.critRTT:
+			raise(CheckCritical, "RTT "+formatMillis(rtt)+" > "+formatMillis(cfg.critRTT))
+		case cfg.warnRTT > 0 && rtt > cfg.warnRTT:
+			raise(CheckWarning, "RTT "+formatMillis(rtt)+" > "+formatMillis(cfg.warnRTT))
+		}
+	}
+
+	summary := result.Type.String()
+	if result.Public != nil {
+		summary += ", public " + result.Public.AddrPort().String()
+	}
+	if len(problems) > 0 {
+		summary = strings.Join(problems, "; ") + " (" + summary + ")"
+	}
+
+	perf := []string{"confidence=" + strconv.Itoa(int(result.Confidence)) + ";;;0;2"}
+	if haveRTT {
+		perf = append([]string{"rtt=" + formatMillis(rtt) + ";" + thresholdMillis(cfg.warnRTT) + ";" + thresholdMillis(cfg.critRTT) + ";0"}, perf...)
+	}
+
+	return status, "NAT " + checkStatusNames[status] + " - " + summary + " | " + strings.Join(perf, " ")
+}
+
+// formatMillis renders a duration in milliseconds with the ms unit
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64) + "ms"
+}
+
+// thresholdMillis renders a perfdata threshold, empty when unset
+func thresholdMillis(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
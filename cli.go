@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+)
+
+// Command is a nat-info subcommand with its own flag set
+type Command struct {
+	Name    string
+	Summary string
+	// Run executes the command with the arguments following its name and
+	// returns the process exit code
+	Run func(args []string) int
+}
+
+// DefaultCommand runs when the first argument is a flag or absent, which keeps
+// the original flat `nat-info --flag ...` invocation working
+const DefaultCommand = "detect"
+
+// commands lists the subcommands in the order they appear in help output
+var commands = []*Command{
+	{Name: "detect", Summary: "Detect the NAT type (default)", Run: runDetect},
+	{Name: "watch", Summary: "Run detection repeatedly and report changes", Run: runWatch},
+	{Name: "collect", Summary: "Collect results from many watchers and serve fleet views", Run: runCollect},
+	{Name: "analyze", Summary: "Summarize watch and monitor history files", Run: runAnalyze},
+	{Name: "paths", Summary: "Run detection over each uplink and spot policy routing", Run: runPaths},
+	{Name: "portmap", Summary: "Find which of PCP, NAT-PMP and UPnP the gateway supports", Run: runPortMap},
+	{Name: "lan", Summary: "Check multicast and broadcast discovery on the local segment", Run: runLAN},
+	{Name: "ports", Summary: "Check from outside which public ports are open (opt-in)", Run: runPorts},
+	{Name: "stress", Summary: "Measure how many flows the NAT's session table holds (opt-in)", Run: runStress},
+	{Name: "survey", Summary: "Compare the public address seen by every server", Run: runSurvey},
+	{Name: "compliance", Summary: "Grade the NAT against RFC 4787/5382/5508 requirements", Run: runCompliance},
+	{Name: "test-server", Summary: "Check a STUN server's RFC 5389/5780 compliance", Run: runTestServer},
+	{Name: "openwrt", Summary: "Detect through the OpenWrt WAN interface and publish via ubus", Run: runOpenWrt},
+	{Name: "pair", Summary: "Test a direct path to a peer using copy-paste signaling", Run: runPair},
+	{Name: "responder", Summary: "Answer ICE connectivity checks as an ICE-lite agent", Run: runResponder},
+	{Name: "monitor", Summary: "Watch a mapping or peer path and record when and how it dies", Run: runMonitor},
+	{Name: "webrtc-preflight", Summary: "Check an RTCIceServer config the way a WebRTC app would use it", Run: runWebRTCPreflight},
+	{Name: "sip", Summary: "Check the network for SIP phones: port mappings, SIP ALG and RTP", Run: runSIP},
+	{Name: "game-host", Summary: "Check whether a game server's ports can be mapped and reached", Run: runGameHost},
+	{Name: "torrent", Summary: "Check a BitTorrent listen port, µTP/DHT mapping and connection rates", Run: runTorrent},
+	{Name: "mesh", Summary: "Check an overlay VPN port, its keepalive and which sites connect directly", Run: runMesh},
+	{Name: "timeouts", Summary: "Measure how long the NAT keeps idle UDP and TCP flows", Run: runTimeouts},
+	{Name: "tui", Summary: "Show a live terminal dashboard", Run: runTUI},
+	{Name: "selftest", Summary: "Check the local environment before filing a bug", Run: runSelftest},
+	{Name: "explain", Summary: "Decode a share code from another user", Run: runExplain},
+	{Name: "compat", Summary: "Predict whether two share codes can connect directly", Run: runCompat},
+	{Name: "decode", Summary: "Decode a hex-encoded STUN message", Run: runDecode},
+	{Name: "version", Summary: "Print the version", Run: runVersion},
+}
+
+// findCommand returns the registered command with the given name
+func findCommand(name string) *Command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// runCLI dispatches to a subcommand and returns the exit code
+func runCLI(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		return findCommand(DefaultCommand).Run(args)
+	}
+
+	switch args[0] {
+	case "help", "-h", "--help":
+		if len(args) > 1 {
+			if cmd := findCommand(args[1]); cmd != nil {
+				return cmd.Run([]string{"-h"})
+			}
+		}
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		printLine("Unknown command: " + args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+	return cmd.Run(args[1:])
+}
+
+// printUsage writes the top-level help listing every subcommand
+func printUsage(w io.Writer) {
+	width := 0
+	for _, cmd := range commands {
+		if len(cmd.Name) > width {
+			width = len(cmd.Name)
+		}
+	}
+
+	io.WriteString(w, "Usage: nat-info <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		io.WriteString(w, "  "+cmd.Name+strings.Repeat(" ", width-len(cmd.Name)+2)+cmd.Summary+"\n")
+	}
+	io.WriteString(w, "\nRun 'nat-info <command> -h' for command flags.\n")
+}
+
+// newFlagSet creates a flag set for a subcommand with a usage line naming it
+func newFlagSet(name, argsUsage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		usage := "Usage: nat-info " + name + " [flags]"
+		if argsUsage != "" {
+			usage += " " + argsUsage
+		}
+		io.WriteString(out, usage+"\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.String("lang", "en", "language of human-readable output: "+strings.Join(languages(), " or ")+"; JSON codes are unchanged")
+	fs.Bool("plain", false, "screen-reader friendly text: no color, no columns, one labeled value per line")
+	return fs
+}
+
+// parseFlags applies NATINFO_* environment variables and then the command
+// line to fs. It returns the exit code to use when parsing stops the command.
+func parseFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := applyEnv(fs); err != nil {
+		printLine(err.Error())
+		return 2, false
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	if _, err := parseLang(fs.Lookup("lang").Value.String()); err != nil {
+		printLine("Invalid --lang: " + err.Error())
+		return 2, false
+	}
+	return 0, true
+}
+
+func runVersion(args []string) int {
+	fs := newFlagSet("version", "")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	printLine("nat-info " + version)
+	return 0
+}
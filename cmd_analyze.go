@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func runAnalyze(args []string) int {
+	fs := newFlagSet("analyze", "<file>...")
+	output := fs.String("output", "text", "output format: text, csv or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 {
+		printLine("Usage: nat-info analyze [options] <file>... (- reads standard input)")
+		return 2
+	}
+	switch *output {
+	case "text", "csv", "json":
+	default:
+		printLine("Invalid --output: " + *output + " (expected text, csv or json)")
+		return 2
+	}
+
+	var h history
+	for _, name := range fs.Args() {
+		f := os.Stdin
+		if name != "-" {
+			var err error
+			if f, err = os.Open(name); err != nil {
+				printLine("Error opening history: " + err.Error())
+				return 1
+			}
+		}
+		err := readHistory(f, &h)
+		f.Close()
+		if err != nil {
+			printLine("Error reading " + name + ": " + err.Error())
+			return 1
+		}
+	}
+	a := analyzeHistory(&h)
+
+	switch *output {
+	case "json":
+		return encodeJSON(a)
+	case "csv":
+		writeAnalysisCSV(a)
+		return 0
+	}
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderAnalysis(r, a)
+	return 0
+}
+
+// renderAnalysis prints the analysis as sections answering one question each
+func renderAnalysis(r *textReport, a HistoryAnalysis) {
+	r.section("History")
+	r.field("Runs", strconv.Itoa(a.Runs)+" ("+strconv.Itoa(a.Errors)+" failed)")
+	if a.Runs > 0 {
+		r.field("Span", historyTime(a.First)+" to "+historyTime(a.Last)+" ("+roundSpan(a.Last.Sub(a.First))+")")
+	}
+	if a.Undated > 0 {
+		r.field("Skipped", strconv.Itoa(a.Undated)+" results without run metadata")
+	}
+
+	if len(a.PublicIPs) > 0 {
+		r.section("Public IP")
+		switch n := len(a.IPChanges); n {
+		case 0:
+			r.field("Changes", "none, "+a.PublicIPs[0].Value+" throughout")
+		default:
+			r.field("Changes", strconv.Itoa(n)+", about every "+roundSpan(a.ChangeInterval()))
+			last := a.IPChanges[n-1]
+			r.field("Last change", historyTime(last.Time)+" ("+last.From+" -> "+last.To+")")
+		}
+		for _, v := range a.PublicIPs {
+			r.item(r.column(v.Value, 16) + " " + strconv.Itoa(v.Runs) + " runs, " + historyTime(v.First) + " to " + historyTime(v.Last))
+		}
+	}
+
+	if len(a.NATTypes) > 0 {
+		r.section("NAT type")
+		ok := a.Runs - a.Errors
+		for _, v := range a.NATTypes {
+			t, _ := ParseNATType(v.Value)
+			r.item(r.paint(natTypeColor(t), r.tr(t.String())) + ": " + strconv.Itoa(v.Runs) + " runs (" + strconv.Itoa(v.Runs*100/ok) + "%)")
+		}
+		if n := len(a.NATTypeChanges); n > 0 {
+			last := a.NATTypeChanges[n-1]
+			r.field("Last change", historyTime(last.Time)+" ("+last.From+" -> "+last.To+"), "+strconv.Itoa(n)+" in total")
+		} else {
+			r.field("Last change", "never")
+		}
+	}
+
+	if len(a.Lifetimes) > 0 || len(a.Survived) > 0 {
+		r.section("Binding lifetimes")
+		if n := len(a.Lifetimes); n > 0 {
+			r.field("Died", strconv.Itoa(n)+" mappings")
+			r.field("Lifetime", "min "+roundSpan(a.Lifetimes[0])+", median "+roundSpan(quantile(a.Lifetimes, 0.5))+
+				", p90 "+roundSpan(quantile(a.Lifetimes, 0.9))+", max "+roundSpan(a.Lifetimes[n-1]))
+			for _, cause := range sortedKeys(a.LifetimeCauses) {
+				r.item(cause + ": " + strconv.Itoa(a.LifetimeCauses[cause]))
+			}
+		}
+		if n := len(a.Survived); n > 0 {
+			longest := a.Survived[0]
+			for _, d := range a.Survived {
+				longest = max(longest, d)
+			}
+			r.field("Survived", strconv.Itoa(n)+" runs ended with the mapping alive, the longest after "+roundSpan(longest))
+		}
+	}
+}
+
+// writeAnalysisCSV writes the analysis as section,key,value rows
+func writeAnalysisCSV(a HistoryAnalysis) {
+	w := csv.NewWriter(os.Stdout)
+	row := func(section, key, value string) { w.Write([]string{section, key, value}) }
+	seconds := func(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', 0, 64) }
+
+	row("section", "key", "value")
+	row("runs", "total", strconv.Itoa(a.Runs))
+	row("runs", "failed", strconv.Itoa(a.Errors))
+	if a.Runs > 0 {
+		row("runs", "first", historyTime(a.First))
+		row("runs", "last", historyTime(a.Last))
+	}
+
+	row("public-ip", "changes", strconv.Itoa(len(a.IPChanges)))
+	if len(a.IPChanges) > 0 {
+		row("public-ip", "mean-interval-seconds", seconds(a.ChangeInterval()))
+	}
+	for _, c := range a.IPChanges {
+		row("public-ip-change", historyTime(c.Time), c.From+" -> "+c.To)
+	}
+	for _, v := range a.PublicIPs {
+		row("public-ip-runs", v.Value, strconv.Itoa(v.Runs))
+	}
+
+	for _, v := range a.NATTypes {
+		row("nat-type-runs", v.Value, strconv.Itoa(v.Runs))
+	}
+	for _, c := range a.NATTypeChanges {
+		row("nat-type-change", historyTime(c.Time), c.From+" -> "+c.To)
+	}
+
+	for _, d := range a.Lifetimes {
+		row("binding-lifetime", "seconds", seconds(d))
+	}
+	for _, cause := range sortedKeys(a.LifetimeCauses) {
+		row("binding-cause", cause, strconv.Itoa(a.LifetimeCauses[cause]))
+	}
+	for _, d := range a.Survived {
+		row("binding-survived", "seconds", seconds(d))
+	}
+	w.Flush()
+}
+
+// historyTime formats a history time
+func historyTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// roundSpan rounds a duration for reading: seconds under an hour, minutes
+// beyond, and days past two of them
+func roundSpan(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return strconv.FormatFloat(d.Hours()/24, 'f', 1, 64) + " days"
+	case d >= time.Hour:
+		return d.Round(time.Minute).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// sortedKeys returns a count map's keys in order
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func runCollect(args []string) int {
+	fs := newFlagSet("collect", "")
+	listen := fs.String("listen", ":8443", "address to accept uploads and serve the fleet views on")
+	certFile := fs.String("tls-cert", "", "PEM certificate chain for HTTPS")
+	keyFile := fs.String("tls-key", "", "PEM private key for --tls-cert")
+	plainHTTP := fs.Bool("plain-http", false, "serve plain HTTP, for running behind a TLS-terminating reverse proxy")
+	token := fs.String("token", "", "bearer token uploaders and viewers must present (or NATINFO_TOKEN)")
+	store := fs.String("store", "", "keep the latest result of every host in this file across restarts")
+	maxAge := fs.Duration("max-age", 0, "drop hosts once they have not uploaded for this long; 0 keeps them")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if len(*token) < 16 {
+		printLine("--token needs at least 16 characters")
+		return 2
+	}
+	if *plainHTTP == (*certFile != "") {
+		printLine("Give --tls-cert and --tls-key, or --plain-http behind a proxy that terminates TLS")
+		return 2
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			printLine("Error loading TLS certificate: " + err.Error())
+			return 1
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	fleet, err := openFleetStore(*store, *maxAge)
+	if err != nil {
+		printLine("Error opening --store: " + err.Error())
+		return 1
+	}
+
+	c := &collectServer{token: *token, store: fleet}
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           c.handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			errs <- srv.ListenAndServeTLS("", "")
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+	printProgress("Collecting results on " + *listen)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		printLine("Error serving: " + err.Error())
+		return 1
+	case <-stop:
+		srv.Close()
+		return 0
+	}
+}
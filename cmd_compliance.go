@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+func runCompliance(args []string) int {
+	fs := newFlagSet("compliance", "")
+	df := addDetectFlags(fs)
+	timers := fs.String("timers", "", "also check the UDP mapping timer against this nat-info responder --timeouts (takes 5 minutes)")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	// Behavior mode measures filtering too, which REQ-8 grades
+	opts.Algorithm = AlgorithmBehavior
+
+	var timerTarget *net.UDPAddr
+	if *timers != "" {
+		timerTarget, err = net.ResolveUDPAddr("udp4", *timers)
+		if err != nil {
+			printLine("Invalid --timers: " + err.Error())
+			return 2
+		}
+	}
+
+	printProgress("Detecting NAT behavior...")
+	result, err := detectNATType(opts)
+	if err != nil {
+		printLine("Error during detection: " + err.Error())
+		return 1
+	}
+	card := &ReportCard{Result: result}
+	env := opts.probeEnv()
+
+	if primary := firstPassed(result, TestBinding); primary != nil {
+		printProgress("Testing hairpinning...")
+		hairpin := probeHairpin(primary, env, opts.withDefaults().ProbeTimeout)
+		card.Hairpin = &hairpin
+
+		printProgress("Provoking an ICMP port unreachable...")
+		if kept, err := probeICMPResilience(primary, env, opts.withDefaults().ProbeTimeout); err == nil {
+			card.ICMPKept = &kept
+		}
+	}
+	if timerTarget != nil {
+		printProgress("Idling UDP mappings for 2 and 5 minutes...")
+		card.UDPTimers = probeUDPTimers(timerTarget, env)
+	}
+	gradeCard(card)
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(card); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	report := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	rfc := ""
+	for _, item := range card.Items {
+		if item.RFC != rfc {
+			rfc = item.RFC
+			report.section("RFC " + rfc)
+		}
+		report.item(report.column(item.Req, 7) + report.paint(gradeColorFor(item.Grade), report.column(item.Grade, 9)) + item.Title + " (" + item.Level + ")")
+		if item.Detail != "" {
+			io.WriteString(report.w, "           "+item.Detail+"\n")
+		}
+	}
+
+	report.section("Summary")
+	report.field("Passed", strconv.Itoa(card.Passed)+" of "+strconv.Itoa(len(card.Items)))
+	report.field("MUST failed", strconv.Itoa(card.MustFailed))
+	report.field("Untested", strconv.Itoa(card.Untested))
+	return 0
+}
+
+// gradeColorFor colors a compliance grade
+func gradeColorFor(grade string) string {
+	switch grade {
+	case GradePass:
+		return ansiGreen
+	case GradeFail:
+		return ansiRed
+	}
+	return ansiYellow
+}
+
+// firstPassed returns the address of the first server that passed a test
+func firstPassed(r *NatResult, test TestName) *net.UDPAddr {
+	for _, e := range r.Evidence {
+		if e.Test == test && e.Passed {
+			addr, err := net.ResolveUDPAddr("udp4", e.Addr)
+			if err == nil {
+				return addr
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runDecode(args []string) int {
+	fs := newFlagSet("decode", "[hex]")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	// Read the hex dump from the arguments, or stdin when none are given
+	input := strings.Join(fs.Args(), "")
+	if input == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			printLine("Error reading stdin: " + err.Error())
+			return 1
+		}
+		input = string(data)
+	}
+
+	buf, err := decodeHex(input)
+	if err != nil {
+		printLine("Invalid hex: " + err.Error())
+		return 2
+	}
+
+	msg, err := interpretStunMessage(buf)
+	if err != nil {
+		printLine("Invalid STUN message: " + err.Error())
+		return 1
+	}
+
+	printLine("Message Type:   0x" + strconv.FormatUint(uint64(msg.Type), 16))
+	printLine("Length:         " + strconv.Itoa(msg.Length))
+	if msg.RFC5389 {
+		printLine("Magic Cookie:   present (RFC 5389)")
+	} else {
+		printLine("Magic Cookie:   absent (RFC 3489)")
+	}
+	printLine("Transaction ID: " + msg.TransactionID)
+
+	for _, attr := range msg.Attributes {
+		line := "  " + attr.Name + " (" + strconv.Itoa(attr.Length) + " bytes)"
+		switch {
+		case attr.Address != "":
+			line += ": " + attr.Address
+		case attr.Text != "":
+			line += ": " + strconv.Quote(attr.Text)
+		case attr.Hex != "":
+			line += ": " + attr.Hex
+		}
+		printLine(line)
+	}
+	return 0
+}
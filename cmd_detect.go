@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// detectFlags holds the flags shared by every command that runs detection
+type detectFlags struct {
+	fs             *flag.FlagSet
+	algorithm      *string
+	timeout        *time.Duration
+	timeoutPrimary *time.Duration
+	timeoutMapping *time.Duration
+	timeoutProbe   *time.Duration
+	servers        *string
+	serversFile    *string
+	serversReplace *bool
+	iface          *string
+	stability      *int
+	votes          *int
+	quic           *string
+	dtls           *string
+	dtlsCA         *string
+	dtlsInsecure   *bool
+	dtlsPSK        *string
+	dtlsIdentity   *string
+	bandwidth      *string
+	reach          *string
+	ecn            *string
+	strictSource   *bool
+	conntrack      *bool
+	snmp           *string
+	snmpCommunity  *string
+	salt           *string
+	fwmark         *int
+	vrf            *string
+	policy         *string
+	pluginTimeout  *time.Duration
+	sockopts       sockoptFlag
+	plugins        pluginFlag
+}
+
+// addDetectFlags registers the detection flags on fs
+func addDetectFlags(fs *flag.FlagSet) *detectFlags {
+	f := &detectFlags{
+		fs:             fs,
+		algorithm:      fs.String("algorithm", string(AlgorithmClassic), "classification algorithm: classic (RFC 3489 cone/symmetric) or behavior (RFC 4787 mapping/filtering)"),
+		timeout:        fs.Duration("timeout", 0, "timeout for every phase; per-phase flags take precedence"),
+		timeoutPrimary: fs.Duration("timeout-primary", DefaultPrimaryTimeout, "timeout for the primary binding request"),
+		timeoutMapping: fs.Duration("timeout-mapping", DefaultMappingTimeout, "timeout for each mapping-behavior request"),
+		timeoutProbe:   fs.Duration("timeout-probe", DefaultProbeTimeout, "timeout for each cone-subtype probe"),
+		servers:        fs.String("servers", "", "comma-separated STUN servers, each optionally annotated like a --servers-file line"),
+		serversFile:    fs.String("servers-file", "", "file with one STUN server per line, optionally annotated with rfc3489 or tls"),
+		serversReplace: fs.Bool("servers-replace", false, "use only the servers from --servers/--servers-file instead of merging them with the built-in lists"),
+		quic:           fs.String("quic", "", "also probe this host[:port] (default port 443) for QUIC version negotiation"),
+		dtls:           fs.String("dtls", "", "also send a binding request over DTLS to this host[:port] (default port 5349)"),
+		dtlsCA:         fs.String("dtls-ca", "", "PEM file of CA certificates to verify the --dtls server with instead of the system pool"),
+		dtlsInsecure:   fs.Bool("dtls-insecure", false, "do not verify the --dtls server's certificate"),
+		dtlsPSK:        fs.String("dtls-psk", "", "authenticate to the --dtls server with this hex pre-shared key instead of a certificate"),
+		dtlsIdentity:   fs.String("dtls-psk-identity", "", "PSK identity sent with --dtls-psk"),
+		bandwidth:      fs.String("bandwidth", "", "estimate throughput against this nat-info responder --bandwidth host:port"),
+		reach:          fs.String("reach", "", "ask this nat-info responder --reach to send unsolicited packets to unrelated ports, revealing a DMZ or static mapping"),
+		ecn:            fs.String("ecn", "", "send probes with each ECN codepoint to this nat-info responder --ecn and report whether the path preserves, remarks or bleaches them (Linux only)"),
+		conntrack:      fs.Bool("conntrack", false, "on a Linux router, read the probes' translations from the conntrack table (needs root; pair with --iface on the LAN side)"),
+		snmp:           fs.String("snmp", "", "query this gateway over SNMPv2c for its WAN address and NAT counters"),
+		snmpCommunity:  fs.String("snmp-community", "public", "SNMP community for --snmp"),
+		strictSource:   fs.Bool("strict-source", false, "accept answers only from the exact address a request was sent to, except for CHANGE-REQUEST probes"),
+		salt:           fs.String("fingerprint-salt", "", "salt for the network fingerprint in the run metadata; give a fleet the same salt to group its results by network"),
+		fwmark:         fs.Int("fwmark", 0, "on Linux, mark probe sockets with this firewall mark (SO_MARK) so ip rules route them through another table or uplink; needs CAP_NET_ADMIN"),
+		vrf:            fs.String("vrf", "", "on Linux, bind probe sockets to this VRF device so its routing table is used; needs CAP_NET_RAW"),
+		iface:          fs.String("iface", "", "network interface to send probes from"),
+		stability:      fs.Int("stability-probes", DefaultStabilityProbes, "extra bindings from fresh sockets that check the public IP is stable; 0 disables"),
+		votes:          fs.Int("votes", DefaultVotes, "binding transactions that must report the same mapping before the primary or a mapping-behavior result is used; 1 trusts a single answer"),
+		policy:         fs.String("policy", "", "judge the result with these rules, or the rules in this file, e.g. \"fail if symmetric or public-ip in 100.64/10\""),
+		pluginTimeout:  fs.Duration("plugin-timeout", DefaultPluginTimeout, "time each --plugin has to answer before it is killed"),
+	}
+	fs.Var(&f.plugins, "plugin", "run this command after detection as a probe plugin: it reads the result as JSON on stdin and prints a pass/warn/fail result as JSON; repeatable")
+	fs.Var(&f.sockopts, "sockopt", "set a socket option on probe sockets as name=value (ttl, tos, rcvbuf, sndbuf, ...) or LEVEL:OPTION=value; repeatable")
+	return f
+}
+
+// options validates the parsed flags and builds the detection options
+func (f *detectFlags) options() (DetectOptions, error) {
+	opts := DetectOptions{
+		Algorithm:      Algorithm(*f.algorithm),
+		PrimaryTimeout: *f.timeoutPrimary,
+		MappingTimeout: *f.timeoutMapping,
+		ProbeTimeout:   *f.timeoutProbe,
+		Interface:      *f.iface,
+		QUICTarget:     *f.quic,
+	}
+	opts.FingerprintSalt = *f.salt
+	opts.BandwidthTarget = *f.bandwidth
+	if *f.dtls != "" {
+		cfg, err := f.dtlsConfig()
+		if err != nil {
+			return opts, err
+		}
+		opts.DTLSTarget = *f.dtls
+		opts.DTLS = cfg
+	}
+	opts.ReachTarget = *f.reach
+	opts.ECNTarget = *f.ecn
+	opts.Conntrack = *f.conntrack
+	opts.SNMPTarget = *f.snmp
+	opts.SNMPCommunity = *f.snmpCommunity
+	opts.StrictSource = *f.strictSource
+	if (*f.fwmark != 0 || *f.vrf != "") && runtime.GOOS != "linux" {
+		return opts, errors.New("--fwmark and --vrf require Linux")
+	}
+	if *f.fwmark < 0 || int64(*f.fwmark) > 0xffffffff {
+		return opts, errors.New("invalid --fwmark: must be a 32-bit unsigned value")
+	}
+	opts.SocketMark, opts.SocketDevice = *f.fwmark, *f.vrf
+	opts.socketOptions = f.sockopts
+	if *f.stability <= 0 {
+		opts.StabilityProbes = -1
+	} else {
+		opts.StabilityProbes = *f.stability
+	}
+	if *f.votes < 1 || *f.votes > 5 {
+		return opts, errors.New("invalid --votes: must be between 1 and 5")
+	}
+	opts.Votes = *f.votes
+	opts.Plugins = f.plugins
+	opts.PluginTimeout = *f.pluginTimeout
+	if *f.policy != "" {
+		policy, err := loadPolicy(*f.policy)
+		if err != nil {
+			return opts, errors.New("invalid --policy: " + err.Error())
+		}
+		opts.Policy = policy
+	}
+	if opts.Algorithm != AlgorithmClassic && opts.Algorithm != AlgorithmBehavior {
+		return opts, errors.New("invalid --algorithm: " + *f.algorithm + " (expected classic or behavior)")
+	}
+
+	// --timeout covers every phase whose own flag was not given
+	if *f.timeout > 0 {
+		set := make(map[string]bool)
+		f.fs.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+		if !set["timeout-primary"] {
+			opts.PrimaryTimeout = *f.timeout
+		}
+		if !set["timeout-mapping"] {
+			opts.MappingTimeout = *f.timeout
+		}
+		if !set["timeout-probe"] {
+			opts.ProbeTimeout = *f.timeout
+		}
+	}
+
+	var entries []ServerEntry
+	if *f.servers != "" {
+		parsed, err := parseServerList(*f.servers)
+		if err != nil {
+			return opts, errors.New("invalid --servers: " + err.Error())
+		}
+		entries = append(entries, parsed...)
+	}
+	if *f.serversFile != "" {
+		parsed, err := loadServersFile(*f.serversFile)
+		if err != nil {
+			return opts, errors.New("error reading servers file: " + err.Error())
+		}
+		entries = append(entries, parsed...)
+	}
+
+	if len(entries) > 0 {
+		servers, rfc3489, skipped := applyServerEntries(entries, defaultServers(), defaultRfc3489Servers(), *f.serversReplace)
+		for _, entry := range skipped {
+			printProgress("Skipping TLS-only server " + entry.Addr + ": detection probes over UDP")
+		}
+		if len(servers) == 0 {
+			return opts, errors.New("no UDP STUN servers configured")
+		}
+		opts.Servers = servers
+		opts.Rfc3489Servers = rfc3489
+	}
+
+	return opts, nil
+}
+
+// dtlsConfig builds the DTLS client configuration from the --dtls-* flags
+func (f *detectFlags) dtlsConfig() (*natinfo.DTLSConfig, error) {
+	cfg := &natinfo.DTLSConfig{InsecureSkipVerify: *f.dtlsInsecure, PSKIdentity: *f.dtlsIdentity}
+	if *f.dtlsCA != "" {
+		pem, err := os.ReadFile(*f.dtlsCA)
+		if err != nil {
+			return nil, errors.New("error reading --dtls-ca: " + err.Error())
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in --dtls-ca " + *f.dtlsCA)
+		}
+	}
+	if *f.dtlsPSK != "" {
+		psk, err := hex.DecodeString(*f.dtlsPSK)
+		if err != nil || len(psk) == 0 {
+			return nil, errors.New("invalid --dtls-psk: expected hex")
+		}
+		cfg.PSK = psk
+	}
+	return cfg, nil
+}
+
+func runDetect(args []string) int {
+	fs := newFlagSet("detect", "")
+	df := addDetectFlags(fs)
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	bundle := fs.String("bundle", "", "write a diagnostic archive (transaction log, raw packets, resolved addresses, interfaces, routes and result) to this .tar.gz for bug reports")
+	redact := fs.Bool("redact", false, "with --bundle, replace public IPs with placeholders")
+	rf := addReportFlags(fs)
+	explain := fs.Bool("explain", false, "also print the evidence chain behind the verdict: each test, what it observed and what was concluded from it")
+	onComplete := fs.String("on-complete", "", "run this shell command after detection, with the result as JSON on stdin and NATINFO_* variables")
+	check := fs.Bool("check", false, "run as a Nagios/Icinga plugin: print one status line and exit 0/1/2/3")
+	var checkCfg checkConfig
+	fs.Var(&checkCfg.expect, "expect", "with --check, required result as key=value[|value...] for type, mapping, filtering, public-ip or confidence; repeatable")
+	fs.DurationVar(&checkCfg.warnRTT, "warn-rtt", 0, "with --check, warn when the primary binding RTT exceeds this")
+	fs.DurationVar(&checkCfg.critRTT, "crit-rtt", 0, "with --check, go critical when the primary binding RTT exceeds this")
+	if code, ok := parseFlags(fs, args); !ok {
+		if *check && code != 0 {
+			return CheckUnknown
+		}
+		return code
+	}
+
+	if *check {
+		progressOut = io.Discard
+		opts, err := df.options()
+		if err != nil {
+			printLine("NAT UNKNOWN - " + err.Error())
+			return CheckUnknown
+		}
+		result, err := detectNATType(opts)
+		status, line := evaluateCheck(result, err, checkCfg)
+		printLine(line)
+		return status
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	uploader, err := rf.uploader(opts.FingerprintSalt)
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	if *bundle != "" {
+		opts.recorder = newBundleRecorder()
+	}
+
+	printProgress("Detecting NAT type...")
+
+	result, err := detectNATType(opts)
+	if *bundle != "" {
+		if err := writeBundle(*bundle, opts.recorder, os.Args, result, err, *redact); err != nil {
+			printLine("Error writing bundle: " + err.Error())
+			return 1
+		}
+		printProgress("Wrote diagnostic bundle to " + *bundle)
+	}
+	var hook *hookSink
+	if *onComplete != "" {
+		hook = &hookSink{command: *onComplete}
+	}
+	if err != nil {
+		printLine("Error during detection: " + err.Error())
+		if hook != nil {
+			hook.handle(WatchEvent{Time: time.Now(), Error: err.Error()})
+		}
+		return 1
+	}
+	if *explain {
+		result.Explanation = explainResult(result)
+	}
+	// A failed upload or hook still prints the result, but fails the run
+	// for cron
+	status := 0
+	if uploader != nil {
+		if err := uploader.upload(result); err != nil {
+			printProgress("Upload to " + uploader.url + " failed: " + err.Error())
+			status = 1
+		}
+	}
+	if hook != nil {
+		if err := hook.run(WatchEvent{Time: time.Now(), Result: result}); err != nil {
+			printProgress("Hook " + strconv.Quote(hook.command) + " failed: " + err.Error())
+			status = 1
+		}
+	}
+	if result.Policy != nil && result.Policy.Verdict == "fail" {
+		status = PolicyFailed
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+		return status
+	}
+
+	report := &textReport{
+		w:         os.Stdout,
+		algorithm: opts.Algorithm,
+		color:     !*noColor && colorEnabled(os.Stdout),
+		textStyle: styleOf(fs),
+	}
+	report.render(result)
+	return status
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func runExplain(args []string) int {
+	fs := newFlagSet("explain", "<code>")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		printLine("Usage: nat-info explain [options] <code>")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+
+	c, err := parseShareCode(fs.Arg(0))
+	if err != nil {
+		printLine("Invalid share code: " + err.Error())
+		return 2
+	}
+	if *output == "json" {
+		return encodeJSON(c)
+	}
+	report := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	report.section("Share code " + c.String())
+	explainShareCode(report, c)
+	return 0
+}
+
+// CompatReport is the JSON output of compat
+type CompatReport struct {
+	A       ShareCode `json:"a"`
+	B       ShareCode `json:"b"`
+	Verdict string    `json:"verdict"`
+	Note    string    `json:"note"`
+}
+
+func runCompat(args []string) int {
+	fs := newFlagSet("compat", "<codeA> <codeB>")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 2 {
+		printLine("Usage: nat-info compat [options] <codeA> <codeB>")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+
+	var codes [2]ShareCode
+	for i := range codes {
+		c, err := parseShareCode(fs.Arg(i))
+		if err != nil {
+			printLine("Invalid share code " + fs.Arg(i) + ": " + err.Error())
+			return 2
+		}
+		codes[i] = c
+	}
+	verdict, note := compatibility(codes[0], codes[1])
+
+	if *output == "json" {
+		return encodeJSON(CompatReport{codes[0], codes[1], verdict, note})
+	}
+	report := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	for i, c := range codes {
+		report.section("Peer " + string(rune('A'+i)) + " (" + c.String() + ")")
+		explainShareCode(report, c)
+	}
+	report.section("Compatibility")
+	color := ansiGreen
+	switch verdict {
+	case CompatRelay:
+		color = ansiRed
+	case CompatUnknown:
+		color = ansiYellow
+	}
+	report.field("Verdict", report.paint(color, verdict))
+	report.item(note)
+	return 0
+}
+
+// explainShareCode renders the fields of a decoded share code
+func explainShareCode(report *textReport, c ShareCode) {
+	report.field("NAT Type", report.paint(natTypeColor(c.Type), report.tr(c.Type.String())))
+	report.field("Mapping", report.paint(behaviorColor(c.Mapping), report.tr(c.Mapping.String())))
+	report.field("Filtering", report.paint(behaviorColor(c.Filtering), report.tr(c.Filtering.String())))
+	preserved := "no"
+	if c.PortPreserved {
+		preserved = "yes"
+	}
+	report.field("Port kept", preserved)
+	if c.Translation != "" {
+		report.field("Translation", report.tr(c.Translation.String()))
+	}
+	lifetime := "not measured"
+	if c.Lifetime > 0 {
+		lifetime = "at least " + c.Lifetime.String()
+	}
+	report.field("Lifetime", lifetime)
+	if c.UnstableAddress {
+		report.field("Address", report.paint(ansiYellow, "unstable"))
+	}
+	report.field("Confidence", report.paint(confidenceColor(c.Confidence), c.Confidence.String()))
+}
+
+// encodeJSON writes v to stdout as indented JSON
+func encodeJSON(v any) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		printLine("Error encoding result: " + err.Error())
+		return 1
+	}
+	return 0
+}
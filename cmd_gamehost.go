@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runGameHost(args []string) int {
+	fs := newFlagSet("game-host", "")
+	df := addDetectFlags(fs)
+	udp := fs.String("udp", "", "comma-separated UDP ports the game server needs, e.g. 27015,27016")
+	tcp := fs.String("tcp", "", "comma-separated TCP ports the game server needs, e.g. 25565")
+	responder := fs.String("responder", "", "nat-info responder --scan host:port that checks the ports from outside")
+	yes := fs.Bool("yes", false, "with --responder, confirm that it may connect to these ports of this network's public IP")
+	gateway := fs.String("gateway", "", "address of the PCP/NAT-PMP server (default the IPv4 default gateway)")
+	protocols := fs.String("protocols", DefaultPortMapOrder, "comma-separated port mapping protocols to try, most preferred first")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	udpPorts, err := parseInboundPorts("udp", *udp)
+	if err != nil {
+		printLine("Invalid --udp: " + err.Error())
+		return 2
+	}
+	tcpPorts, err := parseInboundPorts("tcp", *tcp)
+	if err != nil {
+		printLine("Invalid --tcp: " + err.Error())
+		return 2
+	}
+	ports := append(udpPorts, tcpPorts...)
+	if len(ports) == 0 {
+		printLine("Usage: nat-info game-host --udp ports --tcp ports [flags] (at least one port)")
+		return 2
+	}
+	if len(ports) > maxScanPorts {
+		printLine("At most " + strconv.Itoa(maxScanPorts) + " ports can be checked at once")
+		return 2
+	}
+	order, err := parsePortMapOrder(*protocols)
+	if err != nil {
+		printLine("Invalid --protocols: " + err.Error())
+		return 2
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	var gw net.IP
+	if *gateway != "" {
+		if gw = net.ParseIP(*gateway).To4(); gw == nil {
+			printLine("Invalid --gateway: " + *gateway + " (expected an IPv4 address)")
+			return 2
+		}
+	} else {
+		_, gw = defaultGateway(opts.Interface)
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	if *responder != "" {
+		names := make([]string, len(ports))
+		for i, p := range ports {
+			names[i] = p.String()
+		}
+		printProgress("The responder " + *responder + " will connect to " + strings.Join(names, ", ") + " at this network's public IP.")
+		printProgress("Only check a network you are responsible for.")
+		if !*yes {
+			printProgress("Re-run with --yes to start it.")
+			return 2
+		}
+	}
+
+	opts = opts.withDefaults()
+	check := checkGameHost(opts, ports, gw, order, *responder, opts.PrimaryTimeout)
+	status := 0
+	if check.Verdict != GameReady && check.Verdict != GameNeedsMapping && check.Verdict != GameMappable {
+		status = 1
+	}
+	if *output == "json" {
+		if code := encodeJSON(check); code != 0 {
+			return code
+		}
+		return status
+	}
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderGameHost(r, check)
+	return status
+}
+
+// renderGameHost lists each port's mapping and reachability and ends with
+// the one thing to do
+func renderGameHost(r *textReport, c *GameHostCheck) {
+	r.section("Game ports")
+	if c.PortMap != nil && c.PortMap.Preferred != "" {
+		r.field("Mapped with", portMapNames[c.PortMap.Preferred])
+	} else {
+		r.field("Mapped with", r.paint(ansiYellow, "nothing (no PCP, NAT-PMP or UPnP)"))
+	}
+	for _, p := range c.Ports {
+		r.item(r.column(p.String(), 12) + describeInboundPort(r, p))
+	}
+	if c.ScanError != "" {
+		r.field("Outside", r.paint(ansiYellow, c.ScanError))
+	}
+
+	r.section("Matchmaking")
+	if c.NAT != nil {
+		r.field("NAT type", r.tr(c.NAT.Type.String()))
+	}
+	if c.PublicIP != "" {
+		r.field("Public IP", c.PublicIP)
+	}
+	r.field("NAT", strings.ToUpper(c.Matchmaking))
+	switch c.Matchmaking {
+	case "open":
+		r.item("Players can join hosted games and peer-to-peer sessions without port forwards.")
+	case "moderate":
+		r.item("Joining works, but peer-to-peer sessions with strict players fail; forwarded or mapped ports make this host open.")
+	case "strict":
+		r.item("Only players with an open NAT can connect directly; hosting needs forwarded or mapped ports, or the game's relay servers.")
+	}
+
+	r.section("Verdict")
+	color := ansiGreen
+	switch c.Verdict {
+	case GameNeedsMapping, GameMappable:
+		color = ansiYellow
+	case GameNeedsForward, GameBlocked, GameCGNAT:
+		color = ansiRed
+	}
+	r.field("Verdict", r.paint(color, strings.ToUpper(c.Verdict)))
+	r.item(c.Advice)
+}
+
+// describeInboundPort renders whether a port was mapped and reached
+func describeInboundPort(r *textReport, p InboundPort) string {
+	var parts []string
+	switch {
+	case p.Mapping == nil:
+	case p.Mapping.Error != "":
+		parts = append(parts, r.paint(ansiRed, "not mapped: "+p.Mapping.Error))
+	case p.Mapping.External != p.Port:
+		parts = append(parts, r.paint(ansiYellow, "mapped to external port "+strconv.Itoa(p.Mapping.External)))
+	default:
+		parts = append(parts, r.paint(ansiGreen, "mapped"))
+	}
+	switch p.State {
+	case "":
+	case PortOpen:
+		parts = append(parts, r.paint(ansiGreen, "reachable"))
+	default:
+		parts = append(parts, r.paint(ansiRed, "unreachable ("+p.State+")"))
+	}
+	if p.InUse {
+		parts = append(parts, "in use locally")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func runLAN(args []string) int {
+	fs := newFlagSet("lan", "")
+	iface := fs.String("iface", "", "LAN interface to test (default the one holding the default route)")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to collect answers")
+	answer := fs.Bool("answer", false, "answer nat-info lan beacons from other hosts until interrupted, to test two devices against each other")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+
+	if *answer {
+		stop := make(chan struct{})
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			close(stop)
+		}()
+		printLine("Answering nat-info lan beacons on " + lanPeerGroup.String() + " and broadcast port " + strconv.Itoa(lanPeerGroup.Port) + "; press Ctrl-C to stop")
+		err := answerLAN(*iface, stop, func(from *net.UDPAddr, delivery string) {
+			printLine(time.Now().Format("15:04:05") + "  " + delivery + " beacon from " + from.IP.String())
+		})
+		if err != nil {
+			printLine("Error answering beacons: " + err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	printProgress("Sending LAN discovery queries...")
+	check, err := checkLAN(DetectOptions{Interface: *iface}.probeEnv(), *timeout)
+	if err != nil {
+		printLine("Error: " + err.Error())
+		return 1
+	}
+	if *output == "json" {
+		return encodeJSON(check)
+	}
+
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderLAN(r, check)
+	return 0
+}
+
+// renderLAN prints each probe's responders and what the silence or
+// answers mean
+func renderLAN(r *textReport, c LANCheck) {
+	r.section("LAN segment")
+	if c.Interface != "" {
+		r.field("Interface", c.Interface)
+	}
+	r.field("Address", c.LocalIP)
+	if c.BroadcastAddr != "" {
+		r.field("Broadcast", c.BroadcastAddr)
+	}
+
+	r.section("Discovery")
+	for _, p := range c.Probes {
+		status := r.paint(ansiYellow, "no answer")
+		switch {
+		case p.Error != "":
+			status = r.paint(ansiRed, "error: "+p.Error)
+		case len(p.Responders) > 0:
+			status = r.paint(ansiGreen, strings.Join(p.Responders, ", "))
+		}
+		r.item(r.column(p.Name, 14) + r.column(p.Delivery, 10) + status)
+	}
+
+	r.section("Verdict")
+	for _, line := range lanVerdict(c) {
+		r.item(line)
+	}
+}
+
+// lanVerdict explains the check. Only a nat-info peer proves a path
+// absent; other devices may simply not exist or not speak the protocol.
+func lanVerdict(c LANCheck) []string {
+	var out []string
+	switch {
+	case c.PeerMulticast && c.PeerBroadcast:
+		out = append(out, "A nat-info peer answered by multicast and broadcast: LAN discovery works between these two devices.")
+	case c.PeerAnswered && !c.PeerMulticast:
+		out = append(out, "A nat-info peer answered broadcast but not multicast: the access point or switch filters multicast (IGMP snooping without a querier, or multicast-to-unicast conversion), so mDNS and SSDP discovery fail while direct connections work.")
+	case c.PeerAnswered && !c.PeerBroadcast && c.BroadcastAddr != "":
+		out = append(out, "A nat-info peer answered multicast but not broadcast: broadcast is filtered on this segment, which breaks NetBIOS and some game and DLNA discovery.")
+	case c.MulticastAnswered && c.BroadcastAnswered:
+		out = append(out, "Other devices answered multicast and broadcast discovery on this segment.")
+	case c.MulticastAnswered:
+		out = append(out, "Other devices answered multicast discovery on this segment; none answered broadcast, which proves less, since few devices listen for it.")
+	case c.BroadcastAnswered:
+		out = append(out, "Other devices answered broadcast but not multicast discovery; multicast may be filtered on this segment.")
+	default:
+		out = append(out, "Nothing on the segment answered. Either no other discoverable device is present, or the network isolates clients (common on guest and public Wi-Fi): peers on the same network cannot see or reach each other even though the NAT is fine.")
+		out = append(out, "To tell the two apart, run `nat-info lan --answer` on another device on the same network and run this check again.")
+	}
+	if !c.PeerAnswered && (c.MulticastAnswered || c.BroadcastAnswered) {
+		out = append(out, "Run `nat-info lan --answer` on a second device to test the path between two clients specifically; isolation often exempts the router and wired devices.")
+	}
+	return out
+}
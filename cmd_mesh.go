@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runMesh(args []string) int {
+	fs := newFlagSet("mesh", "[<peer-code>...]")
+	df := addDetectFlags(fs)
+	port := fs.Int("port", DefaultMeshPort, "the overlay's UDP listen port (WireGuard 51820, Tailscale 41641)")
+	keepalive := fs.Duration("keepalive", DefaultMeshKeepalive, "the PersistentKeepalive interval to judge against the binding lifetime")
+	responder := fs.String("responder", "", "nat-info responder --timeouts host:port used to measure the UDP binding lifetime")
+	maxIdle := fs.Duration("max-idle", 2*time.Minute, "with --responder, the longest idle period to test; the run takes this long")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *port < 1 || *port > 65535 {
+		printLine("Invalid --port: " + strconv.Itoa(*port))
+		return 2
+	}
+	if *keepalive <= 0 {
+		printLine("--keepalive must be positive")
+		return 2
+	}
+	var peers []ShareCode
+	for _, arg := range fs.Args() {
+		c, err := parseShareCode(arg)
+		if err != nil {
+			printLine("Invalid share code " + arg + ": " + err.Error())
+			return 2
+		}
+		peers = append(peers, c)
+	}
+	var target *net.UDPAddr
+	if *responder != "" {
+		var err error
+		if target, err = net.ResolveUDPAddr("udp4", *responder); err != nil {
+			printLine("Invalid --responder: " + err.Error())
+			return 2
+		}
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	check := checkMesh(opts.withDefaults(), *port, *keepalive, target, *maxIdle, peers)
+	status := 0
+	if check.Verdict != MeshReady {
+		status = 1
+	}
+	if *output == "json" {
+		if code := encodeJSON(check); code != 0 {
+			return code
+		}
+		return status
+	}
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderMesh(r, check)
+	return status
+}
+
+// renderMesh prints the overlay port's mapping, the keepalive check and the
+// prediction for each peer site, then the verdict
+func renderMesh(r *textReport, c *MeshCheck) {
+	r.section("Overlay port")
+	r.field("Port", strconv.Itoa(c.Port))
+	r.field("UDP mapping", describeLocalMapping(r, c.Mapping))
+	if c.NAT != nil {
+		r.field("NAT type", r.tr(c.NAT.Type.String()))
+		r.field("Filtering", r.tr(c.NAT.Filtering.String()))
+	}
+
+	r.section("Keepalive")
+	r.field("Keepalive", c.Keepalive.String())
+	if c.Lifetime != nil {
+		r.field("Lifetime", describeTimeout(*c.Lifetime))
+	} else {
+		r.field("Lifetime", "not measured")
+	}
+	switch {
+	case c.KeepaliveOK == nil:
+	case *c.KeepaliveOK:
+		r.field("Sufficient", r.paint(ansiGreen, "yes"))
+	default:
+		r.field("Sufficient", r.paint(ansiRed, "no, bindings expire first"))
+	}
+
+	r.section("Sites")
+	r.field("This site", c.ShareCode.String())
+	for _, p := range c.Peers {
+		color := ansiGreen
+		switch p.Verdict {
+		case CompatRelay:
+			color = ansiRed
+		case CompatUnknown:
+			color = ansiYellow
+		}
+		r.item(r.column(p.Code.String(), 12) + r.paint(color, p.Verdict) + ": " + p.Note)
+	}
+	if len(c.Peers) == 0 {
+		r.item("Give other sites' share codes as arguments to predict direct or relayed tunnels.")
+	}
+
+	r.section("Verdict")
+	color := ansiGreen
+	switch c.Verdict {
+	case MeshKeepalive:
+		color = ansiYellow
+	case MeshRelay, MeshBlocked:
+		color = ansiRed
+	}
+	r.field("Verdict", r.paint(color, strings.ToUpper(c.Verdict)))
+	for _, note := range c.Notes {
+		r.item(note)
+	}
+}
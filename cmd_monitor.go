@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultLatencyInterval is the probe interval of monitor --latency, often
+// enough to see short stalls without loading the STUN server
+const defaultLatencyInterval = 5 * time.Second
+
+func runMonitor(args []string) int {
+	fs := newFlagSet("monitor", "[server]")
+	df := addDetectFlags(fs)
+	interval := fs.Duration("interval", 15*time.Second, "time between probes; the probes also keep the mapping open, as a session's keepalives would")
+	probeTimeout := fs.Duration("probe-timeout", 2*time.Second, "how long to wait for each answer")
+	failures := fs.Int("failures", 3, "unanswered probes in a row that count as the path dying")
+	duration := fs.Duration("duration", 0, "stop after this long (default: until the path dies or Ctrl-C)")
+	pair := fs.Bool("pair", false, "open a direct path to a peer with pair's copy-paste signaling and monitor that instead; the peer runs monitor --pair too")
+	peer := fs.String("peer", "", "with --pair, the peer's blob (default read from stdin)")
+	wait := fs.Duration("wait", 30*time.Second, "with --pair, how long to run connectivity checks")
+	latency := fs.Bool("latency", false, "record every probe's RTT as a time series and keep going through losses and address changes, counting mapping migrations; --interval defaults to 5s")
+	series := fs.String("series", "", "with --latency, append each probe to this CSV file as it happens: time,rtt_ms,lost,mapped")
+	output := fs.String("output", "text", "output format: text or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *latency {
+		set := false
+		fs.Visit(func(f *flag.Flag) { set = set || f.Name == "interval" })
+		if !set {
+			*interval = defaultLatencyInterval
+		}
+	} else if *series != "" {
+		printLine("--series needs --latency")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *probeTimeout >= *interval {
+		printLine("--probe-timeout must be shorter than --interval")
+		return 2
+	}
+	if *failures < 1 {
+		printLine("--failures must be at least 1")
+		return 2
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	opts = opts.withDefaults()
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	env := opts.probeEnv()
+	m := &pathMonitor{env: env, interval: *interval, timeout: *probeTimeout, failures: *failures, latency: *latency}
+	if *series != "" {
+		f, err := os.OpenFile(*series, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			printLine("Error opening --series: " + err.Error())
+			return 1
+		}
+		defer f.Close()
+		m.onSample = func(s MonitorSample) {
+			if _, err := io.WriteString(f, seriesLine(s)); err != nil {
+				printProgress("Writing --series failed: " + err.Error())
+			}
+		}
+	}
+	if *pair {
+		conn, localIP, err := env.listenLocal()
+		if err != nil {
+			printLine("Error opening socket: " + err.Error())
+			return 1
+		}
+		defer conn.Close()
+
+		local := PeerInfo{
+			Ufrag:      randomICEString(8),
+			Pwd:        randomICEString(24),
+			Candidates: gatherCandidates(conn, localIP, opts),
+		}
+		printProgress("Send this blob to your peer:")
+		printProgress("")
+		printProgress(encodeBlob(local))
+		printProgress("")
+		var remote PeerInfo
+		if *peer != "" {
+			remote, err = decodeBlob(*peer)
+		} else {
+			printProgress("Paste the peer's blob:")
+			remote, err = readBlob(bufio.NewReader(os.Stdin))
+		}
+		if err != nil {
+			printLine("Error reading peer blob: " + err.Error())
+			return 2
+		}
+
+		printProgress("Running connectivity checks for up to " + wait.String() + "...")
+		agent := newICEAgent(conn, local, remote)
+		established, err := agent.establish(*wait)
+		if established.Selected == nil {
+			printLine("Failed: " + err.Error())
+			return 1
+		}
+		m.conn, m.agent, m.peer = conn, agent, established.Selected
+		m.result = &MonitorResult{Target: established.Selected.String(), Mode: "peer"}
+	} else {
+		server := opts.Servers[0]
+		if fs.NArg() > 0 {
+			server = fs.Arg(0)
+		}
+		endpoints, err := resolveServer(server)
+		if err != nil {
+			printLine("Error resolving server: " + err.Error())
+			return 1
+		}
+		local := &net.UDPAddr{IP: net.IPv4zero}
+		if opts.Interface != "" {
+			if local.IP, err = interfaceIPv4(opts.Interface); err != nil {
+				printLine("Error: " + err.Error())
+				return 1
+			}
+		}
+		// Connected, so that ICMP errors are reported on the socket
+		conn, err := env.dialUDP(local, endpoints[0].Addr)
+		if err != nil {
+			printLine("Error opening socket: " + err.Error())
+			return 1
+		}
+		defer conn.Close()
+		m.conn = conn
+		m.result = &MonitorResult{Target: endpoints[0].Addr.String(), Mode: "server"}
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(done) }) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		finish()
+	}()
+	if *duration > 0 {
+		timer := env.clock.AfterFunc(*duration, finish)
+		defer timer.Stop()
+	}
+	m.stop = done
+
+	printProgress("Monitoring " + m.result.Target + " every " + interval.String() + "; Ctrl-C to stop.")
+	if *output == "text" {
+		m.onEvent = styleOf(fs).printMonitorEvent
+	}
+	result := m.run()
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+	} else {
+		printLine("")
+		printLine("Probes:   " + strconv.Itoa(result.Probes) + " sent, " + strconv.Itoa(result.Lost) + " lost, over " +
+			result.Ended.Sub(result.Started).Round(time.Second).String())
+		if l := result.Latency; l != nil {
+			printLine("RTT:      " + formatMillis(l.Min) + " min, " + formatMillis(l.Median) + " median, " + formatMillis(l.P95) + " p95, " +
+				formatMillis(l.Max) + " max, " + formatMillis(l.Jitter) + " jitter")
+		}
+		if *latency {
+			printLine("Migrated: " + strconv.Itoa(result.Migrations) + " (public mapping changes under the same socket)")
+		}
+		if result.Alive {
+			printLine("Path:     alive")
+		} else {
+			printLine("Path:     died (" + result.Cause + ")")
+			if !result.LastSuccess.IsZero() {
+				printLine("Window:   last answer at " + result.LastSuccess.Format("15:04:05.000") + ", declared dead at " + result.Ended.Format("15:04:05.000"))
+			}
+		}
+	}
+	if !result.Alive {
+		return 1
+	}
+	return 0
+}
+
+// printMonitorEvent writes one timeline line as it happens
+func (s textStyle) printMonitorEvent(e MonitorEvent) {
+	line := e.Time.Format("15:04:05.000") + "  " + s.column(e.Kind, 15) + e.Detail
+	if e.RTT > 0 {
+		line += " (" + formatMillis(e.RTT) + ")"
+	}
+	printLine(strings.TrimRight(line, ", "))
+}
+
+// seriesLine renders a latency sample as a CSV row
+func seriesLine(s MonitorSample) string {
+	rtt := ""
+	if !s.Lost {
+		rtt = strconv.FormatFloat(float64(s.RTT)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	return s.Time.Format(time.RFC3339Nano) + "," + rtt + "," + strconv.FormatBool(s.Lost) + "," + s.Mapped + "\n"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+func runOpenWrt(args []string) int {
+	fs := newFlagSet("openwrt", "")
+	df := addDetectFlags(fs)
+	wan := fs.String("wan", "wan", "logical OpenWrt interface to probe through")
+	publish := fs.Bool("publish", false, "send the result as a \"nat-info\" ubus event")
+	format := fs.String("format", "text", "output format: text, json or uci")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *format != "text" && *format != "json" && *format != "uci" {
+		printLine("Invalid --format: " + *format + " (expected text, json or uci)")
+		return 2
+	}
+	if *format != "text" {
+		progressOut = os.Stderr
+	}
+
+	status, err := ubusWANStatus(*wan)
+	if err != nil {
+		printLine(err.Error())
+		return 1
+	}
+	if !status.Up {
+		printLine("Interface " + *wan + " is down")
+		return 1
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	// Probe out of the WAN device unless told otherwise
+	if opts.Interface == "" {
+		opts.Interface = status.L3Device
+	}
+
+	printProgress("Detecting NAT type on " + *wan + " (" + status.L3Device + ")...")
+	result, err := detectNATType(opts)
+	if err != nil {
+		printLine("Error during detection: " + err.Error())
+		return 1
+	}
+
+	// A WAN address that differs from the public one means another NAT
+	// upstream of this router, typically carrier-grade NAT
+	doubleNAT := result.Public != nil && status.address() != "" && result.Public.IP.String() != status.address()
+
+	if *publish {
+		event := struct {
+			*NatResult
+			WAN       string `json:"wan"`
+			Device    string `json:"device"`
+			DoubleNAT bool   `json:"double_nat"`
+		}{result, *wan, status.L3Device, doubleNAT}
+		if err := ubusPublish("nat-info", event); err != nil {
+			printProgress("Error publishing to ubus: " + err.Error())
+		}
+	}
+
+	switch *format {
+	case "uci":
+		os.Stdout.WriteString(uciResult(*wan, result, status, doubleNAT))
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	default:
+		report := &textReport{w: os.Stdout, algorithm: opts.Algorithm, color: colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+		report.render(result)
+		if doubleNAT {
+			printLine("")
+			printLine("The WAN address " + status.address() + " is not the public IP: there is another NAT upstream (double NAT or CGNAT).")
+		}
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readBlob prompts until a valid peer blob is read from r. Lines that are
+// not blobs, such as the responder's a= lines, are skipped.
+func readBlob(r *bufio.Reader) (PeerInfo, error) {
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "a=") {
+			info, decodeErr := decodeBlob(line)
+			if decodeErr == nil {
+				return info, nil
+			}
+			printLine(decodeErr.Error() + "; paste the peer's blob again:")
+		}
+		if err != nil {
+			if err == io.EOF {
+				return PeerInfo{}, io.ErrUnexpectedEOF
+			}
+			return PeerInfo{}, err
+		}
+	}
+}
+
+func runPair(args []string) int {
+	fs := newFlagSet("pair", "")
+	df := addDetectFlags(fs)
+	peer := fs.String("peer", "", "the peer's blob (default read from stdin)")
+	wait := fs.Duration("wait", 30*time.Second, "how long to run connectivity checks")
+	output := fs.String("output", "text", "output format: text or json")
+	send := fs.String("send", "", "after connecting, send this file to the peer")
+	receive := fs.String("receive", "", "after connecting, write the file the peer sends here")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+
+	if *send != "" && *receive != "" {
+		printLine("--send and --receive are exclusive; the peer runs the other one")
+		return 2
+	}
+
+	// Open the files first so a bad path fails before the peer waits on us
+	var src *os.File
+	var dst *os.File
+	if *send != "" {
+		f, err := os.Open(*send)
+		if err != nil {
+			printLine("Error opening file: " + err.Error())
+			return 1
+		}
+		defer f.Close()
+		src = f
+	}
+	if *receive != "" {
+		f, err := os.Create(*receive)
+		if err != nil {
+			printLine("Error creating file: " + err.Error())
+			return 1
+		}
+		defer f.Close()
+		dst = f
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	opts = opts.withDefaults()
+
+	// Prompts and progress must not corrupt JSON on stdout
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	conn, localIP, err := opts.probeEnv().listenLocal()
+	if err != nil {
+		printLine("Error opening socket: " + err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	local := PeerInfo{
+		Ufrag:      randomICEString(8),
+		Pwd:        randomICEString(24),
+		Candidates: gatherCandidates(conn, localIP, opts),
+	}
+	gwIface := opts.Interface
+	if gwIface == "" {
+		gwIface = interfaceOf(localIP)
+	}
+	local.Gateway = gatewayTag(gwIface)
+	for _, c := range local.Candidates {
+		printProgress("Candidate: " + c.String())
+	}
+	printProgress("Send this blob to your peer:")
+	printProgress("")
+	printProgress(encodeBlob(local))
+	printProgress("")
+
+	var remote PeerInfo
+	if *peer != "" {
+		remote, err = decodeBlob(*peer)
+	} else {
+		printProgress("Paste the peer's blob:")
+		remote, err = readBlob(bufio.NewReader(os.Stdin))
+	}
+	if err != nil {
+		printLine("Error reading peer blob: " + err.Error())
+		return 2
+	}
+	if remote.Ufrag == local.Ufrag {
+		printLine("That is this side's own blob; paste the one your peer printed")
+		return 2
+	}
+
+	printProgress("Running connectivity checks for up to " + wait.String() + "...")
+	agent := newICEAgent(conn, local, remote)
+	result, err := agent.establish(*wait)
+
+	var transferErr error
+	if result.Selected != nil && (src != nil || dst != nil) {
+		var stats TransferStats
+		peerAddr := result.Selected.addr()
+		if src != nil {
+			printProgress("Sending " + *send + "...")
+			stats, transferErr = sendFile(conn, peerAddr, src)
+		} else {
+			printProgress("Receiving into " + *receive + "...")
+			stats, transferErr = receiveFile(conn, peerAddr, dst)
+		}
+		result.Transfer = &stats
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	} else {
+		role := "controlled"
+		if result.Controlling {
+			role = "controlling"
+		}
+		printLine("Role:     " + role)
+		printLine("Checks:   " + strconv.Itoa(result.ChecksSent) + " sent, " + strconv.Itoa(result.ChecksSeen) + " received")
+		if result.Selected != nil {
+			printLine("Success:  direct path to " + result.Selected.String() + " in " + formatMillis(result.RTT))
+			if t := result.Transfer; t != nil {
+				line := strconv.FormatInt(t.Bytes, 10) + " bytes in " + t.Elapsed.Round(time.Millisecond).String() +
+					", " + strconv.FormatFloat(t.Goodput()/1e6, 'f', 2, 64) + " Mbit/s goodput"
+				if t.Retransmits > 0 {
+					line += ", " + strconv.Itoa(t.Retransmits) + " retransmissions"
+				}
+				printLine("Transfer: " + line)
+			}
+			if transferErr != nil {
+				printLine("Transfer failed: " + transferErr.Error())
+			}
+		} else {
+			printLine("Failed:   " + err.Error())
+		}
+		if result.LAN != nil {
+			printLine("LAN:      " + result.LAN.describe())
+		}
+		switch {
+		case result.LAN != nil && result.LAN.Isolated && result.Selected == nil:
+			printLine("The network blocks traffic between its clients and no path through the public address worked either; these two devices will need a TURN relay or another network.")
+		case result.LAN != nil && result.LAN.Isolated:
+			printLine("Traffic between these devices detours through the gateway's public address; local discovery (mDNS, SSDP) will not find them either.")
+		case result.Selected == nil:
+			printLine("A direct path could not be opened; these two networks will need a TURN relay.")
+		}
+	}
+
+	if result.Selected == nil || transferErr != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PathResult is the detection outcome over one uplink
+type PathResult struct {
+	Interface string     `json:"interface"`
+	LocalIP   string     `json:"local_ip"`
+	Servers   []string   `json:"servers,omitempty"`
+	Result    *NatResult `json:"result,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// PathsReport compares the host's uplinks
+type PathsReport struct {
+	Paths        []PathResult  `json:"paths"`
+	Routes       []RouteSource `json:"routes"`
+	PolicyRouted bool          `json:"policy_routed"`
+	Notes        []string      `json:"notes,omitempty"`
+	// Endpoints lists each uplink's public endpoints in one place
+	Endpoints []PublicEndpoint `json:"endpoints,omitempty"`
+}
+
+// pathEndpoints merges the public endpoints of every uplink, tagging each
+// with the interface it was seen through
+func pathEndpoints(report *PathsReport) []PublicEndpoint {
+	var out []PublicEndpoint
+	for _, p := range report.Paths {
+		if p.Result == nil {
+			continue
+		}
+		for _, e := range p.Result.PublicEndpoints {
+			e.Interface = p.Interface
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// pathNotes explains how the uplinks differ
+func pathNotes(report *PathsReport) []string {
+	var notes []string
+	if report.PolicyRouted {
+		notes = append(notes, "servers are reached through different uplinks: a wildcard socket can get a different NAT per destination, which looks like endpoint-dependent mapping")
+	}
+
+	types := make(map[NATType]bool)
+	publics := make(map[string]bool)
+	for _, p := range report.Paths {
+		if p.Result == nil {
+			continue
+		}
+		types[p.Result.Type] = true
+		if ip := publicIP(p.Result); ip != "" {
+			publics[ip] = true
+		}
+	}
+	if len(types) > 1 {
+		notes = append(notes, "uplinks classify differently; results depend on which one a flow takes")
+	}
+	if len(publics) > 1 {
+		notes = append(notes, strconv.Itoa(len(publics))+" different public IPs across uplinks")
+	}
+	return notes
+}
+
+func runPaths(args []string) int {
+	fs := newFlagSet("paths", "")
+	df := addDetectFlags(fs)
+	output := fs.String("output", "text", "output format: text or json")
+	concurrency := fs.Int("concurrency", 4, "uplinks to run detection over at once")
+	ifaces := fs.String("ifaces", "", "comma-separated interfaces to compare instead of every default-route uplink, e.g. wlan0,eth0")
+	compare := fs.Bool("compare", false, "print the uplinks side by side and name the friendliest for direct connections")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	uplinks := defaultRouteInterfaces()
+	if opts.Interface != "" {
+		uplinks = []string{opts.Interface}
+	}
+	if *ifaces != "" {
+		uplinks = nil
+		for _, name := range strings.Split(*ifaces, ",") {
+			name = strings.TrimSpace(name)
+			if _, err := interfaceIPv4(name); err != nil {
+				printLine("Invalid --ifaces: " + err.Error())
+				return 2
+			}
+			uplinks = appendUnique(uplinks, name)
+		}
+	}
+	if len(uplinks) == 0 {
+		printLine("No interface with an IPv4 default route")
+		return 1
+	}
+
+	report := &PathsReport{Routes: routeSources(opts.probeEnv(), opts.withDefaults().Servers)}
+	report.PolicyRouted = distinctSources(report.Routes) > 1
+
+	// Each uplink gets its own detector and sockets, so they run side by side
+	report.Paths = make([]PathResult, len(uplinks))
+	forEachLimit(len(uplinks), *concurrency, func(i int) {
+		path := PathResult{Interface: uplinks[i]}
+		if ip, err := interfaceIPv4(path.Interface); err == nil {
+			path.LocalIP = ip.String()
+		}
+		for _, route := range report.Routes {
+			if route.Source == path.LocalIP {
+				path.Servers = append(path.Servers, route.Server)
+			}
+		}
+
+		printProgress("Detecting over " + path.Interface + "...")
+		pathOpts := opts
+		pathOpts.Interface = path.Interface
+		result, err := detectNATType(pathOpts)
+		if err != nil {
+			path.Error = err.Error()
+		} else {
+			path.Result = result
+		}
+		report.Paths[i] = path
+	})
+	report.Notes = pathNotes(report)
+	report.Endpoints = pathEndpoints(report)
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	text := &textReport{w: os.Stdout, algorithm: opts.Algorithm, color: colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	if *compare {
+		renderPathTable(text, report.Paths)
+		return 0
+	}
+	for _, path := range report.Paths {
+		text.section(path.Interface + " (" + path.LocalIP + ")")
+		if path.Error != "" {
+			text.field("Error", path.Error)
+			continue
+		}
+		text.field("NAT Type", text.paint(natTypeColor(path.Result.Type), path.Result.Type.String()))
+		if ip := publicIP(path.Result); ip != "" {
+			text.field("Public IP", ip)
+		}
+		text.field("Confidence", text.paint(confidenceColor(path.Result.Confidence), path.Result.Confidence.String()))
+		if len(path.Servers) > 0 {
+			text.field("Default for", strconv.Itoa(len(path.Servers))+" of "+strconv.Itoa(len(report.Routes))+" servers")
+		}
+	}
+
+	text.section("Routing")
+	for _, route := range report.Routes {
+		text.item(route.Server + " via " + route.Source)
+	}
+	for _, note := range report.Notes {
+		text.field("Note", note)
+	}
+	return 0
+}
+
+// natFriendliness ranks NAT types by how easily peers reach in
+func natFriendliness(t NATType) int {
+	switch t {
+	case NATOpen:
+		return 6
+	case NATFullCone:
+		return 5
+	case NATRestrictedCone:
+		return 4
+	case NATPortRestricted:
+		return 3
+	case NATSymmetricFirewall:
+		return 2
+	case NATSymmetric:
+		return 1
+	}
+	return 0
+}
+
+// friendliestPath returns the index of the uplink with the friendliest NAT,
+// preferring preserved ports and then higher confidence on a tie. It
+// returns -1 when no detection succeeded or the best uplinks are equal.
+func friendliestPath(paths []PathResult) int {
+	best, tied := -1, false
+	score := func(r *NatResult) int {
+		s := natFriendliness(r.Type) * 100
+		if slices.Contains(r.Reasons, ReasonPortPreserved) {
+			s += 10
+		}
+		return s + int(r.Confidence)
+	}
+	for i, p := range paths {
+		if p.Result == nil {
+			continue
+		}
+		switch {
+		case best < 0 || score(p.Result) > score(paths[best].Result):
+			best, tied = i, false
+		case score(p.Result) == score(paths[best].Result):
+			tied = true
+		}
+	}
+	if tied {
+		return -1
+	}
+	return best
+}
+
+// renderPathTable prints one column per uplink
+func renderPathTable(text *textReport, paths []PathResult) {
+	type cell struct{ value, color string }
+	rows := []struct {
+		label string
+		get   func(p PathResult) cell
+	}{
+		{"Local IP", func(p PathResult) cell { return cell{value: p.LocalIP} }},
+		{"Network", func(p PathResult) cell {
+			if p.Result == nil || p.Result.Link == nil {
+				return cell{}
+			}
+			return cell{value: p.Result.Link.describe()}
+		}},
+		{"Public IP", func(p PathResult) cell { return cell{value: publicIP(p.Result)} }},
+		{"NAT Type", func(p PathResult) cell {
+			return cell{text.tr(p.Result.Type.String()), natTypeColor(p.Result.Type)}
+		}},
+		{"Mapping", func(p PathResult) cell {
+			return cell{text.tr(p.Result.Mapping.String()), behaviorColor(p.Result.Mapping)}
+		}},
+		{"Filtering", func(p PathResult) cell {
+			return cell{text.tr(p.Result.Filtering.String()), behaviorColor(p.Result.Filtering)}
+		}},
+		{"Port kept", func(p PathResult) cell {
+			if slices.Contains(p.Result.Reasons, ReasonPortPreserved) {
+				return cell{value: "yes"}
+			}
+			return cell{value: "no"}
+		}},
+		{"Translation", func(p PathResult) cell { return cell{value: text.tr(p.Result.Translation.String())} }},
+		{"RTT", func(p PathResult) cell {
+			if p.Result.Public == nil || p.Result.Public.RTT == 0 {
+				return cell{}
+			}
+			return cell{value: formatMillis(p.Result.Public.RTT)}
+		}},
+		{"Confidence", func(p PathResult) cell {
+			return cell{p.Result.Confidence.String(), confidenceColor(p.Result.Confidence)}
+		}},
+		{"Share code", func(p PathResult) cell { return cell{value: p.Result.ShareCode} }},
+	}
+
+	// Failed uplinks show their error in the NAT Type row and blanks elsewhere
+	grid := make([][]cell, len(rows))
+	widths := make([]int, len(paths))
+	for i, p := range paths {
+		widths[i] = len(p.Interface)
+	}
+	for r, row := range rows {
+		grid[r] = make([]cell, len(paths))
+		for i, p := range paths {
+			var c cell
+			switch {
+			case p.Result != nil || r < 1:
+				c = row.get(p)
+			case row.label == "NAT Type":
+				c = cell{"error: " + p.Error, ansiRed}
+			}
+			grid[r][i] = c
+			widths[i] = max(widths[i], len(c.value))
+		}
+	}
+
+	// Plain mode lists each uplink as its own section rather than a column
+	if text.plain {
+		for i, p := range paths {
+			text.section(p.Interface)
+			for r, row := range rows {
+				if c := grid[r][i]; c.value != "" {
+					text.field(row.label, c.value)
+				}
+			}
+		}
+	} else {
+		line := "  " + padRight("", 13)
+		for i, p := range paths {
+			line += text.paint(ansiBold, padRight(p.Interface, widths[i]+2))
+		}
+		io.WriteString(text.w, "\n"+strings.TrimRight(line, " ")+"\n")
+		for r, row := range rows {
+			if !slices.ContainsFunc(grid[r], func(c cell) bool { return c.value != "" }) {
+				continue
+			}
+			line := "  " + padRight(row.label+":", 13)
+			for i, c := range grid[r] {
+				value := padRight(c.value, widths[i]+2)
+				if c.color != "" {
+					value = text.paint(c.color, value)
+				}
+				line += value
+			}
+			io.WriteString(text.w, strings.TrimRight(line, " ")+"\n")
+		}
+	}
+
+	text.section("Verdict")
+	if best := friendliestPath(paths); best >= 0 {
+		text.field("Friendliest", paths[best].Interface+" ("+text.tr(paths[best].Result.Type.String())+")")
+	} else {
+		text.field("Friendliest", "no difference for direct connections")
+	}
+}
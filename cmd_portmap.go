@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func runPortMap(args []string) int {
+	fs := newFlagSet("portmap", "")
+	iface := fs.String("iface", "", "LAN interface to probe from (default the one holding the default route)")
+	gateway := fs.String("gateway", "", "address of the PCP/NAT-PMP server (default the IPv4 default gateway)")
+	protocols := fs.String("protocols", DefaultPortMapOrder, "comma-separated protocols to probe, most preferred first")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for each protocol")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	order, err := parsePortMapOrder(*protocols)
+	if err != nil {
+		printLine("Invalid --protocols: " + err.Error())
+		return 2
+	}
+
+	var gw net.IP
+	if *gateway != "" {
+		if gw = net.ParseIP(*gateway).To4(); gw == nil {
+			printLine("Invalid --gateway: " + *gateway + " (expected an IPv4 address)")
+			return 2
+		}
+	} else {
+		_, gw = defaultGateway(*iface)
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	printProgress("Probing " + strings.Join(order, ", ") + "...")
+	check := checkPortMapping(DetectOptions{Interface: *iface}.probeEnv(), gw, order, *timeout)
+
+	status := 0
+	if check.Preferred == "" {
+		status = 1
+	}
+	if *output == "json" {
+		if code := encodeJSON(check); code != 0 {
+			return code
+		}
+		return status
+	}
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderPortMap(r, check)
+	return status
+}
+
+// renderPortMap lists each protocol in preference order and what to make of
+// the answers
+func renderPortMap(r *textReport, c PortMapCheck) {
+	r.section("Gateway control")
+	if c.Gateway != "" {
+		r.field("Gateway", c.Gateway)
+	} else {
+		r.field("Gateway", r.paint(ansiYellow, "unknown (pass --gateway to probe PCP and NAT-PMP)"))
+	}
+	for _, p := range c.Probes {
+		var status string
+		switch {
+		case p.Works:
+			status = r.paint(ansiGreen, "works")
+			if p.ExternalIP != "" {
+				status += ", external " + p.ExternalIP
+			}
+		case p.Answered:
+			status = r.paint(ansiRed, p.Error)
+		default:
+			status = r.paint(ansiYellow, p.Error)
+		}
+		if p.Detail != "" {
+			status += " (" + p.Detail + ")"
+		}
+		r.item(r.column(portMapNames[p.Protocol], 10) + status)
+	}
+	if c.Preferred != "" {
+		r.field("Preferred", r.paint(ansiBold, portMapNames[c.Preferred]))
+	}
+
+	r.section("Verdict")
+	for _, line := range portMapVerdict(c) {
+		r.item(line)
+	}
+}
+
+// portMapVerdict explains the results: which protocol to use, and whether
+// the mappings it makes would be reachable from the internet at all
+func portMapVerdict(c PortMapCheck) []string {
+	var out []string
+	if c.Preferred == "" {
+		out = append(out, "No gateway-control protocol works here: applications cannot open ports on their own. Forward ports by hand, or rely on hole punching and relays.")
+	} else {
+		var working []string
+		for _, p := range c.Probes {
+			if p.Works {
+				working = append(working, portMapNames[p.Protocol])
+			}
+		}
+		line := "Use " + portMapNames[c.Preferred] + ", the first working protocol in the order " + strings.Join(c.Order, ", ") + "."
+		if len(working) > 1 {
+			line += " Also working: " + strings.Join(working[1:], ", ") + "."
+		}
+		out = append(out, line)
+	}
+
+	externals := make(map[string]bool)
+	for _, p := range c.Probes {
+		if p.ExternalIP == "" {
+			continue
+		}
+		externals[p.ExternalIP] = true
+		if ip := net.ParseIP(p.ExternalIP); ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsUnspecified() {
+			out = append(out, portMapNames[p.Protocol]+" reports the external address "+p.ExternalIP+", which is not public: ports it opens are only reachable from the network above this gateway (double NAT or carrier-grade NAT).")
+		}
+	}
+	if len(externals) > 1 {
+		out = append(out, "The protocols report different external addresses, so more than one gateway answers on this network; only mappings on the default gateway affect outgoing traffic.")
+	}
+
+	for _, p := range c.Probes {
+		if p.Protocol != PortMapUPnP || !p.Answered || c.Gateway == "" {
+			continue
+		}
+		if u, err := url.Parse(p.Server); err == nil && u.Hostname() != c.Gateway {
+			out = append(out, "The UPnP gateway at "+u.Hostname()+" is not the default gateway "+c.Gateway+"; ports it opens do not apply to traffic leaving through the default route.")
+		}
+	}
+	return out
+}
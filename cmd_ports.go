@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runPorts(args []string) int {
+	fs := newFlagSet("ports", "<tcp/port|udp/port>...")
+	via := fs.String("via", "", "nat-info responder started with --scan that probes the ports from outside (required)")
+	iface := fs.String("iface", "", "network interface to send the request from")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for the responder beyond its own probing")
+	yes := fs.Bool("yes", false, "confirm that the responder may connect to these ports of this network's public IP")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() == 0 || *via == "" {
+		printLine("Usage: nat-info ports --via host:port [flags] <tcp/port|udp/port>... (a responder started with --scan)")
+		return 2
+	}
+	if fs.NArg() > maxScanPorts {
+		printLine("At most " + strconv.Itoa(maxScanPorts) + " ports can be checked at once")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	var ports []ScanPort
+	for _, arg := range fs.Args() {
+		p, err := parseScanPort(arg)
+		if err != nil {
+			printLine("Invalid port: " + err.Error())
+			return 2
+		}
+		ports = append(ports, p)
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	names := make([]string, len(ports))
+	for i, p := range ports {
+		names[i] = p.String()
+	}
+	printProgress("The responder " + *via + " will connect to " + strings.Join(names, ", ") + " at this network's public IP.")
+	printProgress("Only check a network you are responsible for.")
+	if !*yes {
+		printProgress("Re-run with --yes to start it.")
+		return 2
+	}
+
+	result := probeScan(*via, DetectOptions{Interface: *iface}.probeEnv(), ports, *timeout)
+	status := 0
+	if result.Error != "" {
+		status = 1
+	}
+	if *output == "json" {
+		if code := encodeJSON(result); code != 0 {
+			return code
+		}
+		return status
+	}
+
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	r.section("Public ports")
+	if result.Error != "" {
+		r.field("Status", r.paint(ansiRed, result.Error))
+		return status
+	}
+	r.field("Public IP", result.PublicIP)
+	for _, p := range result.Ports {
+		state := p.State
+		switch state {
+		case PortOpen:
+			state = r.paint(ansiYellow, state)
+		case PortClosed, PortFiltered:
+			state = r.paint(ansiGreen, state)
+		}
+		r.item(r.column(p.String(), 12) + state)
+	}
+	r.section("Verdict")
+	r.item(describeScan(result))
+	return status
+}
+
+// describeScan sums up a scan: open ports are forwarded through every NAT
+// in the way, which is either intended or an accident
+func describeScan(r ScanResult) string {
+	var open, silent []string
+	for _, p := range r.Ports {
+		switch p.State {
+		case PortOpen:
+			open = append(open, p.String())
+		case PortOpenFiltered:
+			silent = append(silent, p.String())
+		}
+	}
+	var line string
+	if len(open) == 0 {
+		line = "No checked port accepts connections from the internet."
+	} else {
+		line = "Reachable from the internet: " + strings.Join(open, ", ") + ". Check that each is a forward you intended."
+	}
+	if len(silent) > 0 {
+		line += " " + strings.Join(silent, ", ") + " neither answered nor refused, which a firewall and a silent UDP service look the same to."
+	}
+	return line
+}
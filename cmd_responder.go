@@ -0,0 +1,304 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// iceLiteResponder answers ICE connectivity checks for a single set of
+// credentials without gathering or sending checks of its own (RFC 8445
+// section 2.5). A lite agent is always the controlled side.
+type iceLiteResponder struct {
+	conn  *net.UDPConn
+	ufrag string
+	pwd   string
+
+	// cookies, if set, hands out the cookies that bandwidth and scan
+	// requests must echo
+	cookies *cookieJar
+	// bandwidth, if set, answers bandwidth probe trains on the same port
+	bandwidth *bandwidthReflector
+	// callbacks, if set, answers UDP idle-timeout callback requests
+	callbacks *callbackReflector
+	// reach, if set, answers unsolicited inbound requests
+	reach *reachReflector
+	// scan, if set, probes requesters' public ports
+	scan *scanReflector
+	// sip, if set, answers SIP OPTIONS and echoes RTP
+	sip *sipReflector
+	// ecn, if set, answers binding requests asking for their TOS byte
+	ecn bool
+	// gro is set when the kernel may glue datagrams together on receive
+	gro bool
+	// verbose prints a line for every check answered, which costs a write
+	// per packet
+	verbose bool
+
+	// Reused by answer so that serving checks does not allocate per packet
+	msg     StunMessage
+	resp    []byte
+	address []byte
+
+	// Responses queued for the end of the batch, and their buffers
+	replies []batchMsg
+	out     [][]byte
+}
+
+// serve answers checks until the socket is closed. Datagrams are read and
+// the responses to them sent a batch at a time, so a busy responder makes
+// a couple of system calls per batch rather than two per packet.
+func (r *iceLiteResponder) serve() {
+	bufSize := 2048
+	if r.gro {
+		bufSize = 65536
+	}
+	batch := newPacketBatch(r.conn, batchSize, bufSize)
+	for {
+		n, err := batch.read()
+		if err != nil {
+			return
+		}
+		r.replies = r.replies[:0]
+		for i := range batch.msgs[:n] {
+			m := &batch.msgs[i]
+			oob := m.OOB[:m.OOBN]
+			tos, at := tosOf(oob), arrival(oob)
+			// A GRO buffer holds datagrams of one flow back to back, all
+			// but the last of the segment size
+			seg := groSegment(oob)
+			if seg <= 0 {
+				seg = m.N
+			}
+			for off := 0; off < m.N; off += seg {
+				r.handle(m.Buf[off:min(off+seg, m.N)], m.Addr, tos, at)
+			}
+		}
+		batch.write(r.replies)
+	}
+}
+
+// handle serves one datagram, queueing any response in r.replies
+func (r *iceLiteResponder) handle(buf []byte, from *net.UDPAddr, tos int, at time.Time) {
+	ce := tos >= 0 && tos&0x03 == ecnCE
+	if r.cookies != nil && isCookieRequest(buf) {
+		r.replies = append(r.replies, batchMsg{Buf: r.cookies.answer(buf, from), Addr: from})
+		return
+	}
+	if r.bandwidth != nil && isBandwidthFrame(buf) {
+		r.bandwidth.handle(buf, from, ce, at)
+		return
+	}
+	if r.callbacks != nil && isCallbackFrame(buf) {
+		r.callbacks.handle(buf, from)
+		return
+	}
+	if r.scan != nil && isScanFrame(buf) {
+		r.scan.handle(buf, from)
+		return
+	}
+	if r.sip != nil && isSIPRequest(buf) {
+		r.sip.handle(buf, from)
+		return
+	}
+	if r.sip != nil && isRTPPacket(buf) {
+		r.sip.handleRTP(buf, from)
+		return
+	}
+	if r.reach != nil && isExposeFrame(buf) {
+		r.reach.handleExposure(buf, from)
+		return
+	}
+	if r.reach != nil && isReachFrame(buf) {
+		r.reach.handle(buf, from)
+		return
+	}
+	if r.ecn && parseStunMessage(buf, &r.msg) == nil && isECNRequest(&r.msg) {
+		r.replies = append(r.replies, batchMsg{Buf: answerECN(&r.msg, from, tos), Addr: from})
+		return
+	}
+	if resp, note := r.answer(buf, from); resp != nil {
+		// answer reuses its buffer for the next datagram, so the response
+		// is copied into one of r.out, which the next batch reuses
+		k := len(r.replies)
+		if k == len(r.out) {
+			r.out = append(r.out, nil)
+		}
+		r.out[k] = append(r.out[k][:0], resp...)
+		r.replies = append(r.replies, batchMsg{Buf: r.out[k], Addr: from})
+		if r.verbose {
+			printLine(from.String() + "  " + note)
+		}
+	}
+}
+
+// answer builds the response to one datagram, or nil for datagrams that are
+// not STUN binding requests, with a note on it when verbose. The response is
+// only valid until the next call.
+func (r *iceLiteResponder) answer(buffer []byte, from *net.UDPAddr) ([]byte, string) {
+	msg := &r.msg
+	if err := parseStunMessage(buffer, msg); err != nil || msg.Type != BindingRequest || msg.Cookie != MagicCookie {
+		return nil, ""
+	}
+
+	username, ok := findAttribute(msg, AttrUsername)
+	if !ok {
+		return r.reject(msg, 400, "Bad Request"), "rejected: no USERNAME"
+	}
+	local, remote, _ := strings.Cut(string(username), ":")
+	if local != r.ufrag {
+		return r.reject(msg, 401, "Unauthorized"), "rejected: unknown ufrag " + local
+	}
+	if !verifyIntegrity(buffer, []byte(r.pwd)) {
+		return r.reject(msg, 401, "Unauthorized"), "rejected: bad MESSAGE-INTEGRITY from " + remote
+	}
+
+	r.address = appendXorAddress(r.address[:0], from, msg.TransactionID)
+	resp := appendStunHeader(r.resp[:0], BindingResponse, msg.TransactionID)
+	resp = appendAttribute(resp, AttrXorMappedAddress, r.address)
+	resp = appendIntegrity(resp, []byte(r.pwd))
+	resp = appendFingerprint(resp)
+	r.resp = resp
+	if !r.verbose {
+		return resp, ""
+	}
+
+	note := "check from " + remote + " ok"
+	if _, nominated := findAttribute(msg, AttrUseCandidate); nominated {
+		note += ", nominated"
+	}
+	if _, controlled := findAttribute(msg, AttrIceControlled); controlled {
+		note += " (peer claims the controlled role; a lite agent's peer must control)"
+	}
+	return resp, note
+}
+
+// reject builds an error response. It carries no MESSAGE-INTEGRITY since
+// the request could not be authenticated.
+func (r *iceLiteResponder) reject(msg *StunMessage, code int, reason string) []byte {
+	resp := encodeStunMessage(BindingErrorResponse, msg.TransactionID, []Attribute{
+		{Type: AttrErrorCode, Value: errorCodeValue(code, reason)},
+	})
+	return appendFingerprint(resp)
+}
+
+func runResponder(args []string) int {
+	fs := newFlagSet("responder", "")
+	listen := fs.String("listen", ":3478", "UDP address to answer connectivity checks on")
+	ufrag := fs.String("ufrag", "", "ICE username fragment (default random)")
+	pwd := fs.String("pwd", "", "ICE password, at least 22 characters (default random)")
+	public := fs.String("public", "", "public IP to advertise in the candidate line (default the listen address)")
+	bandwidth := fs.Bool("bandwidth", false, "also answer bandwidth probe trains from detect --bandwidth")
+	timeouts := fs.Bool("timeouts", false, "also serve the UDP callbacks and TCP echo port used by nat-info timeouts")
+	ecn := fs.Bool("ecn", false, "also echo the TOS byte of binding requests from detect --ecn, to find paths that bleach ECN (Linux only)")
+	reach := fs.Bool("reach", false, "also send the unsolicited packets used by detect --reach (only ever to the requester's own IP)")
+	scan := fs.Bool("scan", false, "also connect to the ports nat-info ports asks for (only ever at the requester's own IP, at most "+strconv.Itoa(maxScanPorts)+" per request)")
+	sip := fs.Bool("sip", false, "also answer SIP OPTIONS with the request as received and echo RTP, for nat-info sip")
+	verbose := fs.Bool("verbose", false, "print a line for every connectivity check answered")
+	reachAlternate := fs.String("reach-alternate", "", "comma-separated other local IPs to send --reach exposure packets from, to show whether strangers reach a mapping")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *ufrag == "" {
+		*ufrag = randomICEString(8)
+	}
+	if *pwd == "" {
+		*pwd = randomICEString(24)
+	}
+	if len(*ufrag) < 4 || len(*pwd) < 22 {
+		printLine("--ufrag needs at least 4 characters and --pwd at least 22")
+		return 2
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", *listen)
+	if err != nil {
+		printLine("Invalid --listen: " + err.Error())
+		return 2
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		printLine("Error listening: " + err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	bound := conn.LocalAddr().(*net.UDPAddr)
+	ip := *public
+	if ip == "" {
+		ip = bound.IP.String()
+		if bound.IP.IsUnspecified() {
+			ip, _ = DetectOptions{}.probeEnv().localIP()
+		}
+	}
+
+	// Host candidate with the RFC 8445 recommended type preference
+	printLine("a=ice-lite")
+	printLine("a=ice-ufrag:" + *ufrag)
+	printLine("a=ice-pwd:" + *pwd)
+	printLine("a=candidate:1 1 udp 2130706431 " + ip + " " + strconv.Itoa(bound.Port) + " typ host")
+	printLine("")
+	printLine("Blob for nat-info pair:")
+	printLine(encodeBlob(PeerInfo{
+		Ufrag:      *ufrag,
+		Pwd:        *pwd,
+		Candidates: []Candidate{{Type: "host", IP: ip, Port: bound.Port}},
+		Lite:       true,
+	}))
+
+	responder := &iceLiteResponder{conn: conn, ufrag: *ufrag, pwd: *pwd, verbose: *verbose}
+	if *bandwidth || *scan {
+		responder.cookies = newCookieJar()
+	}
+	if *bandwidth {
+		enableECN(conn)
+		enableTimestamps(conn)
+		responder.bandwidth = newBandwidthReflector(conn, responder.cookies)
+	}
+	if *timeouts {
+		responder.callbacks = &callbackReflector{conn: conn, clock: natinfo.SystemClock{}}
+		ln, err := serveTCPEcho(bound.String())
+		if err != nil {
+			printLine("Error listening on TCP: " + err.Error())
+			return 1
+		}
+		defer ln.Close()
+	}
+	if *reach {
+		responder.reach = &reachReflector{conn: conn}
+		for _, s := range strings.Split(*reachAlternate, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			alt := net.ParseIP(s).To4()
+			if alt == nil {
+				printLine("Invalid --reach-alternate: " + s + " (expected IPv4 addresses)")
+				return 2
+			}
+			responder.reach.alternates = append(responder.reach.alternates, alt)
+		}
+	}
+	if *scan {
+		responder.scan = newScanReflector(conn, responder.cookies)
+	}
+	if *sip {
+		responder.sip = &sipReflector{conn: conn}
+	}
+	if *ecn {
+		enableECN(conn)
+		responder.ecn = true
+	}
+	responder.gro = enableGRO(conn)
+	go responder.serve()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	return 0
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func BenchmarkResponderAnswer(b *testing.B) {
+	r := &iceLiteResponder{ufrag: "bnch", pwd: "0123456789abcdefghijklmn"}
+	req := appendStunHeader(nil, BindingRequest, []byte("0123456789ab"))
+	req = appendAttribute(req, AttrUsername, []byte("bnch:peer"))
+	req = appendIntegrity(req, []byte(r.pwd))
+	req = appendFingerprint(req)
+	from := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 41000}
+
+	if resp, note := r.answer(req, from); resp == nil {
+		b.Fatalf("no answer: %s", note)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.answer(req, from)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SelfCheck is the outcome of one selftest check. Fix says what to do about
+// a failure in terms a first-line support engineer can act on.
+type SelfCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+func runSelftest(args []string) int {
+	fs := newFlagSet("selftest", "")
+	df := addDetectFlags(fs)
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	opts = opts.withDefaults()
+	env := opts.probeEnv()
+
+	checks := []SelfCheck{
+		checkUDPSocket(env),
+		checkLoopbackStun(env),
+		checkClock(),
+	}
+	checks = append(checks, checkResolve(append(opts.Servers, opts.Rfc3489Servers...))...)
+
+	failed := 0
+	for _, c := range checks {
+		if !c.OK {
+			failed++
+		}
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(checks); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+	} else {
+		report := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+		report.section("Self-test")
+		for _, c := range checks {
+			status := report.paint(ansiGreen, "PASS")
+			if !c.OK {
+				status = report.paint(ansiRed, "FAIL")
+			}
+			report.item(status + " " + c.Name + ": " + c.Detail)
+			if c.Fix != "" {
+				io.WriteString(report.w, "         "+c.Fix+"\n")
+			}
+		}
+		if failed > 0 {
+			printLine("\n" + strconv.Itoa(failed) + " of " + strconv.Itoa(len(checks)) + " checks failed")
+		} else {
+			printLine("\nAll " + strconv.Itoa(len(checks)) + " checks passed")
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkUDPSocket opens the socket detection would use
+func checkUDPSocket(env *probeEnv) SelfCheck {
+	c := SelfCheck{Name: "UDP socket"}
+	conn, localIP, err := env.listenLocal()
+	if err != nil {
+		c.Detail = err.Error()
+		c.Fix = "check --iface names an interface with an IPv4 address, and that no sandbox or seccomp policy forbids UDP sockets"
+		if env.iface == "" {
+			c.Fix = "the host has no IPv4 route or address; connect it to a network, or pick one with --iface"
+		}
+		return c
+	}
+	defer conn.Close()
+	c.OK = true
+	c.Detail = "bound " + conn.LocalAddr().String() + ", local IP " + localIP
+	return c
+}
+
+// checkLoopbackStun runs a binding transaction against an in-process server
+// on 127.0.0.1, exercising the same request and parsing code as detection
+// without touching the network
+func checkLoopbackStun(env *probeEnv) SelfCheck {
+	c := SelfCheck{Name: "Loopback STUN"}
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		c.Detail = err.Error()
+		c.Fix = "bring up the loopback interface (ip link set lo up)"
+		return c
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveLoopbackStun(server)
+	}()
+	defer wg.Wait()
+	defer server.Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		c.Detail = err.Error()
+		c.Fix = "bring up the loopback interface (ip link set lo up)"
+		return c
+	}
+	defer client.Close()
+
+	result, err := env.makeStunRequest(client, server.LocalAddr().(*net.UDPAddr), nil, time.Second, true, 0)
+	if err != nil {
+		c.Detail = err.Error()
+		c.Fix = "a local firewall is dropping UDP on the loopback interface; allow it (e.g. iptables -I INPUT -i lo -j ACCEPT)"
+		return c
+	}
+	local := client.LocalAddr().(*net.UDPAddr)
+	got := result.AddrPort().String()
+	if got != local.String() {
+		c.Detail = "server saw " + got + ", expected " + local.String()
+		c.Fix = "something rewrites loopback traffic; check for transparent proxies or NAT rules on lo"
+		return c
+	}
+	c.OK = true
+	c.Detail = "round trip in " + result.RTT.Round(time.Microsecond).String()
+	return c
+}
+
+// serveLoopbackStun answers binding requests on conn with the sender's
+// address until conn is closed
+func serveLoopbackStun(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg StunMessage
+		if parseStunMessage(buf[:n], &msg) != nil || msg.Type != BindingRequest || msg.Cookie != MagicCookie {
+			continue
+		}
+		resp := appendStunHeader(nil, BindingResponse, msg.TransactionID)
+		resp = appendAttribute(resp, AttrXorMappedAddress, appendXorAddress(nil, from, msg.TransactionID))
+		conn.WriteToUDP(resp, from)
+	}
+}
+
+// checkClock catches wall clocks that are far off, which break TLS server
+// checks and time-limited TURN credentials, and timers that do not fire on
+// time, which break retransmission. It reads the system clock even when
+// detection runs on an injected one.
+func checkClock() SelfCheck {
+	c := SelfCheck{Name: "Clock"}
+	now := time.Now()
+	if now.Year() < 2024 {
+		c.Detail = "wall clock reads " + now.UTC().Format(time.RFC3339)
+		c.Fix = "set the system time, e.g. enable NTP (timedatectl set-ntp true)"
+		return c
+	}
+	start := time.Now()
+	time.Sleep(50 * time.Millisecond)
+	slept := time.Since(start)
+	if slept < 45*time.Millisecond || slept > time.Second {
+		c.Detail = "a 50ms sleep took " + slept.String()
+		c.Fix = "the host is heavily overloaded or its clock source is unstable; timeouts will not be accurate"
+		return c
+	}
+	c.OK = true
+	c.Detail = now.UTC().Format(time.RFC3339) + ", 50ms sleep took " + slept.Round(time.Millisecond).String()
+	return c
+}
+
+// checkResolve resolves every configured server, in parallel
+func checkResolve(servers []string) []SelfCheck {
+	checks := make([]SelfCheck, len(servers))
+	forEachLimit(len(servers), DefaultConcurrency, func(i int) {
+		c := SelfCheck{Name: "Resolve " + servers[i]}
+		endpoints, err := resolveServer(servers[i])
+		if err != nil {
+			c.Detail = err.Error()
+			c.Fix = "check DNS (resolv.conf) or replace the server with --servers"
+		} else {
+			c.OK = true
+			c.Detail = endpoints[0].Addr.IP.String()
+			if len(endpoints) > 1 {
+				c.Detail += " and " + strconv.Itoa(len(endpoints)-1) + " more"
+			}
+		}
+		checks[i] = c
+	})
+	return checks
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func runSIP(args []string) int {
+	fs := newFlagSet("sip", "")
+	df := addDetectFlags(fs)
+	sipPort := fs.Int("sip-port", DefaultSIPPort, "local port phones send SIP from; a random port stands in when it is taken")
+	rtpPorts := fs.String("rtp-ports", "10000-20000", "RTP port range the phones or PBX use")
+	samples := fs.Int("rtp-samples", 4, "RTP ports to sample across --rtp-ports")
+	responder := fs.String("responder", "", "nat-info responder --sip host:port to test for a SIP ALG and symmetric RTP")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *sipPort < 1 || *sipPort > 65535 {
+		printLine("Invalid --sip-port: " + strconv.Itoa(*sipPort))
+		return 2
+	}
+	rtpRange, err := parsePortRange(*rtpPorts)
+	if err != nil {
+		printLine("Invalid --rtp-ports: " + err.Error())
+		return 2
+	}
+	if *samples < 1 {
+		printLine("--rtp-samples must be at least 1")
+		return 2
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	check, err := checkSIP(opts, *sipPort, rtpRange, *samples, *responder)
+	if err != nil {
+		printLine("Error during SIP check: " + err.Error())
+		return 1
+	}
+	if *output == "json" {
+		return encodeJSON(check)
+	}
+
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderSIP(r, check)
+	return 0
+}
+
+// renderSIP prints the SIP preflight in the terms of a PBX installer
+func renderSIP(r *textReport, c *SIPCheck) {
+	r.section("SIP signaling")
+	r.field("Local", c.LocalIP+":"+strconv.Itoa(c.Signaling.Local))
+	r.field("Public", describeLocalMapping(r, c.Signaling))
+	if a := c.ALG; a != nil {
+		switch {
+		case a.Detected:
+			r.field("SIP ALG", r.paint(ansiRed, "detected, rewrote "+strings.Join(a.Rewritten, ", ")))
+		case a.Answered:
+			r.field("SIP ALG", r.paint(ansiGreen, "none"))
+		default:
+			r.field("SIP ALG", r.paint(ansiYellow, "unknown: "+a.Error))
+		}
+		if a.Received != "" {
+			r.field("Via received", a.Received+":"+strconv.Itoa(a.RPort))
+		}
+	}
+
+	r.section("RTP media")
+	r.field("Range", strconv.Itoa(c.RTPRange[0])+"-"+strconv.Itoa(c.RTPRange[1]))
+	for _, m := range c.RTP {
+		r.item(r.column(strconv.Itoa(m.Local), 7) + describeLocalMapping(r, m))
+	}
+	if s := c.SymmetricRTP; s != nil {
+		if s.Returned {
+			r.field("Symmetric", r.paint(ansiGreen, "works")+" ("+s.RTT.Round(time.Millisecond).String()+")")
+		} else {
+			r.field("Symmetric", r.paint(ansiRed, "no media came back"))
+		}
+	}
+
+	if c.NAT != nil {
+		r.section("NAT")
+		r.field("Type", r.tr(c.NAT.Type.String()))
+		r.field("Mapping", r.tr(c.NAT.Mapping.String()))
+		r.field("Filtering", r.tr(c.NAT.Filtering.String()))
+	}
+
+	r.section("Verdict")
+	for _, line := range c.Verdict {
+		r.item(line)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hard limits on the session-table stress test, whatever the flags say
+const (
+	maxStressFlows = 10000
+	maxStressRate  = 500
+	stressBucket   = 100 // flows per checkpoint
+	stressRecheck  = 5   // earliest flows re-probed at each checkpoint
+	stressGiveUp   = 50  // consecutive failures that end the test
+)
+
+// StressBucket counts failures among a run of consecutive new flows
+type StressBucket struct {
+	Upto   int `json:"upto"`
+	Failed int `json:"failed"`
+}
+
+// StressResult summarizes a session-table stress test
+type StressResult struct {
+	Requested int `json:"requested"`
+	// RequestedRate is the new flows per second asked for, Rate the rate
+	// they were opened at; it falls short when sockets open slowly or a
+	// checkpoint's rechecks hold up the schedule
+	RequestedRate int            `json:"requested_rate"`
+	Rate          float64        `json:"rate"`
+	Opened        int            `json:"opened"`
+	Succeeded     int            `json:"succeeded"`
+	FirstFailure  int            `json:"first_failure,omitempty"`
+	Recycled      int            `json:"recycled_mappings"`
+	Expired       int            `json:"expired_mappings"`
+	Buckets       []StressBucket `json:"buckets"`
+	Stopped       string         `json:"stopped,omitempty"`
+}
+
+// stressFlow is one open outbound flow and the mapping it was given
+type stressFlow struct {
+	conn     *net.UDPConn
+	endpoint StunEndpoint
+	mapped   *StunResult
+	lost     bool
+	// answer delivers the outcome of the flow's first transaction
+	answer chan stressAnswer
+}
+
+// stressAnswer is the outcome of a flow's first transaction
+type stressAnswer struct {
+	res *StunResult
+	err error
+}
+
+// recheck re-probes the earliest live flows, all at once so the schedule
+// of new flows stalls for one round trip rather than five. A different
+// public port means the NAT recycled the mapping; silence means it dropped
+// it.
+func recheck(env *probeEnv, flows []*stressFlow, result *StressResult, timeout time.Duration) {
+	var checks []*stressFlow
+	for _, f := range flows {
+		if len(checks) == stressRecheck {
+			break
+		}
+		if f.mapped != nil && !f.lost {
+			checks = append(checks, f)
+		}
+	}
+	answers := make([]stressAnswer, len(checks))
+	var wg sync.WaitGroup
+	for i, f := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := env.makeStunRequest(f.conn, f.endpoint.Addr, nil, timeout, true, 0)
+			answers[i] = stressAnswer{res, err}
+		}()
+	}
+	wg.Wait()
+	for i, f := range checks {
+		switch a := answers[i]; {
+		case a.err != nil:
+			f.lost = true
+			result.Expired++
+		case a.res.IP != f.mapped.IP || a.res.Port != f.mapped.Port:
+			f.lost = true
+			result.Recycled++
+		}
+	}
+}
+
+func runStress(args []string) int {
+	fs := newFlagSet("stress", "")
+	df := addDetectFlags(fs)
+	flows := fs.Int("flows", 1000, "number of outbound flows to open (capped at "+strconv.Itoa(maxStressFlows)+")")
+	rate := fs.Int("rate", 100, "new flows per second (capped at "+strconv.Itoa(maxStressRate)+")")
+	yes := fs.Bool("yes", false, "confirm that filling the NAT's session table is intended")
+	output := fs.String("output", "text", "output format: text or json")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	printProgress("WARNING: this test deliberately fills the NAT's session table. Other devices")
+	printProgress("behind the same router may lose connectivity until the flows time out.")
+	if !*yes {
+		printProgress("Re-run with --yes to start it.")
+		return 2
+	}
+
+	if *flows > maxStressFlows {
+		*flows = maxStressFlows
+	}
+	if *rate > maxStressRate {
+		*rate = maxStressRate
+	}
+	if *flows <= 0 || *rate <= 0 {
+		printLine("--flows and --rate must be positive")
+		return 2
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	opts = opts.withDefaults()
+
+	result, err := stressFlows(opts, *flows, *rate)
+	if err != nil {
+		printLine("Error during stress test: " + err.Error())
+		return 1
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		return 0
+	}
+
+	printLine("")
+	printLine("Flows opened:    " + strconv.Itoa(result.Opened) + " of " + strconv.Itoa(result.Requested))
+	printLine("Rate:            " + result.rateText() + " new flows/s of " + strconv.Itoa(result.RequestedRate) + " requested")
+	printLine("Succeeded:       " + strconv.Itoa(result.Succeeded))
+	if result.FirstFailure > 0 {
+		printLine("First failure:   flow " + strconv.Itoa(result.FirstFailure))
+	} else {
+		printLine("First failure:   none")
+	}
+	printLine("Recycled early:  " + strconv.Itoa(result.Recycled) + " mappings changed port")
+	printLine("Expired early:   " + strconv.Itoa(result.Expired) + " mappings stopped answering")
+	if result.Stopped != "" {
+		printLine("Stopped:         " + result.Stopped)
+	}
+	return 0
+}
+
+// stressFlows opens flows new outbound UDP flows at rate per second, each
+// from its own socket, and tracks when the NAT stops granting mappings or
+// starts recycling and expiring early ones. Each flow's transaction runs on
+// its own, so waiting for answers does not hold up the next flow.
+func stressFlows(opts DetectOptions, flows, rate int) (*StressResult, error) {
+	env := opts.probeEnv()
+	// Spread flows across servers so per-server rate limits are not
+	// mistaken for NAT exhaustion
+	var endpoints []StunEndpoint
+	for _, server := range opts.Servers {
+		if resolved, err := env.resolveServer(server); err == nil {
+			endpoints = append(endpoints, resolved[0])
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no STUN server could be resolved")
+	}
+
+	result := &StressResult{Requested: flows, RequestedRate: rate}
+	var open []*stressFlow
+	defer func() {
+		for _, f := range open {
+			f.conn.Close()
+		}
+	}()
+
+	bucket := StressBucket{}
+	consecutive := 0
+	tallied := 0
+	// tally folds in the answers in the order the flows were opened, so a
+	// failure counts against the flow that suffered it however the answers
+	// interleave. It returns at the first flow still waiting unless wait is
+	// set.
+	tally := func(wait bool) {
+		for tallied < len(open) {
+			f := open[tallied]
+			var a stressAnswer
+			if wait {
+				a = <-f.answer
+			} else {
+				select {
+				case a = <-f.answer:
+				default:
+					return
+				}
+			}
+			tallied++
+
+			if a.err != nil {
+				bucket.Failed++
+				consecutive++
+				if result.FirstFailure == 0 {
+					result.FirstFailure = tallied
+				}
+			} else {
+				f.mapped = a.res
+				result.Succeeded++
+				consecutive = 0
+			}
+
+			if tallied%stressBucket == 0 || wait && tallied == len(open) {
+				bucket.Upto = tallied
+				result.Buckets = append(result.Buckets, bucket)
+				recheck(env, open[:tallied], result, opts.ProbeTimeout)
+				printProgress("  " + strconv.Itoa(tallied) + " flows: " + strconv.Itoa(bucket.Failed) + " failed in the last batch, " +
+					strconv.Itoa(result.Recycled) + " recycled, " + strconv.Itoa(result.Expired) + " expired")
+				bucket = StressBucket{}
+			}
+
+			if consecutive >= stressGiveUp && result.Stopped == "" {
+				result.Stopped = "NAT stopped accepting new flows"
+			}
+		}
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	var first, last time.Time
+
+	for i := 0; i < flows && result.Stopped == ""; i++ {
+		<-ticker.C
+
+		conn, _, err := env.listenLocal()
+		if err != nil {
+			result.Stopped = "local socket limit reached: " + err.Error()
+			break
+		}
+		f := &stressFlow{conn: conn, endpoint: endpoints[i%len(endpoints)], answer: make(chan stressAnswer, 1)}
+		open = append(open, f)
+		result.Opened++
+		last = time.Now()
+		if first.IsZero() {
+			first = last
+		}
+		go func() {
+			res, err := env.makeStunRequest(f.conn, f.endpoint.Addr, nil, opts.ProbeTimeout, true, 0)
+			f.answer <- stressAnswer{res, err}
+		}()
+
+		tally(false)
+	}
+	// The flows still waiting get their answer or time out
+	tally(true)
+
+	if elapsed := last.Sub(first); result.Opened > 1 && elapsed > 0 {
+		result.Rate = float64(result.Opened-1) / elapsed.Seconds()
+	}
+	if result.Rate > 0 && result.Rate < 0.9*float64(rate) {
+		printProgress("Warning: flows were opened at " + formatRate(result.Rate) + " per second, below the " + strconv.Itoa(rate) + " requested, so the results describe the lower rate")
+	}
+	return result, nil
+}
+
+// rateText is the rate flows were opened at, or the requested one when too
+// few were opened to measure it
+func (r *StressResult) rateText() string {
+	if r.Rate == 0 {
+		return strconv.Itoa(r.RequestedRate)
+	}
+	return formatRate(r.Rate)
+}
+
+// formatRate renders a flow rate to one decimal place
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', 1, 64)
+}
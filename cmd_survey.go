@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SurveyProbe is one binding request made during a survey
+type SurveyProbe struct {
+	Server string        `json:"server"`
+	Addr   string        `json:"addr"`
+	Mapped *StunResult   `json:"mapped,omitempty"`
+	RTT    time.Duration `json:"rtt_ns,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// SurveyAddress is one public IP seen during a survey and the servers that
+// reported it
+type SurveyAddress struct {
+	IP      string   `json:"ip"`
+	Ports   []int    `json:"ports"`
+	Servers []string `json:"servers"`
+}
+
+// SurveyResult aggregates the reflexive addresses reported across a pool
+type SurveyResult struct {
+	LocalIP       string          `json:"local_ip"`
+	LocalPort     int             `json:"local_port"`
+	Probes        []SurveyProbe   `json:"probes"`
+	PublicIPs     []SurveyAddress `json:"public_ips"`
+	Responded     int             `json:"responded"`
+	Discrepancies []string        `json:"discrepancies,omitempty"`
+}
+
+// surveyServers returns every UDP server in the pool once, in order
+func surveyServers(opts DetectOptions) []string {
+	var pool []string
+	for _, server := range opts.Servers {
+		pool = appendUnique(pool, server)
+	}
+	for _, server := range opts.Rfc3489Servers {
+		pool = appendUnique(pool, server)
+	}
+	return pool
+}
+
+// runSurveyProbes sends a binding request from one socket to every resolved
+// address of every server and groups the mapped addresses by public IP. Up to
+// workers servers are resolved and probed at once.
+func runSurveyProbes(opts DetectOptions, workers int) (*SurveyResult, error) {
+	opts = opts.withDefaults()
+	env := opts.probeEnv()
+
+	conn, localIP, err := env.listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	survey := &SurveyResult{LocalIP: localIP, LocalPort: conn.LocalAddr().(*net.UDPAddr).Port}
+	socket := newSharedSocket(env, conn)
+
+	// Resolve first so each backend of a round-robin name gets its own slot;
+	// a middlebox may treat them differently
+	servers := surveyServers(opts)
+	resolved := make([][]SurveyProbe, len(servers))
+	forEachLimit(len(servers), workers, func(i int) {
+		endpoints, err := resolveServer(servers[i])
+		if err != nil {
+			resolved[i] = []SurveyProbe{{Server: servers[i], Error: err.Error()}}
+			printProgress("  " + servers[i] + ": " + err.Error())
+			return
+		}
+		for _, ep := range endpoints {
+			resolved[i] = append(resolved[i], SurveyProbe{Server: servers[i], Addr: ep.Addr.String()})
+		}
+	})
+	for _, probes := range resolved {
+		survey.Probes = append(survey.Probes, probes...)
+	}
+
+	forEachLimit(len(survey.Probes), workers, func(i int) {
+		probe := &survey.Probes[i]
+		if probe.Error != "" {
+			return
+		}
+		addr, _ := net.ResolveUDPAddr("udp4", probe.Addr)
+		res, err := socket.bind(addr, opts.PrimaryTimeout)
+		if err != nil {
+			probe.Error = err.Error()
+			printProgress("  " + probe.Addr + " (" + probe.Server + "): " + err.Error())
+			return
+		}
+		probe.Mapped = res
+		probe.RTT = res.RTT
+		printProgress("  " + probe.Addr + " (" + probe.Server + "): " + res.AddrPort().String())
+	})
+
+	byIP := make(map[string]*SurveyAddress)
+	for _, probe := range survey.Probes {
+		res := probe.Mapped
+		if res == nil {
+			continue
+		}
+		survey.Responded++
+		addr := byIP[res.IP.String()]
+		if addr == nil {
+			addr = &SurveyAddress{IP: res.IP.String()}
+			byIP[res.IP.String()] = addr
+		}
+		addr.Servers = append(addr.Servers, probe.Addr)
+		if !containsInt(addr.Ports, res.Port) {
+			addr.Ports = append(addr.Ports, res.Port)
+		}
+	}
+
+	for _, addr := range byIP {
+		survey.PublicIPs = append(survey.PublicIPs, *addr)
+	}
+	// Most commonly reported first
+	sort.Slice(survey.PublicIPs, func(i, j int) bool {
+		a, b := survey.PublicIPs[i], survey.PublicIPs[j]
+		if len(a.Servers) != len(b.Servers) {
+			return len(a.Servers) > len(b.Servers)
+		}
+		return a.IP < b.IP
+	})
+
+	survey.Discrepancies = surveyDiscrepancies(survey)
+	return survey, nil
+}
+
+// surveyDiscrepancies explains any disagreement between the servers
+func surveyDiscrepancies(s *SurveyResult) []string {
+	var notes []string
+	if len(s.PublicIPs) > 1 {
+		notes = append(notes, strconv.Itoa(len(s.PublicIPs))+" different public IPs: traffic leaves through more than one address (ECMP or multi-WAN), or a transparent proxy intercepts some destinations")
+	}
+	for _, addr := range s.PublicIPs {
+		if len(addr.Ports) > 1 {
+			notes = append(notes, addr.IP+" was reported with "+strconv.Itoa(len(addr.Ports))+" different ports: the mapping depends on the destination")
+		}
+	}
+	if failed := len(s.Probes) - s.Responded; failed > 0 && s.Responded > 0 {
+		notes = append(notes, strconv.Itoa(failed)+" of "+strconv.Itoa(len(s.Probes))+" servers did not answer")
+	}
+	return notes
+}
+
+// containsInt reports whether list holds n
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+func runSurvey(args []string) int {
+	fs := newFlagSet("survey", "")
+	df := addDetectFlags(fs)
+	output := fs.String("output", "text", "output format: text or json")
+	concurrency := fs.Int("concurrency", DefaultConcurrency, "servers to resolve and probe at once")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	if *concurrency < 1 {
+		printLine("--concurrency must be at least 1")
+		return 2
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	printProgress("Surveying " + strconv.Itoa(len(surveyServers(opts.withDefaults()))) + " servers...")
+
+	survey, err := runSurveyProbes(opts, *concurrency)
+	if err != nil {
+		printLine("Error during survey: " + err.Error())
+		return 1
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(survey); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	printLine("")
+	printLine("Local address: " + survey.LocalIP + ":" + strconv.Itoa(survey.LocalPort))
+	printLine("Responded:     " + strconv.Itoa(survey.Responded) + " of " + strconv.Itoa(len(survey.Probes)))
+	for _, addr := range survey.PublicIPs {
+		ports := ""
+		for i, port := range addr.Ports {
+			if i > 0 {
+				ports += ","
+			}
+			ports += strconv.Itoa(port)
+		}
+		printLine("Public IP:     " + addr.IP + " (ports " + ports + ", " + strconv.Itoa(len(addr.Servers)) + " servers)")
+	}
+	if len(survey.Discrepancies) == 0 && survey.Responded > 0 {
+		printLine("All servers agree")
+	}
+	for _, note := range survey.Discrepancies {
+		printLine("Discrepancy:   " + note)
+	}
+	return 0
+}
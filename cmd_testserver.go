@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+func runTestServer(args []string) int {
+	fs := newFlagSet("test-server", "<host[:port]>")
+	timeout := fs.Duration("timeout", 2*time.Second, "timeout for each request")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	if fs.NArg() != 1 {
+		printLine("Usage: nat-info test-server [options] <host[:port]>")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	target := fs.Arg(0)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "3478")
+	}
+	target, err := natinfo.NormalizeHostPort(target)
+	if err != nil {
+		printLine("Invalid server: " + err.Error())
+		return 2
+	}
+	server, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		printLine("Invalid server: " + err.Error())
+		return 2
+	}
+
+	items, err := testServer(server, *timeout)
+	if err != nil {
+		printLine("Error: " + err.Error())
+		return 1
+	}
+	mustFailed := 0
+	for _, it := range items {
+		if it.Level == LevelMust && it.Grade == GradeFail {
+			mustFailed++
+		}
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(items); err != nil {
+			printLine("Error encoding result: " + err.Error())
+			return 1
+		}
+	} else {
+		report := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+		rfc := ""
+		for _, it := range items {
+			if it.RFC != rfc {
+				rfc = it.RFC
+				report.section("RFC " + rfc + " (" + server.String() + ")")
+			}
+			report.item(report.column(it.Req, 7) + report.paint(gradeColorFor(it.Grade), report.column(it.Grade, 9)) + it.Title + " (" + it.Level + ")")
+			if it.Detail != "" {
+				io.WriteString(report.w, "           "+it.Detail+"\n")
+			}
+		}
+		report.section("Summary")
+		report.field("MUST failed", strconv.Itoa(mustFailed))
+	}
+
+	if mustFailed > 0 {
+		return 1
+	}
+	return 0
+}
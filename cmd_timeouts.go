@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+func runTimeouts(args []string) int {
+	fs := newFlagSet("timeouts", "host:port")
+	maxIdle := fs.Duration("max", 10*time.Minute, "longest idle period to test; the run takes this long")
+	iface := fs.String("iface", "", "network interface to send probes from")
+	skipTCP := fs.Bool("no-tcp", false, "only measure the UDP mapping timeout")
+	output := fs.String("output", "text", "output format: text or json")
+	policyArg := fs.String("policy", "", "judge the timeouts with these rules, or the rules in this file; lifetime and tcp-lifetime are the measured lower bounds")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	var policy *Policy
+	if *policyArg != "" {
+		var err error
+		if policy, err = loadPolicy(*policyArg); err != nil {
+			printLine("Invalid --policy: " + err.Error())
+			return 2
+		}
+	}
+	if fs.NArg() != 1 {
+		printLine("Usage: nat-info timeouts [flags] host:port (a responder started with --timeouts)")
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+
+	target := fs.Arg(0)
+	udpAddr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		printLine("Invalid reflector: " + err.Error())
+		return 2
+	}
+
+	var ladder []time.Duration
+	for _, idle := range idleLadder {
+		if idle <= *maxIdle {
+			ladder = append(ladder, idle)
+		}
+	}
+	if len(ladder) == 0 {
+		printLine("--max must be at least " + idleLadder[0].String())
+		return 2
+	}
+
+	printProgress("Testing idle periods up to " + ladder[len(ladder)-1].String() + " in parallel; this takes that long.")
+
+	env := DetectOptions{Interface: *iface}.probeEnv()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var probes []IdleProbe
+	record := func(p IdleProbe) {
+		mu.Lock()
+		defer mu.Unlock()
+		probes = append(probes, p)
+		status := "alive"
+		if !p.Alive {
+			status = "gone (" + p.Failure + ")"
+		}
+		printProgress("  " + p.Protocol + " after " + p.Idle.String() + ": " + status)
+	}
+
+	for _, idle := range ladder {
+		wg.Add(1)
+		go func(idle time.Duration) {
+			defer wg.Done()
+			record(probeUDPIdle(udpAddr, env, idle))
+		}(idle)
+		if !*skipTCP {
+			wg.Add(1)
+			go func(idle time.Duration) {
+				defer wg.Done()
+				record(probeTCPIdle(udpAddr.String(), env, idle))
+			}(idle)
+		}
+	}
+	wg.Wait()
+
+	results := []IdleTimeout{bracketTimeout("udp", probes)}
+	if !*skipTCP {
+		results = append(results, bracketTimeout("tcp", probes))
+	}
+
+	// The JSON output stays a plain list, so the verdict goes to stderr
+	status := 0
+	var verdict *PolicyVerdict
+	if policy != nil {
+		verdict = policy.Evaluate(timeoutFacts(results))
+		if verdict.Verdict == "fail" {
+			status = PolicyFailed
+		}
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		if verdict != nil {
+			printProgress("Policy: " + verdict.Summary())
+		}
+		return status
+	}
+
+	style := styleOf(fs)
+	printLine("")
+	for _, t := range results {
+		label := t.Protocol + " idle timeout: "
+		if !style.plain {
+			label = padRight(label, 19)
+		}
+		printLine(label + describeTimeout(t))
+	}
+	if verdict != nil {
+		report := &textReport{w: os.Stdout, color: colorEnabled(os.Stdout), textStyle: style}
+		report.renderPolicy(verdict)
+	}
+	return status
+}
+
+// describeTimeout renders the bracket found for a timeout
+func describeTimeout(t IdleTimeout) string {
+	var s string
+	switch {
+	case t.AtMost == 0 && t.AtLeast == 0:
+		s = "unknown (no probe completed)"
+	case t.AtMost == 0:
+		s = "longer than " + t.AtLeast.String()
+	case t.AtLeast == 0:
+		s = "shorter than " + t.AtMost.String()
+	default:
+		s = "between " + t.AtLeast.String() + " and " + t.AtMost.String()
+	}
+	if t.Incomplete {
+		s += " (inconsistent: some short probes failed for other reasons)"
+	}
+	return s
+}
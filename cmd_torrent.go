@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func runTorrent(args []string) int {
+	fs := newFlagSet("torrent", "")
+	df := addDetectFlags(fs)
+	port := fs.Int("port", DefaultTorrentPort, "the client's listen port, used for TCP, µTP and the DHT")
+	responder := fs.String("responder", "", "nat-info responder --scan host:port that checks the listen port from outside")
+	yes := fs.Bool("yes", false, "confirm that the --responder may connect to the listen port of this network's public IP, and that --flows may fill the NAT's session table")
+	gateway := fs.String("gateway", "", "address of the PCP/NAT-PMP server (default the IPv4 default gateway)")
+	protocols := fs.String("protocols", DefaultPortMapOrder, "comma-separated port mapping protocols to try, most preferred first")
+	flows := fs.Int("flows", 0, "new outbound flows to open to test the NAT at DHT connection rates, e.g. 300 (capped at "+strconv.Itoa(maxStressFlows)+"); needs --yes")
+	rate := fs.Int("rate", defaultTorrentRate, "new flows per second for --flows (capped at "+strconv.Itoa(maxStressRate)+")")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *port < 1 || *port > 65535 {
+		printLine("Invalid --port: " + strconv.Itoa(*port))
+		return 2
+	}
+	if *flows < 0 || *rate <= 0 {
+		printLine("--flows must not be negative and --rate must be positive")
+		return 2
+	}
+	*flows = min(*flows, maxStressFlows)
+	*rate = min(*rate, maxStressRate)
+	order, err := parsePortMapOrder(*protocols)
+	if err != nil {
+		printLine("Invalid --protocols: " + err.Error())
+		return 2
+	}
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	var gw net.IP
+	if *gateway != "" {
+		if gw = net.ParseIP(*gateway).To4(); gw == nil {
+			printLine("Invalid --gateway: " + *gateway + " (expected an IPv4 address)")
+			return 2
+		}
+	} else {
+		_, gw = defaultGateway(opts.Interface)
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	if *responder != "" {
+		printProgress("The responder " + *responder + " will connect to tcp/" + strconv.Itoa(*port) + " and udp/" + strconv.Itoa(*port) + " at this network's public IP.")
+		printProgress("Only check a network you are responsible for.")
+		if !*yes {
+			printProgress("Re-run with --yes to start it.")
+			return 2
+		}
+	}
+	if *flows > 0 {
+		printProgress("WARNING: --flows deliberately fills the NAT's session table. Other devices")
+		printProgress("behind the same router may lose connectivity until the flows time out.")
+		if !*yes {
+			printProgress("Re-run with --yes to start it.")
+			return 2
+		}
+	}
+
+	check := checkTorrent(opts.withDefaults(), *port, gw, order, *responder, *flows, *rate)
+	status := 0
+	if check.Verdict == TorrentFirewalled {
+		status = 1
+	}
+	if *output == "json" {
+		if code := encodeJSON(check); code != 0 {
+			return code
+		}
+		return status
+	}
+	r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+	renderTorrent(r, check)
+	return status
+}
+
+// renderTorrent prints the listen port's reachability, its UDP mapping and
+// the flow test, then the verdict
+func renderTorrent(r *textReport, c *TorrentCheck) {
+	r.section("Listen port")
+	r.field("Port", strconv.Itoa(c.ListenPort))
+	if c.PortMap != nil && c.PortMap.Preferred != "" {
+		r.field("Mapped with", portMapNames[c.PortMap.Preferred])
+	} else {
+		r.field("Mapped with", r.paint(ansiYellow, "nothing (no PCP, NAT-PMP or UPnP)"))
+	}
+	for _, p := range c.Ports {
+		r.item(r.column(p.String(), 12) + describeInboundPort(r, p))
+	}
+
+	r.section("µTP and DHT")
+	r.field("UDP mapping", describeLocalMapping(r, c.UDP))
+	if c.NAT != nil {
+		r.field("NAT type", r.tr(c.NAT.Type.String()))
+	}
+	if f := c.Flows; f != nil {
+		r.field("Flow test", strconv.Itoa(f.Succeeded)+" of "+strconv.Itoa(f.Opened)+" new flows at "+f.rateText()+"/s")
+	}
+
+	r.section("Verdict")
+	color := ansiGreen
+	switch c.Verdict {
+	case TorrentPartial, TorrentMappable:
+		color = ansiYellow
+	case TorrentFirewalled:
+		color = ansiRed
+	}
+	r.field("Verdict", r.paint(color, strings.ToUpper(c.Verdict)))
+	for _, note := range c.Notes {
+		r.item(note)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sparkHistory is how many RTT samples per server the dashboard keeps
+const sparkHistory = 24
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// tuiPhases are the detection phases in the order the dashboard lists them
+var tuiPhases = []Phase{PhasePrimary, PhaseMapping, PhaseFiltering}
+
+// tuiServer tracks the RTT history of one pinned server address
+type tuiServer struct {
+	addr     string
+	host     string
+	rtts     []time.Duration // negative entries are failed transactions
+	failures int
+}
+
+// tuiState is everything the dashboard renders
+type tuiState struct {
+	algorithm  Algorithm
+	interfaces []string // "" selects the default route
+	ifaceIdx   int
+	rawInput   bool
+
+	running bool
+	started map[Phase]bool
+	current Phase
+	runs    int
+	lastRun time.Time
+
+	servers map[string]*tuiServer
+	order   []string
+
+	result *NatResult
+	err    error
+
+	// tracked is the long-lived socket's current mapping and migrations
+	// its moves, most recent last
+	tracked    string
+	migrations []Migration
+}
+
+// tuiMigrations is how many mapping migrations the dashboard lists
+const tuiMigrations = 5
+
+// tuiRun carries the outcome of one detection run back to the UI loop
+type tuiRun struct {
+	result *NatResult
+	err    error
+}
+
+func runTUI(args []string) int {
+	fs := newFlagSet("tui", "")
+	df := addDetectFlags(fs)
+	interval := fs.Duration("interval", 0, "re-run detection automatically at this interval (0 = only when r is pressed)")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if styleOf(fs).plain {
+		printLine("The dashboard redraws the screen and cannot be read as plain text; use detect or watch with --plain instead")
+		return 2
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	// Detection's own progress lines would scribble over the dashboard
+	progressOut = io.Discard
+
+	state := &tuiState{
+		algorithm:  opts.Algorithm,
+		interfaces: append([]string{""}, ipv4Interfaces()...),
+		servers:    make(map[string]*tuiServer),
+	}
+	for i, name := range state.interfaces {
+		if name == opts.Interface {
+			state.ifaceIdx = i
+		}
+	}
+
+	restore, err := enableRawInput()
+	state.rawInput = err == nil
+	defer restore()
+
+	os.Stdout.WriteString(ansiAltScreen + ansiHideCursor)
+	defer os.Stdout.WriteString(ansiShowCursor + ansiMainScreen)
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	events := make(chan ProgressEvent)
+	done := make(chan tuiRun)
+
+	start := func() {
+		state.running = true
+		state.started = make(map[Phase]bool)
+		state.current = ""
+		state.err = nil
+		state.runs++
+		state.lastRun = time.Now()
+
+		runOpts := opts
+		runOpts.Interface = state.interfaces[state.ifaceIdx]
+		runOpts.Progress = func(ev ProgressEvent) { events <- ev }
+		go func() {
+			result, err := detectNATType(runOpts)
+			done <- tuiRun{result: result, err: err}
+		}()
+	}
+
+	// One socket stays open for the whole session, so a mapping moving
+	// under it shows up even between runs
+	var tracker *mappingTracker
+	moved := make(chan struct{}, 1)
+	track := func() {
+		if tracker != nil {
+			tracker.close()
+		}
+		trackOpts := opts
+		trackOpts.Interface = state.interfaces[state.ifaceIdx]
+		tracker, _ = startMappingTracker(trackOpts, DefaultMigrationInterval, func(Migration) {
+			select {
+			case moved <- struct{}{}:
+			default:
+			}
+		})
+		state.tracked = ""
+	}
+	track()
+	defer func() {
+		if tracker != nil {
+			tracker.close()
+		}
+	}()
+
+	var tick <-chan time.Time
+	if *interval > 0 {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	start()
+	for {
+		os.Stdout.WriteString(state.render())
+
+		select {
+		case ev := <-events:
+			state.apply(ev)
+		case run := <-done:
+			state.running = false
+			state.current = ""
+			state.result, state.err = run.result, run.err
+			if tracker != nil {
+				state.tracked = tracker.current()
+			}
+		case <-moved:
+			// A signal may outlive the tracker an interface switch replaced
+			if tracker == nil {
+				continue
+			}
+			state.migrations = append(state.migrations, tracker.take()...)
+			if n := len(state.migrations); n > tuiMigrations {
+				state.migrations = state.migrations[n-tuiMigrations:]
+			}
+			state.tracked = tracker.current()
+		case <-tick:
+			if !state.running {
+				start()
+			}
+		case <-interrupts:
+			return 0
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			switch key {
+			case 'q', 'Q':
+				return 0
+			case 'r', 'R':
+				if !state.running {
+					start()
+				}
+			case 'i', 'I':
+				state.ifaceIdx = (state.ifaceIdx + 1) % len(state.interfaces)
+				track()
+				if !state.running {
+					start()
+				}
+			}
+		}
+	}
+}
+
+// apply folds a progress event into the dashboard state
+func (s *tuiState) apply(ev ProgressEvent) {
+	if ev.Phase != "" {
+		s.started[ev.Phase] = true
+		s.current = ev.Phase
+		return
+	}
+
+	e := ev.Evidence
+	srv, ok := s.servers[e.Addr]
+	if !ok {
+		srv = &tuiServer{addr: e.Addr, host: e.Server}
+		s.servers[e.Addr] = srv
+		s.order = append(s.order, e.Addr)
+	}
+
+	rtt := e.RTT
+	if !e.Passed {
+		rtt = -1
+		srv.failures++
+	}
+	srv.rtts = append(srv.rtts, rtt)
+	if len(srv.rtts) > sparkHistory {
+		srv.rtts = srv.rtts[len(srv.rtts)-sparkHistory:]
+	}
+}
+
+// render draws the full dashboard as a single string
+func (s *tuiState) render() string {
+	var b strings.Builder
+	line := func(text string) {
+		b.WriteString(text + ansiClearToEOL + "\n")
+	}
+
+	b.WriteString(ansiCursorHome)
+
+	iface := s.interfaces[s.ifaceIdx]
+	if iface == "" {
+		iface = "default route"
+	}
+	line(ansiBold + "nat-info " + version + ansiReset + "  interface: " + iface + "  runs: " + strconv.Itoa(s.runs))
+	line("")
+
+	line(ansiBold + "Phases" + ansiReset)
+	for _, phase := range tuiPhases {
+		marker := "  "
+		switch {
+		case s.running && phase == s.current:
+			marker = "▶ "
+		case s.started[phase]:
+			marker = "✓ "
+		case !s.running:
+			marker = "- "
+		}
+		line("  " + marker + string(phase))
+	}
+	line("")
+
+	line(ansiBold + "Servers" + ansiReset)
+	if len(s.order) == 0 {
+		line("  (no transactions yet)")
+	}
+	for _, addr := range s.order {
+		srv := s.servers[addr]
+		last := "timeout"
+		if n := len(srv.rtts); n > 0 && srv.rtts[n-1] >= 0 {
+			last = srv.rtts[n-1].Round(10 * time.Microsecond).String()
+		}
+		line("  " + padRight(srv.addr, 22) + " " + padRight(last, 8) + " " + sparkline(srv.rtts) +
+			"  fail " + strconv.Itoa(srv.failures))
+	}
+	line("")
+
+	line(ansiBold + "Classification" + ansiReset)
+	switch {
+	case s.err != nil:
+		line("  error: " + s.err.Error())
+	case s.result == nil:
+		line("  detecting...")
+	default:
+		if s.algorithm == AlgorithmBehavior {
+			line("  Mapping:    " + s.result.Mapping.String())
+			line("  Filtering:  " + s.result.Filtering.String())
+		} else {
+			line("  NAT Type:   " + s.result.Type.String())
+		}
+		line("  Confidence: " + s.result.Confidence.String())
+		if s.result.Public != nil {
+			line("  Public:     " + s.result.Public.AddrPort().String())
+		}
+		status := "  Updated:    " + s.lastRun.Format("15:04:05")
+		if s.running {
+			status += " (re-running)"
+		}
+		line(status)
+	}
+	line("")
+
+	if s.tracked != "" || len(s.migrations) > 0 {
+		line(ansiBold + "Long-lived mapping" + ansiReset)
+		if s.tracked != "" {
+			line("  Current:    " + s.tracked)
+		}
+		if len(s.migrations) == 0 {
+			line("  Migrations: none")
+		}
+		for _, m := range s.migrations {
+			line("  " + ansiYellow + "Migrated    " + m.describe() + ansiReset)
+		}
+		line("")
+	}
+
+	keys := "[r] re-run  [i] next interface  [q] quit"
+	if !s.rawInput {
+		keys += "  (press Enter after each key)"
+	}
+	line(keys)
+
+	b.WriteString(ansiClearToEOS)
+	return b.String()
+}
+
+// sparkline renders RTT samples scaled between their min and max; failed
+// transactions render as a gap
+func sparkline(rtts []time.Duration) string {
+	var lo, hi time.Duration = -1, 0
+	for _, rtt := range rtts {
+		if rtt < 0 {
+			continue
+		}
+		if lo < 0 || rtt < lo {
+			lo = rtt
+		}
+		if rtt > hi {
+			hi = rtt
+		}
+	}
+
+	out := make([]rune, 0, sparkHistory)
+	for _, rtt := range rtts {
+		if rtt < 0 {
+			out = append(out, '·')
+			continue
+		}
+		idx := 0
+		if hi > lo {
+			idx = int(int64(rtt-lo) * int64(len(sparkBlocks)-1) / int64(hi-lo))
+		}
+		out = append(out, sparkBlocks[idx])
+	}
+	for len(out) < sparkHistory {
+		out = append(out, ' ')
+	}
+	return string(out)
+}
+
+// padRight pads s with spaces to at least width runes
+func padRight(s string, width int) string {
+	if n := len([]rune(s)); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// WatchEvent is the outcome of one watch-mode detection run
+type WatchEvent struct {
+	Time    time.Time  `json:"time"`
+	Result  *NatResult `json:"result,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Changed bool       `json:"changed"`
+	Changes []string   `json:"changes,omitempty"`
+	// Migrations are moves of a long-lived socket's mapping since the
+	// previous run; each also adds "migration" to Changes
+	Migrations []Migration `json:"migrations,omitempty"`
+}
+
+// diffResults lists which externally meaningful properties changed between
+// two runs. The public port is ignored since every run binds a fresh socket.
+func diffResults(prev, cur *NatResult) []string {
+	if prev == nil || cur == nil {
+		return nil
+	}
+
+	var changes []string
+	if prev.Type != cur.Type {
+		changes = append(changes, "nat-type")
+	}
+	if publicIP(prev) != publicIP(cur) {
+		changes = append(changes, "public-ip")
+	}
+	if prev.Mapping != cur.Mapping {
+		changes = append(changes, "mapping")
+	}
+	if prev.Filtering != cur.Filtering {
+		changes = append(changes, "filtering")
+	}
+	if prev.Policy != nil && cur.Policy != nil && prev.Policy.Verdict != cur.Policy.Verdict {
+		changes = append(changes, "policy")
+	}
+	return changes
+}
+
+// publicIP returns the result's public IP, or "" when none was found
+func publicIP(r *NatResult) string {
+	if r.Public == nil {
+		return ""
+	}
+	return r.Public.IP.String()
+}
+
+// watcher runs detection repeatedly and hands each event to its sinks
+type watcher struct {
+	opts     DetectOptions
+	style    textStyle
+	interval time.Duration
+	schedule *Schedule
+	sinks    []OutputSink
+
+	// statePath, when set, keeps last and the DDNS publisher's record
+	// across restarts
+	statePath string
+	ddns      *ddnsPublisher
+
+	// tracker, when set, watches one long-lived socket's mapping between
+	// runs
+	tracker *mappingTracker
+
+	last *NatResult
+}
+
+// nextRun returns when the run after one started at t should begin
+func (w *watcher) nextRun(t time.Time) time.Time {
+	if w.schedule != nil {
+		return w.schedule.Next(t)
+	}
+	return t.Add(w.interval)
+}
+
+// period estimates the time between runs, using the gap between the next two
+// slots for a schedule
+func (w *watcher) period() time.Duration {
+	if w.schedule == nil {
+		return w.interval
+	}
+	first := w.schedule.Next(time.Now())
+	second := w.schedule.Next(first)
+	if second.IsZero() {
+		return 24 * time.Hour
+	}
+	return second.Sub(first)
+}
+
+// runOnce performs a single detection and dispatches the resulting event
+func (w *watcher) runOnce() {
+	ev := WatchEvent{Time: time.Now()}
+
+	result, err := detectNATType(w.opts)
+	if err != nil {
+		ev.Error = err.Error()
+	} else {
+		ev.Result = result
+		ev.Changes = diffResults(w.last, result)
+		w.last = result
+	}
+	if w.tracker != nil {
+		if ev.Migrations = w.tracker.take(); len(ev.Migrations) > 0 {
+			ev.Changes = append(ev.Changes, "migration")
+		}
+	}
+	ev.Changed = len(ev.Changes) > 0
+
+	fanOut(w.sinks, ev)
+	if err == nil {
+		w.saveState()
+	}
+}
+
+// run loops until a value arrives on stop
+func (w *watcher) run(stop <-chan os.Signal) {
+	// A schedule waits for its first slot; an interval starts right away
+	next := time.Now()
+	if w.schedule != nil {
+		next = w.schedule.Next(next)
+	}
+
+	for {
+		if next.IsZero() {
+			printLine("Schedule has no further run times")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		started := time.Now()
+		w.runOnce()
+		next = w.nextRun(started)
+	}
+}
+
+func runWatch(args []string) int {
+	fs := newFlagSet("watch", "")
+	df := addDetectFlags(fs)
+	interval := fs.Duration("interval", 5*time.Minute, "time between detection runs")
+	schedule := fs.String("schedule", "", "cron expression for run times, e.g. \"*/15 * * * *\" (overrides --interval)")
+	output := fs.String("output", "text", "output format: text (one line per run) or json (one object per line)")
+	ddns := ddnsConfig{}
+	fs.StringVar(&ddns.Provider, "ddns", "", "update a DNS A record when the public IP changes: cloudflare, rfc2136 or generic")
+	fs.StringVar(&ddns.Hostname, "ddns-hostname", "", "DNS name to update")
+	fs.StringVar(&ddns.Token, "ddns-token", "", "API token (cloudflare) or \"Authorization: Token\" value (generic)")
+	fs.StringVar(&ddns.Zone, "ddns-zone", "", "zone ID (cloudflare) or zone name (rfc2136)")
+	fs.StringVar(&ddns.URL, "ddns-url", "", "update URL for the generic provider; {ip} and {hostname} are substituted")
+	fs.StringVar(&ddns.Server, "ddns-server", "", "authoritative DNS server for rfc2136 updates")
+	fs.StringVar(&ddns.TSIGKey, "ddns-tsig-key", "", "TSIG key for rfc2136 updates as name:base64secret (hmac-sha256)")
+	fs.IntVar(&ddns.TTL, "ddns-ttl", 60, "TTL of the published record in seconds")
+	influxFile := fs.String("influx-file", "", "append each run as InfluxDB line protocol to this file")
+	influxURL := fs.String("influx-url", "", "InfluxDB write endpoint, e.g. http://localhost:8086/api/v2/write?org=home&bucket=nat")
+	influxToken := fs.String("influx-token", "", "InfluxDB API token")
+	mqttBroker := fs.String("mqtt-broker", "", "publish results to this MQTT broker, e.g. tcp://localhost:1883 or tls://broker:8883")
+	mqttTopic := fs.String("mqtt-topic", "nat-info", "MQTT topic prefix; results go to <prefix>/state (retained) and changes to <prefix>/event")
+	mqttUsername := fs.String("mqtt-username", "", "MQTT user name")
+	mqttPassword := fs.String("mqtt-password", "", "MQTT password")
+	mqttClientID := fs.String("mqtt-client-id", "", "MQTT client ID (default nat-info-<hostname>)")
+	haDiscovery := fs.Bool("mqtt-ha-discovery", false, "announce Home Assistant sensors through MQTT discovery")
+	haPrefix := fs.String("mqtt-ha-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	listen := fs.String("listen", "", "serve /healthz, /readyz, /result, /metrics and /debug/vars on this address, e.g. :8080")
+	debugListen := fs.String("debug-listen", "", "serve net/http/pprof on this loopback address, e.g. 127.0.0.1:6060")
+	readyMaxAge := fs.Duration("ready-max-age", 0, "oldest successful result /readyz accepts (default twice the time between runs)")
+	rf := addReportFlags(fs)
+	config := fs.String("config", "", "JSON file listing more output sinks (text, json, prometheus, mqtt, webhook, influx) to send every run to")
+	onChange := fs.String("on-change", "", "run this shell command when a run's result differs from the last, with the run as JSON on stdin and NATINFO_* variables")
+	onComplete := fs.String("on-complete", "", "run this shell command after every run, with the run as JSON on stdin and NATINFO_* variables")
+	migrationInterval := fs.Duration("migration-interval", DefaultMigrationInterval, "keep one socket open between runs, refreshing its binding this often, and report when its public mapping moves; 0 disables")
+	stateFile := fs.String("state-file", defaultStatePath(), "keep the last result and DDNS record in this file so a restart does not report spurious changes; empty disables")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	opts, err := df.options()
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+
+	w := &watcher{opts: opts, style: styleOf(fs), interval: *interval, statePath: *stateFile}
+	if *schedule != "" {
+		w.schedule, err = ParseSchedule(*schedule)
+		if err != nil {
+			printLine("Invalid --schedule: " + err.Error())
+			return 2
+		}
+		if w.schedule.Next(time.Now()).IsZero() {
+			printLine("Invalid --schedule: " + *schedule + " never fires")
+			return 2
+		}
+	} else if *interval <= 0 {
+		printLine("--interval must be positive")
+		return 2
+	}
+
+	switch *output {
+	case "text":
+		w.sinks = append(w.sinks, sinkFunc(w.style.printWatchLine))
+	case "json":
+		w.sinks = append(w.sinks, newJSONSink(os.Stdout))
+	default:
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+
+	if ddns.Provider != "" {
+		updater, err := newDNSUpdater(ddns)
+		if err != nil {
+			printLine("Invalid DDNS configuration: " + err.Error())
+			return 2
+		}
+		publisher := &ddnsPublisher{updater: updater, hostname: ddns.Hostname}
+		w.sinks = append(w.sinks, publisher)
+		w.ddns = publisher
+	}
+
+	uploader, err := rf.uploader(opts.FingerprintSalt)
+	if err != nil {
+		printLine(err.Error())
+		return 2
+	}
+	if uploader != nil {
+		w.sinks = append(w.sinks, uploader)
+	}
+
+	if *influxFile != "" || *influxURL != "" {
+		sink, err := newInfluxSink(*influxFile, *influxURL, *influxToken)
+		if err != nil {
+			printLine("Error opening InfluxDB file: " + err.Error())
+			return 1
+		}
+		w.sinks = append(w.sinks, sink)
+	}
+
+	if *mqttBroker != "" {
+		client, err := newMQTTClient(*mqttBroker, *mqttClientID, *mqttUsername, *mqttPassword)
+		if err != nil {
+			printLine("Invalid --mqtt-broker: " + err.Error())
+			return 2
+		}
+		publisher := &mqttPublisher{client: client, topic: *mqttTopic}
+		if *haDiscovery {
+			// Expire sensors after missing a few runs
+			expire := 3 * *interval
+			if w.schedule != nil {
+				expire = 0
+			}
+			publisher.discovery = homeAssistantDiscovery(*haPrefix, *mqttTopic+"/state", haNodeID(client.clientID), expire)
+		}
+		w.sinks = append(w.sinks, publisher)
+	}
+
+	if *onChange != "" {
+		w.sinks = append(w.sinks, &hookSink{command: *onChange, changesOnly: true})
+	}
+	if *onComplete != "" {
+		w.sinks = append(w.sinks, &hookSink{command: *onComplete})
+	}
+
+	if *listen != "" {
+		maxAge := *readyMaxAge
+		if maxAge <= 0 {
+			maxAge = 2 * w.period()
+		}
+		api := newAPIServer(maxAge)
+		if err := api.listen(*listen); err != nil {
+			printLine("Error starting API listener: " + err.Error())
+			return 1
+		}
+		w.sinks = append(w.sinks, api)
+	}
+
+	if *config != "" {
+		cfg, err := loadConfig(*config)
+		if err != nil {
+			printLine("Invalid --config: " + err.Error())
+			return 2
+		}
+		for i, sc := range cfg.Sinks {
+			sink, err := newSink(sc, w)
+			if err != nil {
+				printLine("Invalid --config: sink " + strconv.Itoa(i+1) + ": " + err.Error())
+				return 2
+			}
+			w.sinks = append(w.sinks, sink)
+		}
+	}
+
+	if *debugListen != "" {
+		if err := listenDebug(*debugListen); err != nil {
+			printLine("Error starting debug listener: " + err.Error())
+			return 1
+		}
+	}
+
+	// Progress lines would interleave with the per-run output
+	progressOut = os.Stderr
+
+	w.restoreState()
+
+	if *migrationInterval > 0 {
+		tracker, err := startMappingTracker(opts, *migrationInterval, nil)
+		if err != nil {
+			printProgress("Not tracking mapping migrations: " + err.Error())
+		} else {
+			defer tracker.close()
+			w.tracker = tracker
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	w.run(stop)
+	return 0
+}
+
+// printWatchLine writes a one-line summary of a watch event
+func (s textStyle) printWatchLine(ev WatchEvent) {
+	// Plain mode labels every part instead of relying on spacing
+	sep := "  "
+	if s.plain {
+		sep = ", "
+	}
+	line := ev.Time.Format(time.RFC3339) + sep
+	migrated := ""
+	for _, m := range ev.Migrations {
+		migrated += sep + "migrated " + m.describe()
+	}
+	if ev.Error != "" {
+		printLine(line + "error: " + ev.Error + migrated)
+		return
+	}
+
+	r := ev.Result
+	if s.plain {
+		line += "NAT type "
+	}
+	line += s.tr(r.Type.String())
+	if r.Public != nil {
+		line += sep
+		if s.plain {
+			line += "public "
+		}
+		line += r.Public.AddrPort().String()
+	}
+	line += sep + "confidence " + r.Confidence.String()
+	if r.Policy != nil {
+		line += sep + "policy " + r.Policy.Verdict
+	}
+	if ev.Changed {
+		line += sep + "changed:"
+		for _, change := range ev.Changes {
+			line += " " + change
+		}
+	}
+	printLine(line + migrated)
+}
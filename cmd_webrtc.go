@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+func runWebRTCPreflight(args []string) int {
+	fs := newFlagSet("webrtc-preflight", "")
+	iceServers := fs.String("ice-servers", "", "JSON file with an RTCConfiguration or its iceServers list (required)")
+	iface := fs.String("iface", "", "network interface to gather candidates on")
+	timeout := fs.Duration("timeout", 3*time.Second, "timeout for each server transaction")
+	output := fs.String("output", "text", "output format: text or json")
+	noColor := fs.Bool("no-color", false, "disable colored text output")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if *output != "text" && *output != "json" {
+		printLine("Invalid --output: " + *output + " (expected text or json)")
+		return 2
+	}
+	if *iceServers == "" {
+		printLine("--ice-servers is required")
+		return 2
+	}
+	servers, err := loadICEServers(*iceServers)
+	if err != nil {
+		printLine("Invalid --ice-servers: " + err.Error())
+		return 2
+	}
+
+	if *output == "json" {
+		progressOut = os.Stderr
+	}
+	p, err := webrtcPreflight(servers, DetectOptions{Interface: *iface}, *timeout)
+	if err != nil {
+		printLine("Error during preflight: " + err.Error())
+		return 1
+	}
+
+	if *output == "json" {
+		if code := encodeJSON(p); code != 0 {
+			return code
+		}
+	} else {
+		r := &textReport{w: os.Stdout, color: !*noColor && colorEnabled(os.Stdout), textStyle: styleOf(fs)}
+		renderWebRTCPreflight(r, p)
+	}
+	if p.Verdict == WebRTCBlocked {
+		return 1
+	}
+	return 0
+}
+
+// renderWebRTCPreflight writes a report meant to be pasted into a support
+// ticket whole: it names the tool version and time, never the credentials
+func renderWebRTCPreflight(r *textReport, p *WebRTCPreflight) {
+	r.section("WebRTC preflight")
+	r.field("Tool", "nat-info "+p.Version)
+	r.field("Time", p.Time.UTC().Format(time.RFC3339))
+
+	r.section("ICE servers")
+	for _, check := range p.Servers {
+		status := r.paint(ansiGreen, "ok")
+		switch {
+		case !check.OK:
+			status = r.paint(ansiRed, "failed: "+check.Error)
+		case check.Relay != nil && !check.RelayVerified:
+			status = r.paint(ansiYellow, "allocated, "+check.Error)
+		case check.Relay != nil:
+			status = r.paint(ansiGreen, "relay ok")
+		}
+		if check.RTT > 0 {
+			status += " (" + check.RTT.Round(time.Millisecond).String() + ")"
+		}
+		r.item(r.column(check.URL, 40) + status)
+	}
+
+	r.section("Candidates")
+	for i, c := range p.Candidates {
+		line := c.sdp(i + 1)
+		if c.Server != "" {
+			line += " (" + c.Server + ")"
+		}
+		r.item(line)
+	}
+
+	if p.NAT != nil {
+		r.section("NAT")
+		r.field("Type", r.tr(p.NAT.Type.String()))
+		r.field("Mapping", r.tr(p.NAT.Mapping.String()))
+		r.field("Filtering", r.tr(p.NAT.Filtering.String()))
+		if p.NAT.ShareCode != "" {
+			r.field("Share code", p.NAT.ShareCode)
+		}
+	}
+
+	r.section("Verdict")
+	color := ansiGreen
+	switch p.Verdict {
+	case WebRTCBlocked:
+		color = ansiRed
+	case WebRTCRelayOnly, WebRTCNoRelay:
+		color = ansiYellow
+	}
+	r.field("Verdict", r.paint(color, strings.ToUpper(p.Verdict)))
+	for _, note := range p.Notes {
+		r.item(note)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUploadBytes bounds one uploaded result; a full result with evidence
+// and run metadata is a few kilobytes
+const maxUploadBytes = 1 << 20
+
+// Bounds on the fleet store, since uploaders choose the site and host names
+const (
+	maxSiteHosts  = 10000
+	maxFleetHosts = 100000
+)
+
+// errFleetFull refuses a new host once its site or the fleet is at its bound
+var errFleetFull = errors.New("collector is full")
+
+// FleetHost is the latest result uploaded by one host at one site
+type FleetHost struct {
+	Site       string     `json:"site"`
+	Host       string     `json:"host"`
+	Received   time.Time  `json:"received"`
+	Type       NATType    `json:"type"`
+	Mapping    Behavior   `json:"mapping"`
+	Filtering  Behavior   `json:"filtering"`
+	Confidence Confidence `json:"confidence"`
+	PublicIP   string     `json:"public_ip,omitempty"`
+	ShareCode  string     `json:"share_code,omitempty"`
+	Version    string     `json:"version,omitempty"`
+}
+
+// FleetSite counts the NAT types among a site's hosts
+type FleetSite struct {
+	Site  string         `json:"site"`
+	Hosts int            `json:"hosts"`
+	Types map[string]int `json:"types"`
+}
+
+// FleetSummary is the aggregate view served at /fleet
+type FleetSummary struct {
+	Hosts int            `json:"hosts"`
+	Types map[string]int `json:"types"`
+	Sites []FleetSite    `json:"sites"`
+}
+
+// newFleetHost condenses an uploaded result
+func newFleetHost(site, host string, received time.Time, r *NatResult) FleetHost {
+	h := FleetHost{
+		Site:       site,
+		Host:       host,
+		Received:   received,
+		Type:       r.Type,
+		Mapping:    r.Mapping,
+		Filtering:  r.Filtering,
+		Confidence: r.Confidence,
+		PublicIP:   publicIP(r),
+		ShareCode:  r.ShareCode,
+	}
+	if r.Run != nil {
+		h.Version = r.Run.Version
+	}
+	return h
+}
+
+// fleetStore keeps the latest result per host. Given a file, it appends
+// every upload to it so a restarted collector starts complete, and
+// compacts it to one line per host on start. Hosts quiet for longer than
+// maxAge are dropped on start and whenever the store needs room.
+type fleetStore struct {
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]FleetHost
+	// sites counts the hosts of each site
+	sites map[string]int
+	file  *os.File
+}
+
+// openFleetStore replays path, if set, and keeps it open for appending
+func openFleetStore(path string, maxAge time.Duration) (*fleetStore, error) {
+	s := &fleetStore{maxAge: maxAge, hosts: make(map[string]FleetHost), sites: make(map[string]int)}
+	if path == "" {
+		return s, nil
+	}
+
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var h FleetHost
+			// A line torn by a crash is skipped rather than failing the start
+			if json.Unmarshal(scanner.Bytes(), &h) == nil {
+				// Hosts beyond the bounds are dropped like torn lines
+				s.add(h)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.expire(time.Now())
+
+	var b []byte
+	for _, h := range s.hosts {
+		line, _ := json.Marshal(h)
+		b = append(append(b, line...), '\n')
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// add records h as its host's latest state unless a newer one is known. A
+// new host beyond maxSiteHosts or maxFleetHosts is refused with
+// errFleetFull, once expired hosts have been dropped to make room.
+func (s *fleetStore) add(h FleetHost) error {
+	key := h.Site + "\x00" + h.Host
+	if prev, ok := s.hosts[key]; ok {
+		if !prev.Received.After(h.Received) {
+			s.hosts[key] = h
+		}
+		return nil
+	}
+	if s.sites[h.Site] >= maxSiteHosts || len(s.hosts) >= maxFleetHosts {
+		s.expire(time.Now())
+	}
+	if s.sites[h.Site] >= maxSiteHosts || len(s.hosts) >= maxFleetHosts {
+		return errFleetFull
+	}
+	s.hosts[key] = h
+	s.sites[h.Site]++
+	return nil
+}
+
+// expire drops the hosts that have not uploaded within maxAge
+func (s *fleetStore) expire(now time.Time) {
+	if s.maxAge <= 0 {
+		return
+	}
+	for key, h := range s.hosts {
+		if now.Sub(h.Received) > s.maxAge {
+			delete(s.hosts, key)
+			if s.sites[h.Site]--; s.sites[h.Site] == 0 {
+				delete(s.sites, h.Site)
+			}
+		}
+	}
+}
+
+// upload stores a host's state and persists it
+func (s *fleetStore) upload(h FleetHost) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.add(h); err != nil {
+		return err
+	}
+	if s.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// snapshot returns the hosts seen within maxAge, ordered by site and host
+func (s *fleetStore) snapshot() []FleetHost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	hosts := make([]FleetHost, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		if s.maxAge > 0 && now.Sub(h.Received) > s.maxAge {
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Site != hosts[j].Site {
+			return hosts[i].Site < hosts[j].Site
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	return hosts
+}
+
+// summarize counts NAT types across the fleet and per site
+func summarize(hosts []FleetHost) FleetSummary {
+	sum := FleetSummary{Hosts: len(hosts), Types: make(map[string]int), Sites: []FleetSite{}}
+	for _, h := range hosts {
+		code := natTypeCodes[h.Type]
+		sum.Types[code]++
+		if n := len(sum.Sites); n == 0 || sum.Sites[n-1].Site != h.Site {
+			sum.Sites = append(sum.Sites, FleetSite{Site: h.Site, Types: make(map[string]int)})
+		}
+		site := &sum.Sites[len(sum.Sites)-1]
+		site.Hosts++
+		site.Types[code]++
+	}
+	return sum
+}
+
+// collectReply is the body of the collector's status and error responses
+type collectReply struct {
+	Status string `json:"status"`
+}
+
+// collectServer accepts results from many watchers and serves the
+// aggregate. Everything but /healthz needs the bearer token.
+type collectServer struct {
+	token string
+	store *fleetStore
+}
+
+// authorized checks the request's bearer token in constant time
+func (c *collectServer) authorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(c.token)) == 1
+}
+
+// guard wraps a handler with the token check
+func (c *collectServer) guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !c.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nat-info"`)
+			writeJSON(w, http.StatusUnauthorized, collectReply{Status: "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// upload takes a result as printed by `detect --output json`, or a watch
+// event carrying one. The site comes from ?site=, then the result's
+// network fingerprint; the host from ?host=, then the result's hostname,
+// then the uploader's address.
+func (c *collectServer) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, collectReply{Status: "POST a result"})
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadBytes))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, collectReply{Status: err.Error()})
+		return
+	}
+	result, err := decodeUpload(body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, collectReply{Status: err.Error()})
+		return
+	}
+
+	site, host := r.URL.Query().Get("site"), r.URL.Query().Get("host")
+	if site == "" && result.Run != nil {
+		site = result.Run.Network
+	}
+	if site == "" {
+		site = "unknown"
+	}
+	if host == "" && result.Run != nil {
+		host = result.Run.Hostname
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	err = c.store.upload(newFleetHost(site, host, time.Now().UTC(), result))
+	if errors.Is(err, errFleetFull) {
+		writeJSON(w, http.StatusInsufficientStorage, collectReply{Status: "collector is full: at most " + strconv.Itoa(maxSiteHosts) + " hosts per site and " + strconv.Itoa(maxFleetHosts) + " in all"})
+		return
+	}
+	if err != nil {
+		printProgress("Error storing upload from " + host + ": " + err.Error())
+		writeJSON(w, http.StatusInternalServerError, collectReply{Status: "could not store result"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, collectReply{Status: "ok"})
+}
+
+// decodeUpload parses a result or a watch event wrapping one
+func decodeUpload(body []byte) (*NatResult, error) {
+	var probe struct {
+		Result *NatResult `json:"result"`
+		Error  string     `json:"error"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Result != nil {
+		return probe.Result, nil
+	}
+	if probe.Error != "" {
+		return nil, errors.New("watch event without a result: " + probe.Error)
+	}
+
+	var result NatResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if result.Type == NATUnknown && result.Public == nil && len(result.Evidence) == 0 {
+		return nil, errors.New("not a nat-info result")
+	}
+	return &result, nil
+}
+
+func (c *collectServer) fleet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, summarize(c.store.snapshot()))
+}
+
+// hostsCSV exports the latest result of every host for spreadsheets
+func (c *collectServer) hostsCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="nat-fleet.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"site", "host", "received", "type", "mapping", "filtering", "confidence", "public_ip", "share_code", "version"})
+	for _, h := range c.store.snapshot() {
+		out.Write([]string{
+			h.Site, h.Host, h.Received.Format(time.RFC3339), natTypeCodes[h.Type],
+			behaviorCodes[h.Mapping], behaviorCodes[h.Filtering], h.Confidence.String(),
+			h.PublicIP, h.ShareCode, h.Version,
+		})
+	}
+	out.Flush()
+}
+
+func (c *collectServer) hostsJSON(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, c.store.snapshot())
+}
+
+// metrics exports the distribution as Prometheus gauges
+func (c *collectServer) metrics(w http.ResponseWriter, r *http.Request) {
+	sum := summarize(c.store.snapshot())
+	b := []byte("# HELP natinfo_fleet_hosts Hosts whose latest result has this NAT type.\n# TYPE natinfo_fleet_hosts gauge\n")
+	for _, site := range sum.Sites {
+		codes := make([]string, 0, len(site.Types))
+		for code := range site.Types {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			b = append(b, "natinfo_fleet_hosts{site="+strconv.Quote(site.Site)+",type="+strconv.Quote(code)+"} "+strconv.Itoa(site.Types[code])+"\n"...)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// handler routes the collector's endpoints
+func (c *collectServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, collectReply{Status: "ok"})
+	})
+	mux.HandleFunc("/upload", c.guard(c.upload))
+	mux.HandleFunc("/fleet", c.guard(c.fleet))
+	mux.HandleFunc("/hosts", c.guard(c.hostsJSON))
+	mux.HandleFunc("/hosts.csv", c.guard(c.hostsCSV))
+	mux.HandleFunc("/metrics", c.guard(c.metrics))
+	return mux
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFleetStoreBounds(t *testing.T) {
+	s, err := openFleetStore("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	stale := now.Add(-2 * time.Hour)
+	for i := 0; i < maxSiteHosts; i++ {
+		received := now
+		if i%2 == 0 {
+			received = stale
+		}
+		if err := s.add(FleetHost{Site: "a", Host: strconv.Itoa(i), Received: received}); err != nil {
+			t.Fatalf("host %d: %v", i, err)
+		}
+	}
+
+	// A full site makes room by dropping its quiet hosts
+	if err := s.add(FleetHost{Site: "a", Host: "new", Received: now}); err != nil {
+		t.Fatalf("add after expiry: %v", err)
+	}
+	if got, want := s.sites["a"], maxSiteHosts/2+1; got != want || len(s.hosts) != want {
+		t.Fatalf("site a holds %d of %d hosts, want %d", got, len(s.hosts), want)
+	}
+	for i := len(s.hosts); i < maxSiteHosts; i++ {
+		if err := s.add(FleetHost{Site: "a", Host: "fresh" + strconv.Itoa(i), Received: now}); err != nil {
+			t.Fatalf("fresh host %d: %v", i, err)
+		}
+	}
+	if err := s.add(FleetHost{Site: "a", Host: "over", Received: now}); !errors.Is(err, errFleetFull) {
+		t.Fatalf("add to a full site = %v, want errFleetFull", err)
+	}
+
+	// Known hosts still update, and other sites are unaffected
+	if err := s.add(FleetHost{Site: "a", Host: "new", Received: now.Add(time.Second)}); err != nil {
+		t.Errorf("update of a known host: %v", err)
+	}
+	if err := s.add(FleetHost{Site: "b", Host: "x", Received: now}); err != nil {
+		t.Errorf("add to another site: %v", err)
+	}
+}
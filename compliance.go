@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requirement levels as the RFCs word them
+const (
+	LevelMust        = "MUST"
+	LevelRecommended = "RECOMMENDED"
+)
+
+// Grades for one requirement
+const (
+	GradePass     = "pass"
+	GradeFail     = "fail"
+	GradeUntested = "untested"
+	GradeNA       = "n/a"
+)
+
+// ComplianceItem grades the NAT against one numbered requirement
+type ComplianceItem struct {
+	RFC    string `json:"rfc"`
+	Req    string `json:"req"`
+	Level  string `json:"level"`
+	Title  string `json:"title"`
+	Grade  string `json:"grade"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ReportCard is the full compliance report
+type ReportCard struct {
+	Items      []ComplianceItem `json:"items"`
+	MustFailed int              `json:"must_failed"`
+	Passed     int              `json:"passed"`
+	Untested   int              `json:"untested"`
+	Hairpin    *HairpinResult   `json:"hairpin,omitempty"`
+	ICMPKept   *bool            `json:"icmp_mapping_kept,omitempty"`
+	UDPTimers  []IdleProbe      `json:"udp_timers,omitempty"`
+	Result     *NatResult       `json:"result"`
+}
+
+// probeICMPResilience maps a socket, provokes an ICMP port unreachable by
+// sending to a closed port of the same server, and checks the mapping is
+// still the same afterwards (RFC 4787 REQ-12)
+func probeICMPResilience(server *net.UDPAddr, env *probeEnv, timeout time.Duration) (bool, error) {
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	before, err := env.makeStunRequest(conn, server, nil, timeout, true, 0)
+	if err != nil {
+		return false, err
+	}
+	// The discard port is closed on any sane STUN server
+	closed := &net.UDPAddr{IP: server.IP, Port: 9}
+	for i := 0; i < 3; i++ {
+		conn.WriteToUDP([]byte("nat-info"), closed)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	after, err := env.makeStunRequest(conn, server, nil, timeout, true, 0)
+	if err != nil {
+		return false, err
+	}
+	return before.IP == after.IP && before.Port == after.Port, nil
+}
+
+// probeUDPTimers checks the mapping survives the 2 minute floor and the
+// recommended 5 minutes, in parallel against a responder --timeouts
+func probeUDPTimers(target *net.UDPAddr, env *probeEnv) []IdleProbe {
+	idles := []time.Duration{2 * time.Minute, 5 * time.Minute}
+	probes := make([]IdleProbe, len(idles))
+	var wg sync.WaitGroup
+	for i, idle := range idles {
+		wg.Add(1)
+		go func(i int, idle time.Duration) {
+			defer wg.Done()
+			probes[i] = probeUDPIdle(target, env, idle)
+		}(i, idle)
+	}
+	wg.Wait()
+	return probes
+}
+
+// gradeIf turns a condition into pass or fail
+func gradeIf(ok bool) string {
+	if ok {
+		return GradePass
+	}
+	return GradeFail
+}
+
+// portRange names the RFC 4787 REQ-3 range a port falls in
+func portRange(port int) string {
+	if port < 1024 {
+		return "0-1023"
+	}
+	return "1024-65535"
+}
+
+// gradeCard fills in the requirements from everything measured
+func gradeCard(card *ReportCard) {
+	r := card.Result
+	noNAT := r.Public != nil && r.Public.IP.String() == r.LocalIP
+	add := func(rfc, req, level, title, grade, detail string) {
+		if noNAT {
+			grade, detail = GradeNA, "no NAT between this host and the servers"
+		}
+		card.Items = append(card.Items, ComplianceItem{RFC: rfc, Req: req, Level: level, Title: title, Grade: grade, Detail: detail})
+	}
+
+	if r.Mapping == BehaviorUnknown {
+		add("4787", "REQ-1", LevelMust, "Endpoint-independent mapping", GradeUntested, "mapping behavior could not be measured")
+	} else {
+		add("4787", "REQ-1", LevelMust, "Endpoint-independent mapping", gradeIf(r.Mapping == BehaviorEndpointIndependent), r.Mapping.String())
+	}
+
+	if len(r.ObservedIPs) == 0 {
+		add("4787", "REQ-2", LevelRecommended, "Paired IP address pooling", GradeUntested, "stability probes disabled")
+	} else {
+		add("4787", "REQ-2", LevelRecommended, "Paired IP address pooling", gradeIf(!r.UnstableAddress), strconv.Itoa(len(r.ObservedIPs))+" public IP(s) across sockets")
+	}
+
+	if r.Public == nil {
+		add("4787", "REQ-3", LevelMust, "Port kept in its range", GradeUntested, "no mapping")
+		add("4787", "REQ-4", LevelRecommended, "Port parity preserved", GradeUntested, "no mapping")
+	} else {
+		add("4787", "REQ-3", LevelMust, "Port kept in its range", gradeIf(portRange(r.Public.Port) == portRange(r.LocalPort)),
+			strconv.Itoa(r.LocalPort)+" -> "+strconv.Itoa(r.Public.Port))
+		add("4787", "REQ-4", LevelRecommended, "Port parity preserved", gradeIf(r.Public.Port%2 == r.LocalPort%2),
+			strconv.Itoa(r.LocalPort)+" -> "+strconv.Itoa(r.Public.Port))
+	}
+
+	switch len(card.UDPTimers) {
+	case 0:
+		add("4787", "REQ-5", LevelMust, "UDP mapping timer at least 2 minutes", GradeUntested, "needs --timers with a responder --timeouts")
+	default:
+		detail := "mapping gone after 2m"
+		switch {
+		case card.UDPTimers[1].Alive:
+			detail = "mapping alive after 5m (the recommended minimum)"
+		case card.UDPTimers[0].Alive:
+			detail = "mapping alive after 2m but gone by 5m (5m is RECOMMENDED)"
+		}
+		add("4787", "REQ-5", LevelMust, "UDP mapping timer at least 2 minutes", gradeIf(card.UDPTimers[0].Alive), detail)
+	}
+
+	switch r.Filtering {
+	case BehaviorUnknown:
+		add("4787", "REQ-8", LevelRecommended, "Endpoint-independent or address-dependent filtering", GradeUntested, "filtering behavior could not be measured")
+	default:
+		add("4787", "REQ-8", LevelRecommended, "Endpoint-independent or address-dependent filtering", gradeIf(r.Filtering != BehaviorAddressPortDependent), r.Filtering.String())
+	}
+
+	if h := card.Hairpin; h == nil {
+		add("4787", "REQ-9", LevelMust, "Hairpinning with the external source address", GradeUntested, "no server to map against")
+	} else {
+		add("4787", "REQ-9", LevelMust, "Hairpinning with the external source address", gradeIf(h.Supported && h.External), describeHairpin(h))
+	}
+
+	if card.ICMPKept == nil {
+		add("4787", "REQ-12", LevelMust, "ICMP errors do not delete the mapping", GradeUntested, "could not map a socket")
+	} else {
+		detail := "mapping unchanged after an ICMP port unreachable"
+		if !*card.ICMPKept {
+			detail = "mapping changed after an ICMP port unreachable"
+		}
+		add("4787", "REQ-12", LevelMust, "ICMP errors do not delete the mapping", gradeIf(*card.ICMPKept), detail)
+	}
+
+	// These need a TCP peer, a second host or raw sockets
+	add("5382", "REQ-1", LevelMust, "Endpoint-independent mapping for TCP", GradeUntested, "needs a TCP STUN server")
+	add("5382", "REQ-5", LevelMust, "Established TCP idle timeout at least 2h4m", GradeUntested, "run nat-info timeouts --max 2h against a responder")
+	add("5508", "REQ-1", LevelMust, "ICMP queries from inside are permitted", GradeUntested, "needs raw ICMP sockets")
+
+	for _, item := range card.Items {
+		switch item.Grade {
+		case GradePass:
+			card.Passed++
+		case GradeUntested:
+			card.Untested++
+		case GradeFail:
+			if item.Level == LevelMust {
+				card.MustFailed++
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+// ConntrackEntry is one UDP translation the kernel made for a probe
+type ConntrackEntry struct {
+	Destination string `json:"destination"`
+	Translated  string `json:"translated"`
+	Timeout     int    `json:"timeout_seconds"`
+	Assured     bool   `json:"assured"`
+}
+
+// ConntrackReport is what the local conntrack table says about the
+// detection socket's flows, when nat-info runs on the NAT box itself
+type ConntrackReport struct {
+	Entries []ConntrackEntry `json:"entries"`
+	Mapping Behavior         `json:"mapping"`
+	// Configured timeouts for unreplied and assured UDP flows
+	UDPTimeout       int    `json:"udp_timeout_seconds,omitempty"`
+	UDPStreamTimeout int    `json:"udp_stream_timeout_seconds,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// conntrackMapping classifies the translations of one local socket: a
+// single public port for every destination is endpoint independent
+func conntrackMapping(entries []ConntrackEntry) Behavior {
+	if len(entries) == 0 {
+		return BehaviorUnknown
+	}
+	for _, e := range entries[1:] {
+		if e.Translated != entries[0].Translated {
+			return BehaviorAddressPortDependent
+		}
+	}
+	return BehaviorEndpointIndependent
+}
+
+// inspectConntrack builds the report for the socket at localIP:localPort
+func inspectConntrack(localIP string, localPort int) *ConntrackReport {
+	report := &ConntrackReport{}
+	entries, err := conntrackUDP(localIP, localPort)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Entries = entries
+	report.Mapping = conntrackMapping(entries)
+	report.UDPTimeout, report.UDPStreamTimeout = conntrackTimeouts()
+	return report
+}
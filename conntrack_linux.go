@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ctnetlink constants from linux/netfilter/nfnetlink_conntrack.h
+const (
+	netlinkNetfilter    = 12
+	nfnlSubsysCTNetlink = 1
+	ipctnlMsgCTGet      = 1
+	ctaTupleOrig        = 1
+	ctaTupleReply       = 2
+	ctaStatus           = 3
+	ctaTimeout          = 7
+	ctaTupleIP          = 1
+	ctaTupleProto       = 2
+	ctaIPv4Src          = 1
+	ctaIPv4Dst          = 2
+	ctaProtoNum         = 1
+	ctaProtoSrcPort     = 2
+	ctaProtoDstPort     = 3
+	ipsStatusAssured    = 1 << 2
+	nlaTypeMask         = 0x3fff
+)
+
+// ctTuple is one direction of a conntrack entry
+type ctTuple struct {
+	src, dst         net.IP
+	proto            uint8
+	srcPort, dstPort int
+}
+
+// conntrackUDP dumps the conntrack table over netlink and returns the UDP
+// entries originating from localIP:localPort. Needs CAP_NET_ADMIN.
+func conntrackUDP(localIP string, localPort int) ([]ConntrackEntry, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, netlinkNetfilter)
+	if err != nil {
+		return nil, errors.New("opening netlink socket: " + err.Error())
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	// nlmsghdr followed by nfgenmsg for an IPv4 dump
+	req := make([]byte, syscall.NLMSG_HDRLEN+4)
+	binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:6], nfnlSubsysCTNetlink<<8|ipctnlMsgCTGet)
+	binary.NativeEndian.PutUint16(req[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(req[8:12], 1)
+	req[16] = syscall.AF_INET
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	want := net.ParseIP(localIP)
+	var entries []ConntrackEntry
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return entries, nil
+			case syscall.NLMSG_ERROR:
+				code := int32(binary.NativeEndian.Uint32(m.Data[0:4]))
+				if code == 0 {
+					continue
+				}
+				if syscall.Errno(-code) == syscall.EPERM {
+					return nil, errors.New("reading conntrack needs root or CAP_NET_ADMIN")
+				}
+				return nil, syscall.Errno(-code)
+			}
+			if len(m.Data) < 4 {
+				continue
+			}
+
+			orig, reply, status, timeout := parseCTEntry(m.Data[4:])
+			if orig.proto != syscall.IPPROTO_UDP || !orig.src.Equal(want) || orig.srcPort != localPort {
+				continue
+			}
+			// The reply tuple is addressed to the translated source
+			entries = append(entries, ConntrackEntry{
+				Destination: net.JoinHostPort(orig.dst.String(), strconv.Itoa(orig.dstPort)),
+				Translated:  net.JoinHostPort(reply.dst.String(), strconv.Itoa(reply.dstPort)),
+				Timeout:     int(timeout),
+				Assured:     status&ipsStatusAssured != 0,
+			})
+		}
+	}
+}
+
+// nlAttrs splits a run of netlink attributes into type/value pairs
+func nlAttrs(b []byte, fn func(typ uint16, val []byte)) {
+	for len(b) >= 4 {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			return
+		}
+		fn(binary.NativeEndian.Uint16(b[2:4])&nlaTypeMask, b[4:l])
+		next := (l + 3) &^ 3
+		if next > len(b) {
+			return
+		}
+		b = b[next:]
+	}
+}
+
+// parseCTEntry extracts the tuples, status and timeout of one entry.
+// Values inside ctnetlink attributes are big endian.
+func parseCTEntry(b []byte) (orig, reply ctTuple, status, timeout uint32) {
+	nlAttrs(b, func(typ uint16, val []byte) {
+		switch typ {
+		case ctaTupleOrig:
+			orig = parseCTTuple(val)
+		case ctaTupleReply:
+			reply = parseCTTuple(val)
+		case ctaStatus:
+			if len(val) >= 4 {
+				status = binary.BigEndian.Uint32(val)
+			}
+		case ctaTimeout:
+			if len(val) >= 4 {
+				timeout = binary.BigEndian.Uint32(val)
+			}
+		}
+	})
+	return
+}
+
+func parseCTTuple(b []byte) ctTuple {
+	var t ctTuple
+	nlAttrs(b, func(typ uint16, val []byte) {
+		switch typ {
+		case ctaTupleIP:
+			nlAttrs(val, func(typ uint16, val []byte) {
+				if len(val) != 4 {
+					return
+				}
+				switch typ {
+				case ctaIPv4Src:
+					t.src = net.IP(append([]byte(nil), val...))
+				case ctaIPv4Dst:
+					t.dst = net.IP(append([]byte(nil), val...))
+				}
+			})
+		case ctaTupleProto:
+			nlAttrs(val, func(typ uint16, val []byte) {
+				switch {
+				case typ == ctaProtoNum && len(val) >= 1:
+					t.proto = val[0]
+				case typ == ctaProtoSrcPort && len(val) >= 2:
+					t.srcPort = int(binary.BigEndian.Uint16(val))
+				case typ == ctaProtoDstPort && len(val) >= 2:
+					t.dstPort = int(binary.BigEndian.Uint16(val))
+				}
+			})
+		}
+	})
+	return t
+}
+
+// conntrackTimeouts reads the configured UDP timeouts from procfs
+func conntrackTimeouts() (unreplied, stream int) {
+	read := func(name string) int {
+		data, err := os.ReadFile("/proc/sys/net/netfilter/" + name)
+		if err != nil {
+			return 0
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return n
+	}
+	return read("nf_conntrack_udp_timeout"), read("nf_conntrack_udp_timeout_stream")
+}
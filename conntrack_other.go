@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// conntrackUDP is only available where the kernel exposes ctnetlink
+func conntrackUDP(localIP string, localPort int) ([]ConntrackEntry, error) {
+	return nil, errors.New("conntrack inspection requires Linux")
+}
+
+func conntrackTimeouts() (unreplied, stream int) {
+	return 0, 0
+}
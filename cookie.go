@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cookie frames. A download train or a port scan is far more traffic than
+// the datagram asking for it, so the responder only acts on requests that
+// echo a cookie it sent to their source address: a requester that spoofs
+// its source never sees the cookie.
+const (
+	frameCookieReq = 0xee // id, padding: ask for a cookie
+	frameCookie    = 0xef // id, cookie
+)
+
+const (
+	// cookieLength is the issue time in seconds and a truncated HMAC of it
+	// and the requester's address
+	cookieLength   = 12
+	cookieLifetime = time.Minute
+	// cookieFrameLength is the size of a cookie answer. Requests must be
+	// at least as long, so handing out cookies amplifies nothing.
+	cookieFrameLength = 5 + cookieLength
+)
+
+// cookieJar mints and checks return-routability cookies under a secret
+// picked at startup
+type cookieJar struct {
+	secret []byte
+}
+
+func newCookieJar() *cookieJar {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &cookieJar{secret: secret}
+}
+
+// mint returns the cookie for addr issued at the given Unix time
+func (j *cookieJar) mint(addr *net.UDPAddr, issued uint32) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(addr.IP.To16())
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(addr.Port)))
+	cookie := binary.BigEndian.AppendUint32(nil, issued)
+	mac.Write(cookie)
+	return mac.Sum(cookie)[:cookieLength]
+}
+
+// valid reports whether cookie was minted for addr within cookieLifetime
+func (j *cookieJar) valid(cookie []byte, addr *net.UDPAddr) bool {
+	if len(cookie) < cookieLength {
+		return false
+	}
+	issued := binary.BigEndian.Uint32(cookie[:4])
+	age := time.Since(time.Unix(int64(issued), 0))
+	if age < -time.Second || age > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie[:cookieLength], j.mint(addr, issued))
+}
+
+// isCookieRequest reports whether a datagram asks for a cookie
+func isCookieRequest(buf []byte) bool {
+	return len(buf) >= cookieFrameLength && buf[0] == frameCookieReq
+}
+
+// answer builds the cookie frame for a request from addr
+func (j *cookieJar) answer(buf []byte, addr *net.UDPAddr) []byte {
+	reply := append([]byte{frameCookie}, buf[1:5]...)
+	return append(reply, j.mint(addr, uint32(time.Now().Unix()))...)
+}
+
+// fetchCookie asks a responder for the cookie of this socket's address
+func fetchCookie(conn *net.UDPConn, addr *net.UDPAddr) ([]byte, error) {
+	req := make([]byte, cookieFrameLength)
+	req[0] = frameCookieReq
+	rand.Read(req[1:5])
+	buf := make([]byte, 64)
+	for attempt := 0; attempt < 3; attempt++ {
+		conn.WriteToUDP(req, addr)
+		conn.SetReadDeadline(time.Now().Add(trainIdle))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if n == cookieFrameLength && buf[0] == frameCookie && string(buf[1:5]) == string(req[1:5]) {
+				return append([]byte(nil), buf[5:n]...), nil
+			}
+		}
+	}
+	return nil, errors.New("no cookie from " + addr.String())
+}
+
+// sourceLimiter is a token bucket per source IP, holding burst requests
+// and refilled at perSource a second, and one shared by all of them that
+// holds a second's worth of total
+type sourceLimiter struct {
+	perSource, burst float64
+	total            float64
+
+	mu      sync.Mutex
+	all     tokenBucket
+	sources map[string]*tokenBucket
+}
+
+// maxLimitedSources bounds the table of sources; it is cleared when full,
+// which at worst lets a few sources start over with a full bucket
+const maxLimitedSources = 4096
+
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take refills the bucket for the time since the last request and spends a
+// token if there is one
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if b.at.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.at).Seconds()*rate)
+	}
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allow reports whether a request from ip is within both limits
+func (l *sourceLimiter) allow(ip net.IP) bool {
+	now := time.Now()
+	key := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sources == nil || len(l.sources) >= maxLimitedSources {
+		l.sources = make(map[string]*tokenBucket)
+	}
+	b := l.sources[key]
+	if b == nil {
+		b = &tokenBucket{}
+		l.sources[key] = b
+	}
+	if !b.take(l.perSource, l.burst, now) {
+		return false
+	}
+	return l.all.take(l.total, l.total, now)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCookieValid(t *testing.T) {
+	jar := newCookieJar()
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 41000}
+	now := uint32(time.Now().Unix())
+	cookie := jar.mint(addr, now)
+
+	tampered := append([]byte(nil), cookie...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name   string
+		cookie []byte
+		addr   *net.UDPAddr
+		want   bool
+	}{
+		{"same address", cookie, addr, true},
+		{"other IP", cookie, &net.UDPAddr{IP: net.IPv4(203, 0, 113, 8), Port: 41000}, false},
+		{"other port", cookie, &net.UDPAddr{IP: addr.IP, Port: 41001}, false},
+		{"tampered", tampered, addr, false},
+		{"truncated", cookie[:cookieLength-1], addr, false},
+		{"expired", jar.mint(addr, now-uint32(2*cookieLifetime/time.Second)), addr, false},
+		{"from the future", jar.mint(addr, now+60), addr, false},
+		{"other secret", newCookieJar().mint(addr, now), addr, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jar.valid(tt.cookie, tt.addr); got != tt.want {
+				t.Errorf("valid = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceLimiter(t *testing.T) {
+	l := &sourceLimiter{perSource: 0.001, burst: 2, total: 3}
+	a, b := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow(a); got != want {
+			t.Errorf("request %d from a: allow = %v, want %v", i+1, got, want)
+		}
+	}
+	// b has its own bucket, but only one request is left in the shared one
+	for i, want := range []bool{true, false} {
+		if got := l.allow(b); got != want {
+			t.Errorf("request %d from b: allow = %v, want %v", i+1, got, want)
+		}
+	}
+}
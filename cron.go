@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five-field cron expression:
+// minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Standard cron matches either day field when both are restricted. A
+	// field is unrestricted when it spans its whole range, stepped or not,
+	// as with *, */2 or 1-31.
+	domStar, dowStar bool
+}
+
+// scheduleAliases are the common @-shorthands for five-field expressions
+var scheduleAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a cron expression such as "*/15 * * * *". Fields
+// accept *, single values, ranges (a-b), steps (*/n, a-b/n) and lists (a,b).
+// Day-of-week 7 is accepted as Sunday.
+func ParseSchedule(expr string) (*Schedule, error) {
+	if alias, ok := scheduleAliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression needs 5 fields (minute hour day-of-month month day-of-week), got " + strconv.Itoa(len(fields)))
+	}
+
+	s := &Schedule{}
+	var err error
+	if s.minute, _, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, errors.New("minute: " + err.Error())
+	}
+	if s.hour, _, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, errors.New("hour: " + err.Error())
+	}
+	if s.dom, s.domStar, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, errors.New("day-of-month: " + err.Error())
+	}
+	if s.month, _, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, errors.New("month: " + err.Error())
+	}
+	if s.dow, s.dowStar, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, errors.New("day-of-week: " + err.Error())
+	}
+
+	// Fold Sunday-as-7 onto 0
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+		s.dow &^= 1 << 7
+	}
+	s.dowStar = s.dowStar || s.dow == 0x7f
+	return s, nil
+}
+
+// parseCronField parses one comma-separated field into a bitset of allowed
+// values. full reports whether the field spans min to max: a single range
+// that covers it with any step, or values that fill it.
+func parseCronField(field string, min, max int) (bits uint64, full bool, err error) {
+	parts := strings.Split(field, ",")
+
+	for _, part := range parts {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, false, errors.New("invalid step in " + part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(bounds[0])
+			hi, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, false, errors.New("invalid range " + rangePart)
+			}
+		default:
+			n, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, false, errors.New("invalid value " + rangePart)
+			}
+			lo, hi = n, n
+			// "5/10" means starting at 5 through the end of the range
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, false, errors.New(rangePart + " out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		if len(parts) == 1 && lo == min && hi == max && (rangePart == "*" || strings.Contains(rangePart, "-")) {
+			full = true
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	all := uint64(1)<<uint(max+1) - 1<<uint(min)
+	return bits, full || bits == all, nil
+}
+
+// Next returns the first scheduled minute strictly after t, or the zero time
+// if none occurs within the next five years (e.g. "0 0 31 2 *")
+func (s *Schedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+
+	for next.Before(limit) {
+		switch {
+		case s.month&(1<<uint(next.Month())) == 0:
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+		case !s.matchesDay(next):
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+		case s.hour&(1<<uint(next.Hour())) == 0:
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+		case s.minute&(1<<uint(next.Minute())) == 0:
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay applies the day-of-month/day-of-week rule to t's date
+func (s *Schedule) matchesDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
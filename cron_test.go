@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleFields(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		full     bool
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}, true},
+		{"3", 0, 59, []int{3}, false},
+		{"1-4", 0, 59, []int{1, 2, 3, 4}, false},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}, true},
+		{"10-30/10", 0, 59, []int{10, 20, 30}, false},
+		{"5/20", 0, 59, []int{5, 25, 45}, false},
+		{"1,3,5-6", 0, 23, []int{1, 3, 5, 6}, false},
+		{"*/2", 1, 31, []int{1, 3, 5, 7, 9, 11, 13, 15, 17, 19, 21, 23, 25, 27, 29, 31}, true},
+		{"1-31", 1, 31, nil, true},
+		{"1-15,16-31", 1, 31, nil, true},
+		{"1-30", 1, 31, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			bits, full, err := parseCronField(tt.field, tt.min, tt.max)
+			if err != nil {
+				t.Fatalf("parseCronField: %v", err)
+			}
+			if full != tt.full {
+				t.Errorf("full = %v, want %v", full, tt.full)
+			}
+			if tt.want == nil {
+				return
+			}
+			var want uint64
+			for _, v := range tt.want {
+				want |= 1 << uint(v)
+			}
+			if bits != want {
+				t.Errorf("bits = %b, want %b", bits, want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@sometimes",
+	} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2024-03-01 is a Friday
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"every quarter hour", "*/15 * * * *", "2024-03-01 10:07", "2024-03-01 10:15"},
+		{"strictly after", "*/15 * * * *", "2024-03-01 10:15", "2024-03-01 10:30"},
+		{"seconds are dropped", "* * * * *", "2024-03-01 10:15", "2024-03-01 10:16"},
+		{"hourly alias", "@hourly", "2024-03-01 23:30", "2024-03-02 00:00"},
+		{"weekdays", "0 9 * * 1-5", "2024-03-01 10:00", "2024-03-04 09:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-03-01 00:00", "2024-03-03 00:00"},
+		{"month rollover", "30 2 1 * *", "2024-03-01 03:00", "2024-04-01 02:30"},
+		{"year rollover", "@yearly", "2024-03-01 00:00", "2025-01-01 00:00"},
+		{"list of hours", "0 6,18 * * *", "2024-03-01 07:00", "2024-03-01 18:00"},
+		{"leap day", "0 0 29 2 *", "2025-01-01 00:00", "2028-02-29 00:00"},
+
+		// Both day fields restricted: either may match
+		{"13th or friday", "0 0 13 * 5", "2024-03-01 00:00", "2024-03-08 00:00"},
+		{"13th or monday", "0 0 13 * 1", "2024-03-05 00:00", "2024-03-11 00:00"},
+		// A stepped full range is unrestricted, so both must match
+		{"odd days that are mondays", "0 0 */2 * 1", "2024-03-01 00:00", "2024-03-11 00:00"},
+		{"mondays on any day", "0 0 1-31 * 1", "2024-03-01 00:00", "2024-03-04 00:00"},
+		{"first on any weekday", "0 0 1 * 0-6", "2024-03-02 00:00", "2024-04-01 00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseSchedule: %v", err)
+			}
+			if got := s.Next(at(tt.from)); !got.Equal(at(tt.want)) {
+				t.Errorf("Next = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleNever(t *testing.T) {
+	for _, expr := range []string{"0 0 30 2 *", "0 0 31 4,6,9,11 *"} {
+		s, err := ParseSchedule(expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %v", expr, err)
+		}
+		if next := s.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+			t.Errorf("%q fires at %v", expr, next)
+		}
+	}
+}
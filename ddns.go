@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DDNSTimeout bounds a single DNS record update
+const DDNSTimeout = 15 * time.Second
+
+// DNSUpdater publishes a public IPv4 address to a DNS A record
+type DNSUpdater interface {
+	Update(ctx context.Context, ip string) error
+}
+
+// ddnsConfig holds the settings shared by all DDNS providers
+type ddnsConfig struct {
+	Provider string
+	Hostname string
+	Token    string
+	Zone     string
+	URL      string
+	Server   string
+	TSIGKey  string
+	TTL      int
+}
+
+// newDNSUpdater builds the updater for the configured provider
+func newDNSUpdater(cfg ddnsConfig) (DNSUpdater, error) {
+	switch cfg.Provider {
+	case "cloudflare":
+		if cfg.Zone == "" || cfg.Token == "" || cfg.Hostname == "" {
+			return nil, errors.New("cloudflare needs --ddns-zone (zone ID), --ddns-token and --ddns-hostname")
+		}
+		return &cloudflareUpdater{cfg: cfg, client: http.DefaultClient, api: "https://api.cloudflare.com/client/v4"}, nil
+
+	case "generic":
+		if cfg.URL == "" {
+			return nil, errors.New("generic needs --ddns-url")
+		}
+		return &genericUpdater{cfg: cfg, client: http.DefaultClient}, nil
+
+	case "rfc2136":
+		if cfg.Server == "" || cfg.Zone == "" || cfg.Hostname == "" {
+			return nil, errors.New("rfc2136 needs --ddns-server, --ddns-zone and --ddns-hostname")
+		}
+		u := &rfc2136Updater{cfg: cfg}
+		if cfg.TSIGKey != "" {
+			name, secret, ok := strings.Cut(cfg.TSIGKey, ":")
+			if !ok {
+				return nil, errors.New("--ddns-tsig-key must be name:base64secret")
+			}
+			key, err := base64.StdEncoding.DecodeString(secret)
+			if err != nil {
+				return nil, errors.New("invalid TSIG secret: " + err.Error())
+			}
+			u.keyName, u.keySecret = name, key
+		}
+		return u, nil
+	}
+
+	return nil, errors.New("unknown DDNS provider: " + cfg.Provider + " (expected cloudflare, rfc2136 or generic)")
+}
+
+// genericUpdater calls a dyndns2/deSEC-style update URL. The {ip} and
+// {hostname} placeholders are substituted; credentials may be given as URL
+// userinfo (basic auth) or as a token sent in "Authorization: Token ...".
+type genericUpdater struct {
+	cfg    ddnsConfig
+	client *http.Client
+}
+
+func (u *genericUpdater) Update(ctx context.Context, ip string) error {
+	target := strings.ReplaceAll(u.cfg.URL, "{ip}", url.QueryEscape(ip))
+	target = strings.ReplaceAll(target, "{hostname}", url.QueryEscape(u.cfg.Hostname))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if u.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+u.cfg.Token)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("update URL returned " + resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+
+	// dyndns2 reports failures with a 200 and a status keyword
+	status := strings.Fields(string(body))
+	if len(status) > 0 {
+		switch status[0] {
+		case "badauth", "notfqdn", "nohost", "numhost", "abuse", "badagent", "dnserr", "911":
+			return errors.New("update rejected: " + status[0])
+		}
+	}
+	return nil
+}
+
+// cloudflareUpdater sets an A record through the Cloudflare v4 API, creating
+// it if the zone does not have one yet
+type cloudflareUpdater struct {
+	cfg    ddnsConfig
+	client *http.Client
+	api    string
+}
+
+// cloudflareResponse is the envelope every Cloudflare API call returns
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (u *cloudflareUpdater) call(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.api+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return errors.New("cloudflare " + resp.Status + ": " + err.Error())
+	}
+	if !envelope.Success {
+		msgs := make([]string, len(envelope.Errors))
+		for i, e := range envelope.Errors {
+			msgs[i] = e.Message
+		}
+		return errors.New("cloudflare: " + strings.Join(msgs, "; "))
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
+
+func (u *cloudflareUpdater) Update(ctx context.Context, ip string) error {
+	zonePath := "/zones/" + url.PathEscape(u.cfg.Zone) + "/dns_records"
+
+	var records []struct {
+		ID      string `json:"id"`
+		Content string `json:"content"`
+	}
+	query := "?type=A&name=" + url.QueryEscape(u.cfg.Hostname)
+	if err := u.call(ctx, http.MethodGet, zonePath+query, nil, &records); err != nil {
+		return err
+	}
+
+	ttl := u.cfg.TTL
+	if ttl <= 0 {
+		ttl = 1 // Cloudflare's "automatic"
+	}
+
+	if len(records) == 0 {
+		return u.call(ctx, http.MethodPost, zonePath, map[string]interface{}{
+			"type":    "A",
+			"name":    u.cfg.Hostname,
+			"content": ip,
+			"ttl":     ttl,
+		}, nil)
+	}
+	if records[0].Content == ip {
+		return nil
+	}
+	return u.call(ctx, http.MethodPatch, zonePath+"/"+url.PathEscape(records[0].ID), map[string]interface{}{
+		"content": ip,
+	}, nil)
+}
+
+// DNS wire constants for RFC 2136 updates
+const (
+	dnsTypeA      = 1
+	dnsTypeSOA    = 6
+	dnsTypeTSIG   = 250
+	dnsClassIN    = 1
+	dnsClassANY   = 255
+	dnsOpcodeUpd  = 5
+	tsigFudge     = 300
+	tsigAlgorithm = "hmac-sha256."
+)
+
+// dnsRcodeNames names the response codes an UPDATE can return
+var dnsRcodeNames = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+// rfc2136Updater replaces the A RRset of a name with a DNS UPDATE message,
+// signed with TSIG (hmac-sha256) when a key is configured
+type rfc2136Updater struct {
+	cfg       ddnsConfig
+	keyName   string
+	keySecret []byte
+}
+
+func (u *rfc2136Updater) Update(ctx context.Context, ip string) error {
+	ip4 := net.ParseIP(ip).To4()
+	if ip4 == nil {
+		return errors.New("not an IPv4 address: " + ip)
+	}
+
+	ttl := u.cfg.TTL
+	if ttl <= 0 {
+		ttl = 60
+	}
+
+	msg, err := u.buildUpdate(ip4, uint32(ttl))
+	if err != nil {
+		return err
+	}
+
+	server := u.cfg.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 || !bytes.Equal(buf[0:2], msg[0:2]) {
+			continue
+		}
+		if rcode := int(buf[3] & 0x0F); rcode != 0 {
+			name, ok := dnsRcodeNames[rcode]
+			if !ok {
+				name = "rcode " + strconv.Itoa(rcode)
+			}
+			return errors.New("DNS update refused: " + name)
+		}
+		return nil
+	}
+}
+
+// buildUpdate encodes an UPDATE that deletes every A record of the hostname
+// and adds one pointing at ip
+func (u *rfc2136Updater) buildUpdate(ip net.IP, ttl uint32) ([]byte, error) {
+	zone, err := encodeDNSName(u.cfg.Zone)
+	if err != nil {
+		return nil, err
+	}
+	name, err := encodeDNSName(u.cfg.Hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 2)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 12)
+	copy(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], dnsOpcodeUpd<<11)
+	binary.BigEndian.PutUint16(msg[4:6], 1)  // ZOCOUNT
+	binary.BigEndian.PutUint16(msg[8:10], 2) // UPCOUNT
+
+	// Zone section
+	msg = append(msg, zone...)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// Delete the existing A RRset
+	msg = append(msg, name...)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassANY)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+
+	// Add the new address
+	msg = append(msg, name...)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, 4)
+	msg = append(msg, ip...)
+
+	if u.keyName == "" {
+		return msg, nil
+	}
+	return u.signTSIG(msg, time.Now())
+}
+
+// signTSIG appends a TSIG record (RFC 8945) to msg
+func (u *rfc2136Updater) signTSIG(msg []byte, now time.Time) ([]byte, error) {
+	keyName, err := encodeDNSName(strings.ToLower(u.keyName))
+	if err != nil {
+		return nil, err
+	}
+	algorithm, _ := encodeDNSName(tsigAlgorithm)
+
+	timeSigned := make([]byte, 6)
+	secs := uint64(now.Unix())
+	for i := 5; i >= 0; i-- {
+		timeSigned[i] = byte(secs)
+		secs >>= 8
+	}
+
+	// The MAC covers the unsigned message followed by the TSIG variables
+	mac := hmac.New(sha256.New, u.keySecret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write([]byte{0, dnsClassANY, 0, 0, 0, 0})
+	mac.Write(algorithm)
+	mac.Write(timeSigned)
+	mac.Write([]byte{tsigFudge >> 8, tsigFudge & 0xFF, 0, 0, 0, 0})
+	sum := mac.Sum(nil)
+
+	var rdata []byte
+	rdata = append(rdata, algorithm...)
+	rdata = append(rdata, timeSigned...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...) // original ID
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := append([]byte{}, msg...)
+	signed = append(signed, keyName...)
+	signed = binary.BigEndian.AppendUint16(signed, dnsTypeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, dnsClassANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	arcount := binary.BigEndian.Uint16(signed[10:12])
+	binary.BigEndian.PutUint16(signed[10:12], arcount+1)
+	return signed, nil
+}
+
+// encodeDNSName encodes a domain name as length-prefixed labels
+func encodeDNSName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	var out []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, errors.New("invalid DNS name: " + name)
+			}
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	out = append(out, 0)
+	if len(out) > 255 {
+		return nil, errors.New("DNS name too long: " + name)
+	}
+	return out, nil
+}
+
+// ddnsPublisher pushes the public IP to DNS whenever it differs from the
+// last value published successfully, retrying failed updates on later runs
+type ddnsPublisher struct {
+	updater   DNSUpdater
+	hostname  string
+	published string
+}
+
+func (p *ddnsPublisher) handle(ev WatchEvent) {
+	ip := ""
+	if ev.Result != nil {
+		ip = publicIP(ev.Result)
+	}
+	if ip == "" || ip == p.published {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DDNSTimeout)
+	defer cancel()
+
+	if err := p.updater.Update(ctx, ip); err != nil {
+		printProgress("DDNS update to " + ip + " failed: " + err.Error())
+		return
+	}
+	printProgress("DDNS record updated to " + ip)
+	p.published = ip
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// DTLSProbe is the outcome of a binding transaction over DTLS (RFC 7350).
+// Comparing it with the cleartext tests tells whether encrypted UDP gets
+// through where plain STUN is blocked, a telltale of deep packet inspection.
+type DTLSProbe struct {
+	Target      string        `json:"target"`
+	Addr        string        `json:"addr,omitempty"`
+	Handshake   bool          `json:"handshake"`
+	CipherSuite string        `json:"cipher_suite,omitempty"`
+	Mapped      *StunResult   `json:"mapped,omitempty"`
+	RTT         time.Duration `json:"rtt,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// dtlsTarget adds the default STUN over DTLS port 5349 to a bare host
+func dtlsTarget(target string) string {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return net.JoinHostPort(target, "5349")
+	}
+	return target
+}
+
+// probeDTLS handshakes with target and sends one binding request over the
+// association. The handshake and the transaction each get timeout.
+func probeDTLS(target string, env *probeEnv, timeout time.Duration, config *natinfo.DTLSConfig) DTLSProbe {
+	probe := DTLSProbe{Target: dtlsTarget(target)}
+	fail := func(err error) DTLSProbe {
+		probe.Error = err.Error()
+		return probe
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", probe.Target)
+	if err != nil {
+		return fail(err)
+	}
+	probe.Addr = addr.String()
+
+	local := &net.UDPAddr{IP: net.IPv4zero}
+	if env.iface != "" {
+		if local.IP, err = interfaceIPv4(env.iface); err != nil {
+			return fail(err)
+		}
+	}
+	conn, err := env.dialUDP(local, addr)
+	if err != nil {
+		return fail(err)
+	}
+
+	cfg := natinfo.DTLSConfig{}
+	if config != nil {
+		cfg = *config
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(probe.Target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	dc, err := natinfo.DTLSClient(ctx, conn, &cfg)
+	if err != nil {
+		conn.Close()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return fail(errors.New("no handshake answer"))
+		}
+		return fail(err)
+	}
+	defer dc.Close()
+	probe.Handshake = true
+	probe.CipherSuite = dc.CipherSuite()
+
+	tid := make([]byte, 12)
+	rand.Read(tid)
+	req := encodeStunMessage(BindingRequest, tid, nil)
+	deadline := env.clock.Now().Add(timeout)
+	retransmit := 200 * time.Millisecond
+	buf := make([]byte, 1500)
+	for env.clock.Now().Before(deadline) {
+		if _, err := dc.Write(req); err != nil {
+			return fail(err)
+		}
+		sent := env.clock.Now()
+		dc.SetReadDeadline(env.deadline(minTime(sent.Add(retransmit), deadline)))
+		retransmit *= 2
+		for {
+			n, err := dc.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return fail(err)
+			}
+			if n < HeaderLength || string(buf[8:20]) != string(tid) {
+				continue
+			}
+			result, err := parseStunResponse(buf[:n])
+			if err != nil {
+				return fail(err)
+			}
+			probe.RTT = env.clock.Now().Sub(sent)
+			probe.Mapped = result
+			return probe
+		}
+	}
+	return fail(errors.New("handshake succeeded but no binding response"))
+}
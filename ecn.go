@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"slices"
+	"time"
+)
+
+// ECN codepoints in the low two bits of the IPv4 TOS byte
+const (
+	ecnNotECT = 0x00
+	ecnECT1   = 0x01
+	ecnECT0   = 0x02
+	ecnCE     = 0x03
+)
+
+var ecnNames = []string{"Not-ECT", "ECT(1)", "ECT(0)", "CE"}
+
+// attrReceivedTOS is a private comprehension-optional attribute. In a
+// binding request it asks a responder started with --ecn to echo the TOS
+// byte the request arrived with; in the response its first byte holds it.
+const attrReceivedTOS = 0xC0E0
+
+// Verdicts for one codepoint, and for the path as a whole
+const (
+	ECNPreserved = "preserved"
+	ECNBleached  = "bleached"
+	ECNRemarked  = "remarked"
+	ECNMarkedCE  = "ce-marked"
+	// ECNLost on an ECT codepoint while Not-ECT gets through means the
+	// path drops ECN-capable packets outright
+	ECNLost = "lost"
+)
+
+// ECNMark is what became of one codepoint on the way to the responder and
+// of the ECT(0) its answer was sent with on the way back
+type ECNMark struct {
+	Sent        string `json:"sent"`
+	Received    string `json:"received,omitempty"`
+	ReceivedTOS int    `json:"received_tos"`
+	Reply       string `json:"reply,omitempty"`
+	Verdict     string `json:"verdict"`
+}
+
+// ECNProbe is the outcome of the ECN preservation test
+type ECNProbe struct {
+	Target  string    `json:"target"`
+	Marks   []ECNMark `json:"marks,omitempty"`
+	Verdict string    `json:"verdict,omitempty"`
+	// ReplyBleached is set when every answer lost the responder's ECT(0)
+	ReplyBleached bool   `json:"reply_bleached"`
+	Error         string `json:"error,omitempty"`
+}
+
+// isECNRequest reports whether a datagram is a binding request asking for
+// its TOS byte
+func isECNRequest(msg *StunMessage) bool {
+	_, ok := findAttribute(msg, attrReceivedTOS)
+	return msg.Type == BindingRequest && msg.Cookie == MagicCookie && ok
+}
+
+// answerECN builds the response to an ECN request. tos is -1 where the
+// responder cannot read it, and the attribute is left out.
+func answerECN(msg *StunMessage, from *net.UDPAddr, tos int) []byte {
+	resp := appendStunHeader(nil, BindingResponse, msg.TransactionID)
+	resp = appendAttribute(resp, AttrXorMappedAddress, appendXorAddress(nil, from, msg.TransactionID))
+	if tos >= 0 {
+		resp = appendAttribute(resp, attrReceivedTOS, []byte{byte(tos), 0, 0, 0})
+	}
+	return resp
+}
+
+// ecnVerdict compares the codepoint sent with the one received
+func ecnVerdict(sent, received int) string {
+	switch {
+	case received == sent:
+		return ECNPreserved
+	case sent != ecnNotECT && received == ecnNotECT:
+		return ECNBleached
+	case sent != ecnNotECT && received == ecnCE:
+		return ECNMarkedCE
+	}
+	return ECNRemarked
+}
+
+// probeECN sends a binding request with each codepoint to a responder
+// started with --ecn and compares what it saw with what was sent
+func probeECN(target string, env *probeEnv, timeout time.Duration) ECNProbe {
+	probe := ECNProbe{Target: target}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	defer conn.Close()
+	enableECN(conn)
+
+	buf := make([]byte, 1500)
+	replies, bleached := 0, 0
+	for _, cp := range []int{ecnNotECT, ecnECT0, ecnECT1, ecnCE} {
+		mark := ECNMark{Sent: ecnNames[cp], ReceivedTOS: -1, Verdict: ECNLost}
+		if err := setTOS(conn, cp); err != nil {
+			probe.Error = err.Error()
+			return probe
+		}
+		tid := make([]byte, 12)
+		rand.Read(tid)
+		req := encodeStunMessage(BindingRequest, tid, []Attribute{{Type: attrReceivedTOS}})
+
+	attempts:
+		for attempt := 0; attempt < 3; attempt++ {
+			if _, err := conn.WriteToUDP(req, addr); err != nil {
+				probe.Error = err.Error()
+				return probe
+			}
+			conn.SetReadDeadline(time.Now().Add(timeout / 3))
+			for {
+				n, _, tos, err := readWithTOS(conn, buf)
+				if err != nil {
+					break
+				}
+				msg, err := decodeStunMessage(buf[:n])
+				if err != nil || msg.Type != BindingResponse || string(msg.TransactionID) != string(tid) {
+					continue
+				}
+				if tos >= 0 {
+					mark.Reply = ecnNames[tos&0x03]
+					replies++
+					if tos&0x03 == ecnNotECT {
+						bleached++
+					}
+				}
+				if v, ok := findAttribute(msg, attrReceivedTOS); ok && len(v) > 0 {
+					mark.ReceivedTOS = int(v[0])
+					mark.Received = ecnNames[v[0]&0x03]
+					mark.Verdict = ecnVerdict(cp, int(v[0]&0x03))
+				} else {
+					mark.Verdict = ""
+				}
+				break attempts
+			}
+		}
+		probe.Marks = append(probe.Marks, mark)
+	}
+	probe.ReplyBleached = replies > 0 && bleached == replies
+
+	// The ECT codepoints decide, worst first; Not-ECT shows the path
+	// works at all and CE only shows remarking
+	switch {
+	case probe.Marks[0].Verdict == ECNLost:
+		probe.Error = "no answer; is the responder running with --ecn?"
+	case probe.Marks[0].Verdict == "":
+		probe.Error = "the responder cannot read the TOS byte; run it on Linux"
+	default:
+		severity := []string{ECNPreserved, ECNMarkedCE, ECNRemarked, ECNBleached, ECNLost}
+		probe.Verdict = ECNPreserved
+		for _, m := range probe.Marks[1:3] {
+			if slices.Index(severity, m.Verdict) > slices.Index(severity, probe.Verdict) {
+				probe.Verdict = m.Verdict
+			}
+		}
+	}
+	return probe
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableECN marks outgoing packets ECT(0) and asks the kernel to report the
+// TOS byte of incoming packets
+func enableECN(conn *net.UDPConn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, ecnECT0)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+	})
+}
+
+// setTOS sets the TOS byte of the packets conn sends from now on
+func setTOS(conn *net.UDPConn, tos int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var opErr error
+	if err := raw.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	}); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// readWithTOS reads a datagram and returns the TOS byte it arrived with,
+// or -1 when the kernel did not report it
+func readWithTOS(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, int, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, from, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return n, from, -1, err
+	}
+	return n, from, tosOf(oob[:oobn]), nil
+}
+
+// tosOf finds the TOS byte among a datagram's control messages, or -1
+func tosOf(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) > 0 {
+			return int(m.Data[0])
+		}
+	}
+	return -1
+}
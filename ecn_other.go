@@ -0,0 +1,29 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// enableECN is a no-op where the TOS byte of received packets is not
+// available
+func enableECN(conn *net.UDPConn) {}
+
+// setTOS is unsupported; without reading the TOS byte back there is
+// nothing to compare against
+func setTOS(conn *net.UDPConn, tos int) error {
+	return errors.New("the ECN test requires Linux")
+}
+
+// readWithTOS reads a datagram; its TOS byte is never known here
+func readWithTOS(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, int, error) {
+	n, from, err := conn.ReadFromUDP(buf)
+	return n, from, -1, err
+}
+
+// tosOf never finds a TOS byte here
+func tosOf(oob []byte) int {
+	return -1
+}
@@ -0,0 +1,109 @@
+package main
+
+import "net/netip"
+
+// EndpointSource says how a public endpoint was found
+type EndpointSource string
+
+const (
+	// EndpointPrimary is the mapping of the detection socket, the one
+	// NatResult.Public holds and the behavior columns describe
+	EndpointPrimary EndpointSource = "primary"
+	// EndpointPool is another address of the same NAT, seen from other
+	// sockets of a load-balanced CGNAT or dual-WAN router
+	EndpointPool EndpointSource = "pool"
+	// EndpointUplink is the mapping behind another uplink, seen when
+	// servers are reached through different interfaces
+	EndpointUplink EndpointSource = "uplink"
+)
+
+// PublicEndpoint is one public address this host was seen behind, with the
+// behavior measured for it. Mapping and filtering stay unknown for
+// endpoints that were only observed and not tested.
+type PublicEndpoint struct {
+	Family    string         `json:"family"`
+	IP        netip.Addr     `json:"ip"`
+	Port      int            `json:"port,omitempty"`
+	Source    EndpointSource `json:"source"`
+	Interface string         `json:"interface,omitempty"`
+	// Seen counts the samples that reported this address
+	Seen      int      `json:"seen"`
+	Type      NATType  `json:"type"`
+	Mapping   Behavior `json:"mapping"`
+	Filtering Behavior `json:"filtering"`
+}
+
+// addressFamily names the family of ip as in JSON output
+func addressFamily(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// addEndpoint records a public endpoint, or counts another sighting of an
+// address already recorded
+func (r *NatResult) addEndpoint(e PublicEndpoint) {
+	for i := range r.PublicEndpoints {
+		if r.PublicEndpoints[i].IP == e.IP {
+			r.PublicEndpoints[i].Seen += e.Seen
+			return
+		}
+	}
+	if e.Family == "" {
+		e.Family = addressFamily(e.IP)
+	}
+	r.PublicEndpoints = append(r.PublicEndpoints, e)
+}
+
+// collectEndpoints lists every public address the run saw: the primary
+// mapping first, then the other addresses of a NAT pool and the mappings
+// behind other uplinks
+func (r *NatResult) collectEndpoints() {
+	r.PublicEndpoints = nil
+	if r.Public == nil {
+		return
+	}
+	primary := PublicEndpoint{
+		IP:        r.Public.IP,
+		Port:      r.Public.Port,
+		Source:    EndpointPrimary,
+		Seen:      1,
+		Type:      r.Type,
+		Mapping:   r.Mapping,
+		Filtering: r.Filtering,
+	}
+	if r.Run != nil {
+		primary.Interface = r.Run.Interface
+	}
+	for _, o := range r.ObservedIPs {
+		if o.IP == r.Public.IP.String() {
+			primary.Seen = o.Count
+		}
+	}
+	r.addEndpoint(primary)
+
+	for _, o := range r.ObservedIPs {
+		if ip, err := netip.ParseAddr(o.IP); err == nil && ip != r.Public.IP {
+			r.addEndpoint(PublicEndpoint{IP: ip, Source: EndpointPool, Seen: o.Count})
+		}
+	}
+
+	// Any other address answered to the detection socket itself, so it
+	// belongs to another uplink when servers are routed apart, and to the
+	// pool otherwise
+	known := make(map[netip.Addr]bool)
+	for _, p := range r.PublicEndpoints {
+		known[p.IP] = true
+	}
+	source := EndpointPool
+	if r.PolicyRouted {
+		source = EndpointUplink
+	}
+	for _, e := range r.Evidence {
+		if e.Mapped == nil || e.Test == TestStability || known[e.Mapped.IP] {
+			continue
+		}
+		r.addEndpoint(PublicEndpoint{IP: e.Mapped.IP, Port: e.Mapped.Port, Source: source, Seen: 1})
+	}
+}
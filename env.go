@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+)
+
+// EnvPrefix is prepended to a flag's upper-cased name to form the
+// environment variable that configures it, e.g. --timeout-probe is
+// NATINFO_TIMEOUT_PROBE
+const EnvPrefix = "NATINFO_"
+
+// envName returns the environment variable name for a flag
+func envName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag in fs from its NATINFO_* environment variable.
+// It must run before fs.Parse so that command-line flags take precedence.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = errors.New("invalid " + name + ": " + setErr.Error())
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ExplainStep is one link of the chain from the tests to the verdict: what
+// a test observed and what detection concluded from it
+type ExplainStep struct {
+	Test        TestName `json:"test,omitempty"`
+	Server      string   `json:"server,omitempty"`
+	Observation string   `json:"observation"`
+	Inference   string   `json:"inference"`
+}
+
+// explainResult rebuilds the evidence chain behind a result from the tests
+// it recorded, in the order detection walked its decision tree, so the
+// verdict can be audited rather than trusted
+func explainResult(r *NatResult) []ExplainStep {
+	var steps []ExplainStep
+	add := func(test TestName, server, observation, inference string) {
+		steps = append(steps, ExplainStep{Test: test, Server: server, Observation: observation, Inference: inference})
+	}
+
+	// The primary binding decides between blocked, open and translated
+	var primary *Evidence
+	for i, e := range r.Evidence {
+		if e.Test == TestBinding && e.Passed {
+			primary = &r.Evidence[i]
+			break
+		}
+	}
+	if primary == nil {
+		add(TestBinding, "", "no server answered a binding request ("+strconv.Itoa(r.countAttempted(TestBinding))+" tried)",
+			"outbound UDP is blocked or every server is unreachable")
+		return steps
+	}
+	local := r.LocalIP + ":" + strconv.Itoa(r.LocalPort)
+	observed := "local " + local + " was seen as " + primary.Mapped.AddrPort().String()
+	switch {
+	case r.Type == NATOpen || r.Type == NATSymmetricFirewall:
+		add(TestBinding, primary.Server, observed, "the address is not translated: no NAT")
+	case primary.Mapped.Port == r.LocalPort:
+		add(TestBinding, primary.Server, observed, "the address is translated and the port kept: behind a NAT that preserves ports")
+	default:
+		add(TestBinding, primary.Server, observed, "the address and port are translated: behind a NAT")
+	}
+
+	if r.countAttempted(TestStability) > 0 {
+		ips := make([]string, len(r.ObservedIPs))
+		for i, o := range r.ObservedIPs {
+			ips[i] = o.IP + " (" + strconv.Itoa(o.Count) + "x)"
+		}
+		if r.UnstableAddress {
+			add(TestStability, primary.Server, "fresh sockets were seen from "+strings.Join(ips, ", "),
+				"the NAT spreads flows over an address pool, so later comparisons may mix addresses")
+		} else if len(ips) > 0 {
+			add(TestStability, primary.Server, "fresh sockets were all seen from "+strings.Join(ips, ", "), "the public IP is stable")
+		}
+	}
+
+	// Mapping: the same socket compared across destinations
+	if r.Type != NATOpen && r.Type != NATSymmetricFirewall {
+		differs := 0
+		for _, s := range r.MappingSamples {
+			observation := s.First + " saw " + s.FirstMapped.AddrPort().String() + ", " + s.Second + " saw " + s.SecondMapped.AddrPort().String()
+			if s.Differs {
+				differs++
+				add(TestMapping, s.Second, observation, "the mapping changed with the destination")
+			} else {
+				add(TestMapping, s.Second, observation, "the mapping stayed the same for both destinations")
+			}
+		}
+		switch {
+		case len(r.MappingSamples) == 0:
+			add(TestMapping, "", "no second server answered", "endpoint-independent mapping is assumed, not measured")
+		case r.Type == NATSymmetric:
+			add(TestMapping, "", strconv.Itoa(differs)+" of "+strconv.Itoa(len(r.MappingSamples))+" samples differed",
+				"a majority differs: endpoint-dependent mapping, which makes this a Symmetric NAT")
+		case differs > 0:
+			add(TestMapping, "", strconv.Itoa(differs)+" of "+strconv.Itoa(len(r.MappingSamples))+" samples differed",
+				"no majority differs, so the divergent samples are taken as noise: endpoint-independent mapping")
+		default:
+			add(TestMapping, "", "every sample kept the mapping", "endpoint-independent mapping")
+		}
+	}
+
+	for _, e := range r.Evidence {
+		if step, ok := explainEvidence(r, e); ok {
+			steps = append(steps, step)
+		}
+	}
+
+	if r.Type == NATSymmetric && r.countPassed(TestMappingPort) == 0 {
+		add(TestMappingPort, "", "no server could bind from a second port of the same IP", "address and port dependent mapping is assumed")
+	}
+	switch {
+	case r.Filtering != BehaviorUnknown:
+	case r.Type == NATOpen:
+		add("", "", "no server could test filtering", "inbound filtering is untested")
+	case r.Type != NATSymmetric:
+		add("", "", "no server could test filtering", "the stricter subtype is assumed")
+	}
+	return steps
+}
+
+// explainEvidence explains one filtering or mapping-port test; the others
+// are covered by explainResult's summaries
+func explainEvidence(r *NatResult, e Evidence) (ExplainStep, bool) {
+	step := ExplainStep{Test: e.Test, Server: e.Server}
+	seen := ""
+	if e.Mapped != nil {
+		seen = " and saw " + e.Mapped.AddrPort().String()
+	}
+	switch e.Test {
+	case TestMappingPort:
+		if !e.Passed {
+			step.Observation, step.Inference = "the alternate port "+e.Addr+" did not answer", "address vs port dependence is untested"
+			break
+		}
+		step.Observation = "the alternate port " + e.Addr + " answered" + seen
+		if r.Mapping == BehaviorAddressDependent {
+			step.Inference = "the mapping stayed for another port of the same IP: address-dependent mapping"
+		} else {
+			step.Inference = "the mapping changed with the port alone: address and port dependent mapping"
+		}
+
+	case TestConeBinding:
+		if !e.Passed {
+			step.Observation, step.Inference = "no answer from "+e.Addr, "the server is unreachable, so it tests nothing"
+			break
+		}
+		step.Observation, step.Inference = e.Addr+" answered"+seen, "the filter now knows this server, and CHANGE-REQUEST can test it"
+
+	case TestChangeIPPort:
+		switch {
+		case e.Passed:
+			step.Observation, step.Inference = "an answer from another IP and port got through", "packets from addresses never contacted are let in: endpoint-independent filtering"
+		case e.Error == errChangeIgnored.Error():
+			step.Observation, step.Inference = "the server answered from its own address", "it ignores CHANGE-REQUEST, so this tells nothing"
+		default:
+			step.Observation, step.Inference = "no answer from another IP and port", "packets from addresses never contacted are dropped"
+		}
+
+	case TestChangePort:
+		if e.Passed {
+			step.Observation, step.Inference = "an answer from another port of the same IP got through", "the filter admits a contacted address on any port: address-dependent filtering"
+		} else {
+			step.Observation, step.Inference = "no answer from another port of the same IP", "the filter admits only the exact address and port contacted: address and port dependent filtering"
+		}
+
+	case TestResponsePortControl:
+		if e.Passed {
+			step.Observation, step.Inference = "a socket that had sent to the server received its RESPONSE-PORT answer", "the server honors RESPONSE-PORT, so the next tests count"
+		} else {
+			step.Observation, step.Inference = "a socket that had sent to the server got no RESPONSE-PORT answer", "the server does not support RESPONSE-PORT, so it tests nothing"
+		}
+
+	case TestResponsePort:
+		if e.Passed {
+			step.Observation, step.Inference = "a socket that had only sent to another server received the answer", "packets from addresses never contacted are let in: endpoint-independent filtering"
+		} else {
+			step.Observation, step.Inference = "a socket that had only sent to another server got no answer", "packets from addresses never contacted are dropped"
+		}
+
+	case TestResponsePortSameIP:
+		if e.Passed {
+			step.Observation, step.Inference = "after it also sent to another port of the server's IP, it received the answer", "the filter admits a contacted address on any port: address-dependent filtering"
+		} else {
+			step.Observation, step.Inference = "after it also sent to another port of the server's IP, it still got no answer", "the filter admits only the exact address and port contacted: address and port dependent filtering"
+		}
+
+	default:
+		return step, false
+	}
+	return step, true
+}
+
+// renderExplanation writes the Explanation section: each test's
+// observation and the conclusion drawn from it, then the verdict they add
+// up to
+func (r *textReport) renderExplanation(result *NatResult) {
+	r.section("Explanation")
+	for _, step := range result.Explanation {
+		label := string(step.Test)
+		if label == "" {
+			label = "overall"
+		}
+		if step.Server != "" {
+			label += " (" + step.Server + ")"
+		}
+		r.item(label + ": " + step.Observation + " -> " + step.Inference)
+	}
+	verdict := r.tr(result.Type.String())
+	if r.algorithm == AlgorithmBehavior {
+		verdict = r.tr(result.Mapping.String()) + " mapping, " + r.tr(result.Filtering.String()) + " filtering"
+	}
+	r.field("Verdict", verdict+", "+r.tr(result.Confidence.String())+" confidence")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Exposure frames: the client asks from a socket that has only ever talked
+// to the responder, and the responder answers to exactly that address and
+// port, once from the address asked and then from sources the client never
+// contacted: fresh ports of the same IP, and any alternate IPs it was given.
+const (
+	frameExposeReq = 0xea // id
+	frameExpose    = 0xeb // id, source kind
+)
+
+// Source kinds of an exposure frame
+const (
+	exposeContacted = iota // the address the request went to
+	exposeOtherPort        // a fresh port on the same IP
+	exposeOtherIP          // an alternate IP of the responder
+	exposeSummary   = 0xff // how many of each were sent, from the contacted address
+)
+
+// exposurePorts is how many fresh ports the responder sends from
+const exposurePorts = 4
+
+// ExposureResult says which unrelated sources can reach a mapping that was
+// opened towards one endpoint: the inbound attack surface of the mapping
+type ExposureResult struct {
+	// Contacted is set when the answer from the contacted address arrived;
+	// without it nothing else means anything
+	Contacted      bool   `json:"contacted"`
+	OtherPorts     int    `json:"other_ports"`
+	OtherPortsSent int    `json:"other_ports_sent"`
+	OtherIPs       int    `json:"other_ips"`
+	OtherIPsSent   int    `json:"other_ips_sent"`
+	Error          string `json:"error,omitempty"`
+}
+
+// isExposeFrame reports whether a datagram is an exposure request
+func isExposeFrame(buf []byte) bool {
+	return len(buf) >= 5 && buf[0] == frameExposeReq
+}
+
+// handleExposure answers an exposure request. Every packet goes to the
+// requester's own address and port, so the responder cannot be used to
+// send to anyone else.
+func (r *reachReflector) handleExposure(buf []byte, from *net.UDPAddr) {
+	frame := func(kind byte) []byte {
+		return append(append([]byte{frameExpose}, buf[1:5]...), kind)
+	}
+	r.conn.WriteToUDP(frame(exposeContacted), from)
+
+	send := func(laddr *net.UDPAddr, kind byte) int {
+		c, err := net.ListenUDP("udp4", laddr)
+		if err != nil {
+			return 0
+		}
+		defer c.Close()
+		if _, err := c.WriteToUDP(frame(kind), from); err != nil {
+			return 0
+		}
+		return 1
+	}
+	local := r.conn.LocalAddr().(*net.UDPAddr)
+	ports := 0
+	for i := 0; i < exposurePorts; i++ {
+		ports += send(&net.UDPAddr{IP: local.IP}, exposeOtherPort)
+	}
+	ips := 0
+	for _, ip := range r.alternates {
+		ips += send(&net.UDPAddr{IP: ip}, exposeOtherIP)
+	}
+
+	// Tell the client how many were sent, so silence reads as filtered
+	// rather than as a responder without alternates
+	r.conn.WriteToUDP(append(frame(exposeSummary), byte(ports), byte(ips)), from)
+}
+
+// probeExposure opens a mapping towards the responder and counts which of
+// the responder's unrelated sources get through it
+func probeExposure(target string, env *probeEnv, timeout time.Duration) *ExposureResult {
+	result := &ExposureResult{}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	req := append([]byte{frameExposeReq}, id...)
+	// Sent twice in case the first is lost; the responder then answers
+	// twice, which the counts are capped against
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP(req, addr); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	summary := false
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if n < 6 || buf[0] != frameExpose || string(buf[1:5]) != string(id) {
+			continue
+		}
+		switch buf[5] {
+		case exposeSummary:
+			if n >= 8 {
+				summary = true
+				result.OtherPortsSent = int(buf[6])
+				result.OtherIPsSent = int(buf[7])
+			}
+		case exposeContacted:
+			result.Contacted = true
+		case exposeOtherPort:
+			result.OtherPorts++
+		case exposeOtherIP:
+			result.OtherIPs++
+		}
+	}
+
+	if !result.Contacted && !summary {
+		result.Error = "no answer from " + target + " (not a responder with --reach, or UDP is blocked)"
+	}
+	if summary {
+		result.OtherPorts = min(result.OtherPorts, result.OtherPortsSent)
+		result.OtherIPs = min(result.OtherIPs, result.OtherIPsSent)
+	}
+	return result
+}
+
+// describeExposure renders which strangers can send to a mapping
+func describeExposure(e *ExposureResult) string {
+	switch {
+	case e.OtherIPs > 0:
+		return "hosts never contacted reached the mapping (" + strconv.Itoa(e.OtherIPs) + " of " + strconv.Itoa(e.OtherIPsSent) + " other IPs): anyone who learns the public port can send to it"
+	case e.OtherPorts > 0:
+		line := "other ports of a contacted host reached the mapping (" + strconv.Itoa(e.OtherPorts) + " of " + strconv.Itoa(e.OtherPortsSent) + ")"
+		if e.OtherIPsSent == 0 {
+			line += "; other hosts untested (responder has no --reach-alternate)"
+		}
+		return line
+	case !e.Contacted:
+		return "the contacted address itself did not get through"
+	case e.OtherIPsSent == 0:
+		return "only the contacted address and port got through; other hosts untested (responder has no --reach-alternate)"
+	}
+	return "only the contacted address and port got through"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// FirewallCheck describes the host firewall as far as it can be inspected
+// without changing it
+type FirewallCheck struct {
+	Backend  string `json:"backend,omitempty"`
+	Active   bool   `json:"active"`
+	Stateful bool   `json:"stateful"`
+	SelfTest string `json:"self_test"`
+	Detail   string `json:"detail,omitempty"`
+	Rule     string `json:"suggested_rule,omitempty"`
+}
+
+// BlocksReplies reports whether the host itself probably drops responses to
+// outbound UDP, which would look like UDP being blocked upstream
+func (f *FirewallCheck) BlocksReplies() bool {
+	return f.SelfTest == "failed" || (f.Active && !f.Stateful)
+}
+
+// checkLocalFirewall inspects the platform firewall and sends an
+// unsolicited datagram between two sockets on the LAN address
+func checkLocalFirewall(localIP string) *FirewallCheck {
+	f := &FirewallCheck{SelfTest: selfTestInbound(localIP)}
+
+	switch runtime.GOOS {
+	case "linux":
+		inspectLinuxFirewall(f)
+	case "darwin":
+		inspectMacFirewall(f)
+	case "windows":
+		inspectWindowsFirewall(f)
+	}
+	return f
+}
+
+// selfTestInbound sends one datagram from one local socket to another. Both
+// are bound to the LAN address, so the receive side sees it as unsolicited
+// inbound traffic; loopback exemptions make a pass weaker evidence than a
+// failure.
+func selfTestInbound(localIP string) string {
+	ip := net.ParseIP(localIP)
+	if ip == nil {
+		return "skipped"
+	}
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return "skipped"
+	}
+	defer recv.Close()
+	send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return "skipped"
+	}
+	defer send.Close()
+
+	buf := make([]byte, 16)
+	for attempt := 0; attempt < 3; attempt++ {
+		send.WriteToUDP([]byte("nat-info"), recv.LocalAddr().(*net.UDPAddr))
+		recv.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, _, err := recv.ReadFromUDP(buf); err == nil && n == 8 {
+			return "passed"
+		}
+	}
+	return "failed"
+}
+
+// runQuiet runs a command and returns its output, or "" on any failure
+func runQuiet(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return string(out)
+}
+
+// inspectLinuxFirewall reads the nftables ruleset, falling back to
+// iptables. Both need root; without it the self-test is all there is.
+func inspectLinuxFirewall(f *FirewallCheck) {
+	if rules := runQuiet("nft", "list", "ruleset"); rules != "" {
+		f.Backend = "nftables"
+		for _, chain := range strings.Split(rules, "chain ")[1:] {
+			if !strings.Contains(chain, "hook input") {
+				continue
+			}
+			if strings.Contains(chain, "policy drop") || strings.Contains(chain, " drop") || strings.Contains(chain, " reject") {
+				f.Active = true
+			}
+			if strings.Contains(chain, "ct state") && strings.Contains(chain, "established") {
+				f.Stateful = true
+			}
+		}
+		if f.Active {
+			f.Detail = "input chain drops or rejects traffic"
+			if !f.Stateful {
+				f.Rule = "nft insert rule inet filter input ct state established,related accept"
+			}
+		}
+		return
+	}
+
+	if rules := runQuiet("iptables", "-S", "INPUT"); rules != "" {
+		f.Backend = "iptables"
+		f.Active = strings.Contains(rules, "-P INPUT DROP") || strings.Contains(rules, "-j DROP") || strings.Contains(rules, "-j REJECT")
+		f.Stateful = strings.Contains(rules, "ESTABLISHED")
+		if f.Active {
+			f.Detail = "INPUT chain drops or rejects traffic"
+			if !f.Stateful {
+				f.Rule = "iptables -I INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT"
+			}
+		}
+	}
+}
+
+// inspectMacFirewall checks the application firewall and pf
+func inspectMacFirewall(f *FirewallCheck) {
+	const alf = "/usr/libexec/ApplicationFirewall/socketfilterfw"
+	if state := runQuiet(alf, "--getglobalstate"); strings.Contains(state, "enabled") {
+		f.Backend = "alf"
+		f.Active = true
+		// The application firewall only screens inbound connections to
+		// listening apps; replies to outbound traffic pass
+		f.Stateful = true
+		f.Detail = "application firewall enabled"
+		if strings.Contains(runQuiet(alf, "--getblockall"), "enabled") {
+			f.Stateful = false
+			f.Detail = "application firewall blocks all incoming connections"
+			f.Rule = alf + " --setblockall off"
+		}
+	}
+	if info := runQuiet("pfctl", "-s", "info"); strings.Contains(info, "Status: Enabled") {
+		f.Backend = "pf"
+		f.Active = true
+		f.Stateful = true // pf keeps state on outbound rules by default
+		f.Detail = "pf enabled"
+	}
+}
+
+// inspectWindowsFirewall reads the current profile from netsh
+func inspectWindowsFirewall(f *FirewallCheck) {
+	profile := runQuiet("netsh", "advfirewall", "show", "currentprofile")
+	if profile == "" {
+		return
+	}
+	f.Backend = "windows"
+	for _, line := range strings.Split(profile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "State" {
+			f.Active = fields[1] == "ON"
+		}
+	}
+	// Defender Firewall is stateful, so replies to outbound UDP pass unless
+	// the app itself is blocked
+	f.Stateful = true
+	if f.Active {
+		f.Detail = "Windows Defender Firewall is on for the current profile"
+		exe, _ := os.Executable()
+		f.Rule = "netsh advfirewall firewall add rule name=\"nat-info\" dir=in action=allow protocol=UDP program=\"" + exe + "\""
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Game hosting verdicts
+const (
+	// GameReady: every port is reachable from the internet
+	GameReady = "ready"
+	// GameNeedsMapping: the ports are reachable only while mapped, so the
+	// game must use UPnP/PCP or the forwards be made permanent
+	GameNeedsMapping = "needs-mapping"
+	// GameMappable: the gateway maps the ports; reachability was not tested
+	GameMappable = "mappable"
+	// GameNeedsForward: nothing maps the ports, so they must be forwarded
+	// by hand on the router
+	GameNeedsForward = "needs-forward"
+	// GameBlocked: the ports stay unreachable even when mapped, because of
+	// another NAT or a firewall beyond the router
+	GameBlocked = "blocked"
+	// GameCGNAT: the ISP's carrier-grade NAT keeps inbound connections out
+	GameCGNAT = "cgnat"
+)
+
+// GameHostCheck is the outcome of the game hosting preflight
+type GameHostCheck struct {
+	LocalIP  string        `json:"local_ip,omitempty"`
+	Ports    []InboundPort `json:"ports"`
+	PortMap  *PortMapCheck `json:"port_map,omitempty"`
+	PublicIP string        `json:"public_ip,omitempty"`
+	NAT      *NatResult    `json:"nat,omitempty"`
+	// Matchmaking is the NAT type in the open/moderate/strict terms game
+	// consoles and launchers use
+	Matchmaking string `json:"matchmaking"`
+	Verdict     string `json:"verdict"`
+	Advice      string `json:"advice"`
+	ScanError   string `json:"scan_error,omitempty"`
+}
+
+// matchmakingType translates a NAT type into console terms: open hosts and
+// joins anyone, moderate joins open hosts, strict only open hosts and may
+// need relays
+func matchmakingType(t NATType) string {
+	switch t {
+	case NATOpen, NATFullCone:
+		return "open"
+	case NATRestrictedCone, NATPortRestricted:
+		return "moderate"
+	case NATSymmetric, NATSymmetricFirewall, NATUDPBlocked:
+		return "strict"
+	}
+	return "unknown"
+}
+
+// checkGameHost maps the game's ports through the gateway, has a responder
+// check them from outside while mapped and judges what a self-hoster must do
+func checkGameHost(opts DetectOptions, ports []InboundPort, gateway net.IP, order []string, responder string, timeout time.Duration) *GameHostCheck {
+	check := &GameHostCheck{Ports: ports}
+	env := opts.probeEnv()
+
+	printProgress("Detecting NAT behavior...")
+	if result, err := detectNATType(opts); err == nil {
+		check.NAT = result
+		check.LocalIP = result.LocalIP
+		if result.Public != nil {
+			check.PublicIP = result.Public.IP.String()
+		}
+	}
+	check.Matchmaking = "unknown"
+	if check.NAT != nil {
+		check.Matchmaking = matchmakingType(check.NAT.Type)
+	}
+
+	printProgress("Asking the gateway to map the game ports...")
+	pm, scanErr := openInbound(env, check.Ports, gateway, order, responder, timeout)
+	check.PortMap, check.ScanError = &pm, scanErr
+
+	check.Verdict, check.Advice = gameVerdict(check)
+	return check
+}
+
+// gameVerdict boils the check down to one verdict and what to do about it
+func gameVerdict(c *GameHostCheck) (string, string) {
+	var unreachable, mapped, failed []string
+	tested := false
+	for _, p := range c.Ports {
+		if p.State != "" {
+			tested = true
+			if p.State != PortOpen {
+				unreachable = append(unreachable, p.String())
+			}
+		}
+		if p.Mapping != nil && p.Mapping.Error == "" {
+			mapped = append(mapped, p.String())
+		} else {
+			failed = append(failed, p.String())
+		}
+	}
+	where := "this host (" + c.LocalIP + ")"
+	if c.PortMap != nil && c.PortMap.Gateway != "" {
+		where += " on the router at " + c.PortMap.Gateway
+	}
+	cgnat := c.NAT != nil && c.NAT.Access != nil && c.NAT.Access.Type == AccessCGNAT
+	if c.PortMap != nil && c.PublicIP != "" {
+		for _, p := range c.PortMap.Probes {
+			if p.Works && p.ExternalIP != "" && p.ExternalIP != c.PublicIP {
+				cgnat = true
+			}
+		}
+	}
+
+	switch {
+	case tested && len(unreachable) == 0 && len(mapped) > 0:
+		return GameNeedsMapping, "Players can join while the ports are mapped: enable UPnP in the game server, or forward " + strings.Join(mapped, ", ") + " permanently to " + where + "."
+	case tested && len(unreachable) == 0:
+		return GameReady, "Players can join: every game port is reachable from the internet."
+	case cgnat:
+		return GameCGNAT, "Your ISP puts this network behind carrier-grade NAT, so port forwarding cannot let players in. Ask the ISP for a public IPv4 address, or host through a tunnel or a rented server."
+	case tested && len(mapped) == len(c.Ports):
+		return GameBlocked, "The router mapped " + strings.Join(unreachable, ", ") + " but players still cannot reach them: a firewall on this host or the ISP, or a second router in front of this one, blocks them."
+	case tested && len(mapped) > 0:
+		return GameNeedsForward, "The router refused to map " + strings.Join(failed, ", ") + "; forward them by hand to " + where + " and run this check again."
+	case tested:
+		return GameNeedsForward, "The router offers no automatic port mapping; forward " + strings.Join(unreachable, ", ") + " by hand to " + where + " and run this check again."
+	case len(failed) == 0:
+		return GameMappable, "The router maps every game port automatically; add --responder to confirm players can reach them."
+	}
+	return GameNeedsForward, "Nothing mapped " + strings.Join(failed, ", ") + "; forward them by hand to " + where + ", then add --responder to confirm players can reach them."
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Objects queried from the gateway
+const (
+	oidSysDescr         = "1.3.6.1.2.1.1.1.0"
+	oidIPAdEntIfIndex   = "1.3.6.1.2.1.4.20.1.2"
+	oidIfDescr          = "1.3.6.1.2.1.2.2.1.2"
+	oidIfInOctets       = "1.3.6.1.2.1.2.2.1.10"
+	oidIfInDiscards     = "1.3.6.1.2.1.2.2.1.13"
+	oidIfOutOctets      = "1.3.6.1.2.1.2.2.1.16"
+	oidNATUDPTimeout    = "1.3.6.1.2.1.123.1.1.2.0" // natUdpDefIdleTimeout
+	oidNATTCPTimeout    = "1.3.6.1.2.1.123.1.1.5.0" // natTcpDefIdleTimeout
+	oidNATInTranslates  = "1.3.6.1.2.1.123.1.3.1.3" // natInterfaceInTranslates
+	oidNATOutTranslates = "1.3.6.1.2.1.123.1.3.1.4" // natInterfaceOutTranslates
+	oidNATDiscards      = "1.3.6.1.2.1.123.1.3.1.5" // natInterfaceDiscards
+	snmpWalkLimit       = 256
+)
+
+// GatewayInterface holds the ifTable counters of one gateway interface
+type GatewayInterface struct {
+	Index      string `json:"index"`
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	InOctets   uint64 `json:"in_octets"`
+	OutOctets  uint64 `json:"out_octets"`
+	InDiscards uint64 `json:"in_discards"`
+}
+
+// GatewayNAT holds RFC 4008 NAT-MIB objects, when the device has them
+type GatewayNAT struct {
+	UDPTimeout    uint64 `json:"udp_timeout_seconds,omitempty"`
+	TCPTimeout    uint64 `json:"tcp_timeout_seconds,omitempty"`
+	InTranslates  uint64 `json:"in_translates"`
+	OutTranslates uint64 `json:"out_translates"`
+	Discards      uint64 `json:"discards"`
+}
+
+// GatewayInfo is what the gateway reports about itself over SNMP
+type GatewayInfo struct {
+	Target      string            `json:"target"`
+	Description string            `json:"description,omitempty"`
+	WAN         *GatewayInterface `json:"wan,omitempty"`
+	// WANIsPublic is set when the gateway's WAN address is the public IP
+	// STUN reported, i.e. there is no further NAT upstream
+	WANIsPublic bool        `json:"wan_is_public"`
+	NAT         *GatewayNAT `json:"nat,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// queryGateway collects the WAN interface and NAT counters of the gateway.
+// The WAN interface is the one holding publicIP, or failing that the first
+// non-private address.
+func queryGateway(env *probeEnv, target, community, publicIP string, timeout time.Duration) *GatewayInfo {
+	info := &GatewayInfo{Target: target}
+	client, err := newSNMPClient(env, target, community, timeout)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	values, err := client.get(oidSysDescr)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Description = strings.TrimSpace(values[oidSysDescr].String())
+
+	// ipAdEntIfIndex is indexed by the address itself
+	addrs, _ := client.walk(oidIPAdEntIfIndex, snmpWalkLimit)
+	var wanAddr, wanIndex string
+	for _, b := range addrs {
+		addr := strings.TrimPrefix(b.OID, oidIPAdEntIfIndex+".")
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		if addr == publicIP {
+			wanAddr, wanIndex = addr, b.Value.String()
+			break
+		}
+		if wanAddr == "" && !ip.IsPrivate() {
+			wanAddr, wanIndex = addr, b.Value.String()
+		}
+	}
+
+	if wanIndex != "" {
+		wan := &GatewayInterface{Index: wanIndex, Address: wanAddr}
+		values, err := client.get(oidIfDescr+"."+wanIndex, oidIfInOctets+"."+wanIndex,
+			oidIfOutOctets+"."+wanIndex, oidIfInDiscards+"."+wanIndex)
+		if err == nil {
+			wan.Name = values[oidIfDescr+"."+wanIndex].String()
+			wan.InOctets = values[oidIfInOctets+"."+wanIndex].Uint()
+			wan.OutOctets = values[oidIfOutOctets+"."+wanIndex].Uint()
+			wan.InDiscards = values[oidIfInDiscards+"."+wanIndex].Uint()
+		}
+		info.WAN = wan
+		info.WANIsPublic = wanAddr == publicIP
+	}
+
+	// Few consumer devices implement the NAT-MIB; absence is normal
+	if values, err := client.get(oidNATUDPTimeout, oidNATTCPTimeout); err == nil && len(values) > 0 {
+		nat := &GatewayNAT{
+			UDPTimeout: values[oidNATUDPTimeout].Uint(),
+			TCPTimeout: values[oidNATTCPTimeout].Uint(),
+		}
+		sum := func(prefix string) uint64 {
+			var total uint64
+			binds, _ := client.walk(prefix, snmpWalkLimit)
+			for _, b := range binds {
+				total += b.Value.Uint()
+			}
+			return total
+		}
+		nat.InTranslates = sum(oidNATInTranslates)
+		nat.OutTranslates = sum(oidNATOutTranslates)
+		nat.Discards = sum(oidNATDiscards)
+		info.NAT = nat
+	}
+	return info
+}
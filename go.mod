@@ -1,4 +1,4 @@
-module nat-info
+module github.com/rahulshinde11/nat-info
 
 go 1.22
 
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// UDP segmentation and receive offload options, from linux/udp.h
+const (
+	solUDP     = 17
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+// gsoUnsupported is set once the kernel or a route refuses segmented sends
+var gsoUnsupported atomic.Bool
+
+// enableGRO lets the kernel hand over back-to-back datagrams of one flow
+// glued into a single buffer of up to 64 KiB, reported by groSegment
+func enableGRO(conn *net.UDPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var opErr error
+	raw.Control(func(fd uintptr) {
+		opErr = syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 1)
+	})
+	return opErr == nil
+}
+
+// groSegment returns the size of the datagrams glued into one GRO buffer,
+// all but the last of which are that long, or 0 for a plain datagram
+func groSegment(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if m.Header.Level == solUDP && m.Header.Type == udpGRO && len(m.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+	return 0
+}
+
+// sendSegmented sends buf to addr as datagrams of size bytes with a single
+// system call, the kernel or NIC doing the split. It reports false, having
+// sent nothing, when segmentation offload is not available, in which case
+// the caller sends the datagrams itself.
+func sendSegmented(conn *net.UDPConn, addr *net.UDPAddr, buf []byte, size int) bool {
+	if gsoUnsupported.Load() || size <= 0 || size > 0xffff {
+		return false
+	}
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level, h.Type = solUDP, udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[syscall.CmsgLen(0):], uint16(size))
+	_, _, err := conn.WriteMsgUDP(buf, oob, addr)
+	if err == nil {
+		return true
+	}
+	// EIO: no checksum offload on the route; EINVAL: segment exceeds the
+	// path MTU; ENOPROTOOPT: a kernel before 4.18
+	var errno syscall.Errno
+	if errors.As(err, &errno) && (errno == syscall.EIO || errno == syscall.EINVAL || errno == syscall.ENOPROTOOPT || errno == syscall.EOPNOTSUPP) {
+		gsoUnsupported.Store(true)
+	}
+	return false
+}
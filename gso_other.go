@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// enableGRO is unsupported; datagrams always arrive one at a time
+func enableGRO(conn *net.UDPConn) bool {
+	return false
+}
+
+// groSegment never finds glued datagrams here
+func groSegment(oob []byte) int {
+	return 0
+}
+
+// sendSegmented is unsupported; the caller sends the datagrams itself
+func sendSegmented(conn *net.UDPConn, addr *net.UDPAddr, buf []byte, size int) bool {
+	return false
+}
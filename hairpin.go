@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+)
+
+// HairpinResult is the outcome of sending to our own public mapping
+type HairpinResult struct {
+	Supported bool `json:"supported"`
+	// Source is where the looped packet appeared to come from; RFC 4787
+	// REQ-9 wants the sender's public mapping, not its private address
+	Source   string `json:"source,omitempty"`
+	External bool   `json:"external_source"`
+	Error    string `json:"error,omitempty"`
+}
+
+// probeHairpin maps two sockets through server, then sends from one to the
+// other's public address. Only a hairpinning NAT loops it back inside.
+func probeHairpin(server *net.UDPAddr, env *probeEnv, timeout time.Duration) HairpinResult {
+	var result HairpinResult
+	fail := func(err error) HairpinResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	a, _, err := env.listenLocal()
+	if err != nil {
+		return fail(err)
+	}
+	defer a.Close()
+	b, _, err := env.listenLocal()
+	if err != nil {
+		return fail(err)
+	}
+	defer b.Close()
+
+	ma, err := env.makeStunRequest(a, server, nil, timeout, true, 0)
+	if err != nil {
+		return fail(err)
+	}
+	mb, err := env.makeStunRequest(b, server, nil, timeout, true, 0)
+	if err != nil {
+		return fail(err)
+	}
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	target := net.UDPAddrFromAddrPort(mb.AddrPort())
+	for i := 0; i < 3; i++ {
+		a.WriteToUDP(nonce, target)
+	}
+
+	buf := make([]byte, 64)
+	b.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, from, err := b.ReadFromUDP(buf)
+		if err != nil {
+			result.Error = "no packet looped back"
+			return result
+		}
+		if string(buf[:n]) == string(nonce) {
+			result.Supported = true
+			result.Source = from.String()
+			result.External = from.IP.Equal(net.IP(ma.IP.AsSlice())) && from.Port == ma.Port
+			return result
+		}
+	}
+}
+
+// describeHairpin renders the hairpin outcome
+func describeHairpin(h *HairpinResult) string {
+	switch {
+	case !h.Supported:
+		return "not supported (" + h.Error + ")"
+	case h.External:
+		return "supported, source rewritten to the public mapping " + h.Source
+	}
+	return "supported, but the source is the private address " + h.Source
+}
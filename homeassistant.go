@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// haSensor describes one Home Assistant sensor derived from the state topic
+type haSensor struct {
+	ObjectID string
+	Name     string
+	Template string
+	Icon     string
+}
+
+// haSensors are the entities announced through MQTT discovery
+var haSensors = []haSensor{
+	{ObjectID: "nat_type", Name: "NAT type", Template: "{{ value_json.type }}", Icon: "mdi:router-network"},
+	{ObjectID: "public_ip", Name: "Public IP", Template: "{{ value_json.public.ip if value_json.public is defined else 'unknown' }}", Icon: "mdi:ip-network"},
+	{ObjectID: "public_port", Name: "Public port", Template: "{{ value_json.public.port if value_json.public is defined else 'unknown' }}", Icon: "mdi:numeric"},
+	{ObjectID: "mapping", Name: "NAT mapping", Template: "{{ value_json.mapping }}", Icon: "mdi:swap-horizontal"},
+	{ObjectID: "filtering", Name: "NAT filtering", Template: "{{ value_json.filtering }}", Icon: "mdi:filter"},
+	{ObjectID: "confidence", Name: "NAT confidence", Template: "{{ value_json.confidence }}", Icon: "mdi:check-decagram"},
+}
+
+// haNodeID turns a client ID into a discovery-safe node ID
+func haNodeID(clientID string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(clientID) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// homeAssistantDiscovery builds the retained config messages that make Home
+// Assistant create sensors reading from the watch state topic. Sensors expire
+// after expireAfter so a stopped watcher shows up as unavailable.
+func homeAssistantDiscovery(prefix, stateTopic, nodeID string, expireAfter time.Duration) []mqttMessage {
+	device := map[string]interface{}{
+		"identifiers":  []string{nodeID},
+		"name":         "nat-info " + nodeID,
+		"manufacturer": "nat-info",
+		"sw_version":   version,
+	}
+
+	msgs := make([]mqttMessage, 0, len(haSensors))
+	for _, sensor := range haSensors {
+		config := map[string]interface{}{
+			"name":           sensor.Name,
+			"unique_id":      nodeID + "_" + sensor.ObjectID,
+			"state_topic":    stateTopic,
+			"value_template": sensor.Template,
+			"icon":           sensor.Icon,
+			"device":         device,
+		}
+		if expireAfter > 0 {
+			config["expire_after"] = int(expireAfter / time.Second)
+		}
+
+		payload, _ := json.Marshal(config)
+		msgs = append(msgs, mqttMessage{
+			Topic:   prefix + "/sensor/" + nodeID + "/" + sensor.ObjectID + "/config",
+			Payload: payload,
+			Retain:  true,
+		})
+	}
+	return msgs
+}
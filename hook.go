@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HookTimeout bounds a single --on-change or --on-complete command, which
+// watch waits for before the next run
+const HookTimeout = time.Minute
+
+// Hook events, passed to the command as NATINFO_EVENT
+const (
+	HookChange   = "change"
+	HookComplete = "complete"
+)
+
+// hookSink runs a user's shell command after detection with the event as
+// JSON on stdin and its main fields in NATINFO_* environment variables
+type hookSink struct {
+	command     string
+	changesOnly bool
+}
+
+func (h *hookSink) handle(ev WatchEvent) {
+	if h.changesOnly && !ev.Changed {
+		return
+	}
+	if err := h.run(ev); err != nil {
+		printProgress("Hook " + strconv.Quote(h.command) + " failed: " + err.Error())
+	}
+}
+
+// run executes the command through the shell, so hooks may use pipes and
+// quoting like a crontab line. Its output goes to stderr, keeping stdout
+// for results.
+func (h *hookSink) run(ev WatchEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	}
+	event := HookComplete
+	if h.changesOnly {
+		event = HookChange
+	}
+	cmd.Env = append(os.Environ(), hookEnv(event, ev)...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return errors.New("still running after " + HookTimeout.String())
+	}
+	return err
+}
+
+// hookEnv renders an event as NATINFO_* variables, using the JSON codes
+// for NAT type and behaviors; fields that were not measured are empty.
+// None may share a name with a flag's variable, or a hook that runs
+// nat-info would configure it.
+func hookEnv(event string, ev WatchEvent) []string {
+	vars := map[string]string{
+		"EVENT":   event,
+		"TIME":    ev.Time.Format(time.RFC3339),
+		"ERROR":   ev.Error,
+		"CHANGED": "no",
+		"CHANGES": strings.Join(ev.Changes, ","),
+	}
+	if ev.Changed {
+		vars["CHANGED"] = "yes"
+	}
+	if r := ev.Result; r != nil {
+		vars["TYPE"] = natTypeCodes[r.Type]
+		vars["MAPPING"] = behaviorCodes[r.Mapping]
+		vars["FILTERING"] = behaviorCodes[r.Filtering]
+		vars["CONFIDENCE"] = r.Confidence.String()
+		vars["LOCAL_IP"] = r.LocalIP
+		vars["PUBLIC_IP"] = publicIP(r)
+		if r.Public != nil {
+			vars["PUBLIC_PORT"] = strconv.Itoa(r.Public.Port)
+		}
+		vars["SHARE_CODE"] = r.ShareCode
+		if r.Policy != nil {
+			vars["POLICY_VERDICT"] = r.Policy.Verdict
+		}
+	}
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, EnvPrefix+name+"="+value)
+	}
+	return env
+}
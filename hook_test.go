@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flagEnvNames returns the environment variable of every flag of every
+// command, read from their --help output
+func flagEnvNames(t *testing.T) map[string]string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	done := make(chan map[string]string)
+	go func() {
+		names := make(map[string]string)
+		scanner := bufio.NewScanner(r)
+		command := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if rest, ok := strings.CutPrefix(line, "Usage: nat-info "); ok {
+				command, _, _ = strings.Cut(rest, " ")
+			}
+			if rest, ok := strings.CutPrefix(line, "  -"); ok {
+				name, _, _ := strings.Cut(rest, " ")
+				names[envName(name)] = command + " --" + name
+			}
+		}
+		done <- names
+	}()
+	for _, cmd := range commands {
+		if cmd.Name != "version" {
+			cmd.Run([]string{"-h"})
+		}
+	}
+	os.Stdout, os.Stderr = stdout, stderr
+	w.Close()
+	names := <-done
+	io.Copy(io.Discard, r)
+	return names
+}
+
+func TestHookEnvAvoidsFlagVariables(t *testing.T) {
+	flags := flagEnvNames(t)
+	if _, ok := flags["NATINFO_POLICY"]; !ok {
+		t.Fatal("--policy missing from the help output; the test reads the wrong thing")
+	}
+	ev := WatchEvent{
+		Time:    time.Now(),
+		Changed: true,
+		Result: &NatResult{
+			Public: &StunResult{IP: netip.MustParseAddr("203.0.113.7"), Port: 41000},
+			Policy: &PolicyVerdict{Verdict: "pass"},
+		},
+	}
+	for _, v := range hookEnv(HookComplete, ev) {
+		name, _, _ := strings.Cut(v, "=")
+		if flag, ok := flags[name]; ok {
+			t.Errorf("hook variable %s is also the variable of %s", name, flag)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+)
+
+// fingerprintXor is XORed into the FINGERPRINT CRC (RFC 5389 section 15.5)
+const fingerprintXor = 0x5354554e
+
+// iceChars are the characters allowed in ice-ufrag and ice-pwd
+const iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+
+// randomICEString returns n random ice-char characters
+func randomICEString(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	for i, b := range buf {
+		buf[i] = iceChars[int(b)%len(iceChars)]
+	}
+	return string(buf)
+}
+
+// encodeStunMessage builds an RFC 5389 message with the given 12-byte
+// transaction ID and attributes
+func encodeStunMessage(msgType uint16, tid []byte, attributes []Attribute) []byte {
+	msg := appendStunHeader(make([]byte, 0, 256), msgType, tid)
+	for _, attr := range attributes {
+		msg = appendAttribute(msg, attr.Type, attr.Value)
+	}
+	return msg
+}
+
+// appendStunHeader appends an attribute-less RFC 5389 header to dst, so hot
+// paths can encode into a reused buffer
+func appendStunHeader(dst []byte, msgType uint16, tid []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, msgType)
+	dst = binary.BigEndian.AppendUint16(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, MagicCookie)
+	return append(dst, tid[:12]...)
+}
+
+// appendAttribute appends a padded attribute and updates the header length
+func appendAttribute(msg []byte, attrType uint16, value []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, attrType)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-HeaderLength))
+	return msg
+}
+
+// messageIntegrity computes the HMAC-SHA1 over msg with its length field
+// already covering the 24-byte MESSAGE-INTEGRITY attribute. The length is
+// patched in place and restored rather than hashing a copy.
+func messageIntegrity(msg, key []byte) []byte {
+	length := binary.BigEndian.Uint16(msg[2:4])
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-HeaderLength+24))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	binary.BigEndian.PutUint16(msg[2:4], length)
+	return mac.Sum(nil)
+}
+
+// appendIntegrity appends MESSAGE-INTEGRITY keyed with a short-term password
+func appendIntegrity(msg, key []byte) []byte {
+	return appendAttribute(msg, AttrMessageIntegrity, messageIntegrity(msg, key))
+}
+
+// appendFingerprint appends the FINGERPRINT attribute
+func appendFingerprint(msg []byte) []byte {
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)-HeaderLength+8))
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(msg)^fingerprintXor)
+	return appendAttribute(msg, AttrFingerprint, crc[:])
+}
+
+// verifyIntegrity checks the MESSAGE-INTEGRITY attribute of a raw message.
+// Attributes after it (normally FINGERPRINT) are not covered.
+func verifyIntegrity(buffer, key []byte) bool {
+	if len(buffer) < HeaderLength {
+		return false
+	}
+	limit := HeaderLength + int(binary.BigEndian.Uint16(buffer[2:4]))
+	if limit > len(buffer) {
+		return false
+	}
+
+	offset := HeaderLength
+	for offset+4 <= limit {
+		attrType := binary.BigEndian.Uint16(buffer[offset : offset+2])
+		attrLen := int(binary.BigEndian.Uint16(buffer[offset+2 : offset+4]))
+		if attrType == AttrMessageIntegrity {
+			if attrLen != 20 || offset+24 > limit {
+				return false
+			}
+			return hmac.Equal(messageIntegrity(buffer[:offset], key), buffer[offset+4:offset+24])
+		}
+		offset += 4 + (attrLen+3)&^3
+	}
+	return false
+}
+
+// appendXorAddress appends an XOR-MAPPED-ADDRESS value for addr to dst. An
+// IPv6 address is XORed with the cookie followed by tid, the 12-byte
+// transaction ID of the message it goes in.
+func appendXorAddress(dst []byte, addr *net.UDPAddr, tid []byte) []byte {
+	port := uint16(addr.Port) ^ uint16(MagicCookie>>16)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		dst = append(dst, 0, FamilyIPv4)
+		dst = binary.BigEndian.AppendUint16(dst, port)
+		return binary.BigEndian.AppendUint32(dst, binary.BigEndian.Uint32(ip4)^MagicCookie)
+	}
+	dst = append(dst, 0, FamilyIPv6)
+	dst = binary.BigEndian.AppendUint16(dst, port)
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], MagicCookie)
+	copy(key[4:], tid)
+	ip := addr.IP.To16()
+	for i := 0; i < 16; i++ {
+		dst = append(dst, ip[i]^key[i])
+	}
+	return dst
+}
+
+// errorCodeValue encodes an ERROR-CODE value
+func errorCodeValue(code int, reason string) []byte {
+	v := []byte{0, 0, byte(code / 100), byte(code % 100)}
+	return append(v, reason...)
+}
+
+// findAttribute returns the value of the first attribute of the given type
+func findAttribute(msg *StunMessage, attrType uint16) ([]byte, bool) {
+	for _, attr := range msg.Attributes {
+		if attr.Type == attrType {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
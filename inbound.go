@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inboundMapLifetime is how long the test mappings are asked for; they are
+// deleted as soon as the reachability check is done
+const inboundMapLifetime = 2 * time.Minute
+
+// InboundPort is one port an application needs reachable from outside
+type InboundPort struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	// InUse is set when a local program, likely the application itself, already
+	// holds the port, so nat-info did not listen on it
+	InUse   bool         `json:"in_use"`
+	Mapping *PortMapping `json:"mapping,omitempty"`
+	// State is what the responder found from outside
+	State string `json:"state,omitempty"`
+}
+
+// String renders the port as protocol/port
+func (p InboundPort) String() string {
+	return p.Protocol + "/" + strconv.Itoa(p.Port)
+}
+
+// parseInboundPorts reads comma-separated ports for one protocol
+func parseInboundPorts(protocol, list string) ([]InboundPort, error) {
+	var ports []InboundPort
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := parseScanPort(protocol + "/" + s)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, InboundPort{Protocol: p.Protocol, Port: p.Port})
+	}
+	return ports, nil
+}
+
+// listenInbound holds each port the way a server would, so a check from
+// outside finds a listener: TCP connections are accepted and closed and
+// UDP datagrams echoed. Ports another program holds are marked in use.
+func listenInbound(ports []InboundPort) func() {
+	var closers []func() error
+	for i := range ports {
+		p := &ports[i]
+		addr := ":" + strconv.Itoa(p.Port)
+		if p.Protocol == "tcp" {
+			ln, err := net.Listen("tcp4", addr)
+			if err != nil {
+				p.InUse = true
+				continue
+			}
+			closers = append(closers, ln.Close)
+			go func() {
+				for {
+					c, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					c.Close()
+				}
+			}()
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: p.Port})
+		if err != nil {
+			p.InUse = true
+			continue
+		}
+		closers = append(closers, conn.Close)
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, from, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteToUDP(buf[:n], from)
+			}
+		}()
+	}
+	return func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+}
+
+// openInbound maps ports through the gateway with the first protocol that
+// works and, given a responder, listens on them and has the responder
+// connect from outside while they are mapped. The mappings are removed
+// before it returns; the scan error, if any, is returned with the check.
+func openInbound(env *probeEnv, ports []InboundPort, gateway net.IP, order []string, responder string, timeout time.Duration) (PortMapCheck, string) {
+	pm := checkPortMapping(env, gateway, order, timeout)
+	if mapper := newPortMapper(env, pm, gateway, timeout); mapper != nil {
+		for i := range ports {
+			p := &ports[i]
+			m := mapper.add(p.Protocol, p.Port, inboundMapLifetime)
+			p.Mapping = &m
+			defer mapper.remove(m)
+		}
+	}
+	if responder == "" {
+		return pm, ""
+	}
+
+	stop := listenInbound(ports)
+	defer stop()
+	scan := make([]ScanPort, len(ports))
+	for i, p := range ports {
+		scan[i] = ScanPort{Protocol: p.Protocol, Port: p.Port}
+		// Mappings that got another external port are checked there
+		if p.Mapping != nil && p.Mapping.Error == "" && p.Mapping.External != 0 {
+			scan[i].Port = p.Mapping.External
+		}
+	}
+	printProgress("Checking the ports from outside via " + responder + "...")
+	result := probeScan(responder, env, scan, timeout)
+	if result.Error != "" {
+		return pm, result.Error
+	}
+	for i := range ports {
+		ports[i].State = result.Ports[i].State
+	}
+	return pm, ""
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxTimeout bounds a single write to an InfluxDB HTTP endpoint
+const InfluxTimeout = 10 * time.Second
+
+// Line protocol escaping for measurement names, tag keys/values and string fields
+var (
+	influxTagEscaper    = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// influxLines renders a watch event as InfluxDB line protocol: one nat_info
+// point for the run and one nat_info_rtt point per completed transaction
+func influxLines(ev WatchEvent) []string {
+	ts := strconv.FormatInt(ev.Time.UnixNano(), 10)
+
+	if ev.Result == nil {
+		return []string{"nat_info,nat_type=error error=\"" + influxStringEscaper.Replace(ev.Error) + "\" " + ts}
+	}
+
+	r := ev.Result
+	tags := "nat_info" +
+		",nat_type=" + influxTag(natTypeCodes[r.Type]) +
+		",mapping=" + influxTag(behaviorCodes[r.Mapping]) +
+		",filtering=" + influxTag(behaviorCodes[r.Filtering]) +
+		",confidence=" + influxTag(r.Confidence.String())
+
+	fields := []string{
+		"local_port=" + strconv.Itoa(r.LocalPort) + "i",
+		"changed=" + strconv.FormatBool(ev.Changed),
+	}
+	if r.Public != nil {
+		fields = append(fields,
+			"public_ip=\""+influxStringEscaper.Replace(r.Public.IP.String())+"\"",
+			"public_port="+strconv.Itoa(r.Public.Port)+"i",
+			"port_preserved="+strconv.FormatBool(r.Public.Port == r.LocalPort))
+	}
+
+	lines := []string{tags + " " + strings.Join(fields, ",") + " " + ts}
+
+	for _, e := range r.Evidence {
+		line := "nat_info_rtt" +
+			",server=" + influxTag(e.Server) +
+			",addr=" + influxTag(e.Addr) +
+			",test=" + influxTag(string(e.Test)) +
+			" passed=" + strconv.FormatBool(e.Passed)
+		if e.Passed {
+			line += ",rtt_ms=" + strconv.FormatFloat(float64(e.RTT)/float64(time.Millisecond), 'f', 3, 64)
+		}
+		lines = append(lines, line+" "+ts)
+	}
+	return lines
+}
+
+// influxTag escapes a tag value, substituting a placeholder for empty values
+// since line protocol does not allow them
+func influxTag(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return influxTagEscaper.Replace(s)
+}
+
+// influxSink appends line protocol to a file and/or POSTs it to an InfluxDB
+// write endpoint (v1 /write?db=... or v2 /api/v2/write?org=...&bucket=...)
+type influxSink struct {
+	file   io.Writer
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newInfluxSink opens the sink's file in append mode if a path is given
+func newInfluxSink(path, url, token string) (*influxSink, error) {
+	sink := &influxSink{url: url, token: token, client: http.DefaultClient}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		sink.file = f
+	}
+	return sink, nil
+}
+
+func (s *influxSink) handle(ev WatchEvent) {
+	body := strings.Join(influxLines(ev), "\n") + "\n"
+
+	if s.file != nil {
+		if _, err := io.WriteString(s.file, body); err != nil {
+			printProgress("InfluxDB file write failed: " + err.Error())
+		}
+	}
+
+	if s.url != "" {
+		if err := s.post(body); err != nil {
+			printProgress("InfluxDB write failed: " + err.Error())
+		}
+	}
+}
+
+func (s *influxSink) post(body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), InfluxTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
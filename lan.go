@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LAN discovery targets
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	ssdpGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+	// lanPeerGroup is where `lan --answer` listens; beacons sent to the
+	// segment's broadcast address use the same port
+	lanPeerGroup = &net.UDPAddr{IP: net.IPv4(239, 255, 78, 73), Port: 5391}
+)
+
+// Beacons between `nat-info lan` and a peer running `lan --answer`: the
+// magic, the delivery ('m' or 'b') and an 8-byte nonce, echoed back with
+// the peer's hostname
+var (
+	lanBeaconMagic = []byte("NATINFO-LAN?")
+	lanReplyMagic  = []byte("NATINFO-LAN!")
+)
+
+const lanBeaconLen = 12 + 1 + 8
+
+// lanPeerProbe names the probes answered by `lan --answer`
+const lanPeerProbe = "nat-info peer"
+
+// How a LAN probe was delivered
+const (
+	LANMulticast = "multicast"
+	LANBroadcast = "broadcast"
+)
+
+// LANProbe is one discovery query and the hosts that answered it
+type LANProbe struct {
+	Name       string   `json:"name"`
+	Delivery   string   `json:"delivery"`
+	Target     string   `json:"target"`
+	Responders []string `json:"responders"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// LANCheck reports whether multicast and broadcast discovery reach other
+// hosts on the local segment. Silence cannot tell an empty segment from
+// one that isolates its clients; a peer running `lan --answer` can.
+type LANCheck struct {
+	Interface         string     `json:"interface,omitempty"`
+	LocalIP           string     `json:"local_ip"`
+	BroadcastAddr     string     `json:"broadcast_address,omitempty"`
+	Probes            []LANProbe `json:"probes"`
+	MulticastAnswered bool       `json:"multicast_answered"`
+	BroadcastAnswered bool       `json:"broadcast_answered"`
+	PeerMulticast     bool       `json:"peer_multicast"`
+	PeerBroadcast     bool       `json:"peer_broadcast"`
+	PeerAnswered      bool       `json:"peer_answered"`
+}
+
+// lanQuery is a discovery request and how to recognize answers to it
+type lanQuery struct {
+	name     string
+	delivery string
+	target   *net.UDPAddr
+	payload  []byte
+	// match returns the responder's label, or "" for an unrelated packet
+	match func(from *net.UDPAddr, buf []byte) string
+}
+
+// lanSegment returns the interface carrying env's interface address, or
+// the default route's when none is set, with its IPv4 network
+func lanSegment(env *probeEnv) (string, *net.IPNet, error) {
+	var want net.IP
+	if env.iface != "" {
+		ip, err := interfaceIPv4(env.iface)
+		if err != nil {
+			return "", nil, err
+		}
+		want = ip
+	} else {
+		ip, _ := env.localIP()
+		want = net.ParseIP(ip)
+	}
+	return segmentOf(want)
+}
+
+// segmentOf returns the interface holding ip and its IPv4 network
+func segmentOf(want net.IP) (string, *net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(want) && n.IP.To4() != nil {
+				return ifi.Name, &net.IPNet{IP: n.IP.To4(), Mask: n.Mask}, nil
+			}
+		}
+	}
+	return "", nil, errors.New("no LAN interface holds " + want.String())
+}
+
+// directedBroadcast returns the broadcast address of an IPv4 network
+func directedBroadcast(n *net.IPNet) net.IP {
+	mask := n.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	b := make(net.IP, net.IPv4len)
+	for i := range b {
+		b[i] = n.IP[i] | ^mask[i]
+	}
+	return b
+}
+
+// ownAddresses lists this host's addresses, whose answers (from its own
+// mDNS responder, say) say nothing about the segment
+func ownAddresses() map[string]bool {
+	own := make(map[string]bool)
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			own[n.IP.String()] = true
+		}
+	}
+	return own
+}
+
+// checkLAN sends the discovery queries from the segment's address and
+// collects answers for timeout
+func checkLAN(env *probeEnv, timeout time.Duration) (LANCheck, error) {
+	name, segment, err := lanSegment(env)
+	if err != nil {
+		return LANCheck{}, err
+	}
+	check := LANCheck{Interface: name, LocalIP: segment.IP.String()}
+	broadcast := directedBroadcast(segment)
+	if !broadcast.Equal(segment.IP) {
+		check.BroadcastAddr = broadcast.String()
+	}
+
+	queries := []lanQuery{mdnsQuery(), ssdpQuery(LANMulticast, ssdpGroup)}
+	queries = append(queries, peerQuery(LANMulticast, lanPeerGroup))
+	if check.BroadcastAddr != "" {
+		queries = append(queries,
+			ssdpQuery(LANBroadcast, &net.UDPAddr{IP: broadcast, Port: ssdpGroup.Port}),
+			peerQuery(LANBroadcast, &net.UDPAddr{IP: broadcast, Port: lanPeerGroup.Port}))
+	}
+
+	own := ownAddresses()
+	check.Probes = make([]LANProbe, len(queries))
+	var wg sync.WaitGroup
+	for i, q := range queries {
+		wg.Add(1)
+		go func(i int, q lanQuery) {
+			defer wg.Done()
+			check.Probes[i] = runLANQuery(env, segment.IP, q, own, timeout)
+		}(i, q)
+	}
+	wg.Wait()
+
+	for _, p := range check.Probes {
+		if len(p.Responders) == 0 {
+			continue
+		}
+		switch p.Delivery {
+		case LANMulticast:
+			check.MulticastAnswered = true
+		case LANBroadcast:
+			check.BroadcastAnswered = true
+		}
+		if p.Name == lanPeerProbe {
+			check.PeerAnswered = true
+			if p.Delivery == LANMulticast {
+				check.PeerMulticast = true
+			} else {
+				check.PeerBroadcast = true
+			}
+		}
+	}
+	return check, nil
+}
+
+// runLANQuery sends q twice, since a single datagram on Wi-Fi is easily
+// lost, and gathers the distinct responders
+func runLANQuery(env *probeEnv, local net.IP, q lanQuery, own map[string]bool, timeout time.Duration) LANProbe {
+	probe := LANProbe{Name: q.name, Delivery: q.delivery, Target: q.target.String(), Responders: []string{}}
+	// Binding the source address steers multicast and broadcast out of
+	// that interface on Linux, without IP_MULTICAST_IF
+	conn, err := env.listenUDP(&net.UDPAddr{IP: local})
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(q.payload, q.target); err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	resend := time.Now().Add(250 * time.Millisecond)
+	deadline := time.Now().Add(timeout)
+
+	seen := make(map[string]bool)
+	buf := make([]byte, 9000)
+	for {
+		wait := deadline
+		if !resend.IsZero() && resend.Before(wait) {
+			wait = resend
+		}
+		conn.SetReadDeadline(wait)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				probe.Error = err.Error()
+				break
+			}
+			if resend.IsZero() {
+				break
+			}
+			conn.WriteToUDP(q.payload, q.target)
+			resend = time.Time{}
+			continue
+		}
+		if own[from.IP.String()] {
+			continue
+		}
+		if label := q.match(from, buf[:n]); label != "" && !seen[label] {
+			seen[label] = true
+			probe.Responders = append(probe.Responders, label)
+		}
+	}
+	sort.Strings(probe.Responders)
+	return probe
+}
+
+// mdnsQuery asks for the DNS-SD service types on the link. The random
+// source port makes it a legacy unicast query (RFC 6762 section 6.7),
+// which responders answer directly instead of to the group.
+func mdnsQuery() lanQuery {
+	var id [2]byte
+	rand.Read(id[:])
+	msg := append(id[:], 0, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range []string{"_services", "_dns-sd", "_udp", "local"} {
+		msg = append(append(msg, byte(len(label))), label...)
+	}
+	msg = append(msg, 0, 0, 12, 0, 1) // PTR, IN
+
+	return lanQuery{
+		name:     "mDNS",
+		delivery: LANMulticast,
+		target:   mdnsGroup,
+		payload:  msg,
+		match: func(from *net.UDPAddr, buf []byte) string {
+			if from.Port != mdnsGroup.Port || len(buf) < 12 || !bytes.Equal(buf[:2], id[:]) || buf[2]&0x80 == 0 {
+				return ""
+			}
+			return from.IP.String()
+		},
+	}
+}
+
+// ssdpQuery searches for every UPnP device and service
+func ssdpQuery(delivery string, target *net.UDPAddr) lanQuery {
+	msg := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpGroup.String() + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n" +
+		"ST: ssdp:all\r\n\r\n"
+	return lanQuery{
+		name:     "SSDP",
+		delivery: delivery,
+		target:   target,
+		payload:  []byte(msg),
+		match: func(from *net.UDPAddr, buf []byte) string {
+			if !bytes.HasPrefix(buf, []byte("HTTP/1.1 200")) {
+				return ""
+			}
+			return from.IP.String()
+		},
+	}
+}
+
+// peerQuery is a beacon for other hosts running `lan --answer`
+func peerQuery(delivery string, target *net.UDPAddr) lanQuery {
+	beacon := make([]byte, 0, lanBeaconLen)
+	beacon = append(beacon, lanBeaconMagic...)
+	beacon = append(beacon, delivery[0])
+	var nonce [8]byte
+	rand.Read(nonce[:])
+	beacon = append(beacon, nonce[:]...)
+
+	return lanQuery{
+		name:     lanPeerProbe,
+		delivery: delivery,
+		target:   target,
+		payload:  beacon,
+		match: func(from *net.UDPAddr, buf []byte) string {
+			if len(buf) < lanBeaconLen || !bytes.HasPrefix(buf, lanReplyMagic) || !bytes.Equal(buf[12:lanBeaconLen], beacon[12:]) {
+				return ""
+			}
+			label := from.IP.String()
+			if host := buf[lanBeaconLen:]; len(host) > 0 {
+				label += " (" + string(host) + ")"
+			}
+			return label
+		},
+	}
+}
+
+// answerLAN answers beacons from `nat-info lan` on other hosts until stop
+// closes, calling onBeacon for each one
+func answerLAN(iface string, stop <-chan struct{}, onBeacon func(from *net.UDPAddr, delivery string)) error {
+	var ifi *net.Interface
+	if iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(iface); err != nil {
+			return err
+		}
+	}
+	// Bound to the wildcard address, so beacons to the broadcast address
+	// on the same port arrive here too
+	conn, err := net.ListenMulticastUDP("udp4", ifi, lanPeerGroup)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stop
+		conn.Close()
+	}()
+
+	hostname, _ := os.Hostname()
+	if len(hostname) > 64 {
+		hostname = hostname[:64]
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		if n != lanBeaconLen || !bytes.HasPrefix(buf, lanBeaconMagic) {
+			continue
+		}
+		reply := append(append([]byte{}, lanReplyMagic...), buf[12:lanBeaconLen]...)
+		reply = append(reply, hostname...)
+		conn.WriteToUDP(reply, from)
+
+		delivery := LANMulticast
+		if buf[12] == LANBroadcast[0] {
+			delivery = LANBroadcast
+		}
+		onBeacon(from, delivery)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency-under-load sampling
+const (
+	pingInterval = 100 * time.Millisecond
+	pingTimeout  = time.Second
+	idleDuration = 600 * time.Millisecond
+)
+
+// LoadLatency compares STUN round trips on an idle link with those measured
+// while the bandwidth trains keep it busy
+type LoadLatency struct {
+	Server  string        `json:"server"`
+	Idle    time.Duration `json:"idle_rtt"`
+	Up      time.Duration `json:"upload_rtt,omitempty"`
+	Down    time.Duration `json:"download_rtt,omitempty"`
+	Lost    int           `json:"lost_pings"`
+	Grade   string        `json:"grade"`
+	Samples int           `json:"samples"`
+}
+
+// bufferbloatGrades maps the worst added latency to a letter grade
+var bufferbloatGrades = []struct {
+	limit time.Duration
+	grade string
+}{
+	{5 * time.Millisecond, "A+"},
+	{30 * time.Millisecond, "A"},
+	{60 * time.Millisecond, "B"},
+	{200 * time.Millisecond, "C"},
+	{400 * time.Millisecond, "D"},
+}
+
+// bufferbloatGrade grades the latency added under load
+func bufferbloatGrade(added time.Duration) string {
+	for _, g := range bufferbloatGrades {
+		if added < g.limit {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+// latencyPinger sends low-rate STUN binding requests from its own socket and
+// files each RTT under the load phase that was current when it was sent
+type latencyPinger struct {
+	env    *probeEnv
+	conn   *net.UDPConn
+	server StunEndpoint
+
+	mu      sync.Mutex
+	phase   string
+	samples map[string][]time.Duration
+	lost    int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startPinger(server StunEndpoint, env *probeEnv) (*latencyPinger, error) {
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	p := &latencyPinger{
+		env:     env,
+		conn:    conn,
+		server:  server,
+		phase:   "idle",
+		samples: make(map[string][]time.Duration),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *latencyPinger) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		p.mu.Lock()
+		phase := p.phase
+		p.mu.Unlock()
+
+		res, err := p.env.makeStunRequest(p.conn, p.server.Addr, nil, pingTimeout, true, 0)
+		p.mu.Lock()
+		if err != nil {
+			p.lost++
+		} else {
+			p.samples[phase] = append(p.samples[phase], res.RTT)
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setPhase labels the samples taken from now on
+func (p *latencyPinger) setPhase(phase string) {
+	p.mu.Lock()
+	p.phase = phase
+	p.mu.Unlock()
+}
+
+// finish stops pinging and summarizes the samples
+func (p *latencyPinger) finish() *LoadLatency {
+	close(p.stop)
+	<-p.done
+	p.conn.Close()
+
+	l := &LoadLatency{
+		Server: p.server.Host,
+		Idle:   medianDuration(p.samples["idle"]),
+		Up:     medianDuration(p.samples["up"]),
+		Down:   medianDuration(p.samples["down"]),
+		Lost:   p.lost,
+	}
+	for _, s := range p.samples {
+		l.Samples += len(s)
+	}
+
+	worst := l.Up
+	if l.Down > worst {
+		worst = l.Down
+	}
+	added := worst - l.Idle
+	if added < 0 {
+		added = 0
+	}
+	l.Grade = bufferbloatGrade(added)
+	return l
+}
+
+// medianDuration returns the median of ds, or 0 when empty
+func medianDuration(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), ds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
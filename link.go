@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Access network kinds
+const (
+	LinkWiFi     = "wifi"
+	LinkCellular = "cellular"
+)
+
+// LinkInfo identifies the access network a result was measured on. NAT
+// behavior reports are only comparable when tied to a specific Wi-Fi
+// network or mobile carrier.
+type LinkInfo struct {
+	Kind      string `json:"kind"`
+	Interface string `json:"interface,omitempty"`
+	SSID      string `json:"ssid,omitempty"`
+	BSSID     string `json:"bssid,omitempty"`
+	Carrier   string `json:"carrier,omitempty"`
+	APN       string `json:"apn,omitempty"`
+	// Technology is the radio access technology, e.g. lte or 5gnr
+	Technology string `json:"technology,omitempty"`
+}
+
+// captureLink asks the platform tools about iface. It returns nil for
+// wired interfaces and wherever the tools are missing or stay silent;
+// recent macOS versions, for one, hide the SSID without location access.
+func captureLink(iface string) *LinkInfo {
+	if iface == "" {
+		return nil
+	}
+	var info *LinkInfo
+	switch runtime.GOOS {
+	case "linux":
+		info = linuxLink(iface)
+	case "darwin":
+		info = macLink(iface)
+	case "windows":
+		info = windowsLink(iface)
+	}
+	if info != nil {
+		info.Interface = iface
+	}
+	return info
+}
+
+// linuxLink reads the device type from sysfs, so iw and ModemManager are
+// only run for wireless and WWAN interfaces
+func linuxLink(iface string) *LinkInfo {
+	uevent, err := os.ReadFile("/sys/class/net/" + iface + "/uevent")
+	if err != nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(string(uevent), "DEVTYPE=wlan"):
+		// Connected to 00:11:22:33:44:55 (on wlan0)
+		//	SSID: home
+		out := runQuiet("iw", "dev", iface, "link")
+		info := &LinkInfo{Kind: LinkWiFi}
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimSpace(line)
+			if rest, ok := strings.CutPrefix(line, "Connected to "); ok {
+				info.BSSID, _, _ = strings.Cut(rest, " ")
+			} else if ssid, ok := strings.CutPrefix(line, "SSID: "); ok {
+				info.SSID = ssid
+			}
+		}
+		return info
+	case strings.Contains(string(uevent), "DEVTYPE=wwan") || strings.HasPrefix(iface, "wwan"):
+		info := &LinkInfo{Kind: LinkCellular}
+		modem := keyValues(runQuiet("mmcli", "-m", "any", "-K"))
+		info.Carrier = modem["modem.3gpp.operator-name"]
+		info.Technology = modem["modem.generic.access-technologies.value[1]"]
+		if bearer := modem["modem.generic.bearers.value[1]"]; bearer != "" {
+			info.APN = keyValues(runQuiet("mmcli", "-b", bearer, "-K"))["bearer.properties.apn"]
+		}
+		return info
+	}
+	return nil
+}
+
+// macLink only learns the SSID; networksetup reports no BSSID
+func macLink(iface string) *LinkInfo {
+	// Current Wi-Fi Network: home
+	out := strings.TrimSpace(runQuiet("networksetup", "-getairportnetwork", iface))
+	if ssid, ok := strings.CutPrefix(out, "Current Wi-Fi Network: "); ok {
+		return &LinkInfo{Kind: LinkWiFi, SSID: ssid}
+	}
+	return nil
+}
+
+// windowsLink finds iface among the WLAN interfaces netsh lists. Go names
+// Windows interfaces by their friendly name, which is netsh's Name field.
+func windowsLink(iface string) *LinkInfo {
+	out := runQuiet("netsh", "wlan", "show", "interfaces")
+	for _, block := range strings.Split(out, "\n\n") {
+		fields := keyValues(block)
+		if fields["Name"] != iface {
+			continue
+		}
+		return &LinkInfo{Kind: LinkWiFi, SSID: fields["SSID"], BSSID: fields["BSSID"]}
+	}
+	return nil
+}
+
+// keyValues parses "key : value" lines, as printed by mmcli -K and netsh
+func keyValues(out string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if value != "" && value != "--" {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// describe renders the link for the report
+func (l *LinkInfo) describe() string {
+	var parts []string
+	switch l.Kind {
+	case LinkWiFi:
+		if l.SSID != "" {
+			parts = append(parts, l.SSID)
+		}
+		if l.BSSID != "" {
+			parts = append(parts, "BSSID "+l.BSSID)
+		}
+	case LinkCellular:
+		for _, s := range []string{l.Carrier, l.Technology} {
+			if s != "" {
+				parts = append(parts, s)
+			}
+		}
+		if l.APN != "" {
+			parts = append(parts, "APN "+l.APN)
+		}
+	}
+	if len(parts) == 0 {
+		return "unknown network"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// LocalMapping is how the NAT maps one fixed local port, such as the port
+// an application is configured to use
+type LocalMapping struct {
+	Local int `json:"local"`
+	// Public is the mapping seen by the first server; Second by another
+	// server, when one answered
+	Public *StunResult `json:"public,omitempty"`
+	Second *StunResult `json:"second,omitempty"`
+	// Preserved is set when the public port equals the local one
+	Preserved bool `json:"preserved"`
+	// Consistent is set when both servers saw the same mapping, which is
+	// what lets an application advertise the address it learned by STUN
+	Consistent bool   `json:"consistent"`
+	Error      string `json:"error,omitempty"`
+}
+
+// bindPort is listenLocal for a given local port
+func (e *probeEnv) bindPort(port int) (*net.UDPConn, string, error) {
+	laddr := &net.UDPAddr{IP: net.IPv4zero, Port: port}
+	var localIP string
+	if e.iface != "" {
+		ip, err := interfaceIPv4(e.iface)
+		if err != nil {
+			return nil, "", err
+		}
+		laddr.IP = ip
+		localIP = ip.String()
+	} else {
+		ip, err := e.localIP()
+		if err != nil {
+			return nil, "", err
+		}
+		localIP = ip
+	}
+	conn, err := e.listenUDP(laddr)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, localIP, nil
+}
+
+// probeLocalMapping asks two servers for the mapping of conn's port
+func probeLocalMapping(env *probeEnv, conn *net.UDPConn, servers []StunEndpoint, timeout time.Duration) LocalMapping {
+	m := LocalMapping{Local: conn.LocalAddr().(*net.UDPAddr).Port}
+	for i, server := range servers {
+		res, err := env.makeStunRequest(conn, server.Addr, nil, timeout, true, 0)
+		if err == nil && !res.IP.IsValid() {
+			err = errors.New("answer carried no mapped address")
+		}
+		if err != nil {
+			if i == 0 {
+				m.Error = err.Error()
+				return m
+			}
+			continue
+		}
+		if m.Public == nil {
+			m.Public = res
+			m.Preserved = res.Port == m.Local
+			continue
+		}
+		m.Second = res
+		m.Consistent = res.IP == m.Public.IP && res.Port == m.Public.Port
+		break
+	}
+	return m
+}
+
+// mappingServers resolves the first two servers that answer to an address, on
+// different IPs when possible, so a mapping can be compared across them
+func mappingServers(opts DetectOptions) ([]StunEndpoint, error) {
+	var out []StunEndpoint
+	for _, server := range opts.Servers {
+		endpoints, err := resolveServer(server)
+		if err != nil {
+			continue
+		}
+		ep := endpoints[0]
+		if len(out) == 1 && out[0].Addr.IP.Equal(ep.Addr.IP) {
+			continue
+		}
+		out = append(out, ep)
+		if len(out) == 2 {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no STUN server could be resolved")
+	}
+	return out, nil
+}
+
+// describeLocalMapping renders a port's public mapping and how it behaves
+func describeLocalMapping(r *textReport, m LocalMapping) string {
+	if m.Public == nil {
+		return r.paint(ansiRed, "no answer: "+m.Error)
+	}
+	s := m.Public.AddrPort().String()
+	var notes []string
+	if m.Preserved {
+		notes = append(notes, "port kept")
+	} else {
+		notes = append(notes, "port rewritten")
+	}
+	if m.Second != nil && !m.Consistent {
+		notes = append(notes, r.paint(ansiYellow, "differs per destination"))
+	}
+	return s + " (" + strings.Join(notes, ", ") + ")"
+}
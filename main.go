@@ -5,10 +5,17 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
 )
 
 // STUN Constants
@@ -19,35 +26,739 @@ const (
 	HeaderLength         = 20
 	AttrMappedAddress    = 0x0001
 	AttrChangeRequest    = 0x0003
+	AttrChangedAddress   = 0x0005
 	AttrXorMappedAddress = 0x0020
+	AttrOtherAddress     = 0x802C
+	AttrResponsePort     = 0x0027
 	FamilyIPv4           = 0x01
+	FamilyIPv6           = 0x02
+)
+
+// STUN constants used by ICE connectivity checks (RFC 8445)
+const (
+	BindingErrorResponse = 0x0111
+	AttrUsername         = 0x0006
+	AttrMessageIntegrity = 0x0008
+	AttrErrorCode        = 0x0009
+	AttrPriority         = 0x0024
+	AttrUseCandidate     = 0x0025
+	AttrFingerprint      = 0x8028
+	AttrIceControlled    = 0x8029
+	AttrIceControlling   = 0x802A
 )
 
-// STUN Servers
-var StunServers = []string{
-	"stun.l.google.com:19302",
-	"stun1.l.google.com:19302",
-	"stun.stunprotocol.org:3478",
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
+
+// defaultServers returns the built-in STUN servers. It builds a fresh slice
+// on every call so concurrent detections never share a list.
+func defaultServers() []string {
+	return []string{
+		"stun.l.google.com:19302",
+		"stun1.l.google.com:19302",
+		"stun.stunprotocol.org:3478",
+	}
 }
 
-// Servers known to support RFC 3489 CHANGE-REQUEST
-var Rfc3489Servers = []string{
-	"stun.sipgate.net:3478",
-	"stun.voipstunt.com:3478",
-	"stun.schlund.de:3478",
+// defaultRfc3489Servers returns the built-in servers known to support
+// RFC 3489 CHANGE-REQUEST, as a fresh slice
+func defaultRfc3489Servers() []string {
+	return []string{
+		"stun.sipgate.net:3478",
+		"stun.voipstunt.com:3478",
+		"stun.schlund.de:3478",
+	}
 }
 
-// StunResult holds the parsed IP and Port
+// StunResult holds the parsed IP and Port. IP encodes as a string in JSON.
 type StunResult struct {
-	IP   string
-	Port int
+	IP   netip.Addr `json:"ip"`
+	Port int        `json:"port"`
+
+	// Other is the server's alternate address (OTHER-ADDRESS or
+	// CHANGED-ADDRESS), when the server advertises one
+	Other *StunResult `json:"other,omitempty"`
+
+	// RTT is the time from the last transmission to the matching response
+	RTT time.Duration `json:"-"`
+}
+
+// NATType is the NAT classification reported by detection
+type NATType int
+
+const (
+	NATUnknown NATType = iota
+	NATUDPBlocked
+	NATOpen
+	NATFullCone
+	NATRestrictedCone
+	NATPortRestricted
+	NATSymmetric
+	NATSymmetricFirewall
+)
+
+var natTypeNames = map[NATType]string{
+	NATUnknown:           "Unknown",
+	NATUDPBlocked:        "UDP Blocked",
+	NATOpen:              "Open Internet",
+	NATFullCone:          "Full Cone NAT",
+	NATRestrictedCone:    "Restricted Cone NAT",
+	NATPortRestricted:    "Port Restricted Cone NAT",
+	NATSymmetric:         "Symmetric NAT",
+	NATSymmetricFirewall: "Symmetric UDP Firewall",
+}
+
+// Stable machine-readable identifiers used for JSON and command-line values
+var natTypeCodes = map[NATType]string{
+	NATUnknown:           "unknown",
+	NATUDPBlocked:        "udp-blocked",
+	NATOpen:              "open",
+	NATFullCone:          "full-cone",
+	NATRestrictedCone:    "restricted-cone",
+	NATPortRestricted:    "port-restricted-cone",
+	NATSymmetric:         "symmetric",
+	NATSymmetricFirewall: "symmetric-udp-firewall",
+}
+
+// String returns the human-readable name of the NAT type
+func (t NATType) String() string {
+	if name, ok := natTypeNames[t]; ok {
+		return name
+	}
+	return "NATType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// MarshalText encodes the NAT type as its stable code, e.g. "full-cone"
+func (t NATType) MarshalText() ([]byte, error) {
+	code, ok := natTypeCodes[t]
+	if !ok {
+		return nil, errors.New("unknown NAT type " + strconv.Itoa(int(t)))
+	}
+	return []byte(code), nil
+}
+
+// UnmarshalText decodes a stable code produced by MarshalText
+func (t *NATType) UnmarshalText(text []byte) error {
+	parsed, err := ParseNATType(string(text))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// ParseNATType parses a NAT type code such as "symmetric" or "full-cone"
+func ParseNATType(code string) (NATType, error) {
+	for t, c := range natTypeCodes {
+		if c == code {
+			return t, nil
+		}
+	}
+	return NATUnknown, errors.New("unknown NAT type: " + code)
+}
+
+// ReasonCode is a machine-readable explanation for a classification
+type ReasonCode string
+
+const (
+	ReasonAllRequestsFailed   ReasonCode = "all-requests-failed"
+	ReasonNoNAT               ReasonCode = "no-nat"
+	ReasonMappingVaries       ReasonCode = "mapping-varies-by-destination"
+	ReasonEndpointIndependent ReasonCode = "endpoint-independent-mapping"
+	ReasonPortPreserved       ReasonCode = "port-preserved"
+	ReasonInboundFiltered     ReasonCode = "inbound-filtered"
+	ReasonUnstableAddress     ReasonCode = "unstable-reflexive-address"
+	ReasonLocalFirewall       ReasonCode = "local-firewall"
+	ReasonPolicyRouted        ReasonCode = "policy-routed"
+	ReasonOneToOne            ReasonCode = "one-to-one-nat"
+	ReasonDMZ                 ReasonCode = "dmz"
+	ReasonRewritten           ReasonCode = "stun-rewritten"
+)
+
+var reasonTexts = map[ReasonCode]string{
+	ReasonAllRequestsFailed:   "All STUN requests failed",
+	ReasonNoNAT:               "No NAT detected",
+	ReasonMappingVaries:       "Public IP/Port varies by destination",
+	ReasonEndpointIndependent: "Endpoint Independent Mapping.",
+	ReasonPortPreserved:       "Port Preserved.",
+	ReasonInboundFiltered:     "Unsolicited inbound packets are filtered.",
+	ReasonUnstableAddress:     "Public IP changes between probes to the same server.",
+	ReasonLocalFirewall:       "The host firewall may be dropping inbound UDP.",
+	ReasonPolicyRouted:        "Servers are reached through different uplinks.",
+	ReasonOneToOne:            "Address translated 1:1 with ports untouched.",
+	ReasonDMZ:                 "Every unsolicited port is forwarded to this host.",
+	ReasonRewritten:           "A middlebox rewrites or proxies STUN traffic.",
+}
+
+// Text returns the human-readable rendering of the reason code
+func (c ReasonCode) Text() string {
+	if text, ok := reasonTexts[c]; ok {
+		return text
+	}
+	return string(c)
+}
+
+// TestName identifies one of the probes run during detection
+type TestName string
+
+const (
+	TestBinding      TestName = "binding"
+	TestMapping      TestName = "mapping"
+	TestConeBinding  TestName = "cone-binding"
+	TestChangeIPPort TestName = "change-ip-port"
+	TestChangePort   TestName = "change-port"
+	TestMappingPort  TestName = "mapping-alternate-port"
+	TestStability    TestName = "stability"
+
+	TestResponsePortControl TestName = "response-port-control"
+	TestResponsePort        TestName = "response-port"
+	TestResponsePortSameIP  TestName = "response-port-same-ip"
+)
+
+// Evidence records the outcome of a single test and the server it used
+type Evidence struct {
+	Test   TestName      `json:"test"`
+	Server string        `json:"server"`
+	Addr   string        `json:"addr"`
+	Passed bool          `json:"passed"`
+	Mapped *StunResult   `json:"mapped,omitempty"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Phase names a stage of detection reported through DetectOptions.Progress
+type Phase string
+
+const (
+	PhasePrimary   Phase = "primary binding"
+	PhaseMapping   Phase = "mapping behavior"
+	PhaseFiltering Phase = "filtering behavior"
+	PhaseStability Phase = "address stability"
+	PhaseQUIC      Phase = "QUIC reachability"
+	PhaseDTLS      Phase = "STUN over DTLS"
+	PhaseBandwidth Phase = "bandwidth"
+	PhaseReach     Phase = "unsolicited inbound"
+	PhaseECN       Phase = "ECN preservation"
+	PhasePlugins   Phase = "plugin checks"
+)
+
+// ProgressEvent reports detection progress. Exactly one field is set: Phase
+// when a new stage starts, Evidence when a test completes.
+type ProgressEvent struct {
+	Phase    Phase
+	Evidence *Evidence
+}
+
+// Translation is how a NAT rewrites outbound flows
+type Translation string
+
+const (
+	// TranslationPAT shares public IPs by rewriting ports (NAPT)
+	TranslationPAT Translation = "pat"
+	// TranslationOneToOne maps a whole address and leaves ports alone
+	TranslationOneToOne Translation = "one-to-one"
+)
+
+// String returns the human-readable name of the translation
+func (t Translation) String() string {
+	switch t {
+	case TranslationPAT:
+		return "PAT (ports rewritten)"
+	case TranslationOneToOne:
+		return "1:1 NAT"
+	}
+	return "unknown"
+}
+
+// Confidence describes how strongly the probe data supports a classification
+type Confidence int
+
+const (
+	ConfidenceLow Confidence = iota
+	ConfidenceMedium
+	ConfidenceHigh
+)
+
+var confidenceNames = map[Confidence]string{
+	ConfidenceLow:    "low",
+	ConfidenceMedium: "medium",
+	ConfidenceHigh:   "high",
+}
+
+// String returns the confidence level name
+func (c Confidence) String() string {
+	if name, ok := confidenceNames[c]; ok {
+		return name
+	}
+	return "Confidence(" + strconv.Itoa(int(c)) + ")"
+}
+
+// MarshalText encodes the confidence level as its name
+func (c Confidence) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText decodes a confidence level name
+func (c *Confidence) UnmarshalText(text []byte) error {
+	for level, name := range confidenceNames {
+		if name == string(text) {
+			*c = level
+			return nil
+		}
+	}
+	return errors.New("unknown confidence level: " + string(text))
+}
+
+// Behavior is an RFC 4787 mapping or filtering behavior
+type Behavior int
+
+const (
+	BehaviorUnknown Behavior = iota
+	BehaviorEndpointIndependent
+	BehaviorAddressDependent
+	BehaviorAddressPortDependent
+)
+
+var behaviorNames = map[Behavior]string{
+	BehaviorUnknown:              "Unknown",
+	BehaviorEndpointIndependent:  "Endpoint Independent",
+	BehaviorAddressDependent:     "Address Dependent",
+	BehaviorAddressPortDependent: "Address and Port Dependent",
+}
+
+var behaviorCodes = map[Behavior]string{
+	BehaviorUnknown:              "unknown",
+	BehaviorEndpointIndependent:  "endpoint-independent",
+	BehaviorAddressDependent:     "address-dependent",
+	BehaviorAddressPortDependent: "address-port-dependent",
+}
+
+// String returns the human-readable name of the behavior
+func (b Behavior) String() string {
+	if name, ok := behaviorNames[b]; ok {
+		return name
+	}
+	return "Behavior(" + strconv.Itoa(int(b)) + ")"
+}
+
+// MarshalText encodes the behavior as its stable code, e.g. "endpoint-independent"
+func (b Behavior) MarshalText() ([]byte, error) {
+	code, ok := behaviorCodes[b]
+	if !ok {
+		return nil, errors.New("unknown behavior " + strconv.Itoa(int(b)))
+	}
+	return []byte(code), nil
+}
+
+// UnmarshalText decodes a stable code produced by MarshalText
+func (b *Behavior) UnmarshalText(text []byte) error {
+	for behavior, code := range behaviorCodes {
+		if code == string(text) {
+			*b = behavior
+			return nil
+		}
+	}
+	return errors.New("unknown behavior: " + string(text))
+}
+
+// Algorithm selects the classification vocabulary used for the verdict
+type Algorithm string
+
+const (
+	// AlgorithmClassic is the RFC 3489 cone/symmetric decision tree
+	AlgorithmClassic Algorithm = "classic"
+	// AlgorithmBehavior is the RFC 4787 mapping/filtering behavior matrix
+	AlgorithmBehavior Algorithm = "behavior"
+)
+
+// Default per-phase timeouts
+const (
+	DefaultPrimaryTimeout = 3 * time.Second
+	DefaultMappingTimeout = 3 * time.Second
+	DefaultProbeTimeout   = 2 * time.Second
+)
+
+// DefaultStabilityProbes is how many extra bindings check that the public IP
+// stays the same across flows
+const DefaultStabilityProbes = 4
+
+// DefaultVotes is how many binding transactions must report the same
+// mapping before a critical measurement is used
+const DefaultVotes = 2
+
+// DetectOptions configures a detection run
+type DetectOptions struct {
+	Algorithm Algorithm
+
+	// PrimaryTimeout bounds the initial binding transaction
+	PrimaryTimeout time.Duration
+	// MappingTimeout bounds each mapping-behavior transaction
+	MappingTimeout time.Duration
+	// ProbeTimeout bounds each cone-subtype and alternate-port probe
+	ProbeTimeout time.Duration
+
+	// Servers are the STUN servers used for binding and mapping tests,
+	// defaulting to the built-in list
+	Servers []string
+	// Rfc3489Servers are the servers used for CHANGE-REQUEST probes,
+	// defaulting to the built-in RFC 3489 list
+	Rfc3489Servers []string
+
+	// StabilityProbes is the number of extra bindings sent to the primary
+	// server from fresh sockets, defaulting to DefaultStabilityProbes;
+	// negative disables the check
+	StabilityProbes int
+
+	// Votes is how many transactions to the same server must agree before
+	// the primary mapping or a mapping-behavior sample is used, defaulting
+	// to DefaultVotes; 1 trusts a single answer. Up to 2*Votes-1 are sent.
+	Votes int
+
+	// QUICTarget, if set, is a host[:port] (default port 443) probed for
+	// QUIC version negotiation, to tell whether UDP 443 gets out
+	QUICTarget string
+
+	// DTLSTarget, if set, is a STUN over DTLS server host[:port] (default
+	// port 5349) authenticated with DTLS, to tell whether encrypted UDP
+	// passes where cleartext STUN does not
+	DTLSTarget string
+	DTLS       *natinfo.DTLSConfig
+
+	// BandwidthTarget, if set, is a responder started with --bandwidth to
+	// estimate throughput against
+	BandwidthTarget string
+
+	// ReachTarget, if set, is a responder started with --reach that sends
+	// unsolicited packets to unrelated ports, exposing a DMZ host
+	ReachTarget string
+
+	// ECNTarget, if set, is a responder started with --ecn that echoes
+	// the TOS byte of each probe, showing whether the path bleaches ECN
+	ECNTarget string
+
+	// Conntrack, when running on the Linux NAT box itself, reads the
+	// translations of the detection socket from the conntrack table
+	Conntrack bool
+
+	// SNMPTarget, if set, is the gateway to query over SNMPv2c with
+	// SNMPCommunity for its WAN address and NAT counters
+	SNMPTarget    string
+	SNMPCommunity string
+
+	// Policy, if set, judges the result; its verdict is in NatResult.Policy
+	Policy *Policy
+
+	// Plugins are commands run after the built-in tests, each bounded by
+	// PluginTimeout (default DefaultPluginTimeout); see PluginRequest
+	Plugins       []string
+	PluginTimeout time.Duration
+
+	// Interface, if set, binds the detection socket to that interface's
+	// IPv4 address instead of letting the routing table choose
+	Interface string
+
+	// StrictSource makes responses to requests without CHANGE-REQUEST count
+	// only when they come from the exact address the request went to,
+	// instead of from anywhere with a matching transaction ID
+	StrictSource bool
+
+	// SocketMark and SocketDevice steer every probe socket on policy-routed
+	// Linux hosts: the mark (SO_MARK) selects a routing table through ip
+	// rules, and the device binds to a VRF or interface. Other platforms
+	// fail to open sockets when either is set.
+	SocketMark   int
+	SocketDevice string
+
+	// socketOptions are the --sockopt settings
+	socketOptions []sockOption
+
+	// recorder, if set, captures what detection did for --bundle
+	recorder *bundleRecorder
+
+	// FingerprintSalt salts the network fingerprint in the run metadata.
+	// Hosts given the same salt get the same fingerprint on the same
+	// network; empty uses a random per-install salt.
+	FingerprintSalt string
+
+	// Progress, if set, is called synchronously as phases start and tests complete
+	Progress func(ProgressEvent)
+
+	// Clock, if set, replaces the real clock for retransmission schedules,
+	// timers and round trips, so tests can step through them without
+	// waiting
+	Clock natinfo.Clock
+}
+
+// withDefaults fills in zero-valued options with their defaults
+func (o DetectOptions) withDefaults() DetectOptions {
+	if o.Algorithm == "" {
+		o.Algorithm = AlgorithmClassic
+	}
+	if o.PrimaryTimeout <= 0 {
+		o.PrimaryTimeout = DefaultPrimaryTimeout
+	}
+	if o.MappingTimeout <= 0 {
+		o.MappingTimeout = DefaultMappingTimeout
+	}
+	if o.ProbeTimeout <= 0 {
+		o.ProbeTimeout = DefaultProbeTimeout
+	}
+	if o.SNMPCommunity == "" {
+		o.SNMPCommunity = "public"
+	}
+	if o.StabilityProbes == 0 {
+		o.StabilityProbes = DefaultStabilityProbes
+	}
+	if o.Votes <= 0 {
+		o.Votes = DefaultVotes
+	}
+	if o.PluginTimeout <= 0 {
+		o.PluginTimeout = DefaultPluginTimeout
+	}
+	// Copies, so the caller may reuse its options across goroutines
+	if o.Servers == nil {
+		o.Servers = defaultServers()
+	} else {
+		o.Servers = slices.Clone(o.Servers)
+	}
+	if o.Rfc3489Servers == nil {
+		o.Rfc3489Servers = defaultRfc3489Servers()
+	} else {
+		o.Rfc3489Servers = slices.Clone(o.Rfc3489Servers)
+	}
+	return o
+}
+
+// MappingSample is one comparison of the public mappings observed by two
+// destinations from the same local socket
+type MappingSample struct {
+	First        string      `json:"first"`
+	FirstMapped  *StunResult `json:"first_mapped"`
+	Second       string      `json:"second"`
+	SecondMapped *StunResult `json:"second_mapped"`
+	Differs      bool        `json:"differs"`
+}
+
+// newMappingSample builds a sample from two completed binding transactions
+func newMappingSample(a StunEndpoint, aMapped *StunResult, b StunEndpoint, bMapped *StunResult) MappingSample {
+	return MappingSample{
+		First:        a.Addr.String(),
+		FirstMapped:  aMapped,
+		Second:       b.Addr.String(),
+		SecondMapped: bMapped,
+		Differs:      aMapped.IP != bMapped.IP || aMapped.Port != bMapped.Port,
+	}
+}
+
+// Disagreement records a server whose repeated binding transactions
+// reported different mappings. Without a majority the value was not used.
+type Disagreement struct {
+	Test     TestName `json:"test"`
+	Addr     string   `json:"addr"`
+	Answers  []string `json:"answers"`
+	Resolved bool     `json:"resolved"`
+}
+
+// ObservedIP counts how often a public IP was reported by the primary server
+type ObservedIP struct {
+	IP    string `json:"ip"`
+	Count int    `json:"count"`
 }
 
 // NatResult holds the final detection result
 type NatResult struct {
-	Type   string
-	Reason string
-	Public *StunResult
+	Type            NATType         `json:"type"`
+	Mapping         Behavior        `json:"mapping"`
+	Filtering       Behavior        `json:"filtering"`
+	Reasons         []ReasonCode    `json:"reasons"`
+	Evidence        []Evidence      `json:"evidence"`
+	MappingSamples  []MappingSample `json:"mapping_samples,omitempty"`
+	Disagreements   []Disagreement  `json:"disagreements,omitempty"`
+	Responses       *ResponseCounts `json:"responses,omitempty"`
+	Confidence      Confidence      `json:"confidence"`
+	ConfidenceNotes []string        `json:"confidence_notes,omitempty"`
+	Warnings        []Warning       `json:"warnings,omitempty"`
+	LocalIP         string          `json:"local_ip"`
+	LocalPort       int             `json:"local_port"`
+	// Public is the mapping of the detection socket; PublicEndpoints lists
+	// it first, followed by any other public address the run saw
+	Public          *StunResult      `json:"public,omitempty"`
+	PublicEndpoints []PublicEndpoint `json:"public_endpoints,omitempty"`
+	ObservedIPs     []ObservedIP     `json:"observed_ips,omitempty"`
+	QUIC            *QUICProbe       `json:"quic,omitempty"`
+	DTLS            *DTLSProbe       `json:"dtls,omitempty"`
+	Bandwidth       *BandwidthResult `json:"bandwidth,omitempty"`
+	Reach           *ReachResult     `json:"reach,omitempty"`
+	ECN             *ECNProbe        `json:"ecn,omitempty"`
+	Proxy           *ProxyCheck      `json:"proxy,omitempty"`
+	Firewall        *FirewallCheck   `json:"firewall,omitempty"`
+	Conntrack       *ConntrackReport `json:"conntrack,omitempty"`
+	Gateway         *GatewayInfo     `json:"gateway,omitempty"`
+	Access          *AccessGuess     `json:"access,omitempty"`
+	UnstableAddress bool             `json:"unstable_address"`
+	Translation     Translation      `json:"translation,omitempty"`
+	PolicyRouted    bool             `json:"policy_routed"`
+	Link            *LinkInfo        `json:"link,omitempty"`
+	Routes          []RouteSource    `json:"routes,omitempty"`
+	ShareCode       string           `json:"share_code,omitempty"`
+	Plugins         []PluginResult   `json:"plugins,omitempty"`
+	Policy          *PolicyVerdict   `json:"policy,omitempty"`
+	// Explanation is set by --explain
+	Explanation []ExplainStep `json:"explanation,omitempty"`
+	Run         *RunInfo      `json:"run,omitempty"`
+
+	progress func(ProgressEvent)
+}
+
+// ReasonText renders the reason codes as a single human-readable line
+func (r *NatResult) ReasonText() string {
+	texts := make([]string, len(r.Reasons))
+	for i, code := range r.Reasons {
+		texts[i] = code.Text()
+	}
+	return strings.Join(texts, " ")
+}
+
+// countPassed returns how many distinct servers passed the given test
+func (r *NatResult) countPassed(test TestName) int {
+	servers := make(map[string]bool)
+	for _, e := range r.Evidence {
+		if e.Test == test && e.Passed {
+			servers[e.Server] = true
+		}
+	}
+	return len(servers)
+}
+
+// filteringServers returns how many servers answered a filtering test,
+// counting those that honored RESPONSE-PORT along with RFC 3489 ones
+func (r *NatResult) filteringServers() int {
+	return r.countPassed(TestConeBinding) + r.countPassed(TestResponsePortControl)
+}
+
+// countAttempted returns how many distinct servers the given test was run against
+func (r *NatResult) countAttempted(test TestName) int {
+	servers := make(map[string]bool)
+	for _, e := range r.Evidence {
+		if e.Test == test {
+			servers[e.Server] = true
+		}
+	}
+	return len(servers)
+}
+
+// scoreConfidence derives the confidence level from the recorded evidence:
+// how many probes succeeded, whether the alternate-address tests could run,
+// and whether the decision rests on positive or merely negative results.
+func (r *NatResult) scoreConfidence() {
+	r.Confidence = ConfidenceHigh
+	r.ConfidenceNotes = nil
+
+	lower := func(level Confidence, note string) {
+		if level < r.Confidence {
+			r.Confidence = level
+		}
+		r.ConfidenceNotes = append(r.ConfidenceNotes, note)
+	}
+
+	if r.UnstableAddress {
+		lower(ConfidenceMedium, "public IP is unstable, so mapping comparisons may mix addresses")
+	}
+	if r.PolicyRouted {
+		lower(ConfidenceMedium, "servers are reached through different uplinks, so mapping comparisons may mix NATs")
+	}
+	if len(r.Disagreements) > 0 {
+		lower(ConfidenceMedium, "repeated bindings to the same server reported different mappings")
+	}
+
+	switch r.Type {
+	case NATUDPBlocked:
+		switch r.countAttempted(TestBinding) {
+		case 0:
+			lower(ConfidenceLow, "no STUN server could be resolved")
+		case 1:
+			lower(ConfidenceMedium, "only one STUN server was tried")
+		}
+
+	case NATSymmetric:
+		if len(r.MappingSamples) < 2 {
+			lower(ConfidenceLow, "symmetric mapping seen in a single sample only")
+		}
+		if r.countPassed(TestMappingPort) == 0 {
+			lower(ConfidenceMedium, "address vs port dependence untested")
+		}
+
+	case NATOpen:
+		if r.filteringServers() == 0 {
+			lower(ConfidenceLow, "inbound filtering untested: no RFC3489 server reachable")
+		}
+
+	case NATSymmetricFirewall:
+		if r.filteringServers() < 2 {
+			lower(ConfidenceLow, "only one RFC3489 server reachable")
+		} else {
+			lower(ConfidenceMedium, "filtering inferred from missing responses")
+		}
+
+	case NATFullCone, NATRestrictedCone, NATPortRestricted:
+		for _, sample := range r.MappingSamples {
+			if sample.Differs {
+				lower(ConfidenceMedium, "mapping samples were inconsistent")
+				break
+			}
+		}
+		if r.countPassed(TestMapping) == 0 {
+			lower(ConfidenceLow, "mapping behavior untested: no second server reachable")
+		}
+
+		// Full and Restricted Cone are backed by a response actually getting
+		// through; Port Restricted is only the absence of one.
+		if r.Type == NATPortRestricted {
+			switch r.filteringServers() {
+			case 0:
+				lower(ConfidenceLow, "no RFC3489 server reachable, subtype assumed")
+			case 1:
+				lower(ConfidenceLow, "only one RFC3489 server reachable")
+			default:
+				lower(ConfidenceMedium, "filtering inferred from missing responses")
+			}
+		}
+	}
+}
+
+// addEvidence records the outcome of a test against a pinned endpoint
+func (r *NatResult) addEvidence(test TestName, endpoint StunEndpoint, mapped *StunResult, err error) {
+	e := Evidence{
+		Test:   test,
+		Server: endpoint.Host,
+		Addr:   endpoint.Addr.String(),
+		Passed: err == nil,
+		Mapped: mapped,
+	}
+	if mapped != nil {
+		e.RTT = mapped.RTT
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.Evidence = append(r.Evidence, e)
+
+	if r.progress != nil {
+		r.progress(ProgressEvent{Evidence: &e})
+	}
+}
+
+// startPhase reports the start of a detection phase
+func (r *NatResult) startPhase(phase Phase) {
+	if r.progress != nil {
+		r.progress(ProgressEvent{Phase: phase})
+	}
+}
+
+// StunEndpoint is a STUN server pinned to one of its resolved IPv4 addresses
+type StunEndpoint struct {
+	Host string
+	Addr *net.UDPAddr
 }
 
 // Attribute represents a STUN attribute
@@ -61,19 +772,122 @@ func printLine(s string) {
 	os.Stdout.WriteString(s + "\n")
 }
 
-// getLocalIP returns the local IP address used for internet routing
-func getLocalIP() (string, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// progressOut receives progress messages printed while detection runs. It is
+// switched to stderr when stdout carries machine-readable output, always
+// before any detection starts.
+var progressOut io.Writer = os.Stdout
+
+// printProgress writes a progress message line
+func printProgress(s string) {
+	io.WriteString(progressOut, s+"\n")
+}
+
+// interfaceIPv4 returns the first IPv4 address assigned to the named interface
+func interfaceIPv4(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				return ip4, nil
+			}
+		}
+	}
+	return nil, errors.New("no IPv4 address on interface " + name)
+}
+
+// localIP returns the local IP address used for internet routing
+func (e *probeEnv) localIP() (string, error) {
+	conn, err := e.dialUDP(nil, &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 80})
 	if err != nil {
 		return "127.0.0.1", nil
 	}
 	defer conn.Close()
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String(), nil
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
 }
 
-// parseStunResponse parses a STUN message buffer to extract MAPPED-ADDRESS or XOR-MAPPED-ADDRESS
+// resolveServer is resolveServer with the answer recorded for the bundle
+func (e *probeEnv) resolveServer(server string) ([]StunEndpoint, error) {
+	endpoints, err := resolveServer(server)
+	e.recorder.resolve(server, endpoints, err)
+	return endpoints, err
+}
+
+// resolveServer resolves every A record of a STUN server so each transaction
+// can be pinned to one specific backend IP instead of following round-robin DNS
+func resolveServer(server string) (endpoints []StunEndpoint, err error) {
+	host, portStr, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid port in " + server)
+	}
+	if host, err = natinfo.NormalizeHost(host); err != nil {
+		return nil, err
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			endpoints = append(endpoints, StunEndpoint{
+				Host: host,
+				Addr: &net.UDPAddr{IP: ip4, Port: port},
+			})
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return nil, errors.New("no IPv4 address for " + host)
+	}
+	return endpoints, nil
+}
+
+// pickEndpoint resolves a server and returns its first pinned IP that is not
+// shared with any of the excluded endpoints. Servers sharing a hostname with an
+// excluded endpoint are rejected outright, since their backends are not
+// independent destinations.
+func pickEndpoint(env *probeEnv, server string, exclude ...StunEndpoint) (StunEndpoint, bool) {
+	endpoints, err := env.resolveServer(server)
+	if err != nil {
+		return StunEndpoint{}, false
+	}
+
+	for _, ex := range exclude {
+		if endpoints[0].Host == ex.Host {
+			return StunEndpoint{}, false
+		}
+	}
+
+next:
+	for _, endpoint := range endpoints {
+		for _, ex := range exclude {
+			if endpoint.Addr.IP.Equal(ex.Addr.IP) {
+				continue next
+			}
+		}
+		return endpoint, true
+	}
+	return StunEndpoint{}, false
+}
+
+// parseStunResponse parses a STUN message buffer to extract MAPPED-ADDRESS or XOR-MAPPED-ADDRESS,
+// along with the server's alternate address from OTHER-ADDRESS or CHANGED-ADDRESS if present
 func parseStunResponse(buffer []byte) (*StunResult, error) {
 	if len(buffer) < HeaderLength {
 		return nil, errors.New("buffer too short")
@@ -86,7 +900,12 @@ func parseStunResponse(buffer []byte) (*StunResult, error) {
 		return nil, errors.New("invalid message type: 0x" + strconv.FormatUint(uint64(messageType), 16))
 	}
 
-	isRFC5389 := (magicCookie == MagicCookie)
+	// XOR-MAPPED-ADDRESS is keyed by the cookie and transaction ID; an RFC
+	// 3489 server's copy of it was never XORed
+	var xor []byte
+	if magicCookie == MagicCookie {
+		xor = buffer[4:20]
+	}
 	msgLen := binary.BigEndian.Uint16(buffer[2:4])
 
 	// Verify buffer contains full message
@@ -97,6 +916,8 @@ func parseStunResponse(buffer []byte) (*StunResult, error) {
 	offset := HeaderLength
 	limit := len(buffer)
 
+	var xorMapped, mapped, other *StunResult
+
 	for offset+4 <= limit {
 		attrType := binary.BigEndian.Uint16(buffer[offset : offset+2])
 		attrLen := binary.BigEndian.Uint16(buffer[offset+2 : offset+4])
@@ -108,41 +929,18 @@ func parseStunResponse(buffer []byte) (*StunResult, error) {
 
 		attrVal := buffer[offset : offset+int(attrLen)]
 
-		// XOR-MAPPED-ADDRESS
-		if attrType == AttrXorMappedAddress && attrLen >= 8 {
-			family := attrVal[1]
-			if family == FamilyIPv4 {
-				port := binary.BigEndian.Uint16(attrVal[2:4])
-				ipBytes := make([]byte, 4)
-				copy(ipBytes, attrVal[4:8])
-
-				if isRFC5389 {
-					port ^= uint16(MagicCookie >> 16)
-					ipBytes[0] ^= byte(MagicCookie >> 24)
-					ipBytes[1] ^= byte((MagicCookie >> 16) & 0xFF)
-					ipBytes[2] ^= byte((MagicCookie >> 8) & 0xFF)
-					ipBytes[3] ^= byte(MagicCookie & 0xFF)
-				}
-
-				return &StunResult{
-					IP:   net.IP(ipBytes).String(),
-					Port: int(port),
-				}, nil
+		switch attrType {
+		case AttrXorMappedAddress:
+			if xorMapped == nil {
+				xorMapped = decodeAddress(attrVal, xor)
 			}
-		}
-
-		// MAPPED-ADDRESS
-		if attrType == AttrMappedAddress && attrLen >= 8 {
-			family := attrVal[1]
-			if family == FamilyIPv4 {
-				port := binary.BigEndian.Uint16(attrVal[2:4])
-				ipBytes := make([]byte, 4)
-				copy(ipBytes, attrVal[4:8])
-
-				return &StunResult{
-					IP:   net.IP(ipBytes).String(),
-					Port: int(port),
-				}, nil
+		case AttrMappedAddress:
+			if mapped == nil {
+				mapped = decodeAddress(attrVal, nil)
+			}
+		case AttrOtherAddress, AttrChangedAddress:
+			if other == nil {
+				other = decodeAddress(attrVal, nil)
 			}
 		}
 
@@ -151,20 +949,92 @@ func parseStunResponse(buffer []byte) (*StunResult, error) {
 		offset += paddedLen
 	}
 
-	return nil, errors.New("no mapped address found")
+	// Prefer XOR-MAPPED-ADDRESS, which NAT ALGs cannot rewrite
+	result := xorMapped
+	if result == nil {
+		result = mapped
+	}
+	if result == nil {
+		return nil, errors.New("no mapped address found")
+	}
+
+	result.Other = other
+	return result, nil
+}
+
+// decodeAddress decodes an IPv4 or IPv6 address attribute value. xor is the
+// 16 header bytes after the type and length (magic cookie, then transaction
+// ID) for XOR-MAPPED-ADDRESS, or nil for a plain address: RFC 5389 section
+// 15.2 XORs the port and an IPv4 address with the cookie, and an IPv6
+// address with the cookie followed by the transaction ID. It returns nil for
+// unknown families or short values.
+func decodeAddress(attrVal []byte, xor []byte) *StunResult {
+	if len(attrVal) < 4 {
+		return nil
+	}
+	n := 0
+	switch attrVal[1] {
+	case FamilyIPv4:
+		n = 4
+	case FamilyIPv6:
+		n = 16
+	default:
+		return nil
+	}
+	if len(attrVal) < 4+n || xor != nil && len(xor) < n {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(attrVal[2:4])
+	var ipBytes [16]byte
+	copy(ipBytes[:], attrVal[4:4+n])
+
+	if xor != nil {
+		port ^= uint16(MagicCookie >> 16)
+		for i := 0; i < n; i++ {
+			ipBytes[i] ^= xor[i]
+		}
+	}
+
+	ip := netip.AddrFrom16(ipBytes)
+	if n == 4 {
+		ip = netip.AddrFrom4([4]byte(ipBytes[:4]))
+	}
+	return &StunResult{
+		IP:   ip,
+		Port: int(port),
+	}
 }
 
+// AddrPort returns the address as a comparable netip.AddrPort
+func (r *StunResult) AddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(r.IP, uint16(r.Port))
+}
+
+// packetPool holds receive buffers for makeStunRequest, which surveys and
+// stress runs call thousands of times
+var packetPool = sync.Pool{New: func() any {
+	buf := make([]byte, 2048)
+	return &buf
+}}
+
+// errChangeIgnored is returned when a CHANGE-REQUEST got answers, but only
+// from the address it was sent to
+var errChangeIgnored = errors.New("server ignored CHANGE-REQUEST")
+
 // makeStunRequest sends a Binding Request and waits for a response
 // If expectDifferentSource is true, validates the response source based on changeRequestFlags:
 //   - 0: Any different source accepted
 //   - 2 (Change Port): Accepts same IP, different port
 //   - 6 (Change IP+Port): Accepts different IP and different port only
-func makeStunRequest(conn *net.UDPConn, serverAddrStr string, attributes []Attribute, timeout time.Duration, useMagicCookie bool, changeRequestFlags byte) (*StunResult, error) {
-	// Force IPv4 resolution
-	serverAddr, err := net.ResolveUDPAddr("udp4", serverAddrStr)
-	if err != nil {
-		return nil, err
-	}
+//
+// The server address must already be resolved (see resolveServer) so that every
+// transaction of a test talks to the same backend IP.
+//
+// Detection does not go through natinfo.Transport: these checks need the
+// address each answer came from, which Exchange does not return.
+func (e *probeEnv) makeStunRequest(conn *net.UDPConn, serverAddr *net.UDPAddr, attributes []Attribute, timeout time.Duration, useMagicCookie bool, changeRequestFlags byte) (*StunResult, error) {
+	statTransactions.Add(1)
 
 	// Construct STUN Message
 	var tid []byte
@@ -173,7 +1043,7 @@ func makeStunRequest(conn *net.UDPConn, serverAddrStr string, attributes []Attri
 	} else {
 		tid = make([]byte, 16)
 	}
-	_, err = rand.Read(tid)
+	_, err := rand.Read(tid)
 	if err != nil {
 		return nil, err
 	}
@@ -207,42 +1077,55 @@ func makeStunRequest(conn *net.UDPConn, serverAddrStr string, attributes []Attri
 		offset += 4 + paddedLen
 	}
 
-	// Retransmission Logic
-	const baseRetransmit = 200 * time.Millisecond
-
-	deadline := time.Now().Add(timeout)
-	conn.SetReadDeadline(deadline)
-
-	nextRetransmit := time.Now()
-	retransmitDuration := baseRetransmit
+	// Retransmission Logic. The first interval comes from the answers to
+	// earlier transactions; requests with CHANGE-REQUEST neither use nor
+	// update it, since their answers take another path and silence is a
+	// result rather than loss.
+	deadline := e.clock.Now().Add(timeout)
+
+	nextRetransmit := e.clock.Now()
+	retransmitDuration := initialRTO
+	adaptive := changeRequestFlags == 0
+	if adaptive {
+		retransmitDuration = e.rto.initial(conn.LocalAddr(), serverAddr)
+	}
 
-	buf := make([]byte, 2048)
+	bufp := packetPool.Get().(*[]byte)
+	defer packetPool.Put(bufp)
+	buf := *bufp
 	attempt := 1
+	var lastSent time.Time
+	ignored := false
 
-	for time.Now().Before(deadline) {
+	for e.clock.Now().Before(deadline) {
 		// Check if we need to retransmit
-		if time.Now().After(nextRetransmit) {
+		if !e.clock.Now().Before(nextRetransmit) {
 			_, err = conn.WriteToUDP(req, serverAddr)
 			if err != nil {
 				return nil, err
 			}
-			nextRetransmit = time.Now().Add(retransmitDuration)
+			if !lastSent.IsZero() {
+				statRetransmits.Add(1)
+			}
+			lastSent = e.clock.Now()
+			e.recorder.packet("send", conn.LocalAddr(), serverAddr, req)
+			nextRetransmit = e.clock.Now().Add(retransmitDuration)
 			retransmitDuration *= 2
 			attempt++
 		}
 
 		// Determine read deadline
-		readTimeout := time.Until(nextRetransmit)
+		readTimeout := nextRetransmit.Sub(e.clock.Now())
 		if readTimeout < 10*time.Millisecond {
 			readTimeout = 10 * time.Millisecond
 		}
-		if time.Until(deadline) < readTimeout {
-			readTimeout = time.Until(deadline)
+		if deadline.Sub(e.clock.Now()) < readTimeout {
+			readTimeout = deadline.Sub(e.clock.Now())
 		}
 
 		conn.SetReadDeadline(time.Now().Add(readTimeout))
 
-		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		n, remoteAddr, stamp, err := readStamped(conn, buf)
 		if err != nil {
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
@@ -251,192 +1134,621 @@ func makeStunRequest(conn *net.UDPConn, serverAddrStr string, attributes []Attri
 			return nil, err
 		}
 
+		e.recorder.packet("recv", conn.LocalAddr(), remoteAddr, buf[:n])
 		if n < HeaderLength {
 			continue
 		}
 
 		// Check Transaction ID
-		match := false
+		got := buf[4:20]
 		if useMagicCookie {
-			match = bytes.Equal(buf[8:20], tid)
-		} else {
-			match = bytes.Equal(buf[4:20], tid)
+			got = buf[8:20]
+		}
+		if !bytes.Equal(got, tid) {
+			e.strayResponse(conn, got)
+			continue
 		}
 
-		if match {
-			// If we have change request flags, validate the response source
-			if changeRequestFlags > 0 {
-				sameIP := remoteAddr.IP.Equal(serverAddr.IP)
-				samePort := remoteAddr.Port == serverAddr.Port
+		if changeRequestFlags == 0 && e.strictSource &&
+			(!remoteAddr.IP.Equal(serverAddr.IP) || remoteAddr.Port != serverAddr.Port) {
+			e.recorder.note("strict source: ignored answer from " + remoteAddr.String() + " to a request for " + serverAddr.String())
+			continue
+		}
 
-				if sameIP && samePort {
-					continue // Same source - not a CHANGE-REQUEST response
-				}
+		// If we have change request flags, validate the response source
+		if changeRequestFlags > 0 {
+			sameIP := remoteAddr.IP.Equal(serverAddr.IP)
+			samePort := remoteAddr.Port == serverAddr.Port
+
+			if sameIP && samePort {
+				ignored = true
+				continue // Same source - not a CHANGE-REQUEST response
+			}
 
-				// Validate based on change request flags
-				if changeRequestFlags == 6 {
-					// Change IP+Port (0x06): Would need BOTH IP and port different
-					// However, with DNS round-robin hostnames, we cannot reliably distinguish
-					// between legitimate alternate IPs and other servers in the pool.
-					// To avoid false positives, we skip Full Cone detection with these servers.
+			// Validate based on change request flags
+			if changeRequestFlags == 6 {
+				// Change IP+Port (0x06): Must have BOTH IP and port different.
+				// The request was sent to a pinned IP rather than a round-robin
+				// hostname, so a TID match from another IP is the server's
+				// alternate address and not some other member of the pool.
+				if sameIP || samePort {
+					continue
+				}
+			} else if changeRequestFlags == 2 {
+				// Change Port (0x02): Must have SAME IP, different port
+				if !sameIP || samePort {
 					continue
-				} else if changeRequestFlags == 2 {
-					// Change Port (0x02): Must have SAME IP, different port
-					if !sameIP || samePort {
-						continue
-					}
 				}
 			}
+		}
 
-			result, err := parseStunResponse(buf[:n])
-			if err != nil {
-				return &StunResult{}, nil
-			}
-			return result, nil
+		e.finishTransaction(conn, tid, attempt-1, true)
+		rtt := e.receivedAt(stamp, lastSent).Sub(lastSent)
+		if adaptive && attempt == 2 {
+			e.rto.sample(conn.LocalAddr(), serverAddr, rtt)
+		} else if adaptive {
+			e.rto.backoff(conn.LocalAddr(), serverAddr, retransmitDuration/2)
 		}
+		result, err := parseStunResponse(buf[:n])
+		if err != nil {
+			statParseErrors.Add(1)
+			return &StunResult{RTT: rtt}, nil
+		}
+		result.RTT = rtt
+		return result, nil
 	}
 
+	statTimeouts.Add(1)
+	e.finishTransaction(conn, tid, attempt-1, false)
+	if adaptive {
+		e.rto.backoff(conn.LocalAddr(), serverAddr, retransmitDuration/2)
+	}
+	e.recorder.note("timeout waiting for " + serverAddr.String())
+	if ignored {
+		return nil, errChangeIgnored
+	}
 	return nil, errors.New("STUN request timeout")
 }
 
-func detectNATType() (*NatResult, error) {
-	localIP, err := getLocalIP()
+// votedRequest runs binding transactions against endpoint until votes of
+// them report the same mapping, so that one reordered or duplicated
+// datagram cannot decide a measurement. At most 2*votes-1 are sent. Lost
+// answers are not held against the others; answers that disagree are
+// recorded, and without a majority the binding fails.
+func votedRequest(env *probeEnv, result *NatResult, test TestName, conn *net.UDPConn, endpoint StunEndpoint, timeout time.Duration, votes int) (*StunResult, error) {
+	var answers []*StunResult
+	var lastErr error
+	tally := make(map[netip.AddrPort]int)
+	var winner *StunResult
+	for sent := 0; sent < 2*votes-1 && winner == nil; sent++ {
+		res, err := env.makeStunRequest(conn, endpoint.Addr, nil, timeout, true, 0)
+		if err != nil {
+			lastErr = err
+			// Nothing answers at all; trying again would only wait longer
+			if len(answers) == 0 {
+				break
+			}
+			continue
+		}
+		answers = append(answers, res)
+		key := res.AddrPort()
+		tally[key]++
+		if tally[key] >= votes {
+			winner = res
+		}
+	}
+	// Fewer answers than votes but all alike is loss, not disagreement
+	if winner == nil && len(tally) == 1 {
+		winner = answers[0]
+	}
+
+	if len(tally) > 1 {
+		d := Disagreement{Test: test, Addr: endpoint.Addr.String(), Resolved: winner != nil}
+		for _, a := range answers {
+			d.Answers = append(d.Answers, a.AddrPort().String())
+		}
+		result.Disagreements = append(result.Disagreements, d)
+		env.recorder.note("inconsistent answers from " + d.Addr + ": " + strings.Join(d.Answers, ", "))
+	}
+	if winner == nil {
+		if lastErr == nil {
+			lastErr = errors.New("answers disagree: " + strings.Join(result.Disagreements[len(result.Disagreements)-1].Answers, ", "))
+		}
+		result.addEvidence(test, endpoint, nil, lastErr)
+		return nil, lastErr
+	}
+	result.addEvidence(test, endpoint, winner, nil)
+	return winner, nil
+}
+
+// sampleMapping queries two pinned endpoints back to back from the same socket
+// and records whether they observed the same public mapping
+func sampleMapping(env *probeEnv, result *NatResult, conn *net.UDPConn, a, b StunEndpoint, timeout time.Duration, votes int) (MappingSample, error) {
+	aMapped, err := votedRequest(env, result, TestMapping, conn, a, timeout, votes)
 	if err != nil {
-		return nil, err
+		return MappingSample{}, err
 	}
 
-	// Bind to a random local port
-	localAddr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+	bMapped, err := votedRequest(env, result, TestMapping, conn, b, timeout, votes)
 	if err != nil {
-		return nil, err
+		return MappingSample{}, err
+	}
+
+	return newMappingSample(a, aMapped, b, bMapped), nil
+}
+
+// probeFiltering asks RFC 3489 servers to answer from a different IP and/or
+// port to find out which inbound packets reach the mapping
+func probeFiltering(env *probeEnv, result *NatResult, conn *net.UDPConn, servers []string, timeout time.Duration) Behavior {
+	result.startPhase(PhaseFiltering)
+	filtering := BehaviorUnknown
+
+	for _, server := range servers {
+		endpoints, err := env.resolveServer(server)
+		if err != nil {
+			result.warn(WarnServerUnresolved, server, "could not resolve "+server+": "+err.Error())
+			continue
+		}
+
+		for _, endpoint := range endpoints {
+			// 1. Establish mapping (shorter timeout for initial connection test).
+			// The binding and both CHANGE-REQUEST tests use the same pinned IP so
+			// responses are judged against the exact server we opened a mapping to.
+			res, err := env.makeStunRequest(conn, endpoint.Addr, nil, timeout, true, 0)
+			result.addEvidence(TestConeBinding, endpoint, res, err)
+			if err != nil {
+				continue
+			}
+
+			// 2. Test for Full Cone: Change IP and Port
+			changeIpPortVal := []byte{0, 0, 0, 6}
+			res, err = env.makeStunRequest(conn, endpoint.Addr, []Attribute{{Type: AttrChangeRequest, Value: changeIpPortVal}}, timeout, true, 6)
+			result.addEvidence(TestChangeIPPort, endpoint, res, err)
+			if err == nil {
+				return BehaviorEndpointIndependent
+			}
+			if errors.Is(err, errChangeIgnored) {
+				// Its silence says nothing about the NAT, so try another server
+				result.warn(WarnChangeRequestIgnored, server, server+" ignored CHANGE-REQUEST and answered from its own address")
+				break
+			}
+
+			// 3. Test for Restricted Cone: Change Port only
+			changePortVal := []byte{0, 0, 0, 2}
+			res, err = env.makeStunRequest(conn, endpoint.Addr, []Attribute{{Type: AttrChangeRequest, Value: changePortVal}}, timeout, true, 2)
+			result.addEvidence(TestChangePort, endpoint, res, err)
+			if err == nil {
+				return BehaviorAddressDependent
+			}
+
+			// This server answered but neither filter test passed; move on
+			// to the next hostname rather than its other backend IPs
+			filtering = BehaviorAddressPortDependent
+			break
+		}
+	}
+
+	return filtering
+}
+
+// probeMappingPortDependence binds to an RFC 3489 server's primary and
+// alternate port on the same IP. A changed mapping means the NAT keys its
+// mappings on the destination port as well as the address.
+func probeMappingPortDependence(env *probeEnv, result *NatResult, conn *net.UDPConn, servers []string, timeout time.Duration) Behavior {
+	for _, server := range servers {
+		endpoints, err := env.resolveServer(server)
+		if err != nil {
+			continue
+		}
+		endpoint := endpoints[0]
+
+		first, err := env.makeStunRequest(conn, endpoint.Addr, nil, timeout, true, 0)
+		result.addEvidence(TestMapping, endpoint, first, err)
+		if err != nil || first.Other == nil {
+			continue
+		}
+
+		alternate := StunEndpoint{
+			Host: endpoint.Host,
+			Addr: &net.UDPAddr{IP: endpoint.Addr.IP, Port: first.Other.Port},
+		}
+		second, err := env.makeStunRequest(conn, alternate.Addr, nil, timeout, true, 0)
+		result.addEvidence(TestMappingPort, alternate, second, err)
+		if err != nil {
+			continue
+		}
+
+		if first.IP == second.IP && first.Port == second.Port {
+			return BehaviorAddressDependent
+		}
+		return BehaviorAddressPortDependent
+	}
+
+	return BehaviorUnknown
+}
+
+// listenLocal binds a UDP socket to a random local port, on the named
+// interface if any, and returns it with the local IP it sends from
+func (e *probeEnv) listenLocal() (*net.UDPConn, string, error) {
+	localAddr := &net.UDPAddr{IP: net.IPv4zero}
+	var localIP string
+
+	if e.iface != "" {
+		ip, err := interfaceIPv4(e.iface)
+		if err != nil {
+			return nil, "", err
+		}
+		localAddr.IP = ip
+		localIP = ip.String()
+	} else {
+		ip, err := e.localIP()
+		if err != nil {
+			return nil, "", err
+		}
+		localIP = ip
+	}
+
+	conn, err := e.listenUDP(localAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, localIP, nil
+}
+
+// probeAddressStability repeats the primary binding from fresh sockets and
+// tallies the public IPs seen. The primary result counts as the first sample.
+// The same samples show whether the NAT rewrites ports at all.
+func probeAddressStability(env *probeEnv, result *NatResult, primary StunEndpoint, opts DetectOptions) {
+	counts := map[netip.Addr]int{result.Public.IP: 1}
+	order := []netip.Addr{result.Public.IP}
+	samples, preserved := 1, 0
+	if result.Public.Port == result.LocalPort {
+		preserved++
+	}
+
+	for i := 0; i < opts.StabilityProbes; i++ {
+		conn, _, err := env.listenLocal()
+		if err != nil {
+			break
+		}
+		res, err := env.makeStunRequest(conn, primary.Addr, nil, opts.ProbeTimeout, true, 0)
+		conn.Close()
+		result.addEvidence(TestStability, primary, res, err)
+		if err != nil {
+			continue
+		}
+		samples++
+		if res.Port == conn.LocalAddr().(*net.UDPAddr).Port {
+			preserved++
+		}
+		if counts[res.IP] == 0 {
+			order = append(order, res.IP)
+		}
+		counts[res.IP]++
+	}
+
+	for _, ip := range order {
+		result.ObservedIPs = append(result.ObservedIPs, ObservedIP{IP: ip.String(), Count: counts[ip]})
 	}
+	result.UnstableAddress = len(order) > 1
+	result.Translation = classifyTranslation(len(order), samples, preserved)
+}
+
+// classifyTranslation tells PAT from 1:1 NAT. A 1:1 NAT keeps every port and
+// has a single public IP; a few sockets are needed before that stops looking
+// like luck, and a port-preserving PAT with no competing flows still passes.
+func classifyTranslation(publicIPs, samples, preserved int) Translation {
+	switch {
+	case preserved < samples:
+		return TranslationPAT
+	case publicIPs == 1 && samples >= 3:
+		return TranslationOneToOne
+	}
+	return ""
+}
 
-	conn, err := net.ListenUDP("udp4", localAddr)
+func detectNATType(opts DetectOptions) (*NatResult, error) {
+	opts = opts.withDefaults()
+	statDetections.Add(1)
+	env := opts.probeEnv()
+
+	conn, localIP, err := env.listenLocal()
 	if err != nil {
+		statDetectionErrors.Add(1)
 		return nil, err
 	}
 	defer conn.Close()
 
 	localPort := conn.LocalAddr().(*net.UDPAddr).Port
 
-	printLine("Local Network IP: " + localIP)
-	printLine("Local Port: " + strconv.Itoa(localPort))
+	result := &NatResult{Type: NATUnknown, LocalIP: localIP, LocalPort: localPort, progress: opts.Progress}
+	result.Run = newRunInfo(env, localIP)
+	result.Link = captureLink(result.Run.Interface)
+	result.Run.Network = networkFingerprint(opts.FingerprintSalt, result.Run.Interface, result.Link)
+	// Registered first so it judges the finished result
+	if opts.Policy != nil {
+		defer func() { result.Policy = opts.Policy.Evaluate(resultFacts(result)) }()
+	}
+	// Plugins see the finished result, and the policy sees theirs
+	if len(opts.Plugins) > 0 {
+		defer func() {
+			result.startPhase(PhasePlugins)
+			result.Plugins = runPlugins(opts.Plugins, result, opts.Interface, opts.PluginTimeout)
+		}()
+	}
+	// Registered early so it runs late, after confidence is scored
+	defer func() { result.ShareCode = shareCodeOf(result).String() }()
+	defer result.scoreConfidence()
+	defer result.collectWarnings()
+	defer result.collectEndpoints()
+
+	// Counts answers read by later transactions on the detection socket
+	responses := env.trackResponses(conn)
+	defer func() {
+		counts := responses()
+		result.Responses = &counts
+	}()
+
+	// Uses the gateway's answers, so it is deferred ahead of the query
+	defer func() {
+		if result.Type != NATUDPBlocked {
+			result.Access = guessAccess(result)
+		}
+	}()
 
-	var primaryResult *StunResult
+	if opts.SNMPTarget != "" {
+		defer func() {
+			result.Gateway = queryGateway(env, opts.SNMPTarget, opts.SNMPCommunity, publicIP(result), opts.ProbeTimeout)
+		}()
+	}
+	if opts.Conntrack {
+		defer func() { result.Conntrack = inspectConntrack(localIP, localPort) }()
+	}
 
-	// Test 1: Connect to Server 1
-	primaryResult, err = makeStunRequest(conn, StunServers[0], nil, 3*time.Second, true, 0)
-	if err != nil {
-		// Backup server
-		primaryResult, err = makeStunRequest(conn, StunServers[1], nil, 3*time.Second, true, 0)
-		if err != nil {
-			return &NatResult{Type: "UDP Blocked", Reason: "All STUN requests failed"}, nil
+	// Anything short of full reachability may be the host's own doing
+	defer func() {
+		switch result.Type {
+		case NATFullCone, NATOpen:
+			return
+		}
+		result.Firewall = checkLocalFirewall(localIP)
+		if result.Firewall.BlocksReplies() || (result.Type != NATUDPBlocked && result.Firewall.Active) {
+			result.Reasons = append(result.Reasons, ReasonLocalFirewall)
+		}
+	}()
+
+	// The socket is bound to the wildcard unless --iface pins it, so each
+	// server may be reached through a different uplink and NAT
+	if opts.Interface == "" {
+		if routes := routeSources(env, opts.Servers); distinctSources(routes) > 1 {
+			result.PolicyRouted = true
+			result.Routes = routes
+			defer func() { result.Reasons = append(result.Reasons, ReasonPolicyRouted) }()
 		}
 	}
 
-	if primaryResult.IP == localIP {
-		return &NatResult{Type: "Open Internet", Reason: "No NAT detected", Public: primaryResult}, nil
+	// Independent of the STUN tests, so it also runs when they all fail
+	if opts.QUICTarget != "" {
+		result.startPhase(PhaseQUIC)
+		probe := probeQUIC(opts.QUICTarget, env, opts.ProbeTimeout)
+		result.QUIC = &probe
+	}
+	if opts.DTLSTarget != "" {
+		result.startPhase(PhaseDTLS)
+		probe := probeDTLS(opts.DTLSTarget, env, opts.ProbeTimeout, opts.DTLS)
+		result.DTLS = &probe
+	}
+	if opts.BandwidthTarget != "" {
+		result.startPhase(PhaseBandwidth)
+		probe := probeBandwidth(opts.BandwidthTarget, opts.Servers[0], env)
+		result.Bandwidth = &probe
+	}
+	if opts.ReachTarget != "" {
+		result.startPhase(PhaseReach)
+		probe := probeReach(opts.ReachTarget, env, defaultReachPorts, opts.ProbeTimeout)
+		if probe.Error == "" {
+			probe.Exposure = probeExposure(opts.ReachTarget, env, opts.ProbeTimeout)
+		}
+		result.Reach = &probe
+		// Only a NAT makes reaching every port remarkable
+		defer func() {
+			if probe.Reached > 0 && probe.Reached == len(probe.Ports) && result.Public != nil && result.Public.IP.String() != localIP {
+				result.Reach.DMZ = true
+				result.Reasons = append(result.Reasons, ReasonDMZ)
+			}
+		}()
 	}
 
-	portPreserved := (primaryResult.Port == localPort)
+	if opts.ECNTarget != "" {
+		result.startPhase(PhaseECN)
+		probe := probeECN(opts.ECNTarget, env, opts.ProbeTimeout)
+		result.ECN = &probe
+	}
 
-	// Test 2: Check Mapping Behavior
-	mappingBehavior := "Unknown"
+	result.startPhase(PhasePrimary)
 
-	res2, err := makeStunRequest(conn, StunServers[2], nil, 3*time.Second, true, 0)
-	if err == nil {
-		if res2.IP == primaryResult.IP && res2.Port == primaryResult.Port {
-			mappingBehavior = "Endpoint Independent"
-		} else {
-			mappingBehavior = "Endpoint Dependent"
+	var primaryResult *StunResult
+	var primary StunEndpoint
+
+	// Test 1: Connect to Server 1, falling back to Server 2.
+	// Every transaction is pinned to a resolved IP so later comparisons know
+	// exactly which backend produced each mapping.
+	primaryServers := opts.Servers
+	if len(primaryServers) > 2 {
+		primaryServers = primaryServers[:2]
+	}
+	for _, server := range primaryServers {
+		endpoints, err := env.resolveServer(server)
+		if err != nil {
+			result.warn(WarnServerUnresolved, server, "could not resolve "+server+": "+err.Error())
+			continue
 		}
-	} else {
-		res2, err = makeStunRequest(conn, StunServers[1], nil, 3*time.Second, true, 0)
+
+		res, err := votedRequest(env, result, TestBinding, conn, endpoints[0], opts.PrimaryTimeout, opts.Votes)
 		if err == nil {
-			if res2.IP == primaryResult.IP && res2.Port == primaryResult.Port {
-				mappingBehavior = "Endpoint Independent"
-			} else {
-				mappingBehavior = "Endpoint Dependent"
-			}
-		} else {
-			mappingBehavior = "Endpoint Independent"
+			primaryResult = res
+			primary = endpoints[0]
+			break
 		}
 	}
+	if primaryResult == nil {
+		result.Type = NATUDPBlocked
+		result.Reasons = []ReasonCode{ReasonAllRequestsFailed}
+		return result, nil
+	}
+	result.Public = primaryResult
+
+	// Compare the primary server's answers over UDP and TCP while the rest
+	// of detection runs
+	proxyDone := make(chan ProxyCheck, 1)
+	go func() { proxyDone <- probeProxy(primary.Addr.String(), env, opts.ProbeTimeout) }()
+	defer func() {
+		check := <-proxyDone
+		check.assess(result.UnstableAddress)
+		result.Proxy = &check
+		if len(check.Findings) > 0 {
+			result.Reasons = append(result.Reasons, ReasonRewritten)
+		}
+	}()
+
+	if primaryResult.IP.String() == localIP {
+		// No translation, but a stateful firewall may still drop unsolicited
+		// inbound packets (RFC 3489 "Symmetric UDP Firewall")
+		result.Type = NATOpen
+		result.Mapping = BehaviorEndpointIndependent
+		result.Reasons = []ReasonCode{ReasonNoNAT}
+		result.Filtering = filteringBehavior(env, result, conn, opts, true)
+		switch result.Filtering {
+		case BehaviorAddressDependent, BehaviorAddressPortDependent:
+			result.Type = NATSymmetricFirewall
+			result.Reasons = append(result.Reasons, ReasonInboundFiltered)
+		}
+		return result, nil
+	}
 
-	if mappingBehavior == "Endpoint Dependent" {
-		return &NatResult{
-			Type:   "Symmetric NAT",
-			Reason: "Public IP/Port varies by destination",
-			Public: primaryResult,
-		}, nil
+	// Load-balanced CGNAT and dual-WAN routers may hash each flow onto a
+	// different public IP, which every later comparison would misread
+	result.startPhase(PhaseStability)
+	probeAddressStability(env, result, primary, opts)
+	if result.UnstableAddress {
+		defer func() { result.Reasons = append(result.Reasons, ReasonUnstableAddress) }()
+	}
+	if result.Translation == TranslationOneToOne {
+		// A 1:1 NAT never picks a new port per destination
+		defer func() {
+			if result.Type == NATSymmetric {
+				result.Translation = TranslationPAT
+				return
+			}
+			result.Reasons = append(result.Reasons, ReasonOneToOne)
+		}()
 	}
 
-	// Phase 2: Cone NAT Subtype Detection
-	printLine("Detected Endpoint Independent Mapping. Probing for Cone Subtype...")
+	portPreserved := (primaryResult.Port == localPort)
 
-	subtype := "Port Restricted Cone NAT" // Default assumption
+	// Test 2: Check Mapping Behavior
+	result.startPhase(PhaseMapping)
+
+	// Only compare against a different hostname on a different IP; two backend
+	// IPs of the same round-robin name are not independent destinations.
+	// Servers beyond the first two are preferred, since the fallback pair
+	// often shares an operator with the primary.
+	var mappingServers []string
+	if len(opts.Servers) > 2 {
+		mappingServers = append(mappingServers, opts.Servers[2:]...)
+	}
+	mappingServers = append(mappingServers, primaryServers...)
+	mappingBehavior := "Endpoint Independent"
 
-	for _, server := range Rfc3489Servers {
-		// 1. Establish mapping (shorter timeout for initial connection test)
-		// Resolve the server address first to know exactly which IP we're talking to
-		resolvedAddr, err := net.ResolveUDPAddr("udp4", server)
-		if err != nil {
+	var target StunEndpoint
+	for _, server := range mappingServers {
+		endpoint, ok := pickEndpoint(env, server, primary)
+		if !ok {
 			continue
 		}
 
-		_, err = makeStunRequest(conn, server, nil, 2*time.Second, true, 0)
+		res2, err := votedRequest(env, result, TestMapping, conn, endpoint, opts.MappingTimeout, opts.Votes)
 		if err != nil {
 			continue
 		}
 
-		// 2. Test for Full Cone: Change IP and Port
-		// Important: Use the RESOLVED IP as a string to ensure we're comparing against
-		// the exact server we established communication with, not another server in DNS round-robin
-		resolvedServerStr := resolvedAddr.String()
+		target = endpoint
+		sample := newMappingSample(primary, primaryResult, endpoint, res2)
+		result.MappingSamples = append(result.MappingSamples, sample)
+		if sample.Differs {
+			mappingBehavior = "Endpoint Dependent"
+		}
+		break
+	}
 
-		changeIpPortVal := []byte{0, 0, 0, 6}
-		_, err = makeStunRequest(conn, resolvedServerStr, []Attribute{{Type: AttrChangeRequest, Value: changeIpPortVal}}, 2*time.Second, true, 6)
+	// A single divergent sample can come from an anycast backend or a
+	// reordered packet, so confirm it before declaring Symmetric NAT: repeat
+	// the same pair, then cross a second pair using an independent server.
+	if mappingBehavior == "Endpoint Dependent" {
+		sample, err := sampleMapping(env, result, conn, primary, target, opts.MappingTimeout, opts.Votes)
 		if err == nil {
-			subtype = "Full Cone NAT"
-			break
+			result.MappingSamples = append(result.MappingSamples, sample)
 		}
 
-		// 3. Test for Restricted Cone: Change Port only
-		changePortVal := []byte{0, 0, 0, 2}
-		_, err = makeStunRequest(conn, resolvedServerStr, []Attribute{{Type: AttrChangeRequest, Value: changePortVal}}, 2*time.Second, true, 2)
-		if err == nil {
-			subtype = "Restricted Cone NAT"
-			break
+		for _, server := range opts.Servers {
+			third, ok := pickEndpoint(env, server, primary, target)
+			if !ok {
+				continue
+			}
+			sample, err := sampleMapping(env, result, conn, target, third, opts.MappingTimeout, opts.Votes)
+			if err == nil {
+				result.MappingSamples = append(result.MappingSamples, sample)
+				break
+			}
 		}
-	}
 
-	reason := "Endpoint Independent Mapping."
-	if portPreserved {
-		reason += " Port Preserved."
+		divergent := 0
+		for _, sample := range result.MappingSamples {
+			if sample.Differs {
+				divergent++
+			}
+		}
+		if divergent*2 <= len(result.MappingSamples) {
+			mappingBehavior = "Endpoint Independent"
+		}
 	}
 
-	return &NatResult{
-		Type:   subtype,
-		Reason: reason,
-		Public: primaryResult,
-	}, nil
-}
+	if mappingBehavior == "Endpoint Dependent" {
+		result.Type = NATSymmetric
+		result.Reasons = []ReasonCode{ReasonMappingVaries}
+
+		// Assume the stricter behavior when the server pool cannot tell
+		// address dependence from port dependence
+		result.Mapping = probeMappingPortDependence(env, result, conn, opts.Rfc3489Servers, opts.ProbeTimeout)
+		if result.Mapping == BehaviorUnknown {
+			result.Mapping = BehaviorAddressPortDependent
+		}
 
-func main() {
-	printLine("Starting STUN NAT Type Detection...")
-	printLine("-----------------------------------")
+		// The classic decision tree stops here; the behavior matrix still
+		// needs the filtering column
+		if opts.Algorithm == AlgorithmBehavior {
+			result.Filtering = filteringBehavior(env, result, conn, opts, false)
+		}
+		return result, nil
+	}
+	result.Mapping = BehaviorEndpointIndependent
 
-	result, err := detectNATType()
-	if err != nil {
-		printLine("Error during detection: " + err.Error())
-		return
+	// Phase 2: Cone NAT Subtype Detection
+
+	result.Filtering = filteringBehavior(env, result, conn, opts, true)
+	switch result.Filtering {
+	case BehaviorEndpointIndependent:
+		result.Type = NATFullCone
+	case BehaviorAddressDependent:
+		result.Type = NATRestrictedCone
+	default:
+		result.Type = NATPortRestricted // Default assumption
 	}
 
-	printLine("\n=== Final Result ===")
-	printLine("NAT Type:      " + result.Type)
-	printLine("Reason:        " + result.Reason)
-	if result.Public != nil {
-		printLine("Public IP:     " + result.Public.IP)
-		printLine("Public Port:   " + strconv.Itoa(result.Public.Port))
+	result.Reasons = []ReasonCode{ReasonEndpointIndependent}
+	if portPreserved {
+		result.Reasons = append(result.Reasons, ReasonPortPreserved)
 	}
+
+	return result, nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"syscall/js"
+)
+
+// main publishes the codec, result and compatibility logic as the global
+// natinfo object and then stays alive to serve calls. Browsers cannot send
+// raw UDP, so probing stays in the native binary; the functions here take
+// its JSON results and share codes and classify them with the same code.
+//
+// Every function returns a plain object with the same fields as the CLI's
+// JSON output, or {error: "..."} when its input is invalid.
+func main() {
+	js.Global().Set("natinfo", js.ValueOf(map[string]any{
+		"version":              version,
+		"decodeMessage":        js.FuncOf(jsDecodeMessage),
+		"encodeBindingRequest": js.FuncOf(jsEncodeBindingRequest),
+		"explain":              js.FuncOf(jsExplain),
+		"compat":               js.FuncOf(jsCompat),
+		"advise":               js.FuncOf(jsAdvise),
+	}))
+	select {}
+}
+
+// jsDecodeMessage(message) decodes a STUN message given as a Uint8Array or
+// a hex string
+func jsDecodeMessage(this js.Value, args []js.Value) any {
+	if len(args) != 1 {
+		return jsError("decodeMessage expects one message")
+	}
+	var buf []byte
+	if args[0].Type() == js.TypeString {
+		var err error
+		if buf, err = decodeHex(args[0].String()); err != nil {
+			return jsError("invalid hex: " + err.Error())
+		}
+	} else {
+		buf = make([]byte, args[0].Get("length").Int())
+		js.CopyBytesToGo(buf, args[0])
+	}
+	msg, err := interpretStunMessage(buf)
+	if err != nil {
+		return jsError("invalid STUN message: " + err.Error())
+	}
+	return jsObject(msg)
+}
+
+// jsEncodeBindingRequest() returns {transaction_id, message} for a fresh
+// RFC 5389 Binding request, the message as a Uint8Array
+func jsEncodeBindingRequest(this js.Value, args []js.Value) any {
+	tid := make([]byte, 12)
+	rand.Read(tid)
+	msg := encodeStunMessage(BindingRequest, tid, nil)
+	out := js.Global().Get("Uint8Array").New(len(msg))
+	js.CopyBytesToJS(out, msg)
+	decoded, _ := interpretStunMessage(msg)
+	return map[string]any{"transaction_id": decoded.TransactionID, "message": out}
+}
+
+// jsExplain(code) decodes a share code
+func jsExplain(this js.Value, args []js.Value) any {
+	if len(args) != 1 {
+		return jsError("explain expects one share code")
+	}
+	c, err := parseShareCode(args[0].String())
+	if err != nil {
+		return jsError("invalid share code: " + err.Error())
+	}
+	return jsObject(c)
+}
+
+// jsCompat(codeA, codeB) predicts whether two peers can connect directly
+func jsCompat(this js.Value, args []js.Value) any {
+	if len(args) != 2 {
+		return jsError("compat expects two share codes")
+	}
+	var codes [2]ShareCode
+	for i := range codes {
+		c, err := parseShareCode(args[i].String())
+		if err != nil {
+			return jsError("invalid share code " + args[i].String() + ": " + err.Error())
+		}
+		codes[i] = c
+	}
+	verdict, note := compatibility(codes[0], codes[1])
+	return jsObject(CompatReport{codes[0], codes[1], verdict, note})
+}
+
+// Advice is what advise returns for a detection result
+type Advice struct {
+	Type            NATType  `json:"type"`
+	TypeName        string   `json:"type_name"`
+	ShareCode       string   `json:"share_code"`
+	Reason          string   `json:"reason"`
+	Recommendations []string `json:"recommendations"`
+	// Report is the text report detect prints, without color
+	Report string `json:"report"`
+}
+
+// jsAdvise(result) takes a result from `nat-info --output json`, as an
+// object or a JSON string, and returns its advice and text report
+func jsAdvise(this js.Value, args []js.Value) any {
+	if len(args) != 1 {
+		return jsError("advise expects one result")
+	}
+	text := args[0]
+	if text.Type() != js.TypeString {
+		text = js.Global().Get("JSON").Call("stringify", text)
+	}
+	var result NatResult
+	if err := json.Unmarshal([]byte(text.String()), &result); err != nil {
+		return jsError("invalid result: " + err.Error())
+	}
+
+	var report bytes.Buffer
+	(&textReport{w: &report}).render(&result)
+	return jsObject(Advice{
+		Type:            result.Type,
+		TypeName:        result.Type.String(),
+		ShareCode:       shareCodeOf(&result).String(),
+		Reason:          result.ReasonText(),
+		Recommendations: recommendations(&result),
+		Report:          report.String(),
+	})
+}
+
+// jsObject converts v to a JavaScript object through its JSON encoding, so
+// callers see the same field names and codes as the CLI prints
+func jsObject(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return jsError(err.Error())
+	}
+	return js.Global().Get("JSON").Call("parse", string(data))
+}
+
+func jsError(msg string) any {
+	return map[string]any{"error": msg}
+}
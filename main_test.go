@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestXorMappedAddressRoundTrip(t *testing.T) {
+	tid := []byte("0123456789ab")
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"ipv4", "203.0.113.7:41000"},
+		{"ipv4 low port", "192.0.2.1:1"},
+		{"ipv6", "[2001:db8::1234:5678]:3478"},
+		{"ipv6 max port", "[2001:db8:ffff::c000:207]:65535"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := netip.MustParseAddrPort(tt.addr)
+			value := appendXorAddress(nil, net.UDPAddrFromAddrPort(want), tid)
+			msg := encodeStunMessage(BindingResponse, tid, []Attribute{{Type: AttrXorMappedAddress, Value: value}})
+
+			res, err := parseStunResponse(msg)
+			if err != nil {
+				t.Fatalf("parseStunResponse: %v", err)
+			}
+			if got := res.AddrPort(); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestXorMappedAddressTruncated(t *testing.T) {
+	tid := []byte("0123456789ab")
+	v6 := appendXorAddress(nil, net.UDPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::1]:3478")), tid)
+	v4 := appendXorAddress(nil, net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.0.2.1:3478")), tid)
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"ipv6 cut to ipv4 length", v6[:8]},
+		{"ipv6 one byte short", v6[:19]},
+		{"ipv4 one byte short", v4[:7]},
+		{"header only", v4[:4]},
+		{"family missing", v4[:2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := encodeStunMessage(BindingResponse, tid, []Attribute{{Type: AttrXorMappedAddress, Value: tt.value}})
+			if res, err := parseStunResponse(msg); err == nil {
+				t.Errorf("parsed %v from a truncated attribute", res.AddrPort())
+			}
+		})
+	}
+}
+
+// bindingResponse is a typical server answer: XOR-MAPPED-ADDRESS,
+// MAPPED-ADDRESS, OTHER-ADDRESS, SOFTWARE and FINGERPRINT
+func bindingResponse() []byte {
+	tid := []byte("0123456789ab")
+	addr := net.UDPAddrFromAddrPort(netip.MustParseAddrPort("203.0.113.7:41000"))
+	resp := appendStunHeader(nil, BindingResponse, tid)
+	resp = appendAttribute(resp, AttrXorMappedAddress, appendXorAddress(nil, addr, tid))
+	resp = appendAttribute(resp, AttrMappedAddress, []byte{0, FamilyIPv4, 0xa0, 0x28, 203, 0, 113, 7})
+	resp = appendAttribute(resp, AttrOtherAddress, []byte{0, FamilyIPv4, 0x0d, 0x97, 198, 51, 100, 2})
+	resp = appendAttribute(resp, 0x8022, []byte("bench")) // SOFTWARE
+	return appendFingerprint(resp)
+}
+
+func BenchmarkParseStunResponse(b *testing.B) {
+	resp := bindingResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseStunResponse(resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseStunMessage(b *testing.B) {
+	resp := bindingResponse()
+	var msg StunMessage
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := parseStunMessage(resp, &msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Overlay defaults: WireGuard's customary listen port and the persistent
+// keepalive its documentation recommends for peers behind NAT
+const (
+	DefaultMeshPort      = 51820
+	DefaultMeshKeepalive = 25 * time.Second
+)
+
+// Mesh VPN preflight verdicts
+const (
+	// MeshReady: tunnels can form and the keepalive holds them open
+	MeshReady = "ready"
+	// MeshKeepalive: the NAT drops idle bindings before the keepalive
+	// refreshes them
+	MeshKeepalive = "keepalive-too-long"
+	// MeshRelay: at least one peer site can only be reached through a relay
+	MeshRelay = "relay"
+	// MeshBlocked: UDP from the overlay port gets nowhere
+	MeshBlocked = "blocked"
+)
+
+// MeshPeer is the prediction for one other site
+type MeshPeer struct {
+	Code    ShareCode `json:"code"`
+	Verdict string    `json:"verdict"`
+	Note    string    `json:"note"`
+}
+
+// MeshCheck is the outcome of the mesh VPN preflight
+type MeshCheck struct {
+	Port int `json:"port"`
+	// Mapping is the overlay port's UDP mapping; PortBound is false when
+	// the VPN held the port and a random one stood in
+	Mapping   LocalMapping `json:"mapping"`
+	PortBound bool         `json:"port_bound"`
+	NAT       *NatResult   `json:"nat,omitempty"`
+	// Keepalive is the persistent keepalive judged against Lifetime, the
+	// measured UDP binding lifetime, when a responder was given
+	Keepalive   time.Duration `json:"keepalive"`
+	Lifetime    *IdleTimeout  `json:"lifetime,omitempty"`
+	KeepaliveOK *bool         `json:"keepalive_ok,omitempty"`
+	// ShareCode is this site's code, with the lifetime bucket filled in
+	// when it was measured, for the other sites to compare against
+	ShareCode ShareCode  `json:"share_code"`
+	Peers     []MeshPeer `json:"peers,omitempty"`
+	Verdict   string     `json:"verdict"`
+	Notes     []string   `json:"notes"`
+}
+
+// measureLifetime runs the UDP idle test against a responder --timeouts for
+// the keepalive interval and the idle ladder up to maxIdle, in parallel
+func measureLifetime(target *net.UDPAddr, env *probeEnv, keepalive, maxIdle time.Duration) IdleTimeout {
+	ladder := []time.Duration{keepalive}
+	for _, idle := range idleLadder {
+		if idle <= maxIdle && idle != keepalive {
+			ladder = append(ladder, idle)
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var probes []IdleProbe
+	for _, idle := range ladder {
+		wg.Add(1)
+		go func(idle time.Duration) {
+			defer wg.Done()
+			p := probeUDPIdle(target, env, idle)
+			mu.Lock()
+			probes = append(probes, p)
+			mu.Unlock()
+		}(idle)
+	}
+	wg.Wait()
+	slices.SortFunc(probes, func(a, b IdleProbe) int { return int(a.Idle - b.Idle) })
+	return bracketTimeout("udp", probes)
+}
+
+// checkMesh runs the mesh VPN preflight
+func checkMesh(opts DetectOptions, port int, keepalive time.Duration, responder *net.UDPAddr, maxIdle time.Duration, peers []ShareCode) *MeshCheck {
+	check := &MeshCheck{Port: port, Keepalive: keepalive}
+	env := opts.probeEnv()
+
+	printProgress("Probing the overlay port's UDP mapping...")
+	conn, _, err := env.bindPort(port)
+	if err == nil {
+		check.PortBound = true
+	} else {
+		conn, _, err = env.listenLocal()
+	}
+	if err != nil {
+		check.Mapping = LocalMapping{Local: port, Error: err.Error()}
+	} else {
+		if servers, err := mappingServers(opts); err != nil {
+			check.Mapping = LocalMapping{Local: port, Error: err.Error()}
+		} else {
+			check.Mapping = probeLocalMapping(env, conn, servers, opts.PrimaryTimeout)
+		}
+		conn.Close()
+	}
+
+	printProgress("Detecting NAT behavior...")
+	if result, err := detectNATType(opts); err == nil {
+		check.NAT = result
+		check.ShareCode = shareCodeOf(result)
+	}
+
+	if responder != nil {
+		printProgress("Measuring the UDP binding lifetime up to " + max(maxIdle, keepalive).String() + "; this takes that long...")
+		lifetime := measureLifetime(responder, env, keepalive, maxIdle)
+		check.Lifetime = &lifetime
+		for _, p := range lifetime.Probes {
+			if p.Idle == keepalive {
+				ok := p.Alive
+				check.KeepaliveOK = &ok
+			}
+		}
+		if bucket := lifetimeBits(lifetime.AtLeast); bucket > 0 {
+			check.ShareCode.Lifetime = lifetimeBuckets[bucket-1]
+		}
+	}
+
+	for _, code := range peers {
+		verdict, note := compatibility(check.ShareCode, code)
+		check.Peers = append(check.Peers, MeshPeer{Code: code, Verdict: verdict, Note: note})
+	}
+
+	check.Verdict = meshVerdict(check)
+	return check
+}
+
+// meshVerdict sets the verdict and explains it in overlay terms: whether
+// peers can reach this site directly, and whether the keepalive holds the
+// binding open
+func meshVerdict(c *MeshCheck) string {
+	verdict := MeshReady
+	portName := strconv.Itoa(c.Port)
+	switch m := c.Mapping; {
+	case m.Public == nil:
+		verdict = MeshBlocked
+		c.Notes = append(c.Notes, "UDP from the overlay port got no answer: tunnels cannot form over UDP here, so the overlay falls back to its relays (Tailscale DERP) or fails (plain WireGuard).")
+	case m.Second != nil && !m.Consistent:
+		c.Notes = append(c.Notes, "The overlay port's mapping differs per destination (symmetric NAT): peers learn an endpoint that only works for the server that reported it, so direct tunnels need the other site to accept unsolicited packets, and otherwise go through a relay.")
+	case m.Preserved:
+		c.Notes = append(c.Notes, "The overlay port leaves the NAT unchanged as "+m.Public.AddrPort().String()+", so forwarding UDP "+portName+" would make this site a reachable endpoint for every peer.")
+	default:
+		c.Notes = append(c.Notes, "The NAT maps the overlay port to "+m.Public.AddrPort().String()+" consistently: peers can use that endpoint once this site has sent to them.")
+	}
+	if !c.PortBound {
+		c.Notes = append(c.Notes, "Port "+portName+" is held by a running program, likely the VPN itself; the mapping was probed from another port.")
+	}
+	if c.NAT != nil {
+		switch c.NAT.Filtering {
+		case BehaviorEndpointIndependent:
+			c.Notes = append(c.Notes, "The NAT accepts packets from any peer once the tunnel has sent anything (endpoint-independent filtering), so peers can start handshakes.")
+		case BehaviorAddressDependent, BehaviorAddressPortDependent:
+			c.Notes = append(c.Notes, "The NAT only accepts packets from endpoints this site has sent to, so both sites must send at about the same time: coordinated overlays such as Tailscale do this, plain WireGuard needs the other site to be reachable.")
+		}
+	}
+
+	switch {
+	case c.Lifetime == nil:
+		c.Notes = append(c.Notes, "The binding lifetime was not measured; add --responder with a nat-info responder --timeouts to check the keepalive.")
+	case c.KeepaliveOK != nil && !*c.KeepaliveOK:
+		if verdict == MeshReady {
+			verdict = MeshKeepalive
+		}
+		limit := ""
+		if c.Lifetime.AtLeast > 0 && c.Lifetime.AtLeast < c.Keepalive {
+			limit = " to " + c.Lifetime.AtLeast.String() + " or less"
+		}
+		c.Notes = append(c.Notes, "The NAT dropped a binding idle for "+c.Keepalive.String()+": with that keepalive, idle tunnels go silent and peers cannot reach this site until it sends again. Lower PersistentKeepalive"+limit+".")
+	case c.Lifetime.AtMost == 0:
+		c.Notes = append(c.Notes, "Every tested binding survived up to "+c.Lifetime.AtLeast.String()+" idle, so a "+c.Keepalive.String()+" keepalive holds tunnels open.")
+	default:
+		c.Notes = append(c.Notes, "Bindings last between "+c.Lifetime.AtLeast.String()+" and "+c.Lifetime.AtMost.String()+", so a "+c.Keepalive.String()+" keepalive holds tunnels open.")
+	}
+	if c.Lifetime != nil && c.Lifetime.Incomplete {
+		c.Notes = append(c.Notes, "A longer idle period survived a shorter one, so packet loss rather than the NAT's timer ended some probes; repeat the test.")
+	}
+
+	for _, p := range c.Peers {
+		switch p.Verdict {
+		case CompatRelay:
+			if verdict != MeshBlocked {
+				verdict = MeshRelay
+			}
+			c.Notes = append(c.Notes, "Traffic to "+p.Code.String()+" goes through a relay (Tailscale DERP), adding latency and capping throughput; plain WireGuard cannot connect at all unless one site forwards UDP "+portName+".")
+		case CompatUnknown:
+			c.Notes = append(c.Notes, "Whether "+p.Code.String()+" connects directly is unknown; run nat-info at both sites again.")
+		}
+	}
+	return verdict
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+)
+
+// StunMessage is a decoded STUN message header with its raw attributes
+type StunMessage struct {
+	Type          uint16
+	Length        uint16
+	Cookie        uint32
+	TransactionID []byte
+	Attributes    []Attribute
+}
+
+// attrNames maps attribute types to their RFC names for display
+var attrNames = map[uint16]string{
+	AttrMappedAddress:      "MAPPED-ADDRESS",
+	0x0002:                 "RESPONSE-ADDRESS",
+	AttrChangeRequest:      "CHANGE-REQUEST",
+	0x0004:                 "SOURCE-ADDRESS",
+	AttrChangedAddress:     "CHANGED-ADDRESS",
+	AttrUsername:           "USERNAME",
+	AttrMessageIntegrity:   "MESSAGE-INTEGRITY",
+	AttrErrorCode:          "ERROR-CODE",
+	0x000A:                 "UNKNOWN-ATTRIBUTES",
+	AttrLifetime:           "LIFETIME",
+	AttrXorPeerAddress:     "XOR-PEER-ADDRESS",
+	AttrData:               "DATA",
+	AttrRealm:              "REALM",
+	AttrNonce:              "NONCE",
+	AttrXorRelayedAddress:  "XOR-RELAYED-ADDRESS",
+	AttrRequestedTransport: "REQUESTED-TRANSPORT",
+	AttrXorMappedAddress:   "XOR-MAPPED-ADDRESS",
+	AttrPriority:           "PRIORITY",
+	AttrUseCandidate:       "USE-CANDIDATE",
+	0x0026:                 "PADDING",
+	AttrResponsePort:       "RESPONSE-PORT",
+	0x8022:                 "SOFTWARE",
+	0x8023:                 "ALTERNATE-SERVER",
+	AttrFingerprint:        "FINGERPRINT",
+	AttrIceControlled:      "ICE-CONTROLLED",
+	AttrIceControlling:     "ICE-CONTROLLING",
+	0x802B:                 "RESPONSE-ORIGIN",
+	AttrOtherAddress:       "OTHER-ADDRESS",
+}
+
+// attrName returns the RFC name of an attribute type, or its hex value
+func attrName(attrType uint16) string {
+	if name, ok := attrNames[attrType]; ok {
+		return name
+	}
+	return "0x" + strconv.FormatUint(uint64(attrType), 16)
+}
+
+// decodeStunMessage splits a STUN message into its header fields and
+// attributes without interpreting attribute values. Messages without the
+// RFC 5389 magic cookie are treated as RFC 3489 with a 16-byte transaction ID.
+func decodeStunMessage(buffer []byte) (*StunMessage, error) {
+	msg := &StunMessage{}
+	if err := parseStunMessage(buffer, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseStunMessage decodes into a caller-owned message, reusing its
+// attribute slice, so a long-running server can decode without allocating.
+// The transaction ID and attribute values alias buffer.
+func parseStunMessage(buffer []byte, msg *StunMessage) error {
+	if len(buffer) < HeaderLength {
+		return errors.New("buffer too short")
+	}
+
+	msg.Type = binary.BigEndian.Uint16(buffer[0:2])
+	msg.Length = binary.BigEndian.Uint16(buffer[2:4])
+	msg.Cookie = binary.BigEndian.Uint32(buffer[4:8])
+	msg.Attributes = msg.Attributes[:0]
+	if msg.Cookie == MagicCookie {
+		msg.TransactionID = buffer[8:20]
+	} else {
+		msg.TransactionID = buffer[4:20]
+	}
+
+	if len(buffer) < HeaderLength+int(msg.Length) {
+		return errors.New("buffer incomplete")
+	}
+
+	offset := HeaderLength
+	limit := HeaderLength + int(msg.Length)
+
+	for offset+4 <= limit {
+		attrType := binary.BigEndian.Uint16(buffer[offset : offset+2])
+		attrLen := int(binary.BigEndian.Uint16(buffer[offset+2 : offset+4]))
+		offset += 4
+
+		if offset+attrLen > limit {
+			return errors.New("attribute " + attrName(attrType) + " overruns message")
+		}
+
+		msg.Attributes = append(msg.Attributes, Attribute{Type: attrType, Value: buffer[offset : offset+attrLen]})
+		offset += (attrLen + 3) & ^3
+	}
+
+	return nil
+}
+
+// decodeHex decodes a hex dump, ignoring whitespace and an optional 0x prefix
+func decodeHex(s string) ([]byte, error) {
+	clean := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', '\r', ':':
+		default:
+			clean = append(clean, c)
+		}
+	}
+	if len(clean) >= 2 && clean[0] == '0' && (clean[1] == 'x' || clean[1] == 'X') {
+		clean = clean[2:]
+	}
+	return hex.DecodeString(string(clean))
+}
+
+// DecodedMessage is a STUN message with its attribute values interpreted
+// where the type is known, as decode shows it
+type DecodedMessage struct {
+	Type          uint16             `json:"type"`
+	Length        int                `json:"length"`
+	RFC5389       bool               `json:"rfc5389"`
+	TransactionID string             `json:"transaction_id"`
+	Attributes    []DecodedAttribute `json:"attributes"`
+}
+
+// DecodedAttribute is one attribute of a DecodedMessage. Exactly one of
+// Address, Text and Hex is set, except for an address attribute whose value
+// does not parse.
+type DecodedAttribute struct {
+	Type    uint16 `json:"type"`
+	Name    string `json:"name"`
+	Length  int    `json:"length"`
+	Address string `json:"address,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Hex     string `json:"hex,omitempty"`
+}
+
+// interpretStunMessage decodes buf and interprets its attributes
+func interpretStunMessage(buf []byte) (*DecodedMessage, error) {
+	msg, err := decodeStunMessage(buf)
+	if err != nil {
+		return nil, err
+	}
+	out := &DecodedMessage{
+		Type:          msg.Type,
+		Length:        int(msg.Length),
+		RFC5389:       msg.Cookie == MagicCookie,
+		TransactionID: hex.EncodeToString(msg.TransactionID),
+		Attributes:    make([]DecodedAttribute, 0, len(msg.Attributes)),
+	}
+
+	// XOR-MAPPED-ADDRESS is keyed by the cookie and transaction ID
+	var xor []byte
+	if out.RFC5389 {
+		xor = buf[4:20]
+	}
+	for _, attr := range msg.Attributes {
+		d := DecodedAttribute{Type: attr.Type, Name: attrName(attr.Type), Length: len(attr.Value)}
+		switch attr.Type {
+		case AttrXorMappedAddress:
+			if addr := decodeAddress(attr.Value, xor); addr != nil {
+				d.Address = addr.AddrPort().String()
+			}
+		case AttrXorPeerAddress, AttrXorRelayedAddress:
+			if addr := decodeAddress(attr.Value, xor); addr != nil {
+				d.Address = addr.AddrPort().String()
+			}
+		case AttrMappedAddress, AttrChangedAddress, AttrOtherAddress, 0x0004, 0x8023, 0x802B:
+			if addr := decodeAddress(attr.Value, nil); addr != nil {
+				d.Address = addr.AddrPort().String()
+			}
+		case 0x8022, AttrRealm:
+			d.Text = string(attr.Value)
+		default:
+			d.Hex = hex.EncodeToString(attr.Value)
+		}
+		out.Attributes = append(out.Attributes, d)
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Internal counters. They are published under /debug/vars by expvar and in
+// Prometheus text format under /metrics, so an operator can see detection
+// quality degrade (more retransmits and timeouts) before results change.
+var (
+	statTransactions    = expvar.NewInt("stun_transactions")
+	statRetransmits     = expvar.NewInt("stun_retransmits")
+	statTimeouts        = expvar.NewInt("stun_timeouts")
+	statParseErrors     = expvar.NewInt("stun_parse_errors")
+	statDetections      = expvar.NewInt("detections")
+	statDetectionErrors = expvar.NewInt("detection_errors")
+)
+
+// promCounters lists what /metrics exports, in order
+var promCounters = []struct {
+	name, help string
+	v          *expvar.Int
+}{
+	{"natinfo_stun_transactions_total", "STUN binding transactions started.", statTransactions},
+	{"natinfo_stun_retransmits_total", "STUN requests sent again after no answer.", statRetransmits},
+	{"natinfo_stun_timeouts_total", "STUN transactions that got no answer.", statTimeouts},
+	{"natinfo_stun_parse_errors_total", "STUN responses that could not be parsed.", statParseErrors},
+	{"natinfo_detections_total", "Detection runs started.", statDetections},
+	{"natinfo_detection_errors_total", "Detection runs that failed outright.", statDetectionErrors},
+}
+
+// metrics serves the counters and a few runtime gauges in Prometheus text
+// exposition format
+func (s *apiServer) metrics(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	metric := func(name, kind, help, value string) {
+		b = append(b, "# HELP "+name+" "+help+"\n# TYPE "+name+" "+kind+"\n"+name+" "+value+"\n"...)
+	}
+	for _, c := range promCounters {
+		metric(c.name, "counter", c.help, strconv.FormatInt(c.v.Value(), 10))
+	}
+
+	st, ready := s.status()
+	metric("natinfo_ready", "gauge", "1 while /readyz reports ready.", boolGauge(ready))
+	if st.LastSuccessAge != nil {
+		metric("natinfo_last_success_age_seconds", "gauge", "Seconds since the last successful detection.", strconv.FormatFloat(*st.LastSuccessAge, 'f', 3, 64))
+	}
+	metric("natinfo_uptime_seconds", "gauge", "Seconds since the daemon started.", strconv.FormatFloat(time.Since(s.started).Seconds(), 'f', 3, 64))
+	metric("go_goroutines", "gauge", "Number of goroutines.", strconv.Itoa(runtime.NumGoroutine()))
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metric("go_memstats_heap_alloc_bytes", "gauge", "Heap bytes allocated and in use.", strconv.FormatUint(mem.HeapAlloc, 10))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// boolGauge renders a boolean as a 0/1 gauge value
+func boolGauge(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultMigrationInterval is how often a mapping tracker refreshes its
+// binding, well inside the shortest UDP timeouts seen in the wild so the
+// mapping never expires between checks
+const DefaultMigrationInterval = 15 * time.Second
+
+// Migration is a change of a socket's public mapping while the socket
+// stayed open, as NAT rebalancing or a CGNAT failover causes. It happened
+// between LastSeen, the last answer still reporting From, and Detected.
+type Migration struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	LastSeen time.Time `json:"last_seen"`
+	Detected time.Time `json:"detected"`
+}
+
+// describe renders the migration with the window it happened in
+func (m Migration) describe() string {
+	return m.From + " -> " + m.To + " between " + m.LastSeen.Format("15:04:05") + " and " + m.Detected.Format("15:04:05")
+}
+
+// mappingTracker holds one socket open for as long as a long-running mode
+// runs and refreshes its binding with a STUN server, reporting each change
+// of the public mapping. Detection binds fresh sockets every run, so
+// without it a live session's mapping moving would go unnoticed.
+type mappingTracker struct {
+	env      *probeEnv
+	conn     *net.UDPConn
+	server   StunEndpoint
+	interval time.Duration
+	timeout  time.Duration
+	onChange func(Migration)
+
+	mu       sync.Mutex
+	mapped   string
+	lastSeen time.Time
+	pending  []Migration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startMappingTracker binds a socket like detection's and refreshes it
+// against the first server every interval until close. onChange, if set,
+// is called from the tracker's goroutine.
+func startMappingTracker(opts DetectOptions, interval time.Duration, onChange func(Migration)) (*mappingTracker, error) {
+	opts = opts.withDefaults()
+	endpoints, err := resolveServer(opts.Servers[0])
+	if err != nil {
+		return nil, err
+	}
+	env := opts.probeEnv()
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	t := &mappingTracker{
+		env:      env,
+		conn:     conn,
+		server:   endpoints[0],
+		interval: interval,
+		timeout:  opts.PrimaryTimeout,
+		onChange: onChange,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *mappingTracker) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		t.refresh()
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh sends one binding request and records a changed mapping. A lost
+// answer changes nothing: the next one shows whether the mapping moved.
+func (t *mappingTracker) refresh() {
+	res, err := t.env.makeStunRequest(t.conn, t.server.Addr, nil, t.timeout, true, 0)
+	if err != nil {
+		return
+	}
+	mapped := res.AddrPort().String()
+	now := t.env.clock.Now()
+
+	t.mu.Lock()
+	var moved *Migration
+	if t.mapped != "" && mapped != t.mapped {
+		moved = &Migration{From: t.mapped, To: mapped, LastSeen: t.lastSeen, Detected: now}
+		t.pending = append(t.pending, *moved)
+	}
+	t.mapped, t.lastSeen = mapped, now
+	t.mu.Unlock()
+
+	if moved != nil && t.onChange != nil {
+		t.onChange(*moved)
+	}
+}
+
+// current returns the mapping the last answer reported, or ""
+func (t *mappingTracker) current() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.mapped
+}
+
+// take returns the migrations seen since the last call
+func (t *mappingTracker) take() []Migration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := t.pending
+	t.pending = nil
+	return out
+}
+
+// close stops the refreshes and releases the socket
+func (t *mappingTracker) close() {
+	close(t.stop)
+	<-t.done
+	t.conn.Close()
+}
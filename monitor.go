@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Monitor timeline event kinds
+const (
+	EventEstablished   = "established"
+	EventLost          = "lost"
+	EventRecovered     = "recovered"
+	EventAddressChange = "address-change"
+	EventDead          = "dead"
+	EventStopped       = "stopped"
+)
+
+// Causes of a path's death
+const (
+	CauseTimeout       = "silent-timeout"
+	CauseICMP          = "icmp-error"
+	CauseAddressChange = "address-change"
+)
+
+// MonitorEvent is one entry in a path's timeline
+type MonitorEvent struct {
+	Time   time.Time     `json:"time"`
+	Kind   string        `json:"kind"`
+	Detail string        `json:"detail,omitempty"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+}
+
+// MonitorSample is one probe of a latency run
+type MonitorSample struct {
+	Time   time.Time     `json:"time"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+	Lost   bool          `json:"lost,omitempty"`
+	Mapped string        `json:"mapped,omitempty"`
+}
+
+// MonitorLatency summarizes the answered probes of a latency run. Jitter
+// is the mean difference between consecutive round trips.
+type MonitorLatency struct {
+	Min    time.Duration `json:"min"`
+	Median time.Duration `json:"median"`
+	P95    time.Duration `json:"p95"`
+	Max    time.Duration `json:"max"`
+	Jitter time.Duration `json:"jitter"`
+}
+
+// MonitorResult is the timeline of a monitored path. When it died, the
+// death happened between LastSuccess and the first lost probe after it.
+// A latency run never dies: it records every probe in Samples and counts
+// the times the mapping moved under the same socket in Migrations.
+type MonitorResult struct {
+	Target      string          `json:"target"`
+	Mode        string          `json:"mode"`
+	Mapped      string          `json:"mapped,omitempty"`
+	Started     time.Time       `json:"started"`
+	Ended       time.Time       `json:"ended"`
+	Probes      int             `json:"probes"`
+	Lost        int             `json:"lost"`
+	Alive       bool            `json:"alive"`
+	Cause       string          `json:"cause,omitempty"`
+	LastSuccess time.Time       `json:"last_success,omitempty"`
+	Events      []MonitorEvent  `json:"events"`
+	Migrations  int             `json:"migrations,omitempty"`
+	Latency     *MonitorLatency `json:"latency,omitempty"`
+	Samples     []MonitorSample `json:"samples,omitempty"`
+}
+
+// pathMonitor probes one path at a low rate. To a STUN server it sends
+// plain binding requests on a connected socket, so ICMP errors surface as
+// read errors; to a peer it sends ICE connectivity checks through agent,
+// which also keeps answering the peer's own checks.
+type pathMonitor struct {
+	env      *probeEnv
+	conn     *net.UDPConn
+	agent    *iceAgent
+	peer     *Candidate
+	interval time.Duration
+	timeout  time.Duration
+	failures int
+	stop     <-chan struct{}
+	onEvent  func(MonitorEvent)
+	// latency keeps probing through losses and address changes and
+	// records every probe, handing each to onSample
+	latency  bool
+	onSample func(MonitorSample)
+
+	result  *MonitorResult
+	tid     []byte
+	sent    time.Time
+	waiting bool
+	misses  int
+}
+
+func (m *pathMonitor) event(kind, detail string, rtt time.Duration) {
+	e := MonitorEvent{Time: m.env.clock.Now(), Kind: kind, Detail: detail, RTT: rtt}
+	m.result.Events = append(m.result.Events, e)
+	if m.onEvent != nil {
+		m.onEvent(e)
+	}
+}
+
+// sample records one probe of a latency run
+func (m *pathMonitor) sample(s MonitorSample) {
+	if !m.latency {
+		return
+	}
+	m.result.Samples = append(m.result.Samples, s)
+	if m.onSample != nil {
+		m.onSample(s)
+	}
+}
+
+// lose counts the outstanding probe as lost
+func (m *pathMonitor) lose(detail string) {
+	m.waiting = false
+	m.misses++
+	m.result.Lost++
+	m.event(EventLost, detail+" ("+strconv.Itoa(m.misses)+" in a row)", 0)
+	m.sample(MonitorSample{Time: m.sent, Lost: true})
+}
+
+// send starts one probe
+func (m *pathMonitor) send() error {
+	m.result.Probes++
+	m.waiting = true
+	if m.agent != nil {
+		// Answers to older checks arrive too late to count
+		clear(m.agent.pending)
+		m.sent = m.env.clock.Now()
+		return m.agent.sendCheck(*m.peer)
+	}
+	m.tid = make([]byte, 12)
+	rand.Read(m.tid)
+	req := encodeStunMessage(BindingRequest, m.tid, nil)
+	m.sent = m.env.clock.Now()
+	_, err := m.conn.Write(req)
+	return err
+}
+
+// answer matches a datagram to the outstanding probe and returns the
+// mapped address it reports
+func (m *pathMonitor) answer(buf []byte, from *net.UDPAddr) (string, bool) {
+	if m.agent != nil {
+		if _, ok := m.agent.handle(buf, from, &PairResult{}); !ok {
+			return "", false
+		}
+	} else if len(buf) < HeaderLength || string(buf[8:20]) != string(m.tid) {
+		return "", false
+	}
+	mapped, err := parseStunResponse(buf)
+	if err != nil {
+		return "", true
+	}
+	return mapped.AddrPort().String(), true
+}
+
+// run probes until the path dies or stop is closed
+func (m *pathMonitor) run() *MonitorResult {
+	m.result.Started = m.env.clock.Now()
+	m.result.Alive = true
+	buf := make([]byte, 2048)
+	next := m.env.clock.Now()
+
+	defer func() { m.result.Latency = summarizeLatency(m.result.Samples) }()
+	die := func(cause, detail string) *MonitorResult {
+		m.result.Alive = false
+		m.result.Cause = cause
+		if !m.result.LastSuccess.IsZero() {
+			detail += "; last answer " + m.env.clock.Now().Sub(m.result.LastSuccess).Round(time.Millisecond).String() + " ago"
+		}
+		m.event(EventDead, detail, 0)
+		m.result.Ended = m.env.clock.Now()
+		return m.result
+	}
+
+	for {
+		select {
+		case <-m.stop:
+			m.event(EventStopped, "", 0)
+			m.result.Ended = m.env.clock.Now()
+			return m.result
+		default:
+		}
+
+		now := m.env.clock.Now()
+		if m.waiting && now.Sub(m.sent) >= m.timeout {
+			m.lose("no answer within " + m.timeout.String())
+			if !m.latency && m.misses >= m.failures {
+				return die(CauseTimeout, strconv.Itoa(m.misses)+" probes in a row went unanswered")
+			}
+		}
+		if !now.Before(next) {
+			if err := m.send(); err != nil {
+				if cause, ok := icmpCause(err); ok && !m.latency {
+					return die(CauseICMP, cause)
+				}
+			}
+			next = now.Add(m.interval)
+		}
+
+		// Wake often enough to notice stop and probe timeouts promptly
+		wake := minTime(next, now.Add(500*time.Millisecond))
+		if m.waiting {
+			wake = minTime(wake, m.sent.Add(m.timeout))
+		}
+		m.conn.SetReadDeadline(m.env.deadline(wake))
+		n, from, stamp, err := readStamped(m.conn, buf)
+		if err != nil {
+			// A latency run outlasts outages, which often come with ICMP
+			// errors from the access network
+			if cause, ok := icmpCause(err); ok {
+				if !m.latency {
+					return die(CauseICMP, cause)
+				}
+				if m.waiting {
+					m.lose(cause)
+				}
+			}
+			continue
+		}
+		mapped, ok := m.answer(buf[:n], from)
+		if !ok || !m.waiting {
+			continue
+		}
+
+		rtt := m.env.receivedAt(stamp, m.sent).Sub(m.sent)
+		m.waiting = false
+		lastSeen := m.result.LastSuccess
+		m.result.LastSuccess = m.env.clock.Now()
+		m.sample(MonitorSample{Time: m.sent, RTT: rtt, Mapped: mapped})
+		switch {
+		case m.result.Mapped == "":
+			m.result.Mapped = mapped
+			m.event(EventEstablished, "mapped to "+mapped, rtt)
+		case mapped != "" && mapped != m.result.Mapped && m.latency:
+			// The socket never changed, so the NAT moved the flow silently
+			m.result.Migrations++
+			moved := Migration{From: m.result.Mapped, To: mapped, LastSeen: lastSeen, Detected: m.result.LastSuccess}
+			m.event(EventAddressChange, moved.describe()+" on the same socket", rtt)
+			m.result.Mapped = mapped
+		case mapped != "" && mapped != m.result.Mapped:
+			detail := m.result.Mapped + " -> " + mapped
+			m.event(EventAddressChange, detail, rtt)
+			m.result.Mapped = mapped
+			return die(CauseAddressChange, "the NAT rebound the mapping ("+detail+")")
+		case m.misses > 0:
+			m.event(EventRecovered, "after "+strconv.Itoa(m.misses)+" lost", rtt)
+		}
+		m.misses = 0
+	}
+}
+
+// summarizeLatency computes round-trip statistics over the answered
+// samples, or nil when there are none
+func summarizeLatency(samples []MonitorSample) *MonitorLatency {
+	var rtts []time.Duration
+	var jitter time.Duration
+	for _, s := range samples {
+		if s.Lost {
+			continue
+		}
+		if len(rtts) > 0 {
+			jitter += (s.RTT - rtts[len(rtts)-1]).Abs()
+		}
+		rtts = append(rtts, s.RTT)
+	}
+	if len(rtts) == 0 {
+		return nil
+	}
+	l := &MonitorLatency{}
+	if len(rtts) > 1 {
+		l.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+	slices.Sort(rtts)
+	l.Min, l.Max = rtts[0], rtts[len(rtts)-1]
+	l.Median = rtts[len(rtts)/2]
+	l.P95 = rtts[len(rtts)*95/100]
+	return l
+}
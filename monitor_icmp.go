@@ -0,0 +1,22 @@
+//go:build !js
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// icmpCause names the ICMP error a socket error reports. Only a connected
+// socket hears about ICMP errors, so peer monitoring never sees them.
+func icmpCause(err error) (string, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "ICMP port unreachable", true
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "ICMP host unreachable", true
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "ICMP network unreachable", true
+	}
+	return "", false
+}
@@ -0,0 +1,6 @@
+package main
+
+// icmpCause never matches in the browser, which has no ICMP errors
+func icmpCause(err error) (string, bool) {
+	return "", false
+}
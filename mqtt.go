@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MQTTTimeout bounds connecting to the broker and publishing one batch
+const MQTTTimeout = 10 * time.Second
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttDisconnect = 0xE0
+)
+
+// mqttConnackCodes names the CONNACK return codes
+var mqttConnackCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttMessage is a single QoS 0 publication
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// mqttClient publishes batches of QoS 0 messages, opening a fresh MQTT 3.1.1
+// session per batch so no keepalive has to be maintained between runs.
+// Broker URLs use tcp:// (or mqtt://) and tls:// (or mqtts://).
+type mqttClient struct {
+	broker   *url.URL
+	clientID string
+	username string
+	password string
+}
+
+// newMQTTClient validates the broker URL and fills in default ports
+func newMQTTClient(broker, clientID, username, password string) (*mqttClient, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "tls", "mqtts", "ssl":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	default:
+		return nil, errors.New("unsupported MQTT broker scheme " + u.Scheme + " (expected tcp or tls)")
+	}
+
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "nat-info-" + host
+	}
+	return &mqttClient{broker: u, clientID: clientID, username: username, password: password}, nil
+}
+
+// publish connects, sends every message and disconnects
+func (c *mqttClient) publish(msgs []mqttMessage) error {
+	dialer := &net.Dialer{Timeout: MQTTTimeout}
+	var conn net.Conn
+	var err error
+	if c.broker.Scheme == "tcp" || c.broker.Scheme == "mqtt" {
+		conn, err = dialer.Dial("tcp", c.broker.Host)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.broker.Host, &tls.Config{ServerName: c.broker.Hostname()})
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(MQTTTimeout))
+
+	if _, err := conn.Write(c.connectPacket()); err != nil {
+		return err
+	}
+
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return errors.New("reading CONNACK: " + err.Error())
+	}
+	if ack[0] != mqttConnack {
+		return errors.New("unexpected packet from broker: 0x" + strconv.FormatUint(uint64(ack[0]), 16))
+	}
+	if ack[3] != 0 {
+		reason, ok := mqttConnackCodes[ack[3]]
+		if !ok {
+			reason = "code " + strconv.Itoa(int(ack[3]))
+		}
+		return errors.New("broker refused connection: " + reason)
+	}
+
+	for _, msg := range msgs {
+		if _, err := conn.Write(publishPacket(msg)); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.Write([]byte{mqttDisconnect, 0})
+	return err
+}
+
+func (c *mqttClient) connectPacket() []byte {
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	if c.username != "" {
+		flags |= 0x80
+	}
+	if c.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(MQTTTimeout/time.Second)*2)
+
+	body = appendMQTTString(body, c.clientID)
+	if c.username != "" {
+		body = appendMQTTString(body, c.username)
+	}
+	if c.password != "" {
+		body = appendMQTTString(body, c.password)
+	}
+	return mqttPacket(mqttConnect, body)
+}
+
+func publishPacket(msg mqttMessage) []byte {
+	header := byte(mqttPublish)
+	if msg.Retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, msg.Topic)
+	body = append(body, msg.Payload...)
+	return mqttPacket(header, body)
+}
+
+// mqttPacket prefixes body with the fixed header and variable-length size
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPublisher publishes every run's result as the retained
+// "<topic>/state" message and each change as a "<topic>/event" message.
+// Any discovery messages are sent with the first successful publish.
+type mqttPublisher struct {
+	client    *mqttClient
+	topic     string
+	discovery []mqttMessage
+}
+
+func (p *mqttPublisher) handle(ev WatchEvent) {
+	msgs := append([]mqttMessage{}, p.discovery...)
+
+	if ev.Result != nil {
+		state, err := json.Marshal(ev.Result)
+		if err != nil {
+			printProgress("MQTT encode failed: " + err.Error())
+			return
+		}
+		msgs = append(msgs, mqttMessage{Topic: p.topic + "/state", Payload: state, Retain: true})
+	}
+
+	if ev.Changed || ev.Error != "" {
+		event, err := json.Marshal(ev)
+		if err != nil {
+			printProgress("MQTT encode failed: " + err.Error())
+			return
+		}
+		msgs = append(msgs, mqttMessage{Topic: p.topic + "/event", Payload: event})
+	}
+
+	if len(msgs) == 0 {
+		return
+	}
+	if err := p.client.publish(msgs); err != nil {
+		printProgress("MQTT publish failed: " + err.Error())
+		return
+	}
+	p.discovery = nil
+}
@@ -0,0 +1,34 @@
+package natinfo
+
+import "time"
+
+// Clock is the source of time for retransmission schedules, timeouts and
+// socket deadlines. Tests inject a fake to step through multi-second
+// schedules instantly; a PacketConn double then compares its read deadline
+// against the same fake.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once d has passed
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending AfterFunc call
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the real clock
+type SystemClock struct{}
+
+// Now returns time.Now()
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// AfterFunc wraps time.AfterFunc
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Sleep blocks until d has passed on c
+func Sleep(c Clock, d time.Duration) {
+	done := make(chan struct{})
+	c.AfterFunc(d, func() { close(done) })
+	<-done
+}
@@ -0,0 +1,845 @@
+package natinfo
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// This is a deliberately small DTLS 1.2 client (RFC 6347), enough for STUN
+// over DTLS (RFC 7350) against coturn and similar servers without pulling a
+// dependency into the module. It offers ECDHE with ECDSA or RSA certificates,
+// or a pre-shared key, always with AES-128-GCM; it does not resume sessions,
+// renegotiate or present client certificates.
+
+// DTLSConfig configures the DTLS client. Either the server's certificate is
+// verified against RootCAs (the system pool when nil) for ServerName, or,
+// when PSK is set, the handshake authenticates with the pre-shared key alone.
+type DTLSConfig struct {
+	// ServerName is checked against the certificate and sent as SNI; the
+	// DTLS transport defaults it to the server's host
+	ServerName         string
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+
+	// PSK and PSKIdentity select TLS_PSK_WITH_AES_128_GCM_SHA256 instead of
+	// certificate authentication
+	PSK         []byte
+	PSKIdentity string
+}
+
+// Record and handshake constants from RFC 6347 and RFC 5246
+const (
+	dtlsVersion = 0xfefd
+
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	hsClientHello        = 1
+	hsServerHello        = 2
+	hsHelloVerifyRequest = 3
+	hsCertificate        = 11
+	hsServerKeyExchange  = 12
+	hsCertificateRequest = 13
+	hsServerHelloDone    = 14
+	hsClientKeyExchange  = 16
+	hsFinished           = 20
+
+	recordHeaderLength    = 13
+	handshakeHeaderLength = 12
+
+	// tlsPSKWithAES128GCMSHA256 is from RFC 5487; crypto/tls has no PSK suites
+	tlsPSKWithAES128GCMSHA256 = 0x00a8
+
+	// First flight retransmission interval (RFC 6347 section 4.2.4.1)
+	dtlsRetransmit = time.Second
+)
+
+var errDTLSClosed = errors.New("dtls: connection closed by peer")
+
+// DTLSConn is an established DTLS association. Each Write is sent as one
+// record, and each Read returns one record's payload, so message boundaries
+// are kept as on a datagram socket.
+type DTLSConn struct {
+	conn  net.Conn
+	suite uint16
+
+	writeAEAD, readAEAD cipher.AEAD
+	writeIV, readIV     []byte
+	// writeSeq holds the next record sequence number of each epoch
+	writeSeq [2]uint64
+
+	pending [][]byte
+	buf     []byte
+}
+
+// DTLSClient runs a DTLS 1.2 handshake over conn, which must be a connected
+// datagram socket such as one from net.Dial("udp", ...). The handshake is
+// bounded by ctx.
+func DTLSClient(ctx context.Context, conn net.Conn, config *DTLSConfig) (*DTLSConn, error) {
+	if config == nil {
+		config = &DTLSConfig{}
+	}
+	if config.PSK == nil && config.ServerName == "" && !config.InsecureSkipVerify {
+		return nil, errors.New("dtls: ServerName, PSK or InsecureSkipVerify must be set")
+	}
+	c := &DTLSConn{conn: conn, buf: make([]byte, 16384)}
+	h := &dtlsHandshake{c: c, config: config, frags: make(map[uint16]*dtlsFragments)}
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	defer conn.SetReadDeadline(time.Time{})
+	if err := h.run(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// CipherSuite names the negotiated cipher suite
+func (c *DTLSConn) CipherSuite() string {
+	if c.suite == tlsPSKWithAES128GCMSHA256 {
+		return "TLS_PSK_WITH_AES_128_GCM_SHA256"
+	}
+	return tls.CipherSuiteName(c.suite)
+}
+
+// Write sends b as one application data record
+func (c *DTLSConn) Write(b []byte) (int, error) {
+	if _, err := c.conn.Write(c.record(recordApplicationData, 1, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the payload of the next application data record; a payload
+// longer than b is truncated as on a datagram socket
+func (c *DTLSConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		for _, rec := range splitRecords(c.buf[:n]) {
+			if rec.epoch != 1 {
+				continue
+			}
+			plain, err := c.open(rec)
+			if err != nil {
+				continue
+			}
+			switch rec.typ {
+			case recordApplicationData:
+				c.pending = append(c.pending, plain)
+			case recordAlert:
+				if err := alertError(plain); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	n := copy(b, c.pending[0])
+	c.pending = c.pending[1:]
+	return n, nil
+}
+
+// Close sends close_notify and closes the socket
+func (c *DTLSConn) Close() error {
+	if c.writeAEAD != nil {
+		c.conn.Write(c.record(recordAlert, 1, []byte{1, 0}))
+	}
+	return c.conn.Close()
+}
+
+// LocalAddr returns the socket's local address
+func (c *DTLSConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the server's address
+func (c *DTLSConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetDeadline sets the socket's deadlines
+func (c *DTLSConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline sets the socket's read deadline
+func (c *DTLSConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline sets the socket's write deadline
+func (c *DTLSConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// record frames payload as a record of the given epoch, encrypting it in
+// epoch 1, and advances the epoch's sequence number
+func (c *DTLSConn) record(typ byte, epoch uint16, payload []byte) []byte {
+	seq := uint64(epoch)<<48 | c.writeSeq[epoch]
+	c.writeSeq[epoch]++
+
+	out := make([]byte, recordHeaderLength, recordHeaderLength+8+len(payload)+16)
+	out[0] = typ
+	binary.BigEndian.PutUint16(out[1:3], dtlsVersion)
+	binary.BigEndian.PutUint64(out[3:11], seq)
+	if epoch == 0 {
+		binary.BigEndian.PutUint16(out[11:13], uint16(len(payload)))
+		return append(out, payload...)
+	}
+
+	// RFC 5288 AEAD: the explicit nonce is the record's epoch and sequence
+	explicit := out[3:11]
+	nonce := append(append(make([]byte, 0, 12), c.writeIV...), explicit...)
+	ad := append(append(make([]byte, 0, 13), explicit...), typ, 0xfe, 0xfd, byte(len(payload)>>8), byte(len(payload)))
+	binary.BigEndian.PutUint16(out[11:13], uint16(8+len(payload)+c.writeAEAD.Overhead()))
+	out = append(out, explicit...)
+	return c.writeAEAD.Seal(out, nonce, payload, ad)
+}
+
+// open decrypts an epoch 1 record
+func (c *DTLSConn) open(rec dtlsRecord) ([]byte, error) {
+	if c.readAEAD == nil || len(rec.body) < 8+c.readAEAD.Overhead() {
+		return nil, errors.New("dtls: undecryptable record")
+	}
+	nonce := append(append(make([]byte, 0, 12), c.readIV...), rec.body[:8]...)
+	n := len(rec.body) - 8 - c.readAEAD.Overhead()
+	ad := binary.BigEndian.AppendUint64(make([]byte, 0, 13), rec.seq)
+	ad = append(ad, rec.typ, 0xfe, 0xfd, byte(n>>8), byte(n))
+	return c.readAEAD.Open(nil, nonce, rec.body[8:], ad)
+}
+
+// dtlsRecord is one record of a received datagram
+type dtlsRecord struct {
+	typ   byte
+	epoch uint16
+	seq   uint64 // epoch and sequence number, as sent
+	body  []byte
+}
+
+// splitRecords parses the records of a datagram, dropping a truncated tail
+func splitRecords(b []byte) []dtlsRecord {
+	var recs []dtlsRecord
+	for len(b) >= recordHeaderLength {
+		n := int(binary.BigEndian.Uint16(b[11:13]))
+		if recordHeaderLength+n > len(b) {
+			break
+		}
+		seq := binary.BigEndian.Uint64(b[3:11])
+		recs = append(recs, dtlsRecord{typ: b[0], epoch: uint16(seq >> 48), seq: seq, body: b[recordHeaderLength : recordHeaderLength+n]})
+		b = b[recordHeaderLength+n:]
+	}
+	return recs
+}
+
+// alertError turns a fatal alert or close_notify into an error
+func alertError(alert []byte) error {
+	if len(alert) < 2 {
+		return nil
+	}
+	if alert[1] == 0 {
+		return errDTLSClosed
+	}
+	if alert[0] == 2 {
+		return errors.New("dtls: server sent fatal alert " + strconv.Itoa(int(alert[1])))
+	}
+	return nil
+}
+
+// dtlsFragments reassembles one handshake message
+type dtlsFragments struct {
+	typ  byte
+	body []byte
+	have []bool
+	left int
+}
+
+// dtlsMessage is a complete handshake message with its unfragmented header,
+// which is what the transcript covers
+type dtlsMessage struct {
+	typ  byte
+	body []byte
+	raw  []byte
+}
+
+// dtlsHandshake is the client side of one handshake
+type dtlsHandshake struct {
+	c      *DTLSConn
+	config *DTLSConfig
+
+	// flight is the last flight sent, resent when the server's answer is late
+	flight  []func() []byte
+	sendSeq uint16
+	recvSeq uint16
+	frags   map[uint16]*dtlsFragments
+
+	transcript   []byte
+	clientRandom []byte
+	serverRandom []byte
+	master       []byte
+	serverCCS    bool
+}
+
+func (h *dtlsHandshake) run(ctx context.Context) error {
+	h.clientRandom = make([]byte, 32)
+	if _, err := rand.Read(h.clientRandom); err != nil {
+		return err
+	}
+
+	hello := h.message(hsClientHello, h.clientHello(nil))
+	h.send(hello)
+	msg, err := h.next(ctx)
+	if err != nil {
+		return err
+	}
+	// The cookie exchange is left out of the transcript (RFC 6347 4.2.1)
+	if msg.typ == hsHelloVerifyRequest {
+		if len(msg.body) < 3 || len(msg.body) < 3+int(msg.body[2]) {
+			return errors.New("dtls: malformed HelloVerifyRequest")
+		}
+		hello = h.message(hsClientHello, h.clientHello(msg.body[3:3+int(msg.body[2])]))
+		h.send(hello)
+		if msg, err = h.next(ctx); err != nil {
+			return err
+		}
+	}
+	h.transcript = append(h.transcript, hello...)
+
+	if msg.typ != hsServerHello {
+		return errors.New("dtls: expected ServerHello, got message " + strconv.Itoa(int(msg.typ)))
+	}
+	if err := h.serverHello(msg.body); err != nil {
+		return err
+	}
+	h.transcript = append(h.transcript, msg.raw...)
+
+	var certs []*x509.Certificate
+	var shared, serverParams []byte
+	certRequested := false
+	for done := false; !done; {
+		if msg, err = h.next(ctx); err != nil {
+			return err
+		}
+		h.transcript = append(h.transcript, msg.raw...)
+		switch msg.typ {
+		case hsCertificate:
+			if certs, err = h.verifyCertificates(msg.body); err != nil {
+				return err
+			}
+		case hsServerKeyExchange:
+			serverParams = msg.body
+		case hsCertificateRequest:
+			certRequested = true
+		case hsServerHelloDone:
+			done = true
+		default:
+			return errors.New("dtls: unexpected handshake message " + strconv.Itoa(int(msg.typ)))
+		}
+	}
+
+	var clientKeyExchange, premaster []byte
+	if h.c.suite == tlsPSKWithAES128GCMSHA256 {
+		clientKeyExchange = binary.BigEndian.AppendUint16(nil, uint16(len(h.config.PSKIdentity)))
+		clientKeyExchange = append(clientKeyExchange, h.config.PSKIdentity...)
+		// RFC 4279 section 2: zeros as long as the PSK, then the PSK
+		n := len(h.config.PSK)
+		premaster = binary.BigEndian.AppendUint16(nil, uint16(n))
+		premaster = append(premaster, make([]byte, n)...)
+		premaster = binary.BigEndian.AppendUint16(premaster, uint16(n))
+		premaster = append(premaster, h.config.PSK...)
+	} else {
+		if len(certs) == 0 || serverParams == nil {
+			return errors.New("dtls: server sent no certificate or key exchange")
+		}
+		var public []byte
+		if public, shared, err = h.ecdhe(serverParams, certs[0]); err != nil {
+			return err
+		}
+		clientKeyExchange = append([]byte{byte(len(public))}, public...)
+		premaster = shared
+	}
+
+	// Client flight: an empty Certificate if one was asked for, the key
+	// exchange, ChangeCipherSpec and the encrypted Finished
+	var flight []func() []byte
+	if certRequested {
+		cert := h.message(hsCertificate, []byte{0, 0, 0})
+		h.transcript = append(h.transcript, cert...)
+		flight = append(flight, func() []byte { return h.c.record(recordHandshake, 0, cert) })
+	}
+	cke := h.message(hsClientKeyExchange, clientKeyExchange)
+	h.transcript = append(h.transcript, cke...)
+
+	h.master = prf12(premaster, "master secret", append(append([]byte(nil), h.clientRandom...), h.serverRandom...), 48)
+	keys := prf12(h.master, "key expansion", append(append([]byte(nil), h.serverRandom...), h.clientRandom...), 40)
+	if h.c.writeAEAD, err = newGCM(keys[0:16]); err != nil {
+		return err
+	}
+	if h.c.readAEAD, err = newGCM(keys[16:32]); err != nil {
+		return err
+	}
+	h.c.writeIV, h.c.readIV = keys[32:36], keys[36:40]
+
+	finished := h.message(hsFinished, h.verifyData("client finished"))
+	h.transcript = append(h.transcript, finished...)
+	flight = append(flight,
+		func() []byte { return h.c.record(recordHandshake, 0, cke) },
+		func() []byte { return h.c.record(recordChangeCipherSpec, 0, []byte{1}) },
+		func() []byte { return h.c.record(recordHandshake, 1, finished) },
+	)
+	h.flight = flight
+	h.resend()
+
+	if msg, err = h.next(ctx); err != nil {
+		return err
+	}
+	if msg.typ != hsFinished || !h.serverCCS {
+		return errors.New("dtls: expected the server's Finished")
+	}
+	if !hmac.Equal(msg.body, h.verifyData("server finished")) {
+		return errors.New("dtls: server Finished does not verify")
+	}
+	return nil
+}
+
+// message frames a handshake message with the next sequence number, unfragmented
+func (h *dtlsHandshake) message(typ byte, body []byte) []byte {
+	m := make([]byte, handshakeHeaderLength, handshakeHeaderLength+len(body))
+	m[0] = typ
+	putUint24(m[1:4], len(body))
+	binary.BigEndian.PutUint16(m[4:6], h.sendSeq)
+	putUint24(m[9:12], len(body))
+	h.sendSeq++
+	return append(m, body...)
+}
+
+// send starts a single-message flight in epoch 0
+func (h *dtlsHandshake) send(msg []byte) {
+	h.flight = []func() []byte{func() []byte { return h.c.record(recordHandshake, 0, msg) }}
+	h.resend()
+}
+
+// resend transmits the current flight, each record with a fresh sequence
+// number, in one datagram
+func (h *dtlsHandshake) resend() {
+	var out []byte
+	for _, rec := range h.flight {
+		out = append(out, rec()...)
+	}
+	h.c.conn.Write(out)
+}
+
+// next returns the server's next handshake message, retransmitting the last
+// flight on the RFC 6347 timer until it is complete
+func (h *dtlsHandshake) next(ctx context.Context) (dtlsMessage, error) {
+	wait := dtlsRetransmit
+	for {
+		if f, ok := h.frags[h.recvSeq]; ok && f.left == 0 {
+			delete(h.frags, h.recvSeq)
+			raw := make([]byte, handshakeHeaderLength, handshakeHeaderLength+len(f.body))
+			raw[0] = f.typ
+			putUint24(raw[1:4], len(f.body))
+			binary.BigEndian.PutUint16(raw[4:6], h.recvSeq)
+			putUint24(raw[9:12], len(f.body))
+			raw = append(raw, f.body...)
+			h.recvSeq++
+			return dtlsMessage{typ: f.typ, body: f.body, raw: raw}, nil
+		}
+
+		if ctx.Err() != nil {
+			return dtlsMessage{}, ctx.Err()
+		}
+		h.c.conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := h.c.conn.Read(h.c.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				h.resend()
+				wait = min(2*wait, time.Minute)
+				continue
+			}
+			return dtlsMessage{}, err
+		}
+
+		stale := false
+		for _, rec := range splitRecords(h.c.buf[:n]) {
+			body := rec.body
+			if rec.epoch == 1 {
+				if body, err = h.c.open(rec); err != nil {
+					continue
+				}
+			}
+			switch rec.typ {
+			case recordChangeCipherSpec:
+				h.serverCCS = true
+			case recordAlert:
+				if err := alertError(body); err != nil {
+					return dtlsMessage{}, err
+				}
+			case recordHandshake:
+				if !h.addFragments(body) {
+					stale = true
+				}
+			}
+		}
+		// A repeat of the server's previous flight means ours was lost
+		if stale {
+			h.resend()
+		}
+	}
+}
+
+// addFragments files the handshake fragments of a record. It reports false
+// when they belong to messages already processed.
+func (h *dtlsHandshake) addFragments(b []byte) bool {
+	fresh := true
+	for len(b) >= handshakeHeaderLength {
+		typ := b[0]
+		length := uint24(b[1:4])
+		seq := binary.BigEndian.Uint16(b[4:6])
+		offset := uint24(b[6:9])
+		fragLen := uint24(b[9:12])
+		if handshakeHeaderLength+fragLen > len(b) || offset+fragLen > length {
+			return fresh
+		}
+		frag := b[handshakeHeaderLength : handshakeHeaderLength+fragLen]
+		b = b[handshakeHeaderLength+fragLen:]
+
+		if seq < h.recvSeq {
+			fresh = false
+			continue
+		}
+		f, ok := h.frags[seq]
+		if !ok {
+			f = &dtlsFragments{typ: typ, body: make([]byte, length), have: make([]bool, length), left: length}
+			h.frags[seq] = f
+		}
+		// Fragments of one message must agree on what it is; trusting a
+		// later one's length would write past the first one's buffer
+		if typ != f.typ || length != len(f.body) {
+			continue
+		}
+		copy(f.body[offset:], frag)
+		for i := offset; i < offset+fragLen; i++ {
+			if !f.have[i] {
+				f.have[i] = true
+				f.left--
+			}
+		}
+	}
+	return fresh
+}
+
+// clientHello builds the ClientHello body, with the server's cookie on the
+// second attempt
+func (h *dtlsHandshake) clientHello(cookie []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, dtlsVersion)
+	b = append(b, h.clientRandom...)
+	b = append(b, 0) // no session ID
+	b = append(b, byte(len(cookie)))
+	b = append(b, cookie...)
+
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	if h.config.PSK != nil {
+		suites = []uint16{tlsPSKWithAES128GCMSHA256}
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(2*len(suites)))
+	for _, s := range suites {
+		b = binary.BigEndian.AppendUint16(b, s)
+	}
+	b = append(b, 1, 0) // null compression only
+
+	var ext []byte
+	if name := h.config.ServerName; name != "" && net.ParseIP(name) == nil {
+		ext = binary.BigEndian.AppendUint16(ext, 0) // server_name
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(name)+5))
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(name)+3))
+		ext = append(ext, 0)
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(name)))
+		ext = append(ext, name...)
+	}
+	// supported_groups: x25519, secp256r1, secp384r1
+	ext = append(ext, 0, 10, 0, 8, 0, 6, 0, 29, 0, 23, 0, 24)
+	// ec_point_formats: uncompressed
+	ext = append(ext, 0, 11, 0, 2, 1, 0)
+	// signature_algorithms: ECDSA P-256/P-384, RSA-PSS and PKCS#1 with SHA-256/384
+	ext = append(ext, 0, 13, 0, 12, 0, 10, 4, 3, 5, 3, 8, 4, 4, 1, 5, 1)
+	// renegotiation_info, empty on the initial handshake
+	ext = append(ext, 0xff, 0x01, 0, 1, 0)
+
+	b = binary.BigEndian.AppendUint16(b, uint16(len(ext)))
+	return append(b, ext...)
+}
+
+// serverHello records the server random and the chosen suite
+func (h *dtlsHandshake) serverHello(b []byte) error {
+	if len(b) < 35 || len(b) < 35+int(b[34])+3 {
+		return errors.New("dtls: malformed ServerHello")
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != dtlsVersion {
+		return errors.New("dtls: server does not speak DTLS 1.2")
+	}
+	h.serverRandom = b[2:34]
+	sid := int(b[34])
+	suite := binary.BigEndian.Uint16(b[35+sid : 37+sid])
+	switch suite {
+	case tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:
+		if h.config.PSK != nil {
+			return errors.New("dtls: server chose a certificate suite over the PSK")
+		}
+	case tlsPSKWithAES128GCMSHA256:
+		if h.config.PSK == nil {
+			return errors.New("dtls: server chose a PSK suite")
+		}
+	default:
+		return errors.New("dtls: server chose unsupported cipher suite 0x" + strconv.FormatUint(uint64(suite), 16))
+	}
+	h.c.suite = suite
+	return nil
+}
+
+// verifyCertificates parses the server's chain and, unless disabled, checks
+// it against the roots and server name
+func (h *dtlsHandshake) verifyCertificates(b []byte) ([]*x509.Certificate, error) {
+	if len(b) < 3 {
+		return nil, errors.New("dtls: malformed Certificate")
+	}
+	b = b[3:]
+	var certs []*x509.Certificate
+	for len(b) >= 3 {
+		n := uint24(b[0:3])
+		if 3+n > len(b) {
+			return nil, errors.New("dtls: malformed Certificate")
+		}
+		cert, err := x509.ParseCertificate(b[3 : 3+n])
+		if err != nil {
+			return nil, errors.New("dtls: " + err.Error())
+		}
+		certs = append(certs, cert)
+		b = b[3+n:]
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("dtls: server sent an empty certificate chain")
+	}
+	if h.config.InsecureSkipVerify {
+		return certs, nil
+	}
+	opts := x509.VerifyOptions{DNSName: h.config.ServerName, Roots: h.config.RootCAs, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return nil, errors.New("dtls: " + err.Error())
+	}
+	return certs, nil
+}
+
+// ecdhe checks the signature on the server's ephemeral key and returns this
+// side's public key and the shared secret
+func (h *dtlsHandshake) ecdhe(params []byte, leaf *x509.Certificate) ([]byte, []byte, error) {
+	if len(params) < 4 || params[0] != 3 || len(params) < 4+int(params[3])+4 {
+		return nil, nil, errors.New("dtls: malformed ServerKeyExchange")
+	}
+	var curve ecdh.Curve
+	switch binary.BigEndian.Uint16(params[1:3]) {
+	case 29:
+		curve = ecdh.X25519()
+	case 23:
+		curve = ecdh.P256()
+	case 24:
+		curve = ecdh.P384()
+	default:
+		return nil, nil, errors.New("dtls: server chose an unsupported curve")
+	}
+	signedLen := 4 + int(params[3])
+	serverPub, err := curve.NewPublicKey(params[4:signedLen])
+	if err != nil {
+		return nil, nil, errors.New("dtls: " + err.Error())
+	}
+
+	scheme := binary.BigEndian.Uint16(params[signedLen : signedLen+2])
+	sigLen := int(binary.BigEndian.Uint16(params[signedLen+2 : signedLen+4]))
+	if signedLen+4+sigLen > len(params) {
+		return nil, nil, errors.New("dtls: malformed ServerKeyExchange")
+	}
+	sig := params[signedLen+4 : signedLen+4+sigLen]
+	signed := append(append(append([]byte(nil), h.clientRandom...), h.serverRandom...), params[:signedLen]...)
+	if err := verifySignature(leaf.PublicKey, scheme, signed, sig); err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := priv.ECDH(serverPub)
+	if err != nil {
+		return nil, nil, errors.New("dtls: " + err.Error())
+	}
+	return priv.PublicKey().Bytes(), shared, nil
+}
+
+// verifySignature checks a ServerKeyExchange signature for the schemes the
+// ClientHello offers
+func verifySignature(pub any, scheme uint16, signed, sig []byte) error {
+	hash := crypto.SHA256
+	var digest []byte
+	switch scheme {
+	case 0x0403, 0x0401, 0x0804:
+		d := sha256.Sum256(signed)
+		digest = d[:]
+	case 0x0503, 0x0501:
+		hash = crypto.SHA384
+		d := sha512.Sum384(signed)
+		digest = d[:]
+	default:
+		return errors.New("dtls: unsupported signature scheme 0x" + strconv.FormatUint(uint64(scheme), 16))
+	}
+
+	var ok bool
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = (scheme == 0x0403 || scheme == 0x0503) && ecdsa.VerifyASN1(key, digest, sig)
+	case *rsa.PublicKey:
+		switch scheme {
+		case 0x0401, 0x0501:
+			ok = rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+		case 0x0804:
+			ok = rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	}
+	if !ok {
+		return errors.New("dtls: bad ServerKeyExchange signature")
+	}
+	return nil
+}
+
+// verifyData computes a Finished body over the transcript so far
+func (h *dtlsHandshake) verifyData(label string) []byte {
+	sum := sha256.Sum256(h.transcript)
+	return prf12(h.master, label, sum[:], 12)
+}
+
+// prf12 is the TLS 1.2 PRF with SHA-256 (RFC 5246 section 5)
+func prf12(secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	out := make([]byte, 0, n+sha256.Size)
+	a := labelSeed
+	for len(out) < n {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// DTLS runs each transaction over a fresh DTLS 1.2 association (RFC 7350),
+// retransmitting the request as on plain UDP since DTLS does not make
+// delivery reliable. The answer carries the mapping of the UDP flow the
+// association runs on.
+type DTLS struct {
+	// Dialer opens the UDP socket; nil means a *net.Dialer
+	Dialer Dialer
+	// Config authenticates the server; ServerName defaults to its host
+	Config *DTLSConfig
+	// Clock schedules retransmissions; nil means SystemClock
+	Clock Clock
+}
+
+// Exchange implements Transport
+func (d *DTLS) Exchange(ctx context.Context, req []byte, server string) ([]byte, error) {
+	server, err := NormalizeHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	config := DTLSConfig{}
+	if d.Config != nil {
+		config = *d.Config
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(server)
+	}
+	clock := d.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := DTLSClient(ctx, conn, &config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer dc.Close()
+	stop := context.AfterFunc(ctx, func() { dc.SetReadDeadline(clock.Now()) })
+	defer stop()
+
+	buf := make([]byte, 1500)
+	retransmit := baseRetransmit
+	for ctx.Err() == nil {
+		if _, err := dc.Write(req); err != nil {
+			return nil, err
+		}
+		dc.SetReadDeadline(clock.Now().Add(retransmit))
+		retransmit *= 2
+		for {
+			n, err := dc.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				if err == errDTLSClosed {
+					err = io.EOF
+				}
+				return nil, err
+			}
+			if n >= headerLength && string(buf[8:20]) == string(req[8:20]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
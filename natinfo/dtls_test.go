@@ -0,0 +1,56 @@
+package natinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// fragment frames part of handshake message seq as the server would
+func fragment(typ byte, seq uint16, length, offset int, body []byte) []byte {
+	b := make([]byte, handshakeHeaderLength, handshakeHeaderLength+len(body))
+	b[0] = typ
+	putUint24(b[1:4], length)
+	binary.BigEndian.PutUint16(b[4:6], seq)
+	putUint24(b[6:9], offset)
+	putUint24(b[9:12], len(body))
+	return append(b, body...)
+}
+
+func TestAddFragmentsMismatchedLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		frags [][]byte
+	}{
+		{"longer later fragment", [][]byte{
+			fragment(2, 0, 4, 0, []byte{1, 2}),
+			fragment(2, 0, 64, 2, bytes.Repeat([]byte{9}, 62)),
+			fragment(2, 0, 4, 2, []byte{3, 4}),
+		}},
+		{"shorter later fragment", [][]byte{
+			fragment(2, 0, 4, 0, []byte{1, 2}),
+			fragment(2, 0, 3, 2, []byte{9}),
+			fragment(2, 0, 4, 2, []byte{3, 4}),
+		}},
+		{"different type", [][]byte{
+			fragment(2, 0, 4, 0, []byte{1, 2}),
+			fragment(11, 0, 4, 2, []byte{9, 9}),
+			fragment(2, 0, 4, 2, []byte{3, 4}),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &dtlsHandshake{frags: make(map[uint16]*dtlsFragments)}
+			for _, frag := range tt.frags {
+				h.addFragments(frag)
+			}
+			f := h.frags[0]
+			if f == nil || f.left != 0 {
+				t.Fatalf("message incomplete: %+v", f)
+			}
+			if !bytes.Equal(f.body, []byte{1, 2, 3, 4}) {
+				t.Errorf("body = %v, want [1 2 3 4]", f.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package natinfo
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Some regional providers publish STUN and TURN servers under
+// internationalized names. The resolver only takes ASCII, so such names are
+// converted to their IDNA A-label form (RFC 5891: "xn--" and the label's
+// Punycode) before lookup; labels already in that form are checked to
+// decode. Labels are lower-cased but not NFC-normalized, which needs tables
+// the standard library lacks; names typed or pasted are composed already.
+
+// Punycode parameters for IDNA (RFC 3492 section 5)
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// acePrefix marks an A-label
+const acePrefix = "xn--"
+
+var errPunycode = errors.New("invalid punycode")
+
+// NormalizeHost returns host with every internationalized label converted
+// to its A-label, and rejects names DNS cannot carry. IP addresses are
+// returned unchanged. UDP, Stream and DTLS apply it to server names before
+// lookup.
+func NormalizeHost(host string) (string, error) {
+	if _, err := netip.ParseAddr(host); host == "" || err == nil {
+		return host, nil
+	}
+	if !utf8.ValidString(host) {
+		return "", errors.New("invalid host name: not UTF-8")
+	}
+	// Ideographic and full-width full stops separate labels too (RFC 3490)
+	host = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(host)
+	name := strings.TrimSuffix(host, ".")
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		ascii, err := labelToASCII(label)
+		if err != nil {
+			return "", errors.New("invalid host name " + host + ": " + err.Error())
+		}
+		labels[i] = ascii
+	}
+	out := strings.Join(labels, ".")
+	if len(out) > 253 {
+		return "", errors.New("invalid host name " + host + ": longer than 253 characters")
+	}
+	return out + host[len(name):], nil
+}
+
+// NormalizeHostPort applies NormalizeHost to the host of a host:port
+func NormalizeHostPort(hostport string) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", err
+	}
+	if host, err = NormalizeHost(host); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// labelToASCII converts one label and checks the result is a valid DNS
+// label. Underscores are allowed, as in service names.
+func labelToASCII(label string) (string, error) {
+	if label == "" {
+		return "", errors.New("empty label")
+	}
+	ascii := label
+	if !isASCII(label) {
+		label = strings.ToLower(label)
+		for _, r := range label {
+			if r < utf8.RuneSelf && !isLDH(byte(r)) || unicode.IsSpace(r) || unicode.IsControl(r) {
+				return "", errors.New("label " + label + " contains " + quoteRune(r))
+			}
+		}
+		encoded, err := punyEncode(label)
+		if err != nil {
+			return "", err
+		}
+		ascii = acePrefix + encoded
+	} else {
+		for i := 0; i < len(label); i++ {
+			if !isLDH(label[i]) {
+				return "", errors.New("label " + label + " contains " + quoteRune(rune(label[i])))
+			}
+		}
+		if lower := strings.ToLower(label); strings.HasPrefix(lower, acePrefix) {
+			// An A-label must decode, and to the name it was made from
+			decoded, err := punyDecode(lower[len(acePrefix):])
+			if err != nil || isASCII(decoded) {
+				return "", errors.New("label " + label + " is not valid punycode")
+			}
+			if again, _ := punyEncode(decoded); acePrefix+again != lower {
+				return "", errors.New("label " + label + " is not valid punycode")
+			}
+		}
+	}
+	if len(ascii) > 63 {
+		return "", errors.New("label " + label + " is longer than 63 characters")
+	}
+	if ascii[0] == '-' || ascii[len(ascii)-1] == '-' {
+		return "", errors.New("label " + label + " starts or ends with a hyphen")
+	}
+	return ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// isLDH reports whether c may appear in a host name label
+func isLDH(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_'
+}
+
+func quoteRune(r rune) string {
+	if unicode.IsPrint(r) && r != ' ' {
+		return "'" + string(r) + "'"
+	}
+	return "a control or space character"
+}
+
+// punyAdapt is the bias adaptation function of RFC 3492 section 6.1
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyThreshold clamps k - bias to [tmin, tmax]
+func punyThreshold(k, bias int) int {
+	return min(max(k-bias, punyTMin), punyTMax)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyValue(c byte) (int, bool) {
+	switch {
+	case 'a' <= c && c <= 'z':
+		return int(c - 'a'), true
+	case 'A' <= c && c <= 'Z':
+		return int(c - 'A'), true
+	case '0' <= c && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
+
+// punyEncode encodes a label as Punycode, without the ACE prefix
+func punyEncode(label string) (string, error) {
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled := basic; handled < len(runes); {
+		m := math.MaxInt32
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if m-n > (math.MaxInt32-delta)/(handled+1) {
+			return "", errPunycode
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				if delta++; delta == math.MaxInt32 {
+					return "", errPunycode
+				}
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes a Punycode label, without the ACE prefix
+func punyDecode(s string) (string, error) {
+	var out []rune
+	pos := 0
+	if i := strings.LastIndexByte(s, '-'); i >= 0 {
+		for j := 0; j < i; j++ {
+			if s[j] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			out = append(out, rune(s[j]))
+		}
+		pos = i + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(s) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos == len(s) {
+				return "", errPunycode
+			}
+			d, ok := punyValue(s[pos])
+			pos++
+			if !ok || d > (math.MaxInt32-i)/w {
+				return "", errPunycode
+			}
+			i += d * w
+			t := punyThreshold(k, bias)
+			if d < t {
+				break
+			}
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", errPunycode
+			}
+			w *= punyBase - t
+		}
+		points := len(out) + 1
+		bias = punyAdapt(i-oldi, points, oldi == 0)
+		if i/points > math.MaxInt32-n {
+			return "", errPunycode
+		}
+		n += i / points
+		i %= points
+		if n > unicode.MaxRune || 0xD800 <= n && n <= 0xDFFF {
+			return "", errPunycode
+		}
+		out = slices.Insert(out, i, rune(n))
+		i++
+	}
+	return string(out), nil
+}
@@ -0,0 +1,146 @@
+package natinfo
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// RFC 3492 section 7.1 sample strings
+var punycodeSamples = []struct {
+	name    string
+	decoded string
+	encoded string
+}{
+	{"arabic", "ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	{"chinese simplified", "他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	{"chinese traditional", "他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	{"japanese with ascii", "3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	{"japanese mixed", "パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	{"japanese", "そのスピードで", "d9juau41awczczp"},
+	{"ascii only", "-> $1.00 <-", "-> $1.00 <--"},
+}
+
+func TestPunycodeSamples(t *testing.T) {
+	for _, tt := range punycodeSamples {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := punyEncode(tt.decoded)
+			if err != nil || encoded != tt.encoded {
+				t.Errorf("punyEncode = %q, %v; want %q", encoded, err, tt.encoded)
+			}
+			decoded, err := punyDecode(tt.encoded)
+			if err != nil || decoded != tt.decoded {
+				t.Errorf("punyDecode = %q, %v; want %q", decoded, err, tt.decoded)
+			}
+		})
+	}
+}
+
+func TestPunycodeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// Code points from ASCII, Latin, CJK and the supplementary planes
+	ranges := [][2]rune{{'a', 'z'}, {0xc0, 0x24f}, {0x4e00, 0x9fff}, {0x1f300, 0x1faff}}
+	for i := 0; i < 1000; i++ {
+		runes := make([]rune, 1+rng.Intn(20))
+		for j := range runes {
+			r := ranges[rng.Intn(len(ranges))]
+			runes[j] = r[0] + rune(rng.Intn(int(r[1]-r[0]+1)))
+		}
+		label := string(runes)
+		encoded, err := punyEncode(label)
+		if err != nil {
+			t.Fatalf("punyEncode(%q): %v", label, err)
+		}
+		decoded, err := punyDecode(encoded)
+		if err != nil || decoded != label {
+			t.Fatalf("punyDecode(%q) = %q, %v; want %q", encoded, decoded, err, label)
+		}
+	}
+}
+
+func TestPunycodeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"delta overflow", "99999999999"},
+		{"weight overflow", "zzzzzzzzzzzzzz"},
+		{"truncated variable-length integer", "9"},
+		{"non-digit", "ab!c"},
+		{"non-ASCII basic code point", "ü-a"},
+		{"surrogate", "ib9b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if decoded, err := punyDecode(tt.encoded); err == nil {
+				t.Errorf("punyDecode(%q) = %q, want an error", tt.encoded, decoded)
+			}
+		})
+	}
+
+	// The first delta of a label with many basic code points before the
+	// highest code point there is does not fit in 32 bits
+	long := strings.Repeat("a", 2100) + "\U0010FFFF"
+	if _, err := punyEncode(long); err == nil {
+		t.Error("punyEncode of an overflowing label succeeded")
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"stun.example.com", "stun.example.com"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"stun.münchen.example", "stun.xn--mnchen-3ya.example"},
+		{"STUN.MÜNCHEN.example", "STUN.xn--mnchen-3ya.example"},
+		{"münchen.example.", "xn--mnchen-3ya.example."},
+		{"münchen。example", "xn--mnchen-3ya.example"},
+		{"xn--mnchen-3ya.example", "xn--mnchen-3ya.example"},
+		{"_stun._udp.example", "_stun._udp.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := NormalizeHost(tt.host)
+			if err != nil || got != tt.want {
+				t.Errorf("NormalizeHost = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeHostInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+	}{
+		{"not UTF-8", "\xff.example"},
+		{"empty label", "stun..example"},
+		{"space", "stun ü.example"},
+		{"ASCII punctuation", "stun!.example"},
+		{"leading hyphen", "-stun.example"},
+		{"label too long", strings.Repeat("ü", 60) + ".example"},
+		{"name too long", strings.Repeat(strings.Repeat("a", 60)+".", 5) + "example"},
+		{"A-label of ASCII", "xn--abc-.example"},
+		{"A-label that does not decode", "xn--99999999999.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := NormalizeHost(tt.host); err == nil {
+				t.Errorf("NormalizeHost(%q) = %q, want an error", tt.host, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeHostPort(t *testing.T) {
+	got, err := NormalizeHostPort("stun.münchen.example:3478")
+	if err != nil || got != "stun.xn--mnchen-3ya.example:3478" {
+		t.Errorf("NormalizeHostPort = %q, %v", got, err)
+	}
+	if got, err := NormalizeHostPort("[2001:db8::1]:3478"); err != nil || got != "[2001:db8::1]:3478" {
+		t.Errorf("NormalizeHostPort of an IPv6 address = %q, %v", got, err)
+	}
+}
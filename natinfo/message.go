@@ -0,0 +1,156 @@
+package natinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Attribute types decoded into Message fields
+const (
+	AttrMappedAddress    = 0x0001
+	AttrChangedAddress   = 0x0005
+	AttrErrorCode        = 0x0009
+	AttrXORMappedAddress = 0x0020
+	AttrSoftware         = 0x8022
+	AttrResponseOrigin   = 0x802B
+	AttrOtherAddress     = 0x802C
+)
+
+// Message classes of binding answers
+const (
+	BindingSuccess = 0x0101
+	BindingError   = 0x0111
+)
+
+// Attribute is one attribute as it appeared on the wire
+type Attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// Message is a parsed STUN message. Every attribute is kept in order with
+// its raw value, vendor attributes included; the ones listed above are
+// also decoded into the typed fields, which stay zero when absent.
+type Message struct {
+	Type uint16
+	// TransactionID is 12 bytes, or 16 for an RFC 3489 message without
+	// the magic cookie
+	TransactionID []byte
+	Attributes    []Attribute
+
+	XORMappedAddress netip.AddrPort
+	MappedAddress    netip.AddrPort
+	// OtherAddress is OTHER-ADDRESS, or RFC 3489's CHANGED-ADDRESS
+	OtherAddress   netip.AddrPort
+	ResponseOrigin netip.AddrPort
+	Software       string
+	ErrorCode      int
+	ErrorReason    string
+}
+
+// ParseMessage parses a STUN message. Attribute values are copied, so buf
+// may be reused afterwards. Typed fields are left zero for attributes that
+// fail to decode; their raw values are still in Attributes.
+func ParseMessage(buf []byte) (*Message, error) {
+	if len(buf) < headerLength {
+		return nil, errors.New("message too short")
+	}
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if headerLength+length > len(buf) {
+		return nil, errors.New("truncated message")
+	}
+	buf = append([]byte(nil), buf[:headerLength+length]...)
+
+	m := &Message{Type: binary.BigEndian.Uint16(buf[0:2])}
+	var xor []byte
+	if binary.BigEndian.Uint32(buf[4:8]) == magicCookie {
+		m.TransactionID = buf[8:20]
+		xor = buf[4:20]
+	} else {
+		m.TransactionID = buf[4:20]
+	}
+
+	attrs := buf[headerLength:]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		n := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+n > len(attrs) {
+			return nil, errors.New("attribute 0x" + strconv.FormatUint(uint64(typ), 16) + " overruns message")
+		}
+		value := attrs[4 : 4+n]
+		m.Attributes = append(m.Attributes, Attribute{Type: typ, Value: value})
+		m.decode(typ, value, xor)
+		attrs = attrs[min(len(attrs), 4+((n+3)&^3)):]
+	}
+	return m, nil
+}
+
+// decode fills the typed field for a known attribute; the first of each
+// kind wins
+func (m *Message) decode(typ uint16, value, xor []byte) {
+	switch typ {
+	case AttrXORMappedAddress:
+		// An RFC 3489 server's copy was never XORed
+		if addr, ok := parseAddress(value, xor); ok && !m.XORMappedAddress.IsValid() {
+			m.XORMappedAddress = addr
+		}
+	case AttrMappedAddress:
+		if addr, ok := parseAddress(value, nil); ok && !m.MappedAddress.IsValid() {
+			m.MappedAddress = addr
+		}
+	case AttrOtherAddress, AttrChangedAddress:
+		if addr, ok := parseAddress(value, nil); ok && !m.OtherAddress.IsValid() {
+			m.OtherAddress = addr
+		}
+	case AttrResponseOrigin:
+		if addr, ok := parseAddress(value, nil); ok && !m.ResponseOrigin.IsValid() {
+			m.ResponseOrigin = addr
+		}
+	case AttrSoftware:
+		if m.Software == "" {
+			m.Software = strings.TrimRight(string(value), "\x00")
+		}
+	case AttrErrorCode:
+		// Two reserved bytes, the class (hundreds) and the number
+		if len(value) >= 4 && m.ErrorCode == 0 {
+			m.ErrorCode = int(value[2]&0x07)*100 + int(value[3])
+			m.ErrorReason = string(value[4:])
+		}
+	}
+}
+
+// Get returns the raw value of the first attribute of type typ
+func (m *Message) Get(typ uint16) ([]byte, bool) {
+	for _, a := range m.Attributes {
+		if a.Type == typ {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Mapped returns the reflexive address, preferring XOR-MAPPED-ADDRESS,
+// which NAT ALGs cannot rewrite
+func (m *Message) Mapped() netip.AddrPort {
+	if m.XORMappedAddress.IsValid() {
+		return m.XORMappedAddress
+	}
+	return m.MappedAddress
+}
+
+// ResponseError is returned when a server answers with a binding error
+// response. Message holds the whole answer.
+type ResponseError struct {
+	Message *Message
+}
+
+func (e *ResponseError) Error() string {
+	s := "STUN error " + strconv.Itoa(e.Message.ErrorCode)
+	if e.Message.ErrorReason != "" {
+		s += ": " + e.Message.ErrorReason
+	}
+	return s
+}
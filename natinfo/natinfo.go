@@ -0,0 +1,328 @@
+// Package natinfo finds the public (server-reflexive) address of a host, or
+// of one of the application's own sockets, with STUN binding transactions.
+// It is the embeddable part of nat-info for applications that only need
+// their reflexive address; full NAT type detection stays in the nat-info
+// command.
+package natinfo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// DefaultServer is the STUN server used when no WithServer option is given
+const DefaultServer = "stun.l.google.com:19302"
+
+// DefaultTimeout bounds a transaction when the context has no deadline
+const DefaultTimeout = 3 * time.Second
+
+// First retransmission interval; it doubles after every send (RFC 5389 7.2.1)
+const baseRetransmit = 200 * time.Millisecond
+
+// PacketConnFactory opens the sockets PublicAddress runs on. Inject one to
+// use VPN-bound or otherwise protected sockets, or a test double;
+// *net.ListenConfig satisfies it and is the default.
+type PacketConnFactory interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Dialer opens the connections used to resolve server names; *net.Dialer
+// satisfies it. The system resolver is used when none is given.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// config is what the options set
+type config struct {
+	servers   []string
+	timeout   time.Duration
+	localAddr netip.AddrPort
+	factory   PacketConnFactory
+	dialer    Dialer
+	transport Transport
+	clock     Clock
+}
+
+// Option customizes a lookup
+type Option func(*config)
+
+// WithServer adds a STUN server as host:port. Servers are tried in the order
+// given until one answers; the default server is used when none is given.
+func WithServer(server string) Option {
+	return func(c *config) { c.servers = append(c.servers, server) }
+}
+
+// WithTimeout bounds each server's transaction when the context has no
+// earlier deadline
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) { c.timeout = d }
+}
+
+// WithLocalAddr binds the socket PublicAddress opens to a local address,
+// for example to pick an uplink
+func WithLocalAddr(addr netip.AddrPort) Option {
+	return func(c *config) { c.localAddr = addr }
+}
+
+// WithPacketConnFactory opens PublicAddress's socket through f instead of
+// net.ListenConfig
+func WithPacketConnFactory(f PacketConnFactory) Option {
+	return func(c *config) { c.factory = f }
+}
+
+// WithDialer resolves server names with DNS connections opened through d,
+// so lookups follow the same path as the STUN traffic
+func WithDialer(d Dialer) Option {
+	return func(c *config) { c.dialer = d }
+}
+
+// WithTransport runs PublicAddress's transactions over t, for example a
+// Stream for STUN over TCP or TLS, instead of a fresh UDP socket
+func WithTransport(t Transport) Option {
+	return func(c *config) { c.transport = t }
+}
+
+// WithClock replaces the real clock for retransmissions and timeouts, so
+// tests can run the schedule without waiting
+func WithClock(c Clock) Option {
+	return func(cfg *config) { cfg.clock = c }
+}
+
+// resolver returns the resolver for server names
+func (c *config) resolver() *net.Resolver {
+	if c.dialer == nil {
+		return nil
+	}
+	return &net.Resolver{PreferGo: true, Dial: c.dialer.DialContext}
+}
+
+// udp wraps conn in a UDP transport using the configured resolver
+func (c *config) udp(conn net.PacketConn) Transport {
+	return &UDP{Conn: conn, Resolver: c.resolver(), Clock: c.clock}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{timeout: DefaultTimeout, factory: &net.ListenConfig{}, clock: SystemClock{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if len(c.servers) == 0 {
+		c.servers = []string{DefaultServer}
+	}
+	return c
+}
+
+// PublicAddress opens a UDP socket, runs one binding transaction against the
+// first server that answers and returns the address the server saw. The
+// socket is closed on return, so the mapping is of no further use to the
+// caller beyond learning the public IP; use MappedAddressFor to keep it.
+func PublicAddress(ctx context.Context, opts ...Option) (netip.AddrPort, error) {
+	var mapped netip.AddrPort
+	err := withTransport(ctx, newConfig(opts), func(t Transport, cfg *config) (err error) {
+		mapped, err = lookup(ctx, cfg, func(server string) (netip.AddrPort, error) {
+			return transact(ctx, t, server, cfg)
+		})
+		return err
+	})
+	return mapped, err
+}
+
+// Binding is PublicAddress returning the first answer in full, for
+// inspecting SOFTWARE, OTHER-ADDRESS or vendor attributes. A server that
+// answers with an error response is skipped like one that does not answer;
+// its message is in the *ResponseError if none succeeds.
+func Binding(ctx context.Context, opts ...Option) (*Message, error) {
+	var msg *Message
+	err := withTransport(ctx, newConfig(opts), func(t Transport, cfg *config) (err error) {
+		msg, err = lookup(ctx, cfg, func(server string) (*Message, error) {
+			return transactMessage(ctx, t, server, cfg)
+		})
+		return err
+	})
+	return msg, err
+}
+
+// withTransport runs fn over the configured transport, or over a UDP socket
+// opened for the call and closed afterwards
+func withTransport(ctx context.Context, cfg *config, fn func(Transport, *config) error) error {
+	if cfg.transport != nil {
+		return fn(cfg.transport, cfg)
+	}
+
+	network := "udp4"
+	if cfg.localAddr.Addr().Is6() {
+		network = "udp6"
+	}
+	local := ":0"
+	if cfg.localAddr.IsValid() {
+		local = cfg.localAddr.String()
+	}
+	conn, err := cfg.factory.ListenPacket(ctx, network, local)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return fn(cfg.udp(conn), cfg)
+}
+
+// MappedAddressFor runs one binding transaction from the caller's own socket
+// and returns the mapping the NAT created for exactly that socket, so it can
+// be advertised and the socket kept in use afterwards. conn is never closed;
+// its read deadline is cleared on return. Datagrams for the application that
+// arrive during the transaction are dropped.
+func MappedAddressFor(ctx context.Context, conn net.PacketConn, opts ...Option) (netip.AddrPort, error) {
+	cfg := newConfig(opts)
+	t := cfg.udp(conn)
+	return lookup(ctx, cfg, func(server string) (netip.AddrPort, error) {
+		return transact(ctx, t, server, cfg)
+	})
+}
+
+// BindingFor is MappedAddressFor returning the answer in full, like Binding
+func BindingFor(ctx context.Context, conn net.PacketConn, opts ...Option) (*Message, error) {
+	cfg := newConfig(opts)
+	t := cfg.udp(conn)
+	return lookup(ctx, cfg, func(server string) (*Message, error) {
+		return transactMessage(ctx, t, server, cfg)
+	})
+}
+
+// Result is what DetectWithConn learned about one socket
+type Result struct {
+	// Public is the mapping the first answering server saw
+	Public netip.AddrPort
+	// Observed maps each answering server to the address it saw
+	Observed map[string]netip.AddrPort
+	// EndpointIndependent is set when at least two servers answered and all
+	// saw the same mapping, so the address is usable towards any peer
+	EndpointIndependent bool
+	// PortPreserved is set when the public port equals the local one
+	PortPreserved bool
+}
+
+// DetectWithConn queries every configured server from the caller's socket and
+// compares the mappings. Like MappedAddressFor it leaves conn open. Give at
+// least two servers with WithServer to learn the mapping behavior.
+func DetectWithConn(ctx context.Context, conn net.PacketConn, opts ...Option) (*Result, error) {
+	cfg := newConfig(opts)
+	transport := cfg.udp(conn)
+	result := &Result{Observed: make(map[string]netip.AddrPort)}
+
+	var errs []error
+	for _, server := range cfg.servers {
+		mapped, err := transact(ctx, transport, server, cfg)
+		if err != nil {
+			errs = append(errs, serverError{server, err})
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		if !result.Public.IsValid() {
+			result.Public = mapped
+		}
+		result.Observed[server] = mapped
+	}
+	if len(result.Observed) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	result.EndpointIndependent = len(result.Observed) > 1
+	for _, mapped := range result.Observed {
+		if mapped != result.Public {
+			result.EndpointIndependent = false
+		}
+	}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		result.PortPreserved = local.Port == int(result.Public.Port())
+	}
+	return result, nil
+}
+
+// lookup tries each configured server in turn until one answers
+func lookup[T any](ctx context.Context, cfg *config, try func(server string) (T, error)) (T, error) {
+	var errs []error
+	for _, server := range cfg.servers {
+		answer, err := try(server)
+		if err == nil {
+			return answer, nil
+		}
+		errs = append(errs, serverError{server, err})
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	var zero T
+	return zero, errors.Join(errs...)
+}
+
+// serverError prefixes an error with the server it came from, keeping it
+// reachable through errors.As
+type serverError struct {
+	server string
+	err    error
+}
+
+func (e serverError) Error() string { return e.server + ": " + e.err.Error() }
+func (e serverError) Unwrap() error { return e.err }
+
+var errTimeout = errors.New("STUN request timeout")
+
+// exchange runs one binding transaction against server, bounded by the
+// configured timeout on the configured clock, and returns the raw answer
+// with the transaction ID it must carry
+func exchange(ctx context.Context, t Transport, server string, cfg *config) ([]byte, []byte, error) {
+	req, tid, err := newBindingRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+	tctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timer := cfg.clock.AfterFunc(cfg.timeout, func() { cancel(errTimeout) })
+	defer timer.Stop()
+
+	resp, err := t.Exchange(tctx, req, server)
+	if err != nil {
+		if context.Cause(tctx) == errTimeout {
+			return nil, nil, errTimeout
+		}
+		return nil, nil, err
+	}
+	return resp, tid, nil
+}
+
+// transact runs one binding transaction and returns the mapped address
+func transact(ctx context.Context, t Transport, server string, cfg *config) (netip.AddrPort, error) {
+	resp, tid, err := exchange(ctx, t, server, cfg)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return parseBindingResponse(resp, tid)
+}
+
+// transactMessage runs one binding transaction and returns the whole answer
+func transactMessage(ctx context.Context, t Transport, server string, cfg *config) (*Message, error) {
+	resp, tid, err := exchange(ctx, t, server, cfg)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := ParseMessage(resp)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(msg.TransactionID, tid) {
+		return nil, errNotResponse
+	}
+	switch msg.Type {
+	case BindingSuccess:
+		return msg, nil
+	case BindingError:
+		return msg, &ResponseError{Message: msg}
+	}
+	return nil, errNotResponse
+}
@@ -0,0 +1,108 @@
+package natinfo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// Wire constants from RFC 5389
+const (
+	magicCookie    = 0x2112A442
+	headerLength   = 20
+	bindingRequest = 0x0001
+)
+
+var errNotResponse = errors.New("not a binding response")
+
+// newBindingRequest builds an attribute-less RFC 5389 binding request and
+// returns it with its transaction ID
+func newBindingRequest() ([]byte, []byte, error) {
+	req := make([]byte, headerLength)
+	binary.BigEndian.PutUint16(req[0:2], bindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], magicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, nil, err
+	}
+	return req, req[8:20], nil
+}
+
+// parseBindingResponse extracts the reflexive address from a success
+// response for tid, preferring XOR-MAPPED-ADDRESS
+func parseBindingResponse(buf, tid []byte) (netip.AddrPort, error) {
+	if len(buf) < headerLength ||
+		binary.BigEndian.Uint16(buf[0:2]) != BindingSuccess ||
+		binary.BigEndian.Uint32(buf[4:8]) != magicCookie ||
+		!bytes.Equal(buf[8:20], tid) {
+		return netip.AddrPort{}, errNotResponse
+	}
+
+	length := int(binary.BigEndian.Uint16(buf[2:4]))
+	if headerLength+length > len(buf) {
+		return netip.AddrPort{}, errors.New("truncated binding response")
+	}
+	attrs := buf[headerLength : headerLength+length]
+
+	var mapped netip.AddrPort
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		n := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+n > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+n]
+		switch typ {
+		case AttrXORMappedAddress:
+			if addr, ok := parseAddress(value, buf[4:20]); ok {
+				return addr, nil
+			}
+		case AttrMappedAddress:
+			if addr, ok := parseAddress(value, nil); ok {
+				mapped = addr
+			}
+		}
+		attrs = attrs[min(len(attrs), 4+((n+3)&^3)):]
+	}
+
+	if mapped.IsValid() {
+		return mapped, nil
+	}
+	return netip.AddrPort{}, errors.New("binding response carries no mapped address")
+}
+
+// parseAddress decodes a (XOR-)MAPPED-ADDRESS value. xor is the cookie and
+// transaction ID the value was XORed with, or nil for a plain address.
+func parseAddress(value, xor []byte) (netip.AddrPort, bool) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, false
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	// A fixed array keeps the address off the heap
+	var ip [16]byte
+	n := 0
+	switch value[1] {
+	case 0x01:
+		n = 4
+	case 0x02:
+		n = 16
+	default:
+		return netip.AddrPort{}, false
+	}
+	if len(value) < 4+n {
+		return netip.AddrPort{}, false
+	}
+	copy(ip[:], value[4:4+n])
+
+	if xor != nil {
+		port ^= uint16(magicCookie >> 16)
+		for i := 0; i < n; i++ {
+			ip[i] ^= xor[i]
+		}
+	}
+	if n == 4 {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip[:4])), port), true
+	}
+	return netip.AddrPortFrom(netip.AddrFrom16(ip), port), true
+}
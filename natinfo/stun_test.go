@@ -0,0 +1,55 @@
+package natinfo
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// response builds a binding success response for tid carrying attrs, whose
+// lengths are declared as given and not padded
+func response(tid []byte, attrs ...[]byte) []byte {
+	buf := make([]byte, headerLength)
+	binary.BigEndian.PutUint16(buf[0:2], BindingSuccess)
+	binary.BigEndian.PutUint32(buf[4:8], magicCookie)
+	copy(buf[8:20], tid)
+	for _, a := range attrs {
+		buf = append(buf, a...)
+	}
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(buf)-headerLength))
+	return buf
+}
+
+func attribute(typ uint16, value []byte) []byte {
+	a := binary.BigEndian.AppendUint16(nil, typ)
+	a = binary.BigEndian.AppendUint16(a, uint16(len(value)))
+	return append(a, value...)
+}
+
+func TestParseBindingResponseTruncatedTrailingAttribute(t *testing.T) {
+	tid := []byte("0123456789ab")
+	mapped := attribute(AttrMappedAddress, []byte{0, 0x01, 0x0d, 0x05, 192, 0, 2, 7})
+	tests := []struct {
+		name  string
+		attrs [][]byte
+	}{
+		{"one byte value", [][]byte{mapped, attribute(0x8022, []byte{'x'})}},
+		{"three byte value", [][]byte{mapped, attribute(0x8022, []byte{'x', 'y', 'z'})}},
+	}
+	want := netip.MustParseAddrPort("192.0.2.7:3333")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := response(tid, tt.attrs...)
+			got, err := parseBindingResponse(buf, tid)
+			if err != nil {
+				t.Fatalf("parseBindingResponse: %v", err)
+			}
+			if got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if _, err := ParseMessage(buf); err != nil {
+				t.Errorf("ParseMessage: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package natinfo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Transport carries one STUN transaction to a server. Exchange sends req and
+// returns the message answering it (the one with the same transaction ID),
+// retransmitting if the transport is unreliable, until ctx ends.
+//
+// The address in the answer is the mapping of whatever flow the transport
+// used: a UDP transport learns the UDP mapping, a stream transport the TCP
+// one, and a proxied transport the proxy's.
+type Transport interface {
+	Exchange(ctx context.Context, req []byte, server string) ([]byte, error)
+}
+
+// TransportFunc adapts a function to Transport, which is all an in-memory
+// test double needs
+type TransportFunc func(ctx context.Context, req []byte, server string) ([]byte, error)
+
+// Exchange calls f
+func (f TransportFunc) Exchange(ctx context.Context, req []byte, server string) ([]byte, error) {
+	return f(ctx, req, server)
+}
+
+// bufferPool holds receive buffers, so keepalive loops that refresh a
+// mapping every few seconds do not allocate one per transaction
+var bufferPool = sync.Pool{New: func() any {
+	buf := make([]byte, 1500)
+	return &buf
+}}
+
+// UDP runs transactions on a datagram socket, retransmitting per RFC 5389
+// section 7.2.1. Datagrams that are not the answer are skipped, so the socket
+// may be shared with an application protocol; it is never closed, and its
+// read deadline is cleared after each exchange.
+type UDP struct {
+	Conn net.PacketConn
+	// Resolver looks up server names; nil means net.DefaultResolver
+	Resolver *net.Resolver
+	// Clock schedules retransmissions and deadlines; nil means SystemClock
+	Clock Clock
+}
+
+// Exchange implements Transport
+func (u *UDP) Exchange(ctx context.Context, req []byte, server string) ([]byte, error) {
+	addr, err := u.resolve(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := u.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
+	// Cancellation interrupts a blocked read by moving the deadline
+	stop := context.AfterFunc(ctx, func() { u.Conn.SetReadDeadline(clock.Now()) })
+	defer stop()
+	defer u.Conn.SetReadDeadline(time.Time{})
+
+	to := net.UDPAddrFromAddrPort(addr)
+	retransmit := baseRetransmit
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	buf := *bufp
+	for ctx.Err() == nil {
+		if _, err := u.Conn.WriteTo(req, to); err != nil {
+			return nil, err
+		}
+		u.Conn.SetReadDeadline(clock.Now().Add(retransmit))
+		retransmit *= 2
+
+		for {
+			n, _, err := u.Conn.ReadFrom(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if n >= headerLength && bytes.Equal(buf[8:20], req[8:20]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// resolve looks up the first address of server in the socket's family. A
+// wildcard socket is assumed to reach IPv4 servers.
+func (u *UDP) resolve(ctx context.Context, server string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if host, err = NormalizeHost(host); err != nil {
+		return netip.AddrPort{}, err
+	}
+	family := "ip4"
+	if local, ok := u.Conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil && !local.IP.IsUnspecified() {
+		family = "ip6"
+	}
+
+	resolver := u.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupNetIP(ctx, family, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	portNum, err := resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(portNum)), nil
+}
+
+// Stream runs each transaction on a fresh connection from Dialer, framing
+// messages by their header length (RFC 5389 section 7.2.2). A *net.Dialer
+// gives STUN over TCP, a *tls.Dialer STUN over TLS, and a SOCKS client's
+// dialer STUN through the proxy.
+type Stream struct {
+	Dialer Dialer
+	// Network is passed to the dialer; empty means "tcp"
+	Network string
+}
+
+// Exchange implements Transport
+func (s *Stream) Exchange(ctx context.Context, req []byte, server string) ([]byte, error) {
+	network := s.Network
+	if network == "" {
+		network = "tcp"
+	}
+	server, err := NormalizeHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.Dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	// Reliable transports carry no stray datagrams, but a server may still
+	// send indications first
+	for {
+		msg := make([]byte, headerLength)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(msg[2:4]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, err
+		}
+		msg = append(msg, body...)
+		if bytes.Equal(msg[8:20], req[8:20]) {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// wanStatus is the part of "ubus call network.interface.<name> status" that
+// detection needs
+type wanStatus struct {
+	Up        bool   `json:"up"`
+	L3Device  string `json:"l3_device"`
+	Proto     string `json:"proto"`
+	Addresses []struct {
+		Address string `json:"address"`
+	} `json:"ipv4-address"`
+}
+
+// address returns the first IPv4 address of the interface, or ""
+func (w *wanStatus) address() string {
+	if len(w.Addresses) == 0 {
+		return ""
+	}
+	return w.Addresses[0].Address
+}
+
+// ubusWANStatus asks netifd for the state of a logical interface
+func ubusWANStatus(name string) (*wanStatus, error) {
+	out, err := exec.Command("ubus", "call", "network.interface."+name, "status").Output()
+	if err != nil {
+		return nil, errors.New("ubus call network.interface." + name + " status: " + err.Error())
+	}
+	var status wanStatus
+	if err := json.Unmarshal(out, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ubusPublish sends the result as a ubus event, which scripts can follow
+// with "ubus listen nat-info"
+func ubusPublish(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return exec.Command("ubus", "send", event, string(data)).Run()
+}
+
+// uciQuote renders a UCI option value in single quotes
+func uciQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// uciResult renders a result as a UCI section, suitable for "uci import" or
+// a state file under /var/state
+func uciResult(section string, result *NatResult, wan *wanStatus, doubleNAT bool) string {
+	var b strings.Builder
+	option := func(name, value string) {
+		b.WriteString("\toption " + name + " " + uciQuote(value) + "\n")
+	}
+
+	b.WriteString("package 'nat-info'\n\n")
+	b.WriteString("config result " + uciQuote(section) + "\n")
+	option("nat_type", natTypeCodes[result.Type])
+	option("mapping", behaviorCodes[result.Mapping])
+	option("filtering", behaviorCodes[result.Filtering])
+	option("confidence", result.Confidence.String())
+	if result.Public != nil {
+		option("public_ip", result.Public.IP.String())
+		option("public_port", strconv.Itoa(result.Public.Port))
+	}
+	if wan != nil {
+		option("wan_device", wan.L3Device)
+		option("wan_address", wan.address())
+	}
+	if doubleNAT {
+		option("double_nat", "1")
+	} else {
+		option("double_nat", "0")
+	}
+	return b.String()
+}
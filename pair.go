@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Candidate is one transport address a peer can be reached at
+type Candidate struct {
+	Type string `json:"t"`
+	IP   string `json:"i"`
+	Port int    `json:"p"`
+}
+
+func (c Candidate) addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(c.IP), Port: c.Port}
+}
+
+func (c Candidate) String() string {
+	return c.Type + " " + c.IP + ":" + strconv.Itoa(c.Port)
+}
+
+// candidatePriority follows RFC 8445 section 5.1.2.1 for a single component
+func candidatePriority(typ string) uint32 {
+	pref := uint32(0)
+	switch typ {
+	case "host":
+		pref = 126
+	case "prflx":
+		pref = 110
+	case "srflx":
+		pref = 100
+	}
+	return pref<<24 | 65535<<8 | 255
+}
+
+// PeerInfo is what one side of a pairing test shares with the other
+type PeerInfo struct {
+	Ufrag      string      `json:"u"`
+	Pwd        string      `json:"p"`
+	Candidates []Candidate `json:"c"`
+	Lite       bool        `json:"l,omitempty"`
+	// Gateway is a hash of the default gateway's identity, so two peers
+	// can tell they share a LAN without revealing its MAC address
+	Gateway string `json:"g,omitempty"`
+}
+
+// encodeBlob renders peer info as a single base64 line for copy-paste
+func encodeBlob(info PeerInfo) string {
+	data, _ := json.Marshal(info)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeBlob parses a blob produced by encodeBlob
+func decodeBlob(blob string) (PeerInfo, error) {
+	var info PeerInfo
+	data, err := base64.RawURLEncoding.DecodeString(blob)
+	if err != nil {
+		return info, errors.New("not a nat-info blob: " + err.Error())
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, errors.New("not a nat-info blob: " + err.Error())
+	}
+	if info.Ufrag == "" || info.Pwd == "" || len(info.Candidates) == 0 {
+		return info, errors.New("blob is missing credentials or candidates")
+	}
+	return info, nil
+}
+
+// gatherCandidates returns the host candidate of conn and, if a STUN server
+// answers, its server-reflexive candidate
+func gatherCandidates(conn *net.UDPConn, localIP string, opts DetectOptions) []Candidate {
+	env := opts.probeEnv()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	candidates := []Candidate{{Type: "host", IP: localIP, Port: port}}
+
+	for _, server := range opts.Servers {
+		endpoints, err := resolveServer(server)
+		if err != nil {
+			continue
+		}
+		res, err := env.makeStunRequest(conn, endpoints[0].Addr, nil, opts.PrimaryTimeout, true, 0)
+		if err != nil {
+			continue
+		}
+		if res.IP.String() != localIP || res.Port != port {
+			candidates = append(candidates, Candidate{Type: "srflx", IP: res.IP.String(), Port: res.Port})
+		}
+		break
+	}
+	return candidates
+}
+
+// gatewayTag hashes the identity of the default gateway behind iface
+func gatewayTag(iface string) string {
+	id := gatewayIdentity(iface)
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("nat-info pair\x00" + id))
+	return hex.EncodeToString(sum[:6])
+}
+
+// PairLAN describes the direct path between two peers behind the same
+// gateway. Wi-Fi client isolation lets both reach the internet, and often
+// each other hairpinned through the public address, while dropping every
+// frame between them on the LAN.
+type PairLAN struct {
+	SameGateway bool `json:"same_gateway"`
+	SameSubnet  bool `json:"same_subnet"`
+	// HostReached is set when a check to the peer's host candidate was
+	// answered, HostHeard when a check arrived from it
+	HostReached bool `json:"host_reached"`
+	HostHeard   bool `json:"host_heard"`
+	Isolated    bool `json:"isolated"`
+}
+
+// sharedLAN returns a PairLAN when local and remote sit behind the same
+// gateway: the same gateway hash, or without one on either side, a host
+// candidate in this side's subnet and the same public address
+func sharedLAN(local, remote PeerInfo) *PairLAN {
+	var lan PairLAN
+	lan.SameGateway = local.Gateway != "" && local.Gateway == remote.Gateway
+
+	var localHost net.IP
+	localPublic := ""
+	for _, c := range local.Candidates {
+		switch c.Type {
+		case "host":
+			localHost = net.ParseIP(c.IP)
+		case "srflx":
+			localPublic = c.IP
+		}
+	}
+	samePublic := false
+	var segment *net.IPNet
+	if localHost != nil {
+		_, segment, _ = segmentOf(localHost)
+	}
+	for _, c := range remote.Candidates {
+		switch c.Type {
+		case "host":
+			ip := net.ParseIP(c.IP)
+			if ip.Equal(localHost) {
+				// Both ends on one machine say nothing about the LAN
+				return nil
+			}
+			if segment != nil && segment.Contains(ip) {
+				lan.SameSubnet = true
+			}
+		case "srflx":
+			samePublic = localPublic != "" && c.IP == localPublic
+		}
+	}
+
+	if !lan.SameGateway && !(lan.SameSubnet && samePublic && (local.Gateway == "" || remote.Gateway == "")) {
+		return nil
+	}
+	return &lan
+}
+
+// describe explains what the LAN checks found
+func (l *PairLAN) describe() string {
+	switch {
+	case !l.Isolated:
+		return "the peers reach each other directly on the LAN"
+	case l.SameSubnet:
+		return "client isolation: both peers share a gateway and subnet, but traffic between them on the LAN is blocked (common on guest and public Wi-Fi)"
+	default:
+		return "both peers share a gateway, but it does not pass traffic between their LAN segments"
+	}
+}
+
+// PairResult is the outcome of a connectivity-check run
+type PairResult struct {
+	Local       PeerInfo       `json:"local"`
+	Remote      PeerInfo       `json:"remote"`
+	Controlling bool           `json:"controlling"`
+	Selected    *Candidate     `json:"selected,omitempty"`
+	RTT         time.Duration  `json:"rtt,omitempty"`
+	ChecksSent  int            `json:"checks_sent"`
+	ChecksSeen  int            `json:"checks_received"`
+	Transfer    *TransferStats `json:"transfer,omitempty"`
+	LAN         *PairLAN       `json:"lan,omitempty"`
+}
+
+// iceCheck is an outstanding connectivity check
+type iceCheck struct {
+	candidate Candidate
+	sent      time.Time
+}
+
+// iceAgent runs connectivity checks on one socket while answering the
+// peer's checks on the same socket
+type iceAgent struct {
+	conn        *net.UDPConn
+	local       PeerInfo
+	remote      PeerInfo
+	controlling bool
+	tiebreaker  []byte
+	responder   *iceLiteResponder
+	// lan is set when both peers share a gateway, to test the host
+	// candidates even after another pair succeeded
+	lan *PairLAN
+
+	pending map[string]iceCheck
+}
+
+func newICEAgent(conn *net.UDPConn, local, remote PeerInfo) *iceAgent {
+	a := &iceAgent{
+		conn:       conn,
+		local:      local,
+		remote:     remote,
+		tiebreaker: make([]byte, 8),
+		responder:  &iceLiteResponder{ufrag: local.Ufrag, pwd: local.Pwd},
+		pending:    make(map[string]iceCheck),
+	}
+	rand.Read(a.tiebreaker)
+
+	// A lite peer never checks, so we must control; between two full
+	// agents the larger ufrag controls
+	a.controlling = remote.Lite || (!local.Lite && local.Ufrag > remote.Ufrag)
+	a.lan = sharedLAN(local, remote)
+	return a
+}
+
+// sendCheck sends an authenticated binding request to a remote candidate
+func (a *iceAgent) sendCheck(c Candidate) error {
+	tid := make([]byte, 12)
+	rand.Read(tid)
+
+	role := Attribute{Type: AttrIceControlled, Value: a.tiebreaker}
+	if a.controlling {
+		role.Type = AttrIceControlling
+	}
+	attrs := []Attribute{
+		{Type: AttrUsername, Value: []byte(a.remote.Ufrag + ":" + a.local.Ufrag)},
+		{Type: AttrPriority, Value: binary.BigEndian.AppendUint32(nil, candidatePriority("prflx"))},
+		role,
+	}
+	// Aggressive nomination: every check from the controlling side nominates
+	if a.controlling {
+		attrs = append(attrs, Attribute{Type: AttrUseCandidate})
+	}
+
+	msg := encodeStunMessage(BindingRequest, tid, attrs)
+	msg = appendIntegrity(msg, []byte(a.remote.Pwd))
+	msg = appendFingerprint(msg)
+
+	if _, err := a.conn.WriteToUDP(msg, c.addr()); err != nil {
+		return err
+	}
+	a.pending[string(tid)] = iceCheck{candidate: c, sent: time.Now()}
+	return nil
+}
+
+// handle processes one datagram. It answers checks from the peer and
+// returns the check a valid success response belongs to.
+func (a *iceAgent) handle(buffer []byte, from *net.UDPAddr, result *PairResult) (iceCheck, bool) {
+	msg, err := decodeStunMessage(buffer)
+	if err != nil || msg.Cookie != MagicCookie {
+		return iceCheck{}, false
+	}
+
+	switch msg.Type {
+	case BindingRequest:
+		if resp, _ := a.responder.answer(buffer, from); resp != nil {
+			a.conn.WriteToUDP(resp, from)
+			result.ChecksSeen++
+			if a.lan != nil && a.isRemoteHost(from) {
+				a.lan.HostHeard = true
+			}
+		}
+	case BindingResponse:
+		check, ok := a.pending[string(msg.TransactionID)]
+		if !ok || !verifyIntegrity(buffer, []byte(a.remote.Pwd)) {
+			return iceCheck{}, false
+		}
+		// Responses must come back from the address the check went to
+		if !from.IP.Equal(check.candidate.addr().IP) || from.Port != check.candidate.Port {
+			return iceCheck{}, false
+		}
+		return check, true
+	}
+	return iceCheck{}, false
+}
+
+// isRemoteHost reports whether from is one of the peer's host candidates
+func (a *iceAgent) isRemoteHost(from *net.UDPAddr) bool {
+	for _, c := range a.remote.Candidates {
+		if c.Type == "host" && from.Port == c.Port && from.IP.Equal(c.addr().IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHosts returns the peer's host candidates
+func (a *iceAgent) remoteHosts() []Candidate {
+	var out []Candidate
+	for _, c := range a.remote.Candidates {
+		if c.Type == "host" {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// establish paces checks to every remote candidate until one succeeds or
+// wait elapses. A success is followed by a short linger so the peer's own
+// checks still get answered.
+func (a *iceAgent) establish(wait time.Duration) (*PairResult, error) {
+	result := &PairResult{Local: a.local, Remote: a.remote, Controlling: a.controlling, LAN: a.lan}
+	defer func() {
+		if a.lan != nil {
+			a.lan.Isolated = !a.lan.HostReached && !a.lan.HostHeard
+		}
+	}()
+
+	const pace = 100 * time.Millisecond
+	// lanWait is how long the host candidates keep being checked after
+	// a pair through the public address succeeded
+	const lanWait = 3 * time.Second
+	deadline := time.Now().Add(wait)
+	nextSend := time.Now()
+	next := 0
+	var lingerUntil, hostsUntil time.Time
+	buf := make([]byte, 2048)
+
+	for {
+		now := time.Now()
+		checkingHosts := now.Before(hostsUntil)
+		if !lingerUntil.IsZero() && now.After(lingerUntil) && !checkingHosts {
+			return result, nil
+		}
+		if lingerUntil.IsZero() && now.After(deadline) {
+			return result, errors.New("no candidate pair succeeded within " + wait.String())
+		}
+
+		if (lingerUntil.IsZero() || checkingHosts) && !now.Before(nextSend) {
+			candidates := a.remote.Candidates
+			if checkingHosts {
+				candidates = a.remoteHosts()
+			}
+			c := candidates[next%len(candidates)]
+			next++
+			if err := a.sendCheck(c); err == nil {
+				result.ChecksSent++
+			}
+			nextSend = now.Add(pace)
+		}
+
+		readUntil := nextSend
+		if !lingerUntil.IsZero() && !checkingHosts {
+			readUntil = lingerUntil
+		}
+		a.conn.SetReadDeadline(readUntil)
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return result, err
+		}
+
+		check, ok := a.handle(buf[:n], from, result)
+		if !ok {
+			continue
+		}
+		isHost := check.candidate.Type == "host"
+		if isHost && a.lan != nil && !a.lan.HostReached {
+			a.lan.HostReached = true
+			hostsUntil = time.Time{}
+			// The LAN path beats a hairpin through the NAT for anything
+			// sent over it afterwards
+			result.Selected = nil
+		}
+		if result.Selected == nil {
+			selected := check.candidate
+			result.Selected = &selected
+			result.RTT = time.Since(check.sent)
+			lingerUntil = time.Now().Add(2 * time.Second)
+			if a.lan != nil && !a.lan.HostReached && !isHost && len(a.remoteHosts()) > 0 {
+				hostsUntil = time.Now().Add(lanWait)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+)
+
+// ipv4Interfaces lists the up, non-loopback interfaces that have an IPv4 address
+func ipv4Interfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if _, err := interfaceIPv4(iface.Name); err == nil {
+			names = append(names, iface.Name)
+		}
+	}
+	return names
+}
+
+// defaultRouteInterfaces returns the interfaces holding an IPv4 default
+// route. Only Linux exposes the table without extra tools; elsewhere every
+// interface with an IPv4 address is a candidate uplink.
+func defaultRouteInterfaces() []string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ipv4Interfaces()
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway Flags ... Mask
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		if _, err := interfaceIPv4(fields[0]); err != nil {
+			continue
+		}
+		names = appendUnique(names, fields[0])
+	}
+	return names
+}
+
+// routeSource returns the local address the kernel picks for a destination.
+// Connecting a UDP socket sends nothing but runs the route lookup.
+func routeSource(env *probeEnv, addr *net.UDPAddr) string {
+	conn, err := env.dialUDP(nil, addr)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// RouteSource is the local address used to reach one server
+type RouteSource struct {
+	Server string `json:"server"`
+	Addr   string `json:"addr"`
+	Source string `json:"source"`
+}
+
+// routeSources looks up the source address for each server's first IP
+func routeSources(env *probeEnv, servers []string) []RouteSource {
+	var out []RouteSource
+	for _, server := range servers {
+		endpoints, err := env.resolveServer(server)
+		if err != nil {
+			continue
+		}
+		if src := routeSource(env, endpoints[0].Addr); src != "" {
+			out = append(out, RouteSource{Server: server, Addr: endpoints[0].Addr.String(), Source: src})
+		}
+	}
+	return out
+}
+
+// distinctSources counts the different source addresses in use
+func distinctSources(sources []RouteSource) int {
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		seen[s.Source] = true
+	}
+	return len(seen)
+}
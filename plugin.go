@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Plugins are external programs that add organization-specific checks to
+// detection, such as allocating on an internal TURN farm or reaching a
+// proprietary relay. Each runs after the built-in tests with a
+// PluginRequest as JSON on stdin and answers with one PluginResult as JSON
+// on stdout:
+//
+//	{"name": "turn-farm", "status": "warn", "summary": "2 of 3 relays allocate",
+//	 "details": ["turn3.corp.example: 401 Unauthorized"], "data": {...}}
+//
+// Status is pass, warn or fail. A plugin that exits non-zero, prints no
+// such object or outlives its timeout gets status error. The results
+// appear in the report and JSON output with the built-in tests, and a
+// policy can test them as plugin-failed.
+
+// PluginProtocol is the version of the request and result format
+const PluginProtocol = 1
+
+// DefaultPluginTimeout bounds each plugin run
+const DefaultPluginTimeout = 30 * time.Second
+
+// maxPluginOutput caps what is read from a plugin's stdout and stderr
+const maxPluginOutput = 1 << 20
+
+// Plugin statuses; the first three come from the plugin itself
+const (
+	PluginPass  = "pass"
+	PluginWarn  = "warn"
+	PluginFail  = "fail"
+	PluginError = "error"
+)
+
+// PluginRequest is written to a plugin's stdin
+type PluginRequest struct {
+	Protocol  int    `json:"protocol"`
+	Interface string `json:"interface,omitempty"`
+	// TimeoutMS is how long the plugin has before it is killed
+	TimeoutMS int64 `json:"timeout_ms"`
+	// Result is the detection result so far, in the --output json format,
+	// so a plugin can test what the built-in tests found
+	Result *NatResult `json:"result"`
+}
+
+// PluginResult is a plugin's answer, with the command that produced it
+type PluginResult struct {
+	Command string   `json:"command"`
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Summary string   `json:"summary,omitempty"`
+	Details []string `json:"details,omitempty"`
+	// Data is whatever structured output the plugin chose to attach
+	Data     json.RawMessage `json:"data,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Duration time.Duration   `json:"duration"`
+}
+
+// pluginFlag collects --plugin commands; it may be repeated
+type pluginFlag []string
+
+func (f *pluginFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *pluginFlag) Set(value string) error {
+	if len(strings.Fields(value)) == 0 {
+		return errors.New("expected a command")
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// cappedBuffer keeps the first maxPluginOutput bytes written to it
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxPluginOutput - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// runPlugins runs each plugin command in turn against the result
+func runPlugins(commands []string, result *NatResult, iface string, timeout time.Duration) []PluginResult {
+	req, err := json.Marshal(PluginRequest{Protocol: PluginProtocol, Interface: iface, TimeoutMS: timeout.Milliseconds(), Result: result})
+	out := make([]PluginResult, len(commands))
+	for i, command := range commands {
+		if err != nil {
+			out[i] = PluginResult{Command: command, Name: pluginName(command), Status: PluginError, Error: "encoding the request: " + err.Error()}
+			continue
+		}
+		out[i] = runPlugin(command, req, timeout)
+	}
+	return out
+}
+
+// runPlugin runs one plugin command, split on spaces, with req on stdin
+func runPlugin(command string, req []byte, timeout time.Duration) PluginResult {
+	res := PluginResult{Command: command, Name: pluginName(command)}
+	args := strings.Fields(command)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr cappedBuffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	// Children the plugin left behind may hold its stdout open
+	cmd.WaitDelay = time.Second
+	start := time.Now()
+	err := cmd.Run()
+	res.Duration = time.Since(start)
+
+	switch {
+	case ctx.Err() != nil:
+		res.Status, res.Error = PluginError, "no result within "+timeout.String()
+		return res
+	case err != nil:
+		res.Status, res.Error = PluginError, err.Error()
+		if line := lastLine(stderr.String()); line != "" {
+			res.Error += ": " + line
+		}
+		return res
+	}
+
+	var answer PluginResult
+	if err := json.NewDecoder(&stdout.Buffer).Decode(&answer); err != nil {
+		res.Status, res.Error = PluginError, "invalid result: "+err.Error()
+		return res
+	}
+	switch answer.Status {
+	case PluginPass, PluginWarn, PluginFail:
+	default:
+		res.Status, res.Error = PluginError, "invalid status "+answer.Status+" (expected pass, warn or fail)"
+		return res
+	}
+	if answer.Name != "" {
+		res.Name = answer.Name
+	}
+	res.Status, res.Summary, res.Details, res.Data = answer.Status, answer.Summary, answer.Details, answer.Data
+	return res
+}
+
+// pluginName names a plugin after its executable until it names itself
+func pluginName(command string) string {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(args[0]), filepath.Ext(args[0]))
+}
+
+// lastLine returns the last non-empty line of s
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// pluginsFailed reports whether any plugin failed or could not run
+func pluginsFailed(results []PluginResult) bool {
+	for _, p := range results {
+		if p.Status == PluginFail || p.Status == PluginError {
+			return true
+		}
+	}
+	return false
+}
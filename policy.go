@@ -0,0 +1,616 @@
+package main
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PolicyFailed is the exit code of a run whose result a fail rule matched
+const PolicyFailed = 3
+
+// Policy is a list of rules deciding whether a network is good enough,
+// written one per line:
+//
+//	fail if symmetric or lifetime < 30s or public-ip in 100.64/10
+//	warn if rtt > 150ms because "calls will lag"
+//
+// A line without fail or warn is a fail rule. Conditions combine
+// comparisons of result fields with and, or, not and parentheses; a bare
+// NAT type code such as symmetric tests the type, and a bare yes/no field
+// such as unstable tests that it is set. Blank lines and # comments are
+// ignored.
+type Policy struct {
+	Rules []PolicyRule
+}
+
+// PolicyRule is one line of a policy
+type PolicyRule struct {
+	Action  string // "fail" or "warn"
+	Text    string // the condition as written
+	Message string // from "because", if given
+	cond    policyExpr
+}
+
+// PolicyVerdict is the outcome of a policy for one result
+type PolicyVerdict struct {
+	Verdict string        `json:"verdict"` // pass, warn or fail
+	Matched []PolicyMatch `json:"matched,omitempty"`
+	// Undecided lists rules that could not be decided because a field they
+	// use was not measured; they neither fail nor warn
+	Undecided []string `json:"undecided,omitempty"`
+}
+
+// PolicyMatch is a rule that matched
+type PolicyMatch struct {
+	Action  string `json:"action"`
+	Rule    string `json:"rule"`
+	Message string `json:"message,omitempty"`
+}
+
+// describe renders a match as the reason it gives
+func (m PolicyMatch) describe() string {
+	if m.Message != "" {
+		return m.Message + " (" + m.Rule + ")"
+	}
+	return m.Rule
+}
+
+// Summary renders the verdict as one line, e.g. "FAIL - symmetric"
+func (v *PolicyVerdict) Summary() string {
+	line := strings.ToUpper(v.Verdict)
+	var reasons []string
+	for _, m := range v.Matched {
+		if v.Verdict == m.Action {
+			reasons = append(reasons, m.describe())
+		}
+	}
+	if len(reasons) > 0 {
+		line += " - " + strings.Join(reasons, "; ")
+	}
+	return line
+}
+
+// policyKind is the type of a field conditions can test
+type policyKind int
+
+const (
+	policyCode     policyKind = iota // a JSON code such as full-cone
+	policyLevel                      // a confidence level, ordered
+	policyDuration                   // compared with values like 30s
+	policyAddr                       // compared with an IP or tested with in
+	policyFlag                       // yes/no, tested bare
+)
+
+// policyFields lists the fields a policy may test with their kinds. The
+// lifetime fields are measured by the timeouts command; detection takes
+// them from the timeouts the NAT reports, when it reports any.
+var policyFields = map[string]policyKind{
+	"type":           policyCode,
+	"mapping":        policyCode,
+	"filtering":      policyCode,
+	"translation":    policyCode,
+	"access":         policyCode,
+	"confidence":     policyLevel,
+	"public-ip":      policyAddr,
+	"rtt":            policyDuration,
+	"lifetime":       policyDuration,
+	"tcp-lifetime":   policyDuration,
+	"port-preserved": policyFlag,
+	"unstable":       policyFlag,
+	"policy-routed":  policyFlag,
+	"plugin-failed":  policyFlag,
+}
+
+// policyFacts holds the measured value of each field; fields that were not
+// measured are absent. Values are strings for codes, Confidence,
+// time.Duration, netip.Addr and bool.
+type policyFacts map[string]any
+
+// resultFacts collects the fields of a detection result
+func resultFacts(r *NatResult) policyFacts {
+	facts := policyFacts{
+		"type":           natTypeCodes[r.Type],
+		"confidence":     r.Confidence,
+		"port-preserved": slices.Contains(r.Reasons, ReasonPortPreserved),
+		"unstable":       r.UnstableAddress,
+		"policy-routed":  r.PolicyRouted,
+	}
+	if r.Mapping != BehaviorUnknown {
+		facts["mapping"] = behaviorCodes[r.Mapping]
+	}
+	if r.Filtering != BehaviorUnknown {
+		facts["filtering"] = behaviorCodes[r.Filtering]
+	}
+	if r.Translation != "" {
+		facts["translation"] = string(r.Translation)
+	}
+	if r.Access != nil {
+		facts["access"] = string(r.Access.Type)
+	}
+	if r.Public != nil {
+		facts["public-ip"] = r.Public.IP.Unmap()
+	}
+	if rtt, ok := primaryRTT(r); ok {
+		facts["rtt"] = rtt
+	}
+	if len(r.Plugins) > 0 {
+		facts["plugin-failed"] = pluginsFailed(r.Plugins)
+	}
+	if timeout := r.reportedUDPTimeout(); timeout > 0 {
+		facts["lifetime"] = timeout
+	}
+	if g := r.Gateway; g != nil && g.NAT != nil && g.NAT.TCPTimeout > 0 {
+		facts["tcp-lifetime"] = time.Duration(g.NAT.TCPTimeout) * time.Second
+	}
+	return facts
+}
+
+// timeoutFacts collects the lower bounds of measured idle timeouts
+func timeoutFacts(results []IdleTimeout) policyFacts {
+	facts := policyFacts{}
+	for _, t := range results {
+		if t.AtLeast == 0 && t.AtMost == 0 {
+			continue
+		}
+		switch t.Protocol {
+		case "udp":
+			facts["lifetime"] = t.AtLeast
+		case "tcp":
+			facts["tcp-lifetime"] = t.AtLeast
+		}
+	}
+	return facts
+}
+
+// loadPolicy reads a policy from a file, or takes the argument itself as
+// the policy when no such file exists
+func loadPolicy(arg string) (*Policy, error) {
+	text := arg
+	if data, err := os.ReadFile(arg); err == nil {
+		text = string(data)
+	}
+	return parsePolicy(text)
+}
+
+// parsePolicy parses policy text, reporting the line of the first error
+func parsePolicy(text string) (*Policy, error) {
+	p := &Policy{}
+	for i, line := range strings.Split(text, "\n") {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		p.Rules = append(p.Rules, rule)
+	}
+	if len(p.Rules) == 0 {
+		return nil, errors.New("policy has no rules")
+	}
+	return p, nil
+}
+
+func parsePolicyRule(line string) (PolicyRule, error) {
+	toks, err := tokenizePolicy(line)
+	if err != nil {
+		return PolicyRule{}, err
+	}
+	rule := PolicyRule{Action: "fail"}
+	if len(toks) >= 2 && (toks[0].is("fail") || toks[0].is("warn")) && toks[1].is("if") {
+		rule.Action = strings.ToLower(toks[0].text)
+		toks = toks[2:]
+	}
+	if n := len(toks); n >= 2 && toks[n-1].quoted && toks[n-2].is("because") {
+		rule.Message = toks[n-1].text
+		toks = toks[:n-2]
+	}
+	if len(toks) == 0 {
+		return PolicyRule{}, errors.New("rule has no condition")
+	}
+	rule.Text = line[toks[0].start:toks[len(toks)-1].end]
+
+	ps := &policyParser{toks: toks}
+	rule.cond, err = ps.or()
+	if err != nil {
+		return PolicyRule{}, err
+	}
+	if ps.pos < len(toks) {
+		return PolicyRule{}, errors.New("unexpected " + strconv.Quote(toks[ps.pos].text))
+	}
+	return rule, nil
+}
+
+// Evaluate applies every rule to facts
+func (p *Policy) Evaluate(facts policyFacts) *PolicyVerdict {
+	v := &PolicyVerdict{Verdict: "pass"}
+	for _, rule := range p.Rules {
+		missing := make(map[string]bool)
+		switch rule.cond(facts, missing) {
+		case triTrue:
+			v.Matched = append(v.Matched, PolicyMatch{Action: rule.Action, Rule: rule.Text, Message: rule.Message})
+			if rule.Action == "fail" || v.Verdict == "pass" {
+				v.Verdict = rule.Action
+			}
+		case triUnknown:
+			fields := make([]string, 0, len(missing))
+			for field := range missing {
+				fields = append(fields, field)
+			}
+			slices.Sort(fields)
+			v.Undecided = append(v.Undecided, rule.Text+" ("+strings.Join(fields, ", ")+" not measured)")
+		}
+	}
+	return v
+}
+
+// tri is a truth value that may be unknown, so a rule over a field that was
+// not measured neither passes nor fails. and and or follow Kleene's logic: a
+// false operand decides and, a true one decides or.
+type tri int
+
+const (
+	triFalse tri = iota
+	triTrue
+	triUnknown
+)
+
+func triOf(b bool) tri {
+	if b {
+		return triTrue
+	}
+	return triFalse
+}
+
+// policyExpr evaluates a condition, adding the fields it needed but found
+// absent to missing
+type policyExpr func(facts policyFacts, missing map[string]bool) tri
+
+type policyToken struct {
+	text   string
+	quoted bool
+	// start and end are the byte offsets of the token in its line
+	start, end int
+}
+
+// is reports whether the token is the given keyword, in any case
+func (t policyToken) is(keyword string) bool {
+	return !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+// tokenizePolicy splits a rule into words, parentheses, comparison
+// operators and quoted strings. Addresses and prefixes such as
+// 2001:db8::/32 stay single words.
+func tokenizePolicy(s string) ([]policyToken, error) {
+	var toks []policyToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, policyToken{text: string(c), start: i, end: i + 1})
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, policyToken{text: s[i+1 : i+1+end], quoted: true, start: i, end: i + end + 2})
+			i += end + 2
+		case strings.IndexByte("=!<>", c) >= 0:
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			toks = append(toks, policyToken{text: s[i:j], start: i, end: j})
+			i = j
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t()\"=!<>", s[j]) < 0 {
+				j++
+			}
+			toks = append(toks, policyToken{text: s[i:j], start: i, end: j})
+			i = j
+		}
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("empty rule")
+	}
+	return toks, nil
+}
+
+// policyParser is a recursive-descent parser over one rule's tokens:
+//
+//	or     = and { "or" and }
+//	and    = unary { "and" unary }
+//	unary  = "not" unary | "(" or ")" | field op value | field ["not"] "in" prefix | word
+type policyParser struct {
+	toks []policyToken
+	pos  int
+}
+
+func (p *policyParser) peek() (policyToken, bool) {
+	if p.pos >= len(p.toks) {
+		return policyToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *policyParser) next() (policyToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, errors.New("condition ends too early")
+	}
+	p.pos++
+	return t, nil
+}
+
+func (p *policyParser) or() (policyExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if t, ok := p.peek(); !ok || !t.is("or") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f policyFacts, m map[string]bool) tri {
+			a, b := l(f, m), right(f, m)
+			switch {
+			case a == triTrue || b == triTrue:
+				return triTrue
+			case a == triUnknown || b == triUnknown:
+				return triUnknown
+			}
+			return triFalse
+		}
+	}
+}
+
+func (p *policyParser) and() (policyExpr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if t, ok := p.peek(); !ok || !t.is("and") {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f policyFacts, m map[string]bool) tri {
+			a, b := l(f, m), right(f, m)
+			switch {
+			case a == triFalse || b == triFalse:
+				return triFalse
+			case a == triUnknown || b == triUnknown:
+				return triUnknown
+			}
+			return triTrue
+		}
+	}
+}
+
+func (p *policyParser) unary() (policyExpr, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.is("not"):
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f policyFacts, m map[string]bool) tri {
+			switch inner(f, m) {
+			case triTrue:
+				return triFalse
+			case triFalse:
+				return triTrue
+			}
+			return triUnknown
+		}, nil
+	case t.text == "(" && !t.quoted:
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next(); err != nil || t.text != ")" {
+			return nil, errors.New("missing )")
+		}
+		return inner, nil
+	case t.quoted:
+		return nil, errors.New("unexpected string " + strconv.Quote(t.text))
+	}
+
+	word := strings.ToLower(t.text)
+	kind, isField := policyFields[word]
+	if !isField {
+		// A bare NAT type code tests the type
+		if _, err := ParseNATType(word); err == nil {
+			return comparePolicy("type", "=", word, policyCode)
+		}
+		return nil, errors.New("unknown field or condition " + strconv.Quote(t.text))
+	}
+	if kind == policyFlag {
+		return func(f policyFacts, m map[string]bool) tri {
+			v, ok := f[word]
+			if !ok {
+				m[word] = true
+				return triUnknown
+			}
+			return triOf(v.(bool))
+		}, nil
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, errors.New(word + " needs a comparison")
+	}
+	opText := strings.ToLower(op.text)
+	if op.is("not") {
+		if in, err := p.next(); err != nil || !in.is("in") {
+			return nil, errors.New("expected in after not")
+		}
+		opText = "not in"
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, errors.New(word + " " + opText + " needs a value")
+	}
+	return comparePolicy(word, opText, value.text, kind)
+}
+
+// comparePolicy builds the comparison of a field with a literal, checking
+// the literal and operator suit the field's kind
+func comparePolicy(field, op, literal string, kind policyKind) (policyExpr, error) {
+	if op == "==" {
+		op = "="
+	}
+	ordered := op == "<" || op == "<=" || op == ">" || op == ">="
+	equality := op == "=" || op == "!="
+	bad := errors.New("cannot use " + op + " with " + field)
+
+	var test func(v any) bool
+	switch kind {
+	case policyCode:
+		if !equality {
+			return nil, bad
+		}
+		if err := checkPolicyCode(field, literal); err != nil {
+			return nil, err
+		}
+		test = func(v any) bool { return v.(string) == literal }
+
+	case policyLevel:
+		var want Confidence
+		if err := want.UnmarshalText([]byte(literal)); err != nil {
+			return nil, err
+		}
+		if !ordered && !equality {
+			return nil, bad
+		}
+		test = func(v any) bool { return compareOrdered(int(v.(Confidence)), int(want), op) }
+
+	case policyDuration:
+		want, err := time.ParseDuration(literal)
+		if err != nil {
+			return nil, errors.New("invalid duration " + strconv.Quote(literal) + " for " + field)
+		}
+		if !ordered && !equality {
+			return nil, bad
+		}
+		test = func(v any) bool { return compareOrdered(int(v.(time.Duration)), int(want), op) }
+
+	case policyAddr:
+		switch op {
+		case "in", "not in":
+			prefix, err := parsePolicyPrefix(literal)
+			if err != nil {
+				return nil, err
+			}
+			test = func(v any) bool { return prefix.Contains(v.(netip.Addr)) == (op == "in") }
+		case "=", "!=":
+			want, err := netip.ParseAddr(literal)
+			if err != nil {
+				return nil, errors.New("invalid address " + strconv.Quote(literal))
+			}
+			want = want.Unmap()
+			test = func(v any) bool { return (v.(netip.Addr) == want) == (op == "=") }
+		default:
+			return nil, bad
+		}
+	}
+	if op == "!=" && kind != policyAddr {
+		eq := test
+		test = func(v any) bool { return !eq(v) }
+	}
+
+	return func(f policyFacts, m map[string]bool) tri {
+		v, ok := f[field]
+		if !ok {
+			m[field] = true
+			return triUnknown
+		}
+		return triOf(test(v))
+	}, nil
+}
+
+// compareOrdered applies an ordered or equality operator; != is applied by
+// the caller
+func compareOrdered(a, b int, op string) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return a == b
+}
+
+// checkPolicyCode rejects a code the field can never have, so a typo does
+// not silently never match
+func checkPolicyCode(field, code string) error {
+	var known []string
+	switch field {
+	case "type":
+		for _, c := range natTypeCodes {
+			known = append(known, c)
+		}
+	case "mapping", "filtering":
+		for _, c := range behaviorCodes {
+			known = append(known, c)
+		}
+	case "translation":
+		known = []string{string(TranslationPAT), string(TranslationOneToOne)}
+	default:
+		return nil
+	}
+	if slices.Contains(known, code) {
+		return nil
+	}
+	slices.Sort(known)
+	return errors.New("unknown " + field + " " + strconv.Quote(code) + " (expected " + strings.Join(known, ", ") + ")")
+}
+
+// parsePolicyPrefix parses a CIDR prefix, also accepting IPv4 prefixes with
+// trailing zero octets left out, e.g. 100.64/10
+func parsePolicyPrefix(s string) (netip.Prefix, error) {
+	addr, bits, ok := strings.Cut(s, "/")
+	if ok && !strings.Contains(addr, ":") {
+		for strings.Count(addr, ".") < 3 {
+			addr += ".0"
+		}
+		s = addr + "/" + bits
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, errors.New("invalid prefix " + strconv.Quote(s))
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []PolicyRule
+		wantErr string
+	}{
+		{"bare condition fails", "symmetric", []PolicyRule{{Action: "fail", Text: "symmetric"}}, ""},
+		{"warn with message", `warn if rtt > 150ms because "calls will lag"`,
+			[]PolicyRule{{Action: "warn", Text: "rtt > 150ms", Message: "calls will lag"}}, ""},
+		{"keywords in any case", "FAIL IF Symmetric OR NOT unstable", []PolicyRule{{Action: "fail", Text: "Symmetric OR NOT unstable"}}, ""},
+		{"comments and blank lines", "# header\n\nfail if symmetric # trailing\n  warn if unstable\n",
+			[]PolicyRule{{Action: "fail", Text: "symmetric"}, {Action: "warn", Text: "unstable"}}, ""},
+		{"prefix shorthand", "public-ip in 100.64/10", []PolicyRule{{Action: "fail", Text: "public-ip in 100.64/10"}}, ""},
+		{"ipv6 prefix", "public-ip not in 2001:db8::/32", []PolicyRule{{Action: "fail", Text: "public-ip not in 2001:db8::/32"}}, ""},
+		{"operators without spaces", "rtt>=100ms and confidence<high", []PolicyRule{{Action: "fail", Text: "rtt>=100ms and confidence<high"}}, ""},
+
+		{"empty", "# nothing\n", nil, "policy has no rules"},
+		{"no condition", "fail if", nil, "line 1: rule has no condition"},
+		{"unknown field", "speed > 3", nil, `line 1: unknown field or condition "speed"`},
+		{"unknown code", "mapping = endpoint", nil, `line 1: unknown mapping "endpoint" (expected address-dependent, address-port-dependent, endpoint-independent, unknown)`},
+		{"ordered code", "type > symmetric", nil, "line 1: cannot use > with type"},
+		{"bad duration", "rtt > fast", nil, `line 1: invalid duration "fast" for rtt`},
+		{"bad prefix", "public-ip in 10.0.0.0/33", nil, `line 1: invalid prefix "10.0.0.0/33"`},
+		{"in on a duration", "rtt in 10ms", nil, "line 1: cannot use in with rtt"},
+		{"missing value", "rtt >", nil, "line 1: rtt > needs a value"},
+		{"missing comparison", "rtt", nil, "line 1: rtt needs a comparison"},
+		{"not without in", "public-ip not 10/8", nil, "line 1: expected in after not"},
+		{"unclosed parenthesis", "(symmetric or unstable", nil, "line 1: missing )"},
+		{"trailing tokens", "symmetric unstable", nil, `line 1: unexpected "unstable"`},
+		{"dangling or", "symmetric or", nil, "line 1: condition ends too early"},
+		{"unterminated string", `warn if unstable because "oops`, nil, "line 1: unterminated string"},
+		{"string as condition", `"symmetric"`, nil, `line 1: unexpected string "symmetric"`},
+		{"error line number", "symmetric\n\nrtt >", nil, "line 3: rtt > needs a value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := parsePolicy(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePolicy: %v", err)
+			}
+			if len(p.Rules) != len(tt.want) {
+				t.Fatalf("got %d rules, want %d", len(p.Rules), len(tt.want))
+			}
+			for i, rule := range p.Rules {
+				want := tt.want[i]
+				if rule.Action != want.Action || rule.Text != want.Text || rule.Message != want.Message {
+					t.Errorf("rule %d = %s %q %q, want %s %q %q", i, rule.Action, rule.Text, rule.Message, want.Action, want.Text, want.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	facts := policyFacts{
+		"type":           "symmetric",
+		"mapping":        "address-port-dependent",
+		"confidence":     ConfidenceMedium,
+		"public-ip":      netip.MustParseAddr("100.64.1.2"),
+		"rtt":            80 * time.Millisecond,
+		"lifetime":       45 * time.Second,
+		"unstable":       false,
+		"port-preserved": true,
+	}
+	tests := []struct {
+		policy    string
+		verdict   string
+		matched   int
+		undecided int
+	}{
+		{"symmetric", "fail", 1, 0},
+		{"full-cone", "pass", 0, 0},
+		{"type != symmetric", "pass", 0, 0},
+		{"type == symmetric", "fail", 1, 0},
+		{"mapping = address-port-dependent", "fail", 1, 0},
+		{"confidence < high", "fail", 1, 0},
+		{"confidence >= high", "pass", 0, 0},
+		{"public-ip in 100.64/10", "fail", 1, 0},
+		{"public-ip not in 100.64/10", "pass", 0, 0},
+		{"public-ip = 100.64.1.2", "fail", 1, 0},
+		{"public-ip != 100.64.1.2", "pass", 0, 0},
+		{"rtt > 50ms and rtt <= 80ms", "fail", 1, 0},
+		{"lifetime < 30s", "pass", 0, 0},
+		{"lifetime < 1m", "fail", 1, 0},
+		{"unstable", "pass", 0, 0},
+		{"not unstable and port-preserved", "fail", 1, 0},
+		{"not (symmetric or unstable)", "pass", 0, 0},
+		{"warn if rtt > 50ms", "warn", 1, 0},
+		{"warn if rtt > 50ms\nfail if symmetric", "fail", 2, 0},
+		{"fail if symmetric\nwarn if rtt > 50ms", "fail", 2, 0},
+
+		// Kleene logic over fields that were not measured
+		{"tcp-lifetime < 30s", "pass", 0, 1},
+		{"symmetric or tcp-lifetime < 30s", "fail", 1, 0},
+		{"full-cone and tcp-lifetime < 30s", "pass", 0, 0},
+		{"symmetric and tcp-lifetime < 30s", "pass", 0, 1},
+		{"full-cone or tcp-lifetime < 30s", "pass", 0, 1},
+		{"not policy-routed", "pass", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(strings.ReplaceAll(tt.policy, "\n", "; "), func(t *testing.T) {
+			p, err := parsePolicy(tt.policy)
+			if err != nil {
+				t.Fatalf("parsePolicy: %v", err)
+			}
+			v := p.Evaluate(facts)
+			if v.Verdict != tt.verdict || len(v.Matched) != tt.matched || len(v.Undecided) != tt.undecided {
+				t.Errorf("verdict %s, %d matched, %d undecided; want %s, %d, %d", v.Verdict, len(v.Matched), len(v.Undecided), tt.verdict, tt.matched, tt.undecided)
+			}
+		})
+	}
+}
+
+func TestPolicyUndecidedNamesFields(t *testing.T) {
+	p, err := parsePolicy("tcp-lifetime < 30s or not policy-routed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := p.Evaluate(policyFacts{})
+	want := []string{"tcp-lifetime < 30s or not policy-routed (policy-routed, tcp-lifetime not measured)"}
+	if !slices.Equal(v.Undecided, want) {
+		t.Errorf("Undecided = %q, want %q", v.Undecided, want)
+	}
+}
+
+func TestResultFactsLifetime(t *testing.T) {
+	p, err := parsePolicy("fail if symmetric or lifetime < 30s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		result  NatResult
+		verdict string
+		decided bool
+	}{
+		{"nothing reported", NatResult{Type: NATFullCone}, "pass", false},
+		{"short conntrack timeout", NatResult{Type: NATFullCone, Conntrack: &ConntrackReport{UDPTimeout: 20}}, "fail", true},
+		{"long nat-mib timeout", NatResult{Type: NATFullCone, Gateway: &GatewayInfo{NAT: &GatewayNAT{UDPTimeout: 300}}}, "pass", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := p.Evaluate(resultFacts(&tt.result))
+			if v.Verdict != tt.verdict || (len(v.Undecided) == 0) != tt.decided {
+				t.Errorf("verdict %s, undecided %q; want %s, decided %v", v.Verdict, v.Undecided, tt.verdict, tt.decided)
+			}
+		})
+	}
+
+	r := NatResult{Gateway: &GatewayInfo{NAT: &GatewayNAT{TCPTimeout: 3600}}}
+	if got := resultFacts(&r)["tcp-lifetime"]; got != time.Hour {
+		t.Errorf("tcp-lifetime = %v, want 1h", got)
+	}
+}
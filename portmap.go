@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway port-control protocols, in the default order of preference: PCP
+// supersedes NAT-PMP and, unlike UPnP IGD, needs no HTTP or SOAP stack
+const (
+	PortMapPCP    = "pcp"
+	PortMapNATPMP = "nat-pmp"
+	PortMapUPnP   = "upnp"
+)
+
+var portMapNames = map[string]string{
+	PortMapPCP:    "PCP",
+	PortMapNATPMP: "NAT-PMP",
+	PortMapUPnP:   "UPnP IGD",
+}
+
+// DefaultPortMapOrder is the preference order unless --protocols overrides it
+const DefaultPortMapOrder = PortMapPCP + "," + PortMapNATPMP + "," + PortMapUPnP
+
+// pcpPort is where PCP (RFC 6887) and NAT-PMP (RFC 6886) servers listen
+const pcpPort = 5351
+
+// PortMapProbe is what one protocol's server said, if anything
+type PortMapProbe struct {
+	Protocol string `json:"protocol"`
+	// Answered is set when a server speaking the protocol replied at all;
+	// Works when it also accepted the request
+	Answered   bool   `json:"answered"`
+	Works      bool   `json:"works"`
+	Server     string `json:"server,omitempty"`
+	ExternalIP string `json:"external_ip,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	// The UPnP WAN connection service, kept for adding mappings
+	controlURL, serviceType string
+}
+
+// PortMapCheck reports every gateway-control protocol the network offers
+// and which one a client should use
+type PortMapCheck struct {
+	Gateway   string         `json:"gateway,omitempty"`
+	LocalIP   string         `json:"local_ip,omitempty"`
+	Order     []string       `json:"order"`
+	Probes    []PortMapProbe `json:"probes"`
+	Preferred string         `json:"preferred,omitempty"`
+}
+
+// parsePortMapOrder validates a comma-separated protocol list
+func parsePortMapOrder(list string) ([]string, error) {
+	var order []string
+	for _, p := range strings.Split(list, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "natpmp" {
+			p = PortMapNATPMP
+		}
+		if _, ok := portMapNames[p]; !ok {
+			return nil, errors.New("unknown protocol " + strconv.Quote(p) + " (expected pcp, nat-pmp or upnp)")
+		}
+		order = appendUnique(order, p)
+	}
+	return order, nil
+}
+
+// checkPortMapping probes the protocols in order concurrently and picks the
+// first one that works. gateway may be nil when no default route is known;
+// only UPnP, which is discovered by multicast, runs then.
+func checkPortMapping(env *probeEnv, gateway net.IP, order []string, timeout time.Duration) PortMapCheck {
+	check := PortMapCheck{Order: order, Probes: make([]PortMapProbe, len(order))}
+	if gateway != nil {
+		check.Gateway = gateway.String()
+	}
+	if _, segment, err := lanSegment(env); err == nil {
+		check.LocalIP = segment.IP.String()
+	}
+
+	var wg sync.WaitGroup
+	for i, proto := range order {
+		wg.Add(1)
+		go func(i int, proto string) {
+			defer wg.Done()
+			probe := PortMapProbe{Protocol: proto}
+			switch proto {
+			case PortMapPCP:
+				probePCP(env, &probe, gateway, timeout)
+			case PortMapNATPMP:
+				probeNATPMP(env, &probe, gateway, timeout)
+			case PortMapUPnP:
+				probeUPnP(env, &probe, check.LocalIP, timeout)
+			}
+			check.Probes[i] = probe
+		}(i, proto)
+	}
+	wg.Wait()
+
+	for _, p := range check.Probes {
+		if p.Works {
+			check.Preferred = p.Protocol
+			break
+		}
+	}
+	return check
+}
+
+// exchangePortMap sends the request built for the socket's source address
+// to the gateway's port-control port and returns the first reply accepted
+// by valid, resending with the doubling interval both protocols specify,
+// starting at 250ms
+func exchangePortMap(env *probeEnv, gateway net.IP, build func(local net.IP) []byte, timeout time.Duration, valid func([]byte) bool) ([]byte, *net.UDPConn, error) {
+	if gateway == nil {
+		return nil, nil, errors.New("no default gateway found; pass --gateway")
+	}
+	conn, err := env.dialUDP(nil, &net.UDPAddr{IP: gateway, Port: pcpPort})
+	if err != nil {
+		return nil, nil, err
+	}
+	req := build(conn.LocalAddr().(*net.UDPAddr).IP)
+
+	deadline := time.Now().Add(timeout)
+	interval := 250 * time.Millisecond
+	buf := make([]byte, 1100)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		wait := time.Now().Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				// An ICMP port unreachable: nothing listens on the gateway
+				conn.Close()
+				return nil, nil, errors.New("no server on " + gateway.String() + ":" + strconv.Itoa(pcpPort))
+			}
+			if valid(buf[:n]) {
+				return buf[:n], conn, nil
+			}
+		}
+		interval *= 2
+	}
+	conn.Close()
+	return nil, nil, errors.New("no answer")
+}
+
+// PCP result codes (RFC 6887 section 7.4)
+var pcpResults = []string{
+	"SUCCESS", "UNSUPP_VERSION", "NOT_AUTHORIZED", "MALFORMED_REQUEST",
+	"UNSUPP_OPCODE", "UNSUPP_OPTION", "MALFORMED_OPTION", "NETWORK_FAILURE",
+	"NO_RESOURCES", "UNSUPP_PROTOCOL", "USER_EX_QUOTA", "CANNOT_PROVIDE_EXTERNAL",
+	"ADDRESS_MISMATCH", "EXCESSIVE_REMOTE_PEERS",
+}
+
+// probePCP sends an ANNOUNCE, which creates nothing on the gateway. A
+// NAT-PMP-only server answers it with its own UNSUPP_VERSION.
+func probePCP(env *probeEnv, probe *PortMapProbe, gateway net.IP, timeout time.Duration) {
+	announce := func(local net.IP) []byte {
+		req := make([]byte, 24)
+		req[0] = 2 // version; opcode 0 is ANNOUNCE, lifetime 0
+		copy(req[8:], local.To16())
+		return req
+	}
+	resp, conn, err := exchangePortMap(env, gateway, announce, timeout, func(b []byte) bool {
+		return len(b) >= 4 && (b[0] == 2 && b[1] == 0x80 || b[0] == 0 && b[1]&0x80 != 0)
+	})
+	if err != nil {
+		probe.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+	probe.Server = conn.RemoteAddr().String()
+	if resp[0] == 0 {
+		probe.Error = "the server only speaks NAT-PMP"
+		return
+	}
+	probe.Answered = true
+
+	code := int(resp[3])
+	if code != 0 {
+		probe.Error = "result " + pcpResultName(code)
+		if code == 12 {
+			probe.Error += ": another NAT sits between this host and the PCP server"
+		}
+		return
+	}
+	probe.Works = true
+	if len(resp) >= 12 {
+		probe.Detail = "epoch " + strconv.FormatUint(uint64(binary.BigEndian.Uint32(resp[8:12])), 10) + "s"
+	}
+}
+
+func pcpResultName(code int) string {
+	if code < len(pcpResults) {
+		return pcpResults[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// NAT-PMP result codes (RFC 6886 section 3.5)
+var natpmpResults = []string{
+	"success", "unsupported version", "not authorized or refused",
+	"network failure", "out of resources", "unsupported opcode",
+}
+
+// probeNATPMP asks for the external address, which creates nothing on the
+// gateway. A PCP-only server answers with a PCP UNSUPP_VERSION.
+func probeNATPMP(env *probeEnv, probe *PortMapProbe, gateway net.IP, timeout time.Duration) {
+	external := func(net.IP) []byte { return []byte{0, 0} }
+	resp, conn, err := exchangePortMap(env, gateway, external, timeout, func(b []byte) bool {
+		return len(b) >= 4 && (b[0] == 0 && b[1] == 128 || b[0] == 2 && b[1]&0x80 != 0)
+	})
+	if err != nil {
+		probe.Error = err.Error()
+		return
+	}
+	defer conn.Close()
+	probe.Server = conn.RemoteAddr().String()
+	if resp[0] == 2 {
+		probe.Error = "the server only speaks PCP"
+		return
+	}
+	probe.Answered = true
+
+	code := int(binary.BigEndian.Uint16(resp[2:4]))
+	if code != 0 {
+		probe.Error = "result " + strconv.Itoa(code)
+		if code < len(natpmpResults) {
+			probe.Error += " (" + natpmpResults[code] + ")"
+		}
+		return
+	}
+	if len(resp) < 12 {
+		probe.Error = "short answer"
+		return
+	}
+	probe.Works = true
+	probe.ExternalIP = net.IP(resp[8:12]).String()
+	probe.Detail = "epoch " + strconv.FormatUint(uint64(binary.BigEndian.Uint32(resp[4:8])), 10) + "s"
+}
+
+// UPnP service types that control a WAN connection's port mappings
+var upnpWANServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpDevice is the part of a UPnP device description that matters here
+type upnpDevice struct {
+	FriendlyName string `xml:"friendlyName"`
+	ModelName    string `xml:"modelName"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// findService returns the control URL of the first WAN connection service
+// in the device tree, in upnpWANServices order
+func (d *upnpDevice) findService() (string, string) {
+	for _, want := range upnpWANServices {
+		if u := d.controlURL(want); u != "" {
+			return want, u
+		}
+	}
+	return "", ""
+}
+
+func (d *upnpDevice) controlURL(serviceType string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return strings.TrimSpace(s.ControlURL)
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].controlURL(serviceType); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// probeUPnP finds an Internet Gateway Device by SSDP, reads its description
+// and asks its WAN connection service for the external address
+func probeUPnP(env *probeEnv, probe *PortMapProbe, localIP string, timeout time.Duration) {
+	if localIP == "" {
+		probe.Error = "no LAN interface to search from"
+		return
+	}
+	var location string
+	search := ssdpQuery(LANMulticast, ssdpGroup)
+	search.payload = bytes.Replace(search.payload, []byte("ST: ssdp:all"), []byte("ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1"), 1)
+	match := search.match
+	search.match = func(from *net.UDPAddr, buf []byte) string {
+		if match(from, buf) == "" {
+			return ""
+		}
+		for _, line := range strings.Split(string(buf), "\r\n") {
+			if k, v, ok := strings.Cut(line, ":"); ok && strings.EqualFold(k, "location") && location == "" {
+				location = strings.TrimSpace(v)
+			}
+		}
+		return from.IP.String()
+	}
+	found := runLANQuery(env, net.ParseIP(localIP), search, ownAddresses(), timeout)
+	if found.Error != "" {
+		probe.Error = found.Error
+		return
+	}
+	if location == "" {
+		probe.Error = "no Internet Gateway Device answered the SSDP search"
+		return
+	}
+	probe.Server = location
+	probe.Answered = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := upnpGet(ctx, location, &desc); err != nil {
+		probe.Error = "reading the device description: " + err.Error()
+		return
+	}
+	probe.Detail = strings.TrimSpace(desc.Device.FriendlyName)
+	if model := strings.TrimSpace(desc.Device.ModelName); model != "" && model != probe.Detail {
+		probe.Detail = strings.TrimSpace(probe.Detail + " (" + model + ")")
+	}
+
+	serviceType, control := desc.Device.findService()
+	if control == "" {
+		probe.Error = "the device has no WAN connection service"
+		return
+	}
+	base := location
+	if desc.URLBase != "" {
+		base = desc.URLBase
+	}
+	controlURL, err := resolveURL(base, control)
+	if err != nil {
+		probe.Error = "bad control URL: " + err.Error()
+		return
+	}
+	ip, err := upnpExternalIP(ctx, controlURL, serviceType)
+	if err != nil {
+		probe.Error = "GetExternalIPAddress: " + err.Error()
+		return
+	}
+	probe.Works = true
+	probe.ExternalIP = ip
+	probe.controlURL, probe.serviceType = controlURL, serviceType
+}
+
+func resolveURL(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return "", err
+	}
+	return b.ResolveReference(r).String(), nil
+}
+
+// upnpGet fetches and decodes an XML document from the gateway
+func upnpGet(ctx context.Context, location string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// upnpExternalIP calls GetExternalIPAddress on a WAN connection service
+func upnpExternalIP(ctx context.Context, controlURL, serviceType string) (string, error) {
+	var envelope struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := upnpSOAP(ctx, controlURL, serviceType, "GetExternalIPAddress", nil, &envelope); err != nil {
+		return "", err
+	}
+	if net.ParseIP(strings.TrimSpace(envelope.IP)) == nil {
+		return "", errors.New("no external address in the answer")
+	}
+	return strings.TrimSpace(envelope.IP), nil
+}
+
+// upnpSOAP calls an action with arguments given as name, value pairs and
+// decodes the answer into v. A UPnP error becomes an upnpError.
+func upnpSOAP(ctx context.Context, controlURL, serviceType, action string, args [][2]string, v any) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + serviceType + `">`)
+	for _, arg := range args {
+		b.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&b, []byte(arg[1]))
+		b.WriteString("</" + arg[0] + ">")
+	}
+	b.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, strings.NewReader(b.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+`#`+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.NewDecoder(body).Decode(&fault) == nil && fault.Code != 0 {
+			return &upnpError{Code: fault.Code, Description: fault.Description}
+		}
+		return errors.New(resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(body).Decode(v)
+}
+
+// upnpError is an error a UPnP action answered with
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return "UPnP error " + strconv.Itoa(e.Code) + " " + e.Description
+}
+
+// PortMapping is a mapping requested from the gateway: what it granted, or
+// why it refused
+type PortMapping struct {
+	Protocol string `json:"protocol"`
+	Internal int    `json:"internal"`
+	External int    `json:"external,omitempty"`
+	// Via is the protocol that granted the mapping
+	Via      string        `json:"via,omitempty"`
+	Lifetime time.Duration `json:"lifetime,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	// nonce identifies a PCP mapping for deleting it
+	nonce []byte
+}
+
+// portMapper adds and removes mappings with the protocol a PortMapCheck
+// preferred
+type portMapper struct {
+	env     *probeEnv
+	gateway net.IP
+	localIP string
+	probe   PortMapProbe
+	timeout time.Duration
+}
+
+// newPortMapper returns a mapper for the check's preferred protocol, or nil
+// when none works
+func newPortMapper(env *probeEnv, check PortMapCheck, gateway net.IP, timeout time.Duration) *portMapper {
+	for _, p := range check.Probes {
+		if p.Works && p.Protocol == check.Preferred {
+			return &portMapper{env: env, gateway: gateway, localIP: check.LocalIP, probe: p, timeout: timeout}
+		}
+	}
+	return nil
+}
+
+// add asks for the external port equal to port, forwarded to port on this
+// host, for lifetime; the gateway may assign another external port
+func (m *portMapper) add(protocol string, port int, lifetime time.Duration) PortMapping {
+	mapping := PortMapping{Protocol: protocol, Internal: port, Via: m.probe.Protocol}
+	var err error
+	switch m.probe.Protocol {
+	case PortMapPCP:
+		mapping.nonce = make([]byte, 12)
+		rand.Read(mapping.nonce)
+		err = m.pcpMap(&mapping, lifetime)
+	case PortMapNATPMP:
+		err = m.natpmpMap(&mapping, lifetime)
+	case PortMapUPnP:
+		err = m.upnpMap(&mapping, lifetime)
+	}
+	if err != nil {
+		mapping.Error = err.Error()
+	}
+	return mapping
+}
+
+// remove deletes a mapping add created; errors are ignored since the
+// mapping expires with its lifetime anyway
+func (m *portMapper) remove(mapping PortMapping) {
+	if mapping.Error != "" {
+		return
+	}
+	switch m.probe.Protocol {
+	case PortMapPCP:
+		m.pcpMap(&mapping, 0)
+	case PortMapNATPMP:
+		m.natpmpMap(&mapping, 0)
+	case PortMapUPnP:
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		defer cancel()
+		upnpSOAP(ctx, m.probe.controlURL, m.probe.serviceType, "DeletePortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(mapping.External)},
+			{"NewProtocol", strings.ToUpper(mapping.Protocol)},
+		}, nil)
+	}
+}
+
+// pcpMap sends a PCP MAP request (RFC 6887 section 11); lifetime 0
+// deletes the mapping with the same nonce
+func (m *portMapper) pcpMap(mapping *PortMapping, lifetime time.Duration) error {
+	build := func(local net.IP) []byte {
+		req := make([]byte, 60)
+		req[0], req[1] = 2, 1
+		binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+		copy(req[8:24], local.To16())
+		copy(req[24:36], mapping.nonce)
+		req[36] = scanProtoByte(mapping.Protocol)
+		binary.BigEndian.PutUint16(req[40:42], uint16(mapping.Internal))
+		binary.BigEndian.PutUint16(req[42:44], uint16(mapping.Internal))
+		// Any external IPv4 address
+		copy(req[44:60], net.IPv4zero.To16())
+		return req
+	}
+	resp, conn, err := exchangePortMap(m.env, m.gateway, build, m.timeout, func(b []byte) bool {
+		return len(b) >= 60 && b[0] == 2 && b[1] == 0x81 && string(b[24:36]) == string(mapping.nonce)
+	})
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if code := int(resp[3]); code != 0 {
+		return errors.New("PCP result " + pcpResultName(code))
+	}
+	mapping.Lifetime = time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	mapping.External = int(binary.BigEndian.Uint16(resp[42:44]))
+	return nil
+}
+
+// natpmpMap sends a NAT-PMP mapping request (RFC 6886 section 3.3);
+// lifetime 0 deletes it
+func (m *portMapper) natpmpMap(mapping *PortMapping, lifetime time.Duration) error {
+	op := byte(1)
+	if mapping.Protocol == "tcp" {
+		op = 2
+	}
+	// A deletion must suggest no external port (RFC 6886 section 3.4)
+	external := mapping.Internal
+	if lifetime == 0 {
+		external = 0
+	}
+	build := func(net.IP) []byte {
+		req := make([]byte, 12)
+		req[1] = op
+		binary.BigEndian.PutUint16(req[4:6], uint16(mapping.Internal))
+		binary.BigEndian.PutUint16(req[6:8], uint16(external))
+		binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+		return req
+	}
+	resp, conn, err := exchangePortMap(m.env, m.gateway, build, m.timeout, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 128+op && int(binary.BigEndian.Uint16(b[8:10])) == mapping.Internal
+	})
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if code := int(binary.BigEndian.Uint16(resp[2:4])); code != 0 {
+		msg := "NAT-PMP result " + strconv.Itoa(code)
+		if code < len(natpmpResults) {
+			msg += " (" + natpmpResults[code] + ")"
+		}
+		return errors.New(msg)
+	}
+	mapping.External = int(binary.BigEndian.Uint16(resp[10:12]))
+	mapping.Lifetime = time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	return nil
+}
+
+// upnpMap calls AddPortMapping for the same external port. Gateways that
+// only take permanent leases (error 725) are asked again without one.
+func (m *portMapper) upnpMap(mapping *PortMapping, lifetime time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	args := func(lease time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(mapping.Internal)},
+			{"NewProtocol", strings.ToUpper(mapping.Protocol)},
+			{"NewInternalPort", strconv.Itoa(mapping.Internal)},
+			{"NewInternalClient", m.localIP},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "nat-info"},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		}
+	}
+	err := upnpSOAP(ctx, m.probe.controlURL, m.probe.serviceType, "AddPortMapping", args(lifetime), nil)
+	var uerr *upnpError
+	if errors.As(err, &uerr) && uerr.Code == 725 {
+		lifetime = 0
+		err = upnpSOAP(ctx, m.probe.controlURL, m.probe.serviceType, "AddPortMapping", args(0), nil)
+	}
+	if errors.As(err, &uerr) && uerr.Code == 718 {
+		return errors.New("the port is already mapped to another host (UPnP error 718)")
+	}
+	if err != nil {
+		return err
+	}
+	mapping.External, mapping.Lifetime = mapping.Internal, lifetime
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// probeEnv is what one run opens its sockets and times its transactions
+// with. It is built from the run's DetectOptions and handed to every probe,
+// so runs with different settings can share a process.
+type probeEnv struct {
+	// iface, if set, pins sockets to that interface's IPv4 address
+	iface string
+	// clock schedules retransmissions and timers and measures round trips.
+	// Socket deadlines are set on the real clock, which is what the kernel
+	// compares them against.
+	clock natinfo.Clock
+	// strictSource drops answers to requests without CHANGE-REQUEST that
+	// come from anywhere but the address the request went to
+	strictSource bool
+	// mark and device steer sockets on policy-routed Linux hosts: the mark
+	// selects a routing table through ip rules, and the device binds to a
+	// VRF (or any interface) so its table is used
+	mark   int
+	device string
+	// sockopts are set on every socket before it binds, to reproduce an
+	// application's socket configuration
+	sockopts []sockOption
+	// recorder, if set, captures packets, resolutions and notes for a
+	// diagnostic bundle
+	recorder *bundleRecorder
+	// responses counts late and duplicate answers on tracked sockets
+	responses *responseTallies
+	// rto holds the run's retransmission timeouts, used by makeStunRequest
+	// and sharedSocket.bind
+	rto *rtoTable
+}
+
+// probeEnv returns the probe environment of o
+func (o DetectOptions) probeEnv() *probeEnv {
+	clock := o.Clock
+	if clock == nil {
+		clock = natinfo.SystemClock{}
+	}
+	return &probeEnv{
+		iface:        o.Interface,
+		clock:        clock,
+		strictSource: o.StrictSource,
+		mark:         o.SocketMark,
+		device:       o.SocketDevice,
+		sockopts:     o.socketOptions,
+		recorder:     o.recorder,
+		responses:    newResponseTallies(),
+		rto:          newRTOTable(),
+	}
+}
+
+// deadline turns a time on e's clock into a socket deadline
+func (e *probeEnv) deadline(t time.Time) time.Time {
+	return time.Now().Add(t.Sub(e.clock.Now()))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// fakeClock only moves when Advance is called
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) natinfo.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+// Advance moves the clock on by d and fires the timers that have come due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.stopped {
+			continue
+		}
+		if c.now.Before(t.at) {
+			pending = append(pending, t)
+		} else {
+			t.stopped = true
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+func TestMakeStunRequestBackoff(t *testing.T) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	server, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	env := DetectOptions{Clock: clock}.probeEnv()
+	type answer struct {
+		result *StunResult
+		err    error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		result, err := env.makeStunRequest(client, serverAddr, nil, 10*time.Second, true, 0)
+		done <- answer{result, err}
+	}()
+
+	buf := make([]byte, 1500)
+	// receive returns the next request, or nil if none arrives within wait
+	receive := func(wait time.Duration) []byte {
+		server.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := server.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	// kick wakes the client so it looks at the clock again. A datagram
+	// shorter than a STUN header is dropped unread.
+	kick := func() {
+		if _, err := server.WriteToUDP([]byte{0}, clientAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if receive(2*time.Second) == nil {
+		t.Fatal("no initial request")
+	}
+	for _, rto := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond} {
+		clock.Advance(rto - time.Millisecond)
+		kick()
+		if req := receive(50 * time.Millisecond); req != nil {
+			t.Fatalf("retransmitted before the %v timeout", rto)
+		}
+		clock.Advance(time.Millisecond)
+		kick()
+		if receive(2*time.Second) == nil {
+			t.Fatalf("no retransmission after %v", rto)
+		}
+	}
+
+	req := append([]byte(nil), buf[:HeaderLength]...)
+	tid := req[8:20]
+	mapped := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 41000}
+	resp := encodeStunMessage(BindingResponse, tid, []Attribute{{Type: AttrXorMappedAddress, Value: appendXorAddress(nil, mapped, tid)}})
+	clock.Advance(100 * time.Millisecond)
+	if _, err := server.WriteToUDP(resp, clientAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-done
+	if got.err != nil {
+		t.Fatalf("makeStunRequest: %v", got.err)
+	}
+	if got.result.RTT != 100*time.Millisecond {
+		t.Errorf("RTT = %v, want 100ms on the fake clock", got.result.RTT)
+	}
+	// Four copies were sent, so the next one would have waited 1.6s
+	if rto := env.rto.initial(clientAddr, serverAddr); rto != 1600*time.Millisecond {
+		t.Errorf("backed-off RTO = %v, want 1.6s", rto)
+	}
+}
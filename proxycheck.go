@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// ReflectorAnswer is what a server reported to one binding request
+type ReflectorAnswer struct {
+	// Mapped is XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS when it came alone
+	Mapped string `json:"mapped,omitempty"`
+	// Plain is MAPPED-ADDRESS when it came alongside XOR-MAPPED-ADDRESS
+	Plain    string `json:"plain,omitempty"`
+	Software string `json:"software,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	xor, plain netip.AddrPort
+}
+
+// ProxyCheck sends identical binding requests to the primary server over
+// UDP and TCP. A box that rewrites STUN on the way, such as a NAT ALG, a
+// transparent proxy or a DPI middlebox, shows up as answers that disagree
+// with each other or within themselves.
+type ProxyCheck struct {
+	Server   string          `json:"server"`
+	UDP      ReflectorAnswer `json:"udp"`
+	TCP      ReflectorAnswer `json:"tcp"`
+	Findings []string        `json:"findings,omitempty"`
+}
+
+// probeProxy queries server over both transports. Many servers do not
+// speak TCP; that only leaves the comparison between transports untested.
+func probeProxy(server string, env *probeEnv, timeout time.Duration) ProxyCheck {
+	check := ProxyCheck{Server: server}
+	ctx := context.Background()
+	opts := []natinfo.Option{natinfo.WithServer(server), natinfo.WithTimeout(timeout), natinfo.WithClock(env.clock)}
+
+	conn, localIP, err := env.listenLocal()
+	if err != nil {
+		check.UDP.Error = err.Error()
+	} else {
+		msg, err := natinfo.BindingFor(ctx, conn, opts...)
+		conn.Close()
+		check.UDP = reflectorAnswer(msg, err)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout, Control: env.control}
+	if env.iface != "" && localIP != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(localIP)}
+	}
+	msg, err := natinfo.Binding(ctx, append(opts, natinfo.WithTransport(&natinfo.Stream{Dialer: dialer}))...)
+	check.TCP = reflectorAnswer(msg, err)
+	return check
+}
+
+func reflectorAnswer(msg *natinfo.Message, err error) ReflectorAnswer {
+	if err != nil {
+		return ReflectorAnswer{Error: err.Error()}
+	}
+	a := ReflectorAnswer{Software: msg.Software, xor: msg.XORMappedAddress, plain: msg.MappedAddress}
+	if mapped := msg.Mapped(); mapped.IsValid() {
+		a.Mapped = mapped.String()
+	}
+	if a.xor.IsValid() && a.plain.IsValid() {
+		a.Plain = a.plain.String()
+	}
+	return a
+}
+
+// assess compares the answers. unstable is set when the public IP already
+// varied between flows, which makes a differing TCP address unremarkable.
+func (c *ProxyCheck) assess(unstable bool) {
+	for _, t := range []struct {
+		name string
+		a    *ReflectorAnswer
+	}{{"UDP", &c.UDP}, {"TCP", &c.TCP}} {
+		if t.a.xor.IsValid() && t.a.plain.IsValid() && t.a.xor != t.a.plain {
+			c.Findings = append(c.Findings, "over "+t.name+" MAPPED-ADDRESS says "+t.a.plain.String()+" but XOR-MAPPED-ADDRESS says "+
+				t.a.xor.String()+"; something on the path rewrites addresses inside packets (an ALG or DPI box)")
+		}
+	}
+	if c.UDP.Error != "" || c.TCP.Error != "" {
+		return
+	}
+	udp, _ := netip.ParseAddrPort(c.UDP.Mapped)
+	tcp, _ := netip.ParseAddrPort(c.TCP.Mapped)
+	if udp.Addr() != tcp.Addr() && !unstable {
+		c.Findings = append(c.Findings, "the server saw "+udp.Addr().String()+" over UDP but "+tcp.Addr().String()+
+			" over TCP; TCP probably leaves through a transparent proxy")
+	}
+	if c.UDP.Software != "" && c.TCP.Software != "" && c.UDP.Software != c.TCP.Software {
+		c.Findings = append(c.Findings, "the server identifies as "+strconv.Quote(c.UDP.Software)+" over UDP but "+
+			strconv.Quote(c.TCP.Software)+" over TCP; something else may be answering one of them")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// quicGreaseVersion follows the 0x?a?a?a?a pattern reserved by RFC 9000 to
+// force version negotiation
+const quicGreaseVersion = 0x1a2a3a4a
+
+// quicMinInitial is the smallest datagram a server will answer (RFC 9000
+// section 14.1)
+const quicMinInitial = 1200
+
+// QUICProbe is the outcome of eliciting a Version Negotiation packet from a
+// QUIC server
+type QUICProbe struct {
+	Target    string        `json:"target"`
+	Addr      string        `json:"addr,omitempty"`
+	Reachable bool          `json:"reachable"`
+	Versions  []string      `json:"versions,omitempty"`
+	RTT       time.Duration `json:"rtt,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// quicTarget adds the default port 443 to a bare host
+func quicTarget(target string) string {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return net.JoinHostPort(target, "443")
+	}
+	return target
+}
+
+// quicProbePacket builds a padded long-header packet with a reserved version.
+// A server cannot parse it, so it answers with Version Negotiation echoing
+// both connection IDs.
+func quicProbePacket(dcid, scid []byte) []byte {
+	pkt := make([]byte, 0, quicMinInitial)
+	pkt = append(pkt, 0xc0) // long header, fixed bit
+	pkt = binary.BigEndian.AppendUint32(pkt, quicGreaseVersion)
+	pkt = append(pkt, byte(len(dcid)))
+	pkt = append(pkt, dcid...)
+	pkt = append(pkt, byte(len(scid)))
+	pkt = append(pkt, scid...)
+	return pkt[:quicMinInitial]
+}
+
+// parseVersionNegotiation checks that pkt is a Version Negotiation packet
+// answering our connection IDs and returns the versions it lists
+func parseVersionNegotiation(pkt, dcid, scid []byte) ([]string, bool) {
+	if len(pkt) < 7 || pkt[0]&0x80 == 0 || binary.BigEndian.Uint32(pkt[1:5]) != 0 {
+		return nil, false
+	}
+
+	// The server swaps the IDs: its destination is our source
+	rest := pkt[5:]
+	for _, want := range [][]byte{scid, dcid} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, false
+		}
+		if !bytes.Equal(rest[1:1+int(rest[0])], want) {
+			return nil, false
+		}
+		rest = rest[1+int(rest[0]):]
+	}
+
+	var versions []string
+	for ; len(rest) >= 4; rest = rest[4:] {
+		versions = append(versions, quicVersionName(binary.BigEndian.Uint32(rest)))
+	}
+	return versions, true
+}
+
+// quicVersionName names the well-known versions and renders others in hex
+func quicVersionName(v uint32) string {
+	switch {
+	case v == 0x00000001:
+		return "v1"
+	case v == 0x6b3343cf:
+		return "v2"
+	case v&0xffffff00 == 0xff000000:
+		return "draft-" + strconv.Itoa(int(v&0xff))
+	}
+	return "0x" + strconv.FormatUint(uint64(v), 16)
+}
+
+// probeQUIC asks target for version negotiation over UDP to see whether
+// QUIC-style traffic gets out even where STUN ports are blocked
+func probeQUIC(target string, env *probeEnv, timeout time.Duration) QUICProbe {
+	probe := QUICProbe{Target: quicTarget(target)}
+	fail := func(err error) QUICProbe {
+		probe.Error = err.Error()
+		return probe
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", probe.Target)
+	if err != nil {
+		return fail(err)
+	}
+	probe.Addr = addr.String()
+
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+
+	dcid := make([]byte, 8)
+	scid := make([]byte, 8)
+	rand.Read(dcid)
+	rand.Read(scid)
+	pkt := quicProbePacket(dcid, scid)
+
+	const retransmit = 500 * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 2048)
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(pkt, addr); err != nil {
+			return fail(err)
+		}
+		sent := time.Now()
+
+		wait := sent.Add(retransmit)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return fail(err)
+			}
+			if !from.IP.Equal(addr.IP) {
+				continue
+			}
+			if versions, ok := parseVersionNegotiation(buf[:n], dcid, scid); ok {
+				probe.Reachable = true
+				probe.Versions = versions
+				probe.RTT = time.Since(sent)
+				return probe
+			}
+		}
+	}
+	return fail(errors.New("QUIC probe timeout"))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reach frames: the client names some local ports it has never sent from and
+// the responder sends one packet to each at the client's public IP. Only a
+// DMZ host or a static full-port mapping receives them.
+const (
+	frameReachReq = 0xe8 // id, count, ports
+	frameReach    = 0xe9 // id, port
+)
+
+// Ports per reach request; the responder refuses more, so it cannot be used
+// to spray a third party
+const (
+	defaultReachPorts = 4
+	maxReachPorts     = 8
+)
+
+// ReachPort is one unsolicited packet sent to an unrelated port
+type ReachPort struct {
+	Port    int  `json:"port"`
+	Reached bool `json:"reached"`
+}
+
+// ReachResult is the outcome of the unsolicited inbound test
+type ReachResult struct {
+	Target  string      `json:"target"`
+	Ports   []ReachPort `json:"ports,omitempty"`
+	Reached int         `json:"reached"`
+	// DMZ is set when every port was reached through a NAT
+	DMZ   bool   `json:"dmz"`
+	Error string `json:"error,omitempty"`
+	// Exposure is which unrelated sources reach a mapping once it is open
+	Exposure *ExposureResult `json:"exposure,omitempty"`
+}
+
+// isReachFrame reports whether a datagram is a reach request
+func isReachFrame(buf []byte) bool {
+	return len(buf) >= 6 && buf[0] == frameReachReq
+}
+
+// reachReflector is the responder side of the reach and exposure tests
+type reachReflector struct {
+	conn *net.UDPConn
+	// alternates are other local IPs the exposure test sends from
+	alternates []net.IP
+}
+
+// handle sends one packet to each requested port of the sender's own IP
+func (r *reachReflector) handle(buf []byte, from *net.UDPAddr) {
+	count := int(buf[5])
+	if count > maxReachPorts || len(buf) < 6+2*count {
+		return
+	}
+	for i := 0; i < count; i++ {
+		port := binary.BigEndian.Uint16(buf[6+2*i:])
+		reply := append([]byte{frameReach}, buf[1:5]...)
+		reply = binary.BigEndian.AppendUint16(reply, port)
+		r.conn.WriteToUDP(reply, &net.UDPAddr{IP: from.IP, Port: int(port)})
+	}
+}
+
+// probeReach opens sockets that never send, asks the responder to hit their
+// ports from outside and counts what arrives. It assumes a DMZ or static
+// mapping keeps the port, which is how both are normally configured.
+func probeReach(target string, env *probeEnv, ports int, timeout time.Duration) ReachResult {
+	result := ReachResult{Target: target}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	control, _, err := env.listenLocal()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer control.Close()
+
+	var listeners []*net.UDPConn
+	defer func() {
+		for _, conn := range listeners {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < ports; i++ {
+		conn, _, err := env.listenLocal()
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		listeners = append(listeners, conn)
+		result.Ports = append(result.Ports, ReachPort{Port: conn.LocalAddr().(*net.UDPAddr).Port})
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	req := append([]byte{frameReachReq}, id...)
+	req = append(req, byte(len(listeners)))
+	for _, p := range result.Ports {
+		req = binary.BigEndian.AppendUint16(req, uint16(p.Port))
+	}
+	// Sent twice in case the first is lost; duplicates are harmless
+	for i := 0; i < 2; i++ {
+		if _, err := control.WriteToUDP(req, addr); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, conn := range listeners {
+		wg.Add(1)
+		go func(i int, conn *net.UDPConn) {
+			defer wg.Done()
+			buf := make([]byte, 64)
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if n == 7 && buf[0] == frameReach && string(buf[1:5]) == string(id) {
+					result.Ports[i].Reached = true
+					return
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+
+	for _, p := range result.Ports {
+		if p.Reached {
+			result.Reached++
+		}
+	}
+	return result
+}
+
+// describeReach renders the reach outcome in plain words
+func describeReach(r *ReachResult) string {
+	n := strconv.Itoa(r.Reached) + " of " + strconv.Itoa(len(r.Ports)) + " unrelated ports reached"
+	switch {
+	case r.DMZ:
+		return n + ": the gateway forwards every port to this host (DMZ or static mapping)"
+	case r.Reached == len(r.Ports):
+		return n + ": no NAT in the way"
+	case r.Reached > 0:
+		return n + ": some ports are forwarded (port forwards or UPnP)"
+	}
+	return n + ": unsolicited traffic is not forwarded"
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// textReport renders a NatResult as sectioned, optionally colored text
+type textReport struct {
+	w         io.Writer
+	algorithm Algorithm
+	color     bool
+	textStyle
+}
+
+// paint wraps s in an ANSI color when color output is enabled
+func (r *textReport) paint(color, s string) string {
+	if !r.color || r.plain {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// section, field and item translate titles, labels and items through the
+// catalog; text assembled at run time has no entry and stays English
+// In plain mode sections end in a colon and fields and items are neither
+// indented nor aligned, so each line stands on its own when read aloud.
+func (r *textReport) section(title string) {
+	if r.plain {
+		io.WriteString(r.w, "\n"+r.tr(title)+":\n")
+		return
+	}
+	io.WriteString(r.w, "\n"+r.paint(ansiBold, r.tr(title))+"\n")
+}
+
+func (r *textReport) field(label, value string) {
+	if r.plain {
+		io.WriteString(r.w, r.tr(label)+": "+value+"\n")
+		return
+	}
+	io.WriteString(r.w, "  "+padRight(r.tr(label)+":", 13)+value+"\n")
+}
+
+func (r *textReport) item(text string) {
+	if r.plain {
+		io.WriteString(r.w, "- "+r.tr(text)+"\n")
+		return
+	}
+	io.WriteString(r.w, "  - "+r.tr(text)+"\n")
+}
+
+// column pads text to width to line up one column of an item, or in plain
+// mode follows it with a comma so the parts stay apart without alignment
+func (s textStyle) column(text string, width int) string {
+	if s.plain {
+		return text + ", "
+	}
+	return padRight(text, width)
+}
+
+// gradeColor colors a bufferbloat grade
+func gradeColor(grade string) string {
+	switch grade {
+	case "A+", "A":
+		return ansiGreen
+	case "B", "C":
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+// natTypeColor grades NAT types by how friendly they are to direct connections
+func natTypeColor(t NATType) string {
+	switch t {
+	case NATOpen, NATFullCone:
+		return ansiGreen
+	case NATRestrictedCone, NATPortRestricted, NATSymmetricFirewall:
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+// behaviorColor grades RFC 4787 behaviors the same way
+func behaviorColor(b Behavior) string {
+	switch b {
+	case BehaviorEndpointIndependent:
+		return ansiGreen
+	case BehaviorAddressDependent:
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+func confidenceColor(c Confidence) string {
+	switch c {
+	case ConfidenceHigh:
+		return ansiGreen
+	case ConfidenceMedium:
+		return ansiYellow
+	default:
+		return ansiRed
+	}
+}
+
+// render writes the Local network, Public mapping, Behavior and
+// Recommendations sections
+func (r *textReport) render(result *NatResult) {
+	r.section("Local network")
+	r.field("IP", result.LocalIP)
+	r.field("Port", strconv.Itoa(result.LocalPort))
+	if result.Link != nil {
+		label := "Wi-Fi"
+		if result.Link.Kind == LinkCellular {
+			label = "Cellular"
+		}
+		r.field(label, result.Link.describe())
+	}
+	if result.PolicyRouted {
+		r.field("Uplinks", r.paint(ansiYellow, r.tr("policy routed")))
+		for _, route := range result.Routes {
+			r.item(route.Server + " via " + route.Source)
+		}
+	}
+
+	r.section("Public mapping")
+	if result.Public != nil {
+		r.field("IP", result.Public.IP.String())
+		port := strconv.Itoa(result.Public.Port)
+		if result.Public.Port == result.LocalPort {
+			port += " (preserved)"
+		}
+		r.field("Port", port)
+		if result.UnstableAddress {
+			var seen []string
+			for _, o := range result.ObservedIPs {
+				seen = append(seen, o.IP+" x"+strconv.Itoa(o.Count))
+			}
+			r.field("Stability", r.paint(ansiRed, r.tr("unstable"))+" ("+strings.Join(seen, ", ")+")")
+		}
+	} else {
+		r.field("Address", r.tr("unknown"))
+	}
+
+	if q := result.QUIC; q != nil {
+		r.section("QUIC (UDP " + portOf(q.Target) + ")")
+		r.field("Target", q.Target)
+		if q.Reachable {
+			r.field("Status", r.paint(ansiGreen, "reachable")+" in "+formatMillis(q.RTT))
+			if len(q.Versions) > 0 {
+				r.field("Versions", strings.Join(q.Versions, ", "))
+			}
+		} else {
+			r.field("Status", r.paint(ansiRed, "no answer")+" ("+q.Error+")")
+		}
+	}
+
+	if d := result.DTLS; d != nil {
+		r.section("STUN over DTLS (UDP " + portOf(d.Target) + ")")
+		r.field("Target", d.Target)
+		switch {
+		case d.Mapped != nil:
+			r.field("Status", r.paint(ansiGreen, "works")+" in "+formatMillis(d.RTT))
+		case d.Handshake:
+			r.field("Status", r.paint(ansiYellow, "handshake only")+" ("+d.Error+")")
+		default:
+			r.field("Status", r.paint(ansiRed, "failed")+" ("+d.Error+")")
+		}
+		if d.CipherSuite != "" {
+			r.field("Cipher", d.CipherSuite)
+		}
+		if d.Mapped != nil {
+			r.field("Mapped", d.Mapped.AddrPort().String())
+		}
+	}
+
+	if reach := result.Reach; reach != nil {
+		r.section("Unsolicited inbound")
+		if reach.Error != "" {
+			r.field("Status", r.paint(ansiRed, "not tested")+" ("+reach.Error+")")
+		} else {
+			status := describeReach(reach)
+			if reach.DMZ {
+				status = r.paint(ansiYellow, status)
+			}
+			r.field("Status", status)
+		}
+		if e := reach.Exposure; e != nil {
+			switch {
+			case e.Error != "":
+				r.field("Exposure", r.paint(ansiRed, "not tested")+" ("+e.Error+")")
+			case e.OtherIPs > 0:
+				r.field("Exposure", r.paint(ansiYellow, describeExposure(e)))
+			default:
+				r.field("Exposure", describeExposure(e))
+			}
+		}
+	}
+
+	if e := result.ECN; e != nil {
+		r.section("ECN")
+		r.field("Responder", e.Target)
+		if e.Error != "" {
+			r.field("Status", r.paint(ansiRed, "not tested")+" ("+e.Error+")")
+		} else {
+			color := ansiRed
+			switch e.Verdict {
+			case ECNPreserved:
+				color = ansiGreen
+			case ECNMarkedCE:
+				color = ansiYellow
+			}
+			r.field("Status", r.paint(color, e.Verdict))
+			for _, m := range e.Marks {
+				line := r.column(m.Sent, 8) + " -> "
+				switch {
+				case m.Verdict == ECNLost:
+					line += "lost"
+				case m.Received == "":
+					line += "unknown"
+				default:
+					line += r.column(m.Received, 8) + " " + m.Verdict
+				}
+				r.item(line)
+			}
+			if e.ReplyBleached {
+				r.field("Return path", r.paint(ansiRed, "bleached")+" (the responder's ECT(0) arrived as Not-ECT)")
+			}
+		}
+	}
+
+	if p := result.Proxy; p != nil && len(p.Findings) > 0 {
+		r.section("Path integrity")
+		r.field("Server", p.Server)
+		r.field("Status", r.paint(ansiRed, "STUN rewritten in transit"))
+		for _, f := range p.Findings {
+			r.item(f)
+		}
+	}
+
+	if b := result.Bandwidth; b != nil {
+		r.section("Throughput (rough)")
+		r.field("Reflector", b.Target)
+		if b.Up != nil {
+			r.field("Upload", formatTrain(b.Up))
+		}
+		if b.Down != nil {
+			r.field("Download", formatTrain(b.Down))
+		}
+		if l := b.Latency; l != nil {
+			r.field("RTT idle", formatMillis(l.Idle)+" to "+l.Server)
+			if l.Up > 0 {
+				r.field("RTT up", formatMillis(l.Up))
+			}
+			if l.Down > 0 {
+				r.field("RTT down", formatMillis(l.Down))
+			}
+			r.field("Bufferbloat", r.paint(gradeColor(l.Grade), l.Grade))
+		}
+		if b.Error != "" {
+			r.field("Error", b.Error)
+		}
+	}
+
+	if f := result.Firewall; f != nil && (f.Active || f.SelfTest == "failed") {
+		r.section("Host firewall")
+		backend := f.Backend
+		if backend == "" {
+			backend = "unknown"
+		}
+		r.field("Backend", backend)
+		if f.Detail != "" {
+			r.field("Detail", f.Detail)
+		}
+		r.field("Self-test", f.SelfTest)
+		if f.Rule != "" {
+			r.field("Suggested", f.Rule)
+		}
+	}
+
+	if c := result.Conntrack; c != nil {
+		r.section("Conntrack (authoritative)")
+		if c.Error != "" {
+			r.field("Error", c.Error)
+		} else {
+			for _, e := range c.Entries {
+				state := "unreplied"
+				if e.Assured {
+					state = "assured"
+				}
+				r.field("Flow", e.Destination+" via "+e.Translated+", "+strconv.Itoa(e.Timeout)+"s left, "+state)
+			}
+			if len(c.Entries) == 0 {
+				r.field("Flow", "none found; probes may not have been translated (try --iface with a LAN interface)")
+			}
+			r.field("Mapping", r.paint(behaviorColor(c.Mapping), r.tr(c.Mapping.String())))
+			if c.UDPTimeout > 0 {
+				r.field("UDP timeout", strconv.Itoa(c.UDPTimeout)+"s unreplied, "+strconv.Itoa(c.UDPStreamTimeout)+"s assured")
+			}
+		}
+	}
+
+	if g := result.Gateway; g != nil {
+		r.section("Gateway (SNMP)")
+		r.field("Target", g.Target)
+		if g.Description != "" {
+			r.field("Device", g.Description)
+		}
+		if w := g.WAN; w != nil {
+			wan := w.Address
+			if w.Name != "" {
+				wan += " on " + w.Name
+			}
+			if g.WANIsPublic {
+				wan += " (matches public IP)"
+			} else {
+				wan += r.paint(ansiYellow, " (differs from public IP)")
+			}
+			r.field("WAN", wan)
+			r.field("Counters", strconv.FormatUint(w.InOctets, 10)+" bytes in, "+strconv.FormatUint(w.OutOctets, 10)+
+				" bytes out, "+strconv.FormatUint(w.InDiscards, 10)+" inbound discards")
+		}
+		if n := g.NAT; n != nil {
+			r.field("NAT-MIB", strconv.FormatUint(n.OutTranslates, 10)+" out / "+strconv.FormatUint(n.InTranslates, 10)+
+				" in translations, "+strconv.FormatUint(n.Discards, 10)+" discards")
+			if n.UDPTimeout > 0 {
+				r.field("UDP timeout", strconv.FormatUint(n.UDPTimeout, 10)+"s configured")
+			}
+		}
+		if g.Error != "" {
+			r.field("Error", g.Error)
+		}
+	}
+
+	if a := result.Access; a != nil && a.Type != AccessUnknown {
+		r.section("Access")
+		r.field("Likely", r.tr(a.Type.String()))
+		for _, h := range a.Hints {
+			r.field("Hint", h)
+		}
+	}
+
+	if len(result.Plugins) > 0 {
+		r.section("Plugins")
+		for _, p := range result.Plugins {
+			color := ansiRed
+			switch p.Status {
+			case PluginPass:
+				color = ansiGreen
+			case PluginWarn:
+				color = ansiYellow
+			}
+			status := r.paint(color, strings.ToUpper(p.Status))
+			switch {
+			case p.Error != "":
+				status += " (" + p.Error + ")"
+			case p.Summary != "":
+				status += " " + p.Summary
+			}
+			r.field(p.Name, status)
+			for _, d := range p.Details {
+				r.item(d)
+			}
+		}
+	}
+
+	r.section("Behavior")
+	if r.algorithm == AlgorithmBehavior {
+		r.field("Mapping", r.paint(behaviorColor(result.Mapping), r.tr(result.Mapping.String())))
+		r.field("Filtering", r.paint(behaviorColor(result.Filtering), r.tr(result.Filtering.String())))
+	} else {
+		r.field("NAT Type", r.paint(natTypeColor(result.Type), r.tr(result.Type.String())))
+	}
+	if result.Translation != "" {
+		r.field("Translation", r.tr(result.Translation.String()))
+	}
+	reasons := make([]string, len(result.Reasons))
+	for i, code := range result.Reasons {
+		reasons[i] = r.tr(code.Text())
+	}
+	r.field("Reason", strings.Join(reasons, " "))
+	confidence := r.paint(confidenceColor(result.Confidence), r.tr(result.Confidence.String()))
+	if len(result.ConfidenceNotes) > 0 {
+		notes := make([]string, len(result.ConfidenceNotes))
+		for i, note := range result.ConfidenceNotes {
+			notes[i] = r.tr(note)
+		}
+		confidence += " (" + strings.Join(notes, "; ") + ")"
+	}
+	r.field("Confidence", confidence)
+	for _, w := range result.Warnings {
+		r.field("Warning", r.paint(ansiYellow, w.Message))
+	}
+	if result.ShareCode != "" {
+		r.field("Share code", result.ShareCode)
+	}
+	for _, sample := range result.MappingSamples {
+		verdict := "same"
+		if sample.Differs {
+			verdict = "differs"
+		}
+		r.field("Sample", sample.First+" -> "+sample.FirstMapped.AddrPort().String()+
+			", "+sample.Second+" -> "+sample.SecondMapped.AddrPort().String()+" ("+verdict+")")
+	}
+
+	if c := result.Responses; c != nil && c.Late+c.Duplicates > 0 {
+		r.field("Responses", strconv.Itoa(c.Answered)+" answered, "+strconv.Itoa(c.Late)+" late, "+strconv.Itoa(c.Duplicates)+" duplicate")
+	}
+
+	if len(result.Explanation) > 0 {
+		r.renderExplanation(result)
+	}
+
+	r.section("Recommendations")
+	for _, rec := range recommendations(result) {
+		r.item(rec)
+	}
+
+	if result.Policy != nil {
+		r.renderPolicy(result.Policy)
+	}
+}
+
+// renderPolicy writes the Policy section: the verdict and the rules behind it
+func (r *textReport) renderPolicy(v *PolicyVerdict) {
+	r.section("Policy")
+	color := ansiGreen
+	switch v.Verdict {
+	case "fail":
+		color = ansiRed
+	case "warn":
+		color = ansiYellow
+	}
+	r.field("Verdict", r.paint(color, strings.ToUpper(v.Verdict)))
+	for _, m := range v.Matched {
+		r.item(m.Action + ": " + m.describe())
+	}
+	for _, rule := range v.Undecided {
+		r.item("undecided: " + rule)
+	}
+}
+
+// recommendations turns a result into practical advice for peer-to-peer use
+func recommendations(result *NatResult) []string {
+	var recs []string
+
+	quicOK := result.QUIC != nil && result.QUIC.Reachable
+	switch result.Type {
+	case NATUDPBlocked:
+		if result.Firewall != nil && result.Firewall.BlocksReplies() {
+			recs = append(recs, "UDP looks blocked locally: the host firewall is dropping replies before they reach nat-info. Allow established/related inbound traffic and re-run.")
+		} else if quicOK {
+			recs = append(recs, "STUN traffic is blocked but UDP to port 443 gets out; run TURN on UDP 443 so real-time apps can still use UDP.")
+		} else if result.Firewall != nil {
+			recs = append(recs, "Outbound UDP appears blocked by the NAT or ISP, not this host; real-time apps will need a TURN relay over TCP or TLS on port 443.")
+		} else {
+			recs = append(recs, "Outbound UDP appears blocked; real-time apps will need a TURN relay over TCP or TLS on port 443.")
+		}
+	case NATOpen:
+		recs = append(recs, "No NAT or inbound filtering: peers can reach this host directly.")
+	case NATSymmetricFirewall:
+		recs = append(recs, "This host has a public IP but a firewall drops unsolicited packets; allow your application's ports inbound to accept direct connections.")
+	case NATFullCone:
+		recs = append(recs, "Direct peer-to-peer connections should work with any peer.")
+	case NATRestrictedCone, NATPortRestricted:
+		recs = append(recs, "UDP hole punching works with most peers; peers behind Symmetric NAT will need a TURN relay.")
+	case NATSymmetric:
+		recs = append(recs, "Hole punching is unreliable behind Symmetric NAT; expect to need a TURN relay.")
+		recs = append(recs, "If you control the router, enabling UPnP/NAT-PMP or a port forward gives a stable public port.")
+	default:
+		recs = append(recs, "The NAT type could not be determined.")
+	}
+
+	if d := result.DTLS; d != nil && d.Mapped != nil && result.Type == NATUDPBlocked {
+		recs = append(recs, "Cleartext STUN is blocked but STUN over DTLS to port "+portOf(d.Target)+" gets through, which points at deep packet inspection rather than a UDP block; offer TURN over DTLS so real-time apps can keep using UDP.")
+	}
+
+	if f := result.Firewall; f != nil && f.Active && result.Type != NATUDPBlocked {
+		recs = append(recs, "The host firewall is active, so the measured filtering may come from this machine rather than the NAT; re-run with it disabled to see the router alone.")
+	}
+
+	if g := result.Gateway; g != nil && g.WAN != nil && !g.WANIsPublic && result.Public != nil {
+		recs = append(recs, "The gateway's WAN address is not the public IP, so another NAT sits upstream (CGNAT or a modem in router mode); the behavior above is the combination of both.")
+	}
+
+	if a := result.Access; a != nil {
+		if advice := accessAdvice(a.Type); advice != "" {
+			recs = append(recs, advice)
+		}
+	}
+
+	if result.QUIC != nil && !quicOK && result.Type != NATUDPBlocked {
+		recs = append(recs, "STUN works but the QUIC probe got no answer; UDP 443 may be filtered, so HTTP/3 and TURN on UDP 443 could fall back to TCP.")
+	}
+
+	if b := result.Bandwidth; b != nil {
+		for _, t := range []*TrainResult{b.Up, b.Down} {
+			if t != nil && (t.Loss > 0.05 || t.CE > 0) {
+				recs = append(recs, "Packets are lost or congestion-marked under a short burst; games and calls will stutter when this link is busy.")
+				break
+			}
+		}
+	}
+
+	if b := result.Bandwidth; b != nil && b.Latency != nil {
+		switch b.Latency.Grade {
+		case "C", "D", "F":
+			recs = append(recs, "Latency climbs sharply when the link is busy (bufferbloat); enabling SQM/fq_codel or cake on the router usually fixes lag that NAT type does not explain.")
+		}
+	}
+
+	if result.UnstableAddress {
+		recs = append(recs, "The public IP changes from flow to flow (load-balanced CGNAT or multi-WAN); ICE candidates gathered from one server may not match what peers see, so keep TURN available.")
+	}
+
+	if result.Reach != nil && result.Reach.DMZ {
+		recs = append(recs, "The router has this host in its DMZ (or maps every port to it): peers can always reach it, but so can anyone else. Keep the host firewall on, or replace the DMZ with forwards for the ports you need.")
+	}
+
+	if r := result.Reach; r != nil && r.Exposure != nil && r.Exposure.OtherIPs > 0 && !r.DMZ {
+		recs = append(recs, "Once this host sends from a port, anyone on the internet can send to that port's mapping, not just the host it talked to. That is what makes P2P easy here, but an application listening on such a port must treat every sender as untrusted.")
+	}
+
+	if e := result.ECN; e != nil && e.Error == "" {
+		switch {
+		case e.Verdict == ECNLost:
+			recs = append(recs, "Something on the path drops ECN-capable packets; QUIC stacks and L4S senders should detect this and fall back to Not-ECT.")
+		case e.Verdict == ECNBleached || e.Verdict == ECNRemarked || e.ReplyBleached:
+			recs = append(recs, "The path clears or rewrites ECN marks, so QUIC and L4S congestion control lose early congestion signals and fall back to reacting to loss.")
+		}
+	}
+
+	if p := result.Proxy; p != nil && len(p.Findings) > 0 {
+		recs = append(recs, "A middlebox rewrites STUN on the way (an ALG, transparent proxy or DPI box), so reflexive addresses may not be what peers see. Disable SIP/STUN ALGs on the router, or prefer TURN over TLS, which it cannot inspect.")
+	}
+
+	if result.Translation == TranslationOneToOne {
+		recs = append(recs, "The public IP is mapped 1:1 to this host (cloud elastic IP, DMZ or static NAT); allowing the port in the security group or upstream ACL makes it directly reachable. A port-preserving PAT with no competing flows looks the same from one host.")
+	}
+
+	if result.PolicyRouted {
+		recs = append(recs, "Servers are reached through different uplinks, so each one may see a different NAT; pin detection to one path with --iface, or compare them with `nat-info paths`.")
+	}
+
+	if result.Confidence == ConfidenceLow && result.Type != NATUDPBlocked {
+		recs = append(recs, "Confidence is low; re-run, or add more servers with --servers.")
+	}
+	return recs
+}
+
+// portOf returns the port of a host:port string
+func portOf(hostport string) string {
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return port
+}
+
+// formatTrain renders a train result as rate, loss and congestion marks
+func formatTrain(t *TrainResult) string {
+	s := strconv.FormatFloat(t.Bps/1e6, 'f', 1, 64) + " Mbit/s, " +
+		strconv.FormatFloat(t.Loss*100, 'f', 1, 64) + "% loss"
+	if t.CE > 0 {
+		s += ", " + strconv.Itoa(t.CE) + " ECN CE marks"
+	}
+	return s
+}
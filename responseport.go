@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxResponsePortServers bounds how many resolvable servers are asked
+// whether they support RESPONSE-PORT, since each that does not costs a
+// probe timeout
+const maxResponsePortServers = 3
+
+// errNoRedirect is the control's failure: the server did not send the
+// answer to the RESPONSE-PORT, so the other tests would prove nothing
+var errNoRedirect = errors.New("no answer at RESPONSE-PORT; the server does not support it")
+
+// probeResponsePort tells the filtering behavior with the RFC 5780
+// RESPONSE-PORT attribute, which needs one server IP instead of the
+// alternate address CHANGE-REQUEST does. The detection socket asks the
+// server to send its answer to the public port of a second socket:
+//
+//   - a control socket that has itself sent to the server must receive
+//     it, or the server ignores RESPONSE-PORT and nothing can be told;
+//   - a socket that has only sent to another server receives it unless
+//     the NAT filters by address;
+//   - the same socket, after also sending to another port of the
+//     server's IP, receives it unless the NAT filters by port as well.
+//
+// The last test relies on that socket keeping one mapping for both
+// destinations, so without endpoint-independent mapping it is skipped and
+// a NAT that filters is taken to filter by port, as such NATs do.
+func probeResponsePort(env *probeEnv, result *NatResult, conn *net.UDPConn, servers []string, opts DetectOptions, mappingIndependent bool) Behavior {
+	timeout := opts.ProbeTimeout
+	tried := 0
+	for _, server := range servers {
+		if tried == maxResponsePortServers {
+			break
+		}
+		endpoints, err := env.resolveServer(server)
+		if err != nil {
+			continue
+		}
+		endpoint := endpoints[0]
+		tried++
+
+		control, _, err := env.listenLocal()
+		if err != nil {
+			return BehaviorUnknown
+		}
+		res, err := env.makeStunRequest(control, endpoint.Addr, nil, timeout, true, 0)
+		if err == nil {
+			res, err = redirectedBinding(env, conn, control, endpoint.Addr, res.Port, timeout)
+			if err != nil {
+				err = errNoRedirect
+			}
+		}
+		control.Close()
+		result.addEvidence(TestResponsePortControl, endpoint, res, err)
+		if err != nil {
+			continue
+		}
+
+		var other StunEndpoint
+		found := false
+		for _, candidate := range opts.Servers {
+			if other, found = pickEndpoint(env, candidate, endpoint); found {
+				break
+			}
+		}
+		if !found {
+			return BehaviorUnknown
+		}
+		probe, _, err := env.listenLocal()
+		if err != nil {
+			return BehaviorUnknown
+		}
+		defer probe.Close()
+		mapped, err := env.makeStunRequest(probe, other.Addr, nil, timeout, true, 0)
+		if err != nil {
+			return BehaviorUnknown
+		}
+
+		res, err = redirectedBinding(env, conn, probe, endpoint.Addr, mapped.Port, timeout)
+		result.addEvidence(TestResponsePort, endpoint, res, err)
+		if err == nil {
+			return BehaviorEndpointIndependent
+		}
+		if !mappingIndependent {
+			return BehaviorAddressPortDependent
+		}
+
+		// Nothing needs to listen there: the packet only opens the filter
+		// to the server's IP
+		sibling := &net.UDPAddr{IP: endpoint.Addr.IP, Port: endpoint.Addr.Port ^ 1}
+		probe.WriteToUDP([]byte{0}, sibling)
+		res, err = redirectedBinding(env, conn, probe, endpoint.Addr, mapped.Port, timeout)
+		result.addEvidence(TestResponsePortSameIP, endpoint, res, err)
+		if err == nil {
+			return BehaviorAddressDependent
+		}
+		return BehaviorAddressPortDependent
+	}
+	return BehaviorUnknown
+}
+
+// filteringBehavior runs the CHANGE-REQUEST filtering tests and, when no
+// RFC 3489 server could answer them, the RESPONSE-PORT tests
+func filteringBehavior(env *probeEnv, result *NatResult, conn *net.UDPConn, opts DetectOptions, mappingIndependent bool) Behavior {
+	filtering := probeFiltering(env, result, conn, opts.Rfc3489Servers, opts.ProbeTimeout)
+	if filtering != BehaviorUnknown {
+		return filtering
+	}
+	var servers []string
+	for _, server := range append(slices.Clone(opts.Rfc3489Servers), opts.Servers...) {
+		if !slices.Contains(servers, server) {
+			servers = append(servers, server)
+		}
+	}
+	return probeResponsePort(env, result, conn, servers, opts, mappingIndependent)
+}
+
+// redirectedBinding sends a binding request with RESPONSE-PORT set to port
+// from conn to server and waits for the answer on recv
+func redirectedBinding(env *probeEnv, conn, recv *net.UDPConn, server *net.UDPAddr, port int, timeout time.Duration) (*StunResult, error) {
+	statTransactions.Add(1)
+	tid := make([]byte, 12)
+	rand.Read(tid)
+	value := binary.BigEndian.AppendUint16(nil, uint16(port))
+	req := encodeStunMessage(BindingRequest, tid, []Attribute{{Type: AttrResponsePort, Value: append(value, 0, 0)}})
+
+	buf := make([]byte, 2048)
+	deadline := env.clock.Now().Add(timeout)
+	// Three sends spread over the timeout; there is no answer on conn to
+	// time retransmissions by
+	for attempt := 0; attempt < 3; attempt++ {
+		sent := env.clock.Now()
+		if _, err := conn.WriteToUDP(req, server); err != nil {
+			return nil, err
+		}
+		env.recorder.packet("send", conn.LocalAddr(), server, req)
+		wait := sent.Add(timeout / 3)
+		if attempt == 2 {
+			wait = deadline
+		}
+		for {
+			recv.SetReadDeadline(env.deadline(wait))
+			n, from, err := recv.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			env.recorder.packet("recv", recv.LocalAddr(), from, buf[:n])
+			if n < HeaderLength || !bytes.Equal(buf[8:20], tid) {
+				continue
+			}
+			res, err := parseStunResponse(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			res.RTT = env.clock.Now().Sub(sent)
+			return res, nil
+		}
+	}
+	return nil, errors.New("no answer at port " + strconv.Itoa(port) + " within " + timeout.String())
+}
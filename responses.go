@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// ResponseCounts accounts for the STUN answers that arrived on a socket
+// outside the transaction they belonged to. makeStunRequest returns on the
+// first matching answer, so without this a duplicated datagram or the
+// answer to an earlier copy of a retransmitted request would be read and
+// dropped by the next transaction without trace.
+type ResponseCounts struct {
+	// Answered is the number of transactions that got an answer
+	Answered int `json:"answered"`
+	// Late answers came after the transaction had finished, either to an
+	// earlier copy of a retransmitted request or after it timed out
+	Late int `json:"late"`
+	// Duplicates are answers beyond one per request sent: the NAT or the
+	// path copied a datagram
+	Duplicates int `json:"duplicates"`
+}
+
+// recentTransactions bounds how many finished transactions per socket are
+// remembered; answers to older ones count as neither late nor duplicate
+const recentTransactions = 64
+
+// responseTally is what is known about one tracked socket
+type responseTally struct {
+	counts ResponseCounts
+	// expected is how many more answers each finished transaction may still
+	// get without one of them being a duplicate
+	expected map[string]int
+	order    []string
+}
+
+// responseTallies holds the sockets of a run registered by trackResponses
+type responseTallies struct {
+	mu sync.Mutex
+	m  map[*net.UDPConn]*responseTally
+}
+
+func newResponseTallies() *responseTallies {
+	return &responseTallies{m: make(map[*net.UDPConn]*responseTally)}
+}
+
+// trackResponses starts counting late and duplicate answers on conn. The
+// returned function stops and reports the counts.
+func (e *probeEnv) trackResponses(conn *net.UDPConn) func() ResponseCounts {
+	tallies := e.responses
+	tallies.mu.Lock()
+	tallies.m[conn] = &responseTally{expected: make(map[string]int)}
+	tallies.mu.Unlock()
+	return func() ResponseCounts {
+		tallies.mu.Lock()
+		defer tallies.mu.Unlock()
+		t := tallies.m[conn]
+		delete(tallies.m, conn)
+		return t.counts
+	}
+}
+
+// finishTransaction records that the transaction tid on conn is over after
+// sends transmissions, answered or not
+func (e *probeEnv) finishTransaction(conn *net.UDPConn, tid []byte, sends int, answered bool) {
+	e.responses.mu.Lock()
+	defer e.responses.mu.Unlock()
+	t, ok := e.responses.m[conn]
+	if !ok {
+		return
+	}
+	expected := sends
+	if answered {
+		t.counts.Answered++
+		expected--
+	}
+	key := string(tid)
+	if len(t.order) == recentTransactions {
+		delete(t.expected, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.order = append(t.order, key)
+	t.expected[key] = expected
+}
+
+// strayResponse classifies an answer whose transaction ID is not the one
+// being waited for, if it belongs to a finished transaction on conn
+func (e *probeEnv) strayResponse(conn *net.UDPConn, tid []byte) {
+	e.responses.mu.Lock()
+	defer e.responses.mu.Unlock()
+	t, ok := e.responses.m[conn]
+	if !ok {
+		return
+	}
+	left, ok := t.expected[string(tid)]
+	if !ok {
+		return
+	}
+	if left > 0 {
+		t.counts.Late++
+		t.expected[string(tid)] = left - 1
+		e.recorder.note("late answer " + strconv.Itoa(t.counts.Late) + " on " + conn.LocalAddr().String())
+	} else {
+		t.counts.Duplicates++
+		e.recorder.note("duplicate answer " + strconv.Itoa(t.counts.Duplicates) + " on " + conn.LocalAddr().String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Retransmission timeout bounds. Before any answer from a server the first
+// retransmission waits initialRTO, as it always has; once answers arrive the
+// estimate can drop to minRTO on a fast path or rise to maxRTO on a slow one.
+const (
+	initialRTO = 200 * time.Millisecond
+	minRTO     = 50 * time.Millisecond
+	maxRTO     = 3 * time.Second
+)
+
+// rtoEstimate is the smoothed round-trip time to one server (RFC 6298)
+type rtoEstimate struct {
+	srtt, rttvar time.Duration
+	rto          time.Duration
+}
+
+// rtoTable shares retransmission timeouts across the transactions of a
+// run, so that later phases start from what earlier ones measured instead
+// of from initialRTO every time. Estimates are kept per local IP and server
+// address, since each uplink has its own path.
+type rtoTable struct {
+	mu        sync.Mutex
+	estimates map[string]*rtoEstimate
+}
+
+func newRTOTable() *rtoTable {
+	return &rtoTable{estimates: make(map[string]*rtoEstimate)}
+}
+
+func rtoKey(local net.Addr, server *net.UDPAddr) string {
+	if l, ok := local.(*net.UDPAddr); ok {
+		return l.IP.String() + ">" + server.String()
+	}
+	return server.String()
+}
+
+// initial returns the timeout for the first transmission of a transaction
+func (t *rtoTable) initial(local net.Addr, server *net.UDPAddr) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.estimates[rtoKey(local, server)]; ok {
+		return e.rto
+	}
+	return initialRTO
+}
+
+// sample folds in the round trip of a transaction that was sent exactly
+// once. Following Karn's algorithm, retransmitted transactions give no
+// sample: every copy carries the same transaction ID, so the answer cannot
+// be matched to one of them.
+func (t *rtoTable) sample(local net.Addr, server *net.UDPAddr, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := rtoKey(local, server)
+	e, ok := t.estimates[key]
+	if !ok {
+		e = &rtoEstimate{}
+		t.estimates[key] = e
+	}
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = rtt, rtt/2
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = min(max(e.srtt+4*e.rttvar, minRTO), maxRTO)
+}
+
+// backoff keeps the doubled timeout of a transaction that needed
+// retransmissions for the next one, until a clean sample replaces it
+func (t *rtoTable) backoff(local net.Addr, server *net.UDPAddr, rto time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := rtoKey(local, server)
+	e, ok := t.estimates[key]
+	if !ok {
+		e = &rtoEstimate{}
+		t.estimates[key] = e
+	}
+	e.rto = min(max(rto, e.rto), maxRTO)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// RunInfo identifies a detection run so that results collected from a
+// fleet or kept in a history can be grouped and deduplicated
+type RunInfo struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Version   string    `json:"version"`
+	Hostname  string    `json:"hostname,omitempty"`
+	OS        string    `json:"os"`
+	Interface string    `json:"interface,omitempty"`
+	// Network is a salted hash of the default gateway's MAC address and
+	// the Wi-Fi SSID, equal for runs on the same network with the same
+	// salt and meaningless without it
+	Network string `json:"network,omitempty"`
+}
+
+// newRunInfo stamps a run started now from localIP
+func newRunInfo(env *probeEnv, localIP string) *RunInfo {
+	info := &RunInfo{
+		ID:        newRunID(),
+		Time:      env.clock.Now().UTC(),
+		Version:   version,
+		OS:        runtime.GOOS + "/" + runtime.GOARCH,
+		Interface: env.iface,
+	}
+	info.Hostname, _ = os.Hostname()
+	if info.Interface == "" {
+		info.Interface = interfaceOf(localIP)
+	}
+	return info
+}
+
+// networkFingerprint hashes the default gateway's identity and, on Wi-Fi,
+// the SSID. An empty salt uses the per-install salt, so fingerprints only
+// compare across hosts that were given the same --fingerprint-salt.
+func networkFingerprint(salt, iface string, link *LinkInfo) string {
+	id := gatewayIdentity(iface)
+	if link != nil && link.SSID != "" {
+		id += "\x00" + link.SSID
+	}
+	if id == "" {
+		return ""
+	}
+	if salt == "" {
+		salt = installSalt()
+	}
+	sum := sha256.Sum256([]byte(salt + "\x00" + id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newRunID returns a random RFC 4122 version 4 UUID
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// interfaceOf returns the name of the interface holding ip
+func interfaceOf(ip string) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.String() == ip {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// installSalt returns a random salt kept in the user's config directory,
+// created on first use. Without a writable directory the salt lives only
+// as long as the process.
+func installSalt() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return newRunID()
+	}
+	path := filepath.Join(dir, "nat-info", "salt")
+	if data, err := os.ReadFile(path); err == nil && len(strings.TrimSpace(string(data))) > 0 {
+		return strings.TrimSpace(string(data))
+	}
+	salt := newRunID()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err == nil {
+		os.WriteFile(path, []byte(salt+"\n"), 0o600)
+	}
+	return salt
+}
+
+// gatewayIdentity returns the MAC address of the IPv4 default gateway
+// reached through iface (any interface if empty), or the gateway's IP when
+// the neighbor table has no entry. Only Linux exposes both tables without
+// extra tools; elsewhere the network stays unidentified.
+func gatewayIdentity(iface string) string {
+	gwIface, gwIP := defaultGateway(iface)
+	if gwIP == nil {
+		return ""
+	}
+	gw := gwIP.String()
+
+	arp, err := os.ReadFile("/proc/net/arp")
+	if err == nil {
+		for _, line := range strings.Split(string(arp), "\n")[1:] {
+			// IP address, HW type, Flags, HW address, Mask, Device
+			fields := strings.Fields(line)
+			if len(fields) >= 6 && fields[0] == gw && fields[5] == gwIface && fields[3] != "00:00:00:00:00:00" {
+				return fields[3]
+			}
+		}
+	}
+	return gw
+}
+
+// defaultGateway returns the IPv4 default gateway reached through iface (any
+// interface if empty) and the interface it is on, from the Linux routing
+// table.
+func defaultGateway(iface string) (string, net.IP) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway Flags ... Mask
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		if iface != "" && fields[0] != iface {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// The kernel prints the address in host byte order
+		var ip [4]byte
+		binary.BigEndian.PutUint32(ip[:], binary.LittleEndian.Uint32(raw))
+		return fields[0], net.IP(ip[:])
+	}
+	return "", nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Scan frames: the client lists ports and the responder tries each one at
+// the client's public IP, then reports what it found. Like reach, it only
+// ever probes the address the request came from, and only once the client
+// has echoed a cookie sent there.
+const (
+	frameScanReq = 0xec // id, count, (protocol, port)..., cookie
+	frameScan    = 0xed // id, scanned IPv4, count, (protocol, port, state)...
+)
+
+// Limits on a scan request, so the responder cannot be made into a scanner
+const (
+	maxScanPorts   = 16
+	scanDialWait   = 2 * time.Second
+	scanPerIPLimit = 1 // concurrent scans of one IP
+	scanLimit      = 8 // concurrent scans in all
+)
+
+// Port states reported by a scan
+const (
+	PortOpen     = "open"
+	PortClosed   = "closed"
+	PortFiltered = "filtered"
+	// PortOpenFiltered is a UDP port that neither answered nor refused,
+	// which is either a silent service or a firewall
+	PortOpenFiltered = "open|filtered"
+)
+
+var portStates = []string{PortOpen, PortClosed, PortFiltered, PortOpenFiltered}
+
+// ScanPort is one protocol and port to try from outside
+type ScanPort struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	State    string `json:"state,omitempty"`
+}
+
+// String renders the port as protocol/port
+func (p ScanPort) String() string {
+	return p.Protocol + "/" + strconv.Itoa(p.Port)
+}
+
+// ScanResult is what the responder found at the public IP
+type ScanResult struct {
+	Responder string     `json:"responder"`
+	PublicIP  string     `json:"public_ip,omitempty"`
+	Ports     []ScanPort `json:"ports"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// parseScanPort reads tcp/22, udp/51820 or a bare port, which means TCP
+func parseScanPort(s string) (ScanPort, error) {
+	proto, port := "tcp", s
+	if p, n, ok := strings.Cut(s, "/"); ok {
+		proto, port = strings.ToLower(p), n
+	}
+	if proto != "tcp" && proto != "udp" {
+		return ScanPort{}, errors.New("unknown protocol " + strconv.Quote(proto) + " in " + s + " (expected tcp or udp)")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return ScanPort{}, errors.New("bad port in " + s)
+	}
+	return ScanPort{Protocol: proto, Port: n}, nil
+}
+
+// IP protocol numbers identify ports in scan frames
+const (
+	scanTCP = 6
+	scanUDP = 17
+)
+
+func scanProtoByte(proto string) byte {
+	if proto == "udp" {
+		return scanUDP
+	}
+	return scanTCP
+}
+
+func scanProtoName(b byte) string {
+	if b == scanUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// isScanFrame reports whether a datagram is a scan request
+func isScanFrame(buf []byte) bool {
+	return len(buf) >= 6 && buf[0] == frameScanReq
+}
+
+// scanReflector is the responder side of the port scan
+type scanReflector struct {
+	conn    *net.UDPConn
+	cookies *cookieJar
+	// limit paces scans per IP and in all
+	limit *sourceLimiter
+
+	mu     sync.Mutex
+	active map[string]int
+	total  int
+}
+
+func newScanReflector(conn *net.UDPConn, cookies *cookieJar) *scanReflector {
+	return &scanReflector{
+		conn:    conn,
+		cookies: cookies,
+		limit:   &sourceLimiter{perSource: 0.2, burst: 3, total: 2},
+		active:  make(map[string]int),
+	}
+}
+
+// handle scans the requested ports of the sender's own IP in the background
+// and answers with their states
+func (s *scanReflector) handle(buf []byte, from *net.UDPAddr) {
+	count := int(buf[5])
+	if count > maxScanPorts || len(buf) < 6+3*count+cookieLength {
+		return
+	}
+	ip := from.IP.To4()
+	if ip == nil || !s.cookies.valid(buf[6+3*count:], from) {
+		return
+	}
+	key := ip.String()
+	s.mu.Lock()
+	if s.active[key] >= scanPerIPLimit || s.total >= scanLimit || !s.limit.allow(ip) {
+		s.mu.Unlock()
+		return
+	}
+	s.active[key]++
+	s.total++
+	s.mu.Unlock()
+
+	ports := make([]ScanPort, count)
+	for i := range ports {
+		entry := buf[6+3*i:]
+		ports[i] = ScanPort{Protocol: scanProtoName(entry[0]), Port: int(binary.BigEndian.Uint16(entry[1:3]))}
+	}
+	id := append([]byte(nil), buf[1:5]...)
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			if s.active[key]--; s.active[key] == 0 {
+				delete(s.active, key)
+			}
+			s.total--
+			s.mu.Unlock()
+		}()
+
+		var wg sync.WaitGroup
+		for i := range ports {
+			wg.Add(1)
+			go func(p *ScanPort) {
+				defer wg.Done()
+				p.State = scanOne(ip, *p)
+			}(&ports[i])
+		}
+		wg.Wait()
+
+		reply := append([]byte{frameScan}, id...)
+		reply = append(reply, ip...)
+		reply = append(reply, byte(len(ports)))
+		for _, p := range ports {
+			state := byte(0)
+			for i, name := range portStates {
+				if name == p.State {
+					state = byte(i)
+				}
+			}
+			reply = append(reply, scanProtoByte(p.Protocol))
+			reply = binary.BigEndian.AppendUint16(reply, uint16(p.Port))
+			reply = append(reply, state)
+		}
+		// Sent twice in case the first is lost; the client takes the first
+		for i := 0; i < 2; i++ {
+			s.conn.WriteToUDP(reply, from)
+		}
+	}()
+}
+
+// scanOne tries one port. A TCP connection that is refused means nothing
+// listens; one that times out means a firewall dropped it. UDP can only be
+// told closed when an ICMP port unreachable comes back.
+func scanOne(ip net.IP, p ScanPort) string {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(p.Port))
+	if p.Protocol == "tcp" {
+		c, err := net.DialTimeout("tcp4", addr, scanDialWait)
+		if err == nil {
+			c.Close()
+			return PortOpen
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return PortClosed
+		}
+		return PortFiltered
+	}
+
+	c, err := net.Dial("udp4", addr)
+	if err != nil {
+		return PortFiltered
+	}
+	defer c.Close()
+	buf := make([]byte, 64)
+	// Sent twice in case the first is lost; the ICMP error of either is
+	// reported on the connected socket
+	for i := 0; i < 2; i++ {
+		c.SetDeadline(time.Now().Add(scanDialWait / 2))
+		c.Write([]byte("nat-info port check\n"))
+		if _, err := c.Read(buf); err == nil {
+			return PortOpen
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			return PortClosed
+		}
+	}
+	return PortOpenFiltered
+}
+
+// probeScan asks the responder to try ports at this host's public IP and
+// waits for the answer
+func probeScan(target string, env *probeEnv, ports []ScanPort, timeout time.Duration) ScanResult {
+	result := ScanResult{Responder: target, Ports: ports}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	cookie, err := fetchCookie(conn, addr)
+	if err != nil {
+		result.Error = err.Error() + " (not a responder with --scan?)"
+		return result
+	}
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	req := append([]byte{frameScanReq}, id...)
+	req = append(req, byte(len(ports)))
+	for _, p := range ports {
+		req = append(req, scanProtoByte(p.Protocol))
+		req = binary.BigEndian.AppendUint16(req, uint16(p.Port))
+	}
+	req = append(req, cookie...)
+	// Sent twice in case the first is lost; the responder ignores a second
+	// request from an IP it is already scanning
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP(req, addr); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(scanDialWait + timeout))
+	buf := make([]byte, 16+4*maxScanPorts)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			result.Error = "no answer from " + target + " (not a responder with --scan, or it is busy scanning this IP or others)"
+			return result
+		}
+		if n < 10 || buf[0] != frameScan || string(buf[1:5]) != string(id) {
+			continue
+		}
+		count := int(buf[9])
+		if count != len(ports) || n < 10+4*count {
+			continue
+		}
+		result.PublicIP = net.IP(buf[5:9]).String()
+		for i := range result.Ports {
+			state := int(buf[10+4*i+3])
+			if state < len(portStates) {
+				result.Ports[i].State = portStates[state]
+			}
+		}
+		return result
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// Default ports used when a servers file entry omits one
+const (
+	DefaultStunPort  = "3478"
+	DefaultStunsPort = "5349"
+)
+
+// ServerEntry is one server line from a servers file
+type ServerEntry struct {
+	Addr string
+
+	// RFC3489 marks servers known to honor CHANGE-REQUEST
+	RFC3489 bool
+	// TLS marks servers that only speak STUN over TLS
+	TLS bool
+}
+
+// loadServersFile reads one server per line, with optional annotations after
+// the address:
+//
+//	# comments and blank lines are ignored
+//	stun.example.net:3478
+//	stun.example.org rfc3489
+//	stuns.example.com:5349 tls
+func loadServersFile(path string) ([]ServerEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []ServerEntry
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		entry, ok, err := parseServerLine(line)
+		if err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseServerList parses a comma-separated list of servers using the same
+// per-entry syntax as a servers file, e.g. "stun.example.net:3478,10.0.0.6 rfc3489"
+func parseServerList(list string) ([]ServerEntry, error) {
+	var entries []ServerEntry
+	for _, item := range strings.Split(list, ",") {
+		entry, ok, err := parseServerLine(item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// parseServerLine parses a single "host[:port] [annotation...]" entry.
+// It reports false for blank entries.
+func parseServerLine(line string) (ServerEntry, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ServerEntry{}, false, nil
+	}
+
+	entry := ServerEntry{}
+	for _, annotation := range fields[1:] {
+		switch strings.ToLower(annotation) {
+		case "rfc3489":
+			entry.RFC3489 = true
+		case "tls":
+			entry.TLS = true
+		default:
+			return ServerEntry{}, false, errors.New("unknown annotation " + annotation)
+		}
+	}
+
+	entry.Addr = fields[0]
+	if _, _, err := net.SplitHostPort(entry.Addr); err != nil {
+		port := DefaultStunPort
+		if entry.TLS {
+			port = DefaultStunsPort
+		}
+		entry.Addr = net.JoinHostPort(entry.Addr, port)
+	}
+	addr, err := natinfo.NormalizeHostPort(entry.Addr)
+	if err != nil {
+		return ServerEntry{}, false, err
+	}
+	entry.Addr = addr
+
+	return entry, true, nil
+}
+
+// applyServerEntries splits servers file entries into the binding and RFC 3489
+// server lists. RFC 3489 servers answer plain binding requests too, so they go
+// on both. Entries are placed ahead of the given built-in lists, or replace
+// them entirely when replace is set. TLS-only entries are returned separately
+// since detection probes over UDP.
+func applyServerEntries(entries []ServerEntry, builtin, builtinRfc3489 []string, replace bool) (servers, rfc3489 []string, skipped []ServerEntry) {
+	for _, entry := range entries {
+		switch {
+		case entry.TLS:
+			skipped = append(skipped, entry)
+		case entry.RFC3489:
+			rfc3489 = appendUnique(rfc3489, entry.Addr)
+			servers = appendUnique(servers, entry.Addr)
+		default:
+			servers = appendUnique(servers, entry.Addr)
+		}
+	}
+
+	if !replace {
+		for _, server := range builtin {
+			servers = appendUnique(servers, server)
+		}
+		for _, server := range builtinRfc3489 {
+			rfc3489 = appendUnique(rfc3489, server)
+		}
+	}
+	return servers, rfc3489, skipped
+}
+
+// appendUnique appends s to list unless it is already present
+func appendUnique(list []string, s string) []string {
+	for _, existing := range list {
+		if existing == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
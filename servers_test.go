@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestApplyServerEntriesReplaceRfc3489Only(t *testing.T) {
+	entries := []ServerEntry{
+		{Addr: "stun.example.net:3478", RFC3489: true},
+		{Addr: "192.0.2.10:3478", RFC3489: true},
+	}
+	servers, rfc3489, skipped := applyServerEntries(entries, defaultServers(), defaultRfc3489Servers(), true)
+
+	want := []string{"stun.example.net:3478", "192.0.2.10:3478"}
+	if !slices.Equal(servers, want) {
+		t.Errorf("servers = %v, want %v", servers, want)
+	}
+	if !slices.Equal(rfc3489, want) {
+		t.Errorf("rfc3489 = %v, want %v", rfc3489, want)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("skipped = %v, want none", skipped)
+	}
+}
+
+func TestApplyServerEntriesPrepend(t *testing.T) {
+	entries := []ServerEntry{
+		{Addr: "stun.example.net:3478"},
+		{Addr: "classic.example.net:3478", RFC3489: true},
+		{Addr: "stun.example.net:5349", TLS: true},
+	}
+	servers, rfc3489, skipped := applyServerEntries(entries, []string{"builtin:3478"}, []string{"builtin3489:3478"}, false)
+
+	if want := []string{"stun.example.net:3478", "classic.example.net:3478", "builtin:3478"}; !slices.Equal(servers, want) {
+		t.Errorf("servers = %v, want %v", servers, want)
+	}
+	if want := []string{"classic.example.net:3478", "builtin3489:3478"}; !slices.Equal(rfc3489, want) {
+		t.Errorf("rfc3489 = %v, want %v", rfc3489, want)
+	}
+	if len(skipped) != 1 || skipped[0].Addr != "stun.example.net:5349" {
+		t.Errorf("skipped = %v, want the TLS entry", skipped)
+	}
+}
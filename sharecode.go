@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"hash/crc32"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ShareCodePrefix starts every share code so it is recognizable when pasted
+const ShareCodePrefix = "NI-"
+
+// shareCodeVersion is stored in the code; decoders reject other versions
+const shareCodeVersion = 1
+
+// crockford is Crockford's base32 alphabet, which leaves out I, L, O and U
+// so codes survive being read aloud or retyped
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Lifetime buckets, coarse enough to fit three bits
+var lifetimeBuckets = []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute}
+
+// ShareCode is the essential part of a result, packed into five base32
+// characters that users can paste into a forum post or send to a peer
+type ShareCode struct {
+	Type          NATType     `json:"type"`
+	Mapping       Behavior    `json:"mapping"`
+	Filtering     Behavior    `json:"filtering"`
+	PortPreserved bool        `json:"port_preserved"`
+	Translation   Translation `json:"translation,omitempty"`
+	// Lifetime is the lower bound of the UDP mapping lifetime bucket, or
+	// zero when it was not measured
+	Lifetime        time.Duration `json:"lifetime_ns,omitempty"`
+	UnstableAddress bool          `json:"unstable_address"`
+	Confidence      Confidence    `json:"confidence"`
+}
+
+// shareCodeOf extracts the share code fields from a result. The lifetime
+// bucket is filled in from the UDP idle timeout the NAT reports, through
+// --conntrack on the router itself or the NAT-MIB over --snmp; otherwise it
+// stays unknown until a measurement such as mesh's sets it.
+func shareCodeOf(r *NatResult) ShareCode {
+	var lifetime time.Duration
+	if bucket := lifetimeBits(r.reportedUDPTimeout()); bucket > 0 {
+		lifetime = lifetimeBuckets[bucket-1]
+	}
+	return ShareCode{
+		Type:            r.Type,
+		Mapping:         r.Mapping,
+		Filtering:       r.Filtering,
+		PortPreserved:   slices.Contains(r.Reasons, ReasonPortPreserved),
+		Translation:     r.Translation,
+		Lifetime:        lifetime,
+		UnstableAddress: r.UnstableAddress,
+		Confidence:      r.Confidence,
+	}
+}
+
+// reportedUDPTimeout is the idle timeout the NAT itself gives UDP bindings,
+// or zero when it reported none. Conntrack's unreplied-flow timeout is the
+// one the probes' short exchanges get, since they never become assured.
+func (r *NatResult) reportedUDPTimeout() time.Duration {
+	if c := r.Conntrack; c != nil && c.UDPTimeout > 0 {
+		return time.Duration(c.UDPTimeout) * time.Second
+	}
+	if g := r.Gateway; g != nil && g.NAT != nil && g.NAT.UDPTimeout > 0 {
+		return time.Duration(g.NAT.UDPTimeout) * time.Second
+	}
+	return 0
+}
+
+// String encodes the code as NI- and five characters. The 25 bits are,
+// from the top: version (2), type (3), mapping (2), filtering (2), port
+// preserved (1), translation (2), lifetime bucket (3), unstable (1),
+// confidence (2), reserved (2) and a 5-bit checksum.
+func (c ShareCode) String() string {
+	v := uint32(shareCodeVersion)
+	v = v<<3 | uint32(c.Type)&7
+	v = v<<2 | uint32(c.Mapping)&3
+	v = v<<2 | uint32(c.Filtering)&3
+	v = v<<1 | boolBit(c.PortPreserved)
+	v = v<<2 | translationBits(c.Translation)
+	v = v<<3 | lifetimeBits(c.Lifetime)
+	v = v<<1 | boolBit(c.UnstableAddress)
+	v = v<<2 | uint32(c.Confidence)&3
+	v = v << 2
+	v = v<<5 | shareChecksum(v)
+
+	var out [5]byte
+	for i := 4; i >= 0; i-- {
+		out[i] = crockford[v&31]
+		v >>= 5
+	}
+	return ShareCodePrefix + string(out[:])
+}
+
+// parseShareCode decodes a code, with or without its prefix, in any case
+// and with the usual misreadings (O for 0, I or L for 1) forgiven
+func parseShareCode(s string) (ShareCode, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, ShareCodePrefix)
+	s = strings.NewReplacer("-", "", "O", "0", "I", "1", "L", "1").Replace(s)
+	if len(s) != 5 {
+		return ShareCode{}, errors.New("a share code has five characters after " + ShareCodePrefix)
+	}
+	var v uint32
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(crockford, s[i])
+		if d < 0 {
+			return ShareCode{}, errors.New("invalid character " + string(s[i]) + " in share code")
+		}
+		v = v<<5 | uint32(d)
+	}
+	if shareChecksum(v>>5) != v&31 {
+		return ShareCode{}, errors.New("share code checksum mismatch; check for a typo")
+	}
+	v >>= 5
+
+	var c ShareCode
+	v >>= 2 // reserved
+	c.Confidence = Confidence(v & 3)
+	v >>= 2
+	c.UnstableAddress = v&1 == 1
+	v >>= 1
+	if bucket := v & 7; bucket > 0 && int(bucket) <= len(lifetimeBuckets) {
+		c.Lifetime = lifetimeBuckets[bucket-1]
+	}
+	v >>= 3
+	switch v & 3 {
+	case 1:
+		c.Translation = TranslationPAT
+	case 2:
+		c.Translation = TranslationOneToOne
+	}
+	v >>= 2
+	c.PortPreserved = v&1 == 1
+	v >>= 1
+	c.Filtering = Behavior(v & 3)
+	v >>= 2
+	c.Mapping = Behavior(v & 3)
+	v >>= 2
+	c.Type = NATType(v & 7)
+	v >>= 3
+	if v != shareCodeVersion {
+		return ShareCode{}, errors.New("share code is from a newer nat-info; upgrade to read it")
+	}
+	return c, nil
+}
+
+func shareChecksum(v uint32) uint32 {
+	return crc32.ChecksumIEEE([]byte{byte(v >> 16), byte(v >> 8), byte(v)}) & 31
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func translationBits(t Translation) uint32 {
+	switch t {
+	case TranslationPAT:
+		return 1
+	case TranslationOneToOne:
+		return 2
+	}
+	return 0
+}
+
+// lifetimeBits returns the bucket whose lower bound d reaches, 0 for unknown
+func lifetimeBits(d time.Duration) uint32 {
+	bucket := uint32(0)
+	for i, bound := range lifetimeBuckets {
+		if d >= bound {
+			bucket = uint32(i + 1)
+		}
+	}
+	return bucket
+}
+
+// Outcomes of comparing two share codes
+const (
+	CompatDirect  = "direct"
+	CompatPunch   = "hole-punching"
+	CompatRelay   = "relay"
+	CompatUnknown = "unknown"
+)
+
+// compatibility predicts whether two peers can connect directly over UDP
+// and explains why. Hole punching only fails when one side's mapping
+// changes per destination while the other side filters by port, or both
+// change mappings; port prediction can sometimes rescue those pairs.
+func compatibility(a, b ShareCode) (string, string) {
+	if a.Type == NATUDPBlocked || b.Type == NATUDPBlocked {
+		return CompatRelay, "UDP is blocked on at least one side, so only a TURN relay over TCP or TLS will work."
+	}
+	if a.Type == NATUnknown || b.Type == NATUnknown {
+		return CompatUnknown, "At least one side's NAT type is unknown."
+	}
+	open := func(c ShareCode) bool { return c.Type == NATOpen || c.Type == NATFullCone }
+	if open(a) || open(b) {
+		return CompatDirect, "One side accepts unsolicited packets, so the other can connect to it directly."
+	}
+
+	symmetric := func(c ShareCode) bool { return c.Type == NATSymmetric }
+	portFiltering := func(c ShareCode) bool {
+		return c.Type == NATPortRestricted || c.Type == NATSymmetric || c.Type == NATSymmetricFirewall
+	}
+	if symmetric(a) && symmetric(b) {
+		return CompatRelay, "Both sides change their public port per destination; expect to need a TURN relay."
+	}
+	if symmetric(a) && portFiltering(b) || symmetric(b) && portFiltering(a) {
+		note := "One side changes its public port per destination and the other filters by port, so hole punching fails; expect to need a TURN relay."
+		if a.PortPreserved || b.PortPreserved {
+			note += " Port prediction may still work since a side preserves ports."
+		}
+		return CompatRelay, note
+	}
+	return CompatPunch, "Both sides keep a stable mapping or filter by address only, so simultaneous UDP hole punching should work."
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShareCodeLifetimeFromReportedTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		result NatResult
+		want   time.Duration
+	}{
+		{"nothing reported", NatResult{}, 0},
+		{"conntrack", NatResult{Conntrack: &ConntrackReport{UDPTimeout: 180}}, 2 * time.Minute},
+		{"nat-mib", NatResult{Gateway: &GatewayInfo{NAT: &GatewayNAT{UDPTimeout: 300}}}, 5 * time.Minute},
+		{"below the first bucket", NatResult{Conntrack: &ConntrackReport{UDPTimeout: 20}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := shareCodeOf(&tt.result)
+			if code.Lifetime != tt.want {
+				t.Errorf("Lifetime = %v, want %v", code.Lifetime, tt.want)
+			}
+			decoded, err := parseShareCode(code.String())
+			if err != nil {
+				t.Fatalf("parseShareCode: %v", err)
+			}
+			if decoded.Lifetime != tt.want {
+				t.Errorf("decoded Lifetime = %v, want %v", decoded.Lifetime, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WebhookTimeout bounds a single POST to a webhook sink
+const WebhookTimeout = 10 * time.Second
+
+// OutputSink is a destination for watch events. Sinks report their own
+// failures on the progress stream, so one broken destination never keeps
+// the others from getting an event.
+type OutputSink interface {
+	handle(ev WatchEvent)
+}
+
+// sinkFunc adapts a plain function to OutputSink
+type sinkFunc func(WatchEvent)
+
+func (f sinkFunc) handle(ev WatchEvent) { f(ev) }
+
+// fanOut hands ev to every sink at once and waits for all of them, so a
+// slow webhook does not delay the others and the next run starts clean
+func fanOut(sinks []OutputSink, ev WatchEvent) {
+	var wg sync.WaitGroup
+	for _, s := range sinks {
+		wg.Add(1)
+		go func(s OutputSink) {
+			defer wg.Done()
+			s.handle(ev)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// SinkConfig is one entry of the "sinks" list in a --config file. Type
+// selects the sink; the other fields apply to the types named beside them.
+type SinkConfig struct {
+	Type string `json:"type"` // text, json, prometheus, mqtt, webhook, influx or command
+
+	// json and influx: file to append to ("-" is standard output for json)
+	Path string `json:"path,omitempty"`
+	// webhook and influx: endpoint to POST to
+	URL string `json:"url,omitempty"`
+	// influx: API token
+	Token string `json:"token,omitempty"`
+	// webhook: extra request headers, e.g. Authorization
+	Headers map[string]string `json:"headers,omitempty"`
+	// webhook: only send runs that changed something or failed; command:
+	// only run on changes, like --on-change
+	ChangesOnly bool `json:"changes_only,omitempty"`
+	// command: shell command, run like --on-complete
+	Command string `json:"command,omitempty"`
+	// prometheus: address serving /metrics and the health endpoints
+	Listen string `json:"listen,omitempty"`
+	// mqtt
+	Broker      string `json:"broker,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	ClientID    string `json:"client_id,omitempty"`
+	HADiscovery bool   `json:"ha_discovery,omitempty"`
+	HAPrefix    string `json:"ha_prefix,omitempty"`
+}
+
+// Config is the --config file of watch
+type Config struct {
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// loadConfig reads a --config file, rejecting unknown fields so that a
+// typo does not silently drop a destination
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// newSink builds the sink a config entry describes for w, whose timing the
+// prometheus sink's readiness check and Home Assistant sensor expiry follow
+func newSink(cfg SinkConfig, w *watcher) (OutputSink, error) {
+	switch cfg.Type {
+	case "text":
+		return sinkFunc(w.style.printWatchLine), nil
+
+	case "json":
+		if cfg.Path == "" || cfg.Path == "-" {
+			return newJSONSink(os.Stdout), nil
+		}
+		f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return newJSONSink(f), nil
+
+	case "prometheus":
+		if cfg.Listen == "" {
+			return nil, errors.New("prometheus sink needs listen")
+		}
+		api := newAPIServer(2 * w.period())
+		if err := api.listen(cfg.Listen); err != nil {
+			return nil, err
+		}
+		return api, nil
+
+	case "mqtt":
+		if cfg.Broker == "" {
+			return nil, errors.New("mqtt sink needs broker")
+		}
+		client, err := newMQTTClient(cfg.Broker, cfg.ClientID, cfg.Username, cfg.Password)
+		if err != nil {
+			return nil, err
+		}
+		topic := cfg.Topic
+		if topic == "" {
+			topic = "nat-info"
+		}
+		publisher := &mqttPublisher{client: client, topic: topic}
+		if cfg.HADiscovery {
+			prefix := cfg.HAPrefix
+			if prefix == "" {
+				prefix = "homeassistant"
+			}
+			// Expire sensors after missing a few runs
+			expire := 3 * w.interval
+			if w.schedule != nil {
+				expire = 0
+			}
+			publisher.discovery = homeAssistantDiscovery(prefix, topic+"/state", haNodeID(client.clientID), expire)
+		}
+		return publisher, nil
+
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, errors.New("webhook sink needs url")
+		}
+		return &webhookSink{url: cfg.URL, headers: cfg.Headers, changesOnly: cfg.ChangesOnly, client: http.DefaultClient}, nil
+
+	case "influx":
+		if cfg.Path == "" && cfg.URL == "" {
+			return nil, errors.New("influx sink needs path or url")
+		}
+		return newInfluxSink(cfg.Path, cfg.URL, cfg.Token)
+
+	case "command":
+		if cfg.Command == "" {
+			return nil, errors.New("command sink needs command")
+		}
+		return &hookSink{command: cfg.Command, changesOnly: cfg.ChangesOnly}, nil
+	}
+	return nil, errors.New("unknown sink type " + strconv.Quote(cfg.Type) + " (expected text, json, prometheus, mqtt, webhook, influx or command)")
+}
+
+// jsonSink writes one JSON object per event
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONSink(w io.Writer) *jsonSink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) handle(ev WatchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(ev); err != nil {
+		printProgress("JSON write failed: " + err.Error())
+	}
+}
+
+// webhookSink POSTs each event as JSON
+type webhookSink struct {
+	url         string
+	headers     map[string]string
+	changesOnly bool
+	client      *http.Client
+}
+
+func (s *webhookSink) handle(ev WatchEvent) {
+	if s.changesOnly && !ev.Changed && ev.Error == "" {
+		return
+	}
+	if err := s.post(ev); err != nil {
+		printProgress("Webhook " + s.url + " failed: " + err.Error())
+	}
+}
+
+func (s *webhookSink) post(ev WatchEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("answered " + resp.Status)
+	}
+	return nil
+}
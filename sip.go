@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSIPPort is the well-known SIP port phones register from and to
+const DefaultSIPPort = 5060
+
+// SIPALGResult is what a nat-info responder --sip saw of an OPTIONS
+// request: rewritten headers or SDP mean a SIP ALG sits on the path
+type SIPALGResult struct {
+	Target   string `json:"target"`
+	Answered bool   `json:"answered"`
+	// Received and RPort are the source the responder put in the Via
+	// (RFC 3581), the address a proxy sends requests for this phone to
+	Received string `json:"received,omitempty"`
+	RPort    int    `json:"rport,omitempty"`
+	// Rewritten lists the parts of the request that arrived changed
+	Rewritten []string `json:"rewritten,omitempty"`
+	Detected  bool     `json:"detected"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// SymmetricRTPResult is whether RTP sent to the responder came back to the
+// port it left from, which is how SBCs and comedia-style servers answer
+// phones behind NAT (RFC 4961)
+type SymmetricRTPResult struct {
+	Target   string        `json:"target"`
+	Local    int           `json:"local"`
+	Returned bool          `json:"returned"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// SIPCheck is the outcome of the SIP preflight
+type SIPCheck struct {
+	LocalIP string `json:"local_ip"`
+	// Signaling is the mapping of the SIP port; SIPPortBound is false when
+	// the port was taken and a random one stood in
+	Signaling    LocalMapping        `json:"signaling"`
+	SIPPortBound bool                `json:"sip_port_bound"`
+	RTP          []LocalMapping      `json:"rtp"`
+	RTPRange     [2]int              `json:"rtp_range"`
+	ALG          *SIPALGResult       `json:"alg,omitempty"`
+	SymmetricRTP *SymmetricRTPResult `json:"symmetric_rtp,omitempty"`
+	NAT          *NatResult          `json:"nat,omitempty"`
+	Verdict      []string            `json:"verdict"`
+}
+
+// parsePortRange reads "10000-20000" into its bounds
+func parsePortRange(s string) ([2]int, error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	a, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	b, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || a < 1 || b > 65535 || a > b {
+		return [2]int{}, errors.New("expected a port range like 10000-20000")
+	}
+	return [2]int{a, b}, nil
+}
+
+// rtpSamplePorts picks count even ports spread across the range, as RTP
+// uses even ports and RTCP the odd one above
+func rtpSamplePorts(r [2]int, count int) []int {
+	lo := r[0] + r[0]%2
+	span := r[1] - lo
+	if span < 0 {
+		return nil
+	}
+	var ports []int
+	for i := 0; i < count; i++ {
+		p := lo + span*i/max(count, 1)
+		p -= p % 2
+		if len(ports) > 0 && p <= ports[len(ports)-1] {
+			continue
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// sipOptions builds an OPTIONS request advertising local in the Via,
+// Contact and an SDP offer, the fields a SIP ALG rewrites
+func sipOptions(target *net.UDPAddr, local *net.UDPAddr, rtpPort int) []byte {
+	id := make([]byte, 8)
+	rand.Read(id)
+	tag := hex.EncodeToString(id)
+	host := local.IP.String()
+	sdp := "v=0\r\n" +
+		"o=nat-info 1 1 IN IP4 " + host + "\r\n" +
+		"s=nat-info\r\n" +
+		"c=IN IP4 " + host + "\r\n" +
+		"t=0 0\r\n" +
+		"m=audio " + strconv.Itoa(rtpPort) + " RTP/AVP 0\r\n"
+	return []byte("OPTIONS sip:" + target.String() + " SIP/2.0\r\n" +
+		"Via: SIP/2.0/UDP " + local.String() + ";branch=z9hG4bK" + tag + ";rport\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"From: <sip:nat-info@" + local.String() + ">;tag=" + tag[:8] + "\r\n" +
+		"To: <sip:" + target.String() + ">\r\n" +
+		"Call-ID: " + tag + "@" + host + "\r\n" +
+		"CSeq: 1 OPTIONS\r\n" +
+		"Contact: <sip:nat-info@" + local.String() + ">\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: " + strconv.Itoa(len(sdp)) + "\r\n" +
+		"\r\n" + sdp)
+}
+
+// sipHeader returns the first value of a header in a SIP message
+func sipHeader(msg []byte, name string) string {
+	head, _, _ := bytes.Cut(msg, []byte("\r\n\r\n"))
+	for _, line := range strings.Split(string(head), "\r\n")[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(k), name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// sipBody returns what follows the headers of a SIP message
+func sipBody(msg []byte) []byte {
+	_, body, _ := bytes.Cut(msg, []byte("\r\n\r\n"))
+	return body
+}
+
+// viaParam returns a parameter of a Via header value
+func viaParam(via, name string) string {
+	for _, p := range strings.Split(via, ";")[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if k == name {
+			return v
+		}
+	}
+	return ""
+}
+
+// compareSIP lists the parts of the request an ALG changed on the way
+func compareSIP(sent, received []byte) []string {
+	var changed []string
+	for _, h := range []string{"Via", "Contact", "From", "Call-ID"} {
+		if sipHeader(sent, h) != sipHeader(received, h) {
+			changed = append(changed, h)
+		}
+	}
+	sentSDP, recvSDP := string(sipBody(sent)), string(sipBody(received))
+	for _, prefix := range []string{"o=", "c=", "m="} {
+		if sdpLine(sentSDP, prefix) != sdpLine(recvSDP, prefix) {
+			changed = append(changed, "SDP "+strings.TrimSuffix(prefix, "="))
+		}
+	}
+	return changed
+}
+
+// sdpLine returns the first SDP line with the given prefix
+func sdpLine(sdp, prefix string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	return ""
+}
+
+// probeSIPALG sends an OPTIONS request from the signaling socket to a
+// nat-info responder --sip and compares what it echoes with what was sent
+func probeSIPALG(conn *net.UDPConn, target, localIP string, rtpPort int, timeout time.Duration) *SIPALGResult {
+	result := &SIPALGResult{Target: target}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	local := &net.UDPAddr{IP: net.ParseIP(localIP), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	req := sipOptions(addr, local, rtpPort)
+	callID := sipHeader(req, "Call-ID")
+
+	buf := make([]byte, 4096)
+	for attempt := 0; attempt < 3 && !result.Answered; attempt++ {
+		if _, err := conn.WriteToUDP(req, addr); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout / 3))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			resp := buf[:n]
+			if !bytes.HasPrefix(resp, []byte("SIP/2.0 200")) {
+				continue
+			}
+			// An ALG may rewrite the Call-ID too, so a response whose echoed
+			// request carries ours is accepted either way
+			echo := sipBody(resp)
+			if sipHeader(resp, "Call-ID") != callID && sipHeader(echo, "Call-ID") != callID {
+				continue
+			}
+			result.Answered = true
+			via := sipHeader(resp, "Via")
+			result.Received = viaParam(via, "received")
+			result.RPort, _ = strconv.Atoi(viaParam(via, "rport"))
+			result.Rewritten = compareSIP(req, echo)
+			result.Detected = len(result.Rewritten) > 0
+			break
+		}
+	}
+	if !result.Answered && result.Error == "" {
+		result.Error = "no answer to SIP OPTIONS"
+	}
+	return result
+}
+
+// probeSymmetricRTP sends RTP packets from conn to the responder, which
+// sends each back to the address it came from
+func probeSymmetricRTP(conn *net.UDPConn, target string, timeout time.Duration) *SymmetricRTPResult {
+	result := &SymmetricRTPResult{Target: target, Local: conn.LocalAddr().(*net.UDPAddr).Port}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	// RTP version 2, PCMU, with a random SSRC to recognize the echo by
+	pkt := make([]byte, 12+160)
+	pkt[0], pkt[1] = 0x80, 0
+	rand.Read(pkt[8:12])
+	ssrc := string(pkt[8:12])
+
+	buf := make([]byte, 512)
+	for seq := 0; seq < 3 && !result.Returned; seq++ {
+		pkt[3] = byte(seq)
+		start := time.Now()
+		if _, err := conn.WriteToUDP(pkt, addr); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		conn.SetReadDeadline(start.Add(timeout / 3))
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			if isRTPPacket(buf[:n]) && string(buf[8:12]) == ssrc {
+				result.Returned, result.RTT = true, time.Since(start)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// isRTPPacket reports whether a datagram looks like RTP rather than RTCP:
+// version 2 and a payload type outside the RTCP range
+func isRTPPacket(buf []byte) bool {
+	return len(buf) >= 12 && buf[0]&0xc0 == 0x80 && (buf[1]&0x7f < 72 || buf[1]&0x7f > 76)
+}
+
+// isSIPRequest reports whether a datagram is a SIP OPTIONS request
+func isSIPRequest(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte("OPTIONS sip:"))
+}
+
+// sipReflector is the responder side of the SIP preflight
+type sipReflector struct {
+	conn *net.UDPConn
+}
+
+// handle answers an OPTIONS request with the source address in the Via
+// and the request as it arrived in a message/sipfrag body (RFC 3420)
+func (s *sipReflector) handle(buf []byte, from *net.UDPAddr) {
+	via := sipHeader(buf, "Via")
+	if via == "" {
+		return
+	}
+	var params []string
+	for _, p := range strings.Split(via, ";") {
+		if k, _, _ := strings.Cut(strings.TrimSpace(p), "="); k != "received" && k != "rport" {
+			params = append(params, p)
+		}
+	}
+	via = strings.Join(params, ";") + ";received=" + from.IP.String() + ";rport=" + strconv.Itoa(from.Port)
+
+	to := sipHeader(buf, "To")
+	if !strings.Contains(to, ";tag=") {
+		to += ";tag=nat-info"
+	}
+	resp := "SIP/2.0 200 OK\r\n" +
+		"Via: " + via + "\r\n" +
+		"From: " + sipHeader(buf, "From") + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Call-ID: " + sipHeader(buf, "Call-ID") + "\r\n" +
+		"CSeq: " + sipHeader(buf, "CSeq") + "\r\n" +
+		"Content-Type: message/sipfrag\r\n" +
+		"Content-Length: " + strconv.Itoa(len(buf)) + "\r\n" +
+		"\r\n"
+	s.conn.WriteToUDP(append([]byte(resp), buf...), from)
+}
+
+// handleRTP sends an RTP packet back where it came from
+func (s *sipReflector) handleRTP(buf []byte, from *net.UDPAddr) {
+	s.conn.WriteToUDP(buf, from)
+}
+
+// checkSIP runs the SIP preflight: the mapping of the SIP port and of
+// sample RTP ports, and with a responder, ALG and symmetric RTP tests
+func checkSIP(opts DetectOptions, sipPort int, rtpRange [2]int, samples int, responder string) (*SIPCheck, error) {
+	opts = opts.withDefaults()
+	servers, err := mappingServers(opts)
+	if err != nil {
+		return nil, err
+	}
+	check := &SIPCheck{RTPRange: rtpRange}
+	env := opts.probeEnv()
+
+	printProgress("Probing the SIP port mapping...")
+	sig, localIP, err := env.bindPort(sipPort)
+	if err == nil {
+		check.SIPPortBound = true
+	} else if sig, localIP, err = env.listenLocal(); err != nil {
+		return nil, err
+	}
+	defer sig.Close()
+	check.LocalIP = localIP
+	check.Signaling = probeLocalMapping(env, sig, servers, opts.PrimaryTimeout)
+
+	printProgress("Probing RTP port mappings...")
+	var rtp *net.UDPConn
+	for _, port := range rtpSamplePorts(rtpRange, samples) {
+		conn, _, err := env.bindPort(port)
+		if err != nil {
+			check.RTP = append(check.RTP, LocalMapping{Local: port, Error: err.Error()})
+			continue
+		}
+		check.RTP = append(check.RTP, probeLocalMapping(env, conn, servers, opts.PrimaryTimeout))
+		if rtp == nil {
+			rtp = conn
+			defer rtp.Close()
+		} else {
+			conn.Close()
+		}
+	}
+
+	if responder != "" {
+		printProgress("Testing for a SIP ALG...")
+		rtpPort := rtpRange[0]
+		if rtp != nil {
+			rtpPort = rtp.LocalAddr().(*net.UDPAddr).Port
+		}
+		check.ALG = probeSIPALG(sig, responder, localIP, rtpPort, opts.PrimaryTimeout)
+		if rtp != nil {
+			printProgress("Testing symmetric RTP...")
+			check.SymmetricRTP = probeSymmetricRTP(rtp, responder, opts.PrimaryTimeout)
+		}
+	}
+
+	printProgress("Detecting NAT behavior...")
+	if result, err := detectNATType(opts); err == nil {
+		check.NAT = result
+	}
+
+	check.Verdict = sipVerdict(check)
+	return check, nil
+}
+
+// sipVerdict phrases the findings for someone installing a PBX or phones
+func sipVerdict(c *SIPCheck) []string {
+	var out []string
+	sig := c.Signaling
+	switch {
+	case sig.Public == nil:
+		out = append(out, "STUN from the SIP port got no answer: outbound UDP is blocked, so phones cannot register over UDP. Try SIP over TCP or TLS, or ask for UDP to the provider to be allowed.")
+	case !c.SIPPortBound:
+		out = append(out, "Port "+strconv.Itoa(DefaultSIPPort)+" was in use on this host, so a random port stood in for the SIP port.")
+	}
+	if sig.Public != nil && !sig.Preserved {
+		out = append(out, "The NAT rewrites the SIP port ("+strconv.Itoa(sig.Local)+" leaves as "+strconv.Itoa(sig.Public.Port)+"). Providers must use rport (RFC 3581) or the phones must send keepalives; a Contact with the private port will not be reachable.")
+	}
+	if sig.Public != nil && sig.Second != nil && !sig.Consistent {
+		out = append(out, "The SIP port's mapping differs per destination (symmetric NAT): a STUN-learned address is wrong for the SIP provider, so leave STUN off on the phones and rely on the provider's NAT handling or an SBC.")
+	}
+
+	if alg := c.ALG; alg != nil {
+		switch {
+		case alg.Detected:
+			out = append(out, "SIP ALG detected: the router rewrote "+strings.Join(alg.Rewritten, ", ")+". Disable SIP ALG (often called SIP helper or SIP passthrough); it is a common cause of one-way audio, dropped calls and failed registrations.")
+		case alg.Answered:
+			out = append(out, "No SIP ALG: SIP headers and SDP arrived unchanged.")
+		case sig.Public != nil:
+			out = append(out, "STUN from the SIP port got out but the SIP OPTIONS request got no answer: something on the path drops SIP, often a SIP ALG or a firewall rule for port 5060.")
+		}
+	} else {
+		out = append(out, "SIP ALG not tested; run a nat-info responder --sip and pass it with --responder.")
+	}
+
+	var mapped, preserved, consistent int
+	for _, m := range c.RTP {
+		if m.Public == nil {
+			continue
+		}
+		mapped++
+		if m.Preserved {
+			preserved++
+		}
+		if m.Second == nil || m.Consistent {
+			consistent++
+		}
+	}
+	if len(c.RTP) > 0 {
+		n := strconv.Itoa(len(c.RTP))
+		switch {
+		case mapped == 0:
+			out = append(out, "No RTP port in "+strconv.Itoa(c.RTPRange[0])+"-"+strconv.Itoa(c.RTPRange[1])+" got out: expect no audio at all.")
+		case consistent < mapped:
+			out = append(out, "RTP mappings differ per destination on "+strconv.Itoa(mapped-consistent)+" of "+n+" sample ports: the addresses phones put in SDP will be wrong, so media relies on symmetric RTP or an SBC/TURN relay.")
+		case preserved == mapped:
+			out = append(out, "RTP ports are kept as-is on all "+n+" sample ports, so the ports in SDP match what the far end sees.")
+		default:
+			out = append(out, "RTP ports are rewritten on "+strconv.Itoa(mapped-preserved)+" of "+n+" sample ports; phones should advertise STUN-learned ports or the provider must latch onto the media source.")
+		}
+	}
+
+	if s := c.SymmetricRTP; s != nil {
+		if s.Returned {
+			out = append(out, "Symmetric RTP works: media sent back to the port it came from arrives, so SBCs and servers with comedia/latching deliver audio.")
+		} else {
+			out = append(out, "Symmetric RTP failed: media returned to the source port did not arrive, so expect one-way or no audio even with an SBC.")
+		}
+	}
+	if c.NAT != nil && c.NAT.Filtering == BehaviorAddressPortDependent {
+		out = append(out, "Inbound media is only accepted from the exact address and port the phone sent to; media servers that send from a different port than they receive on will be blocked until the phone sends first.")
+	}
+	return out
+}
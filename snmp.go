@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BER tags used by SNMPv2c
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	snmpIPAddress  = 0x40
+	snmpCounter32  = 0x41
+	snmpGauge32    = 0x42
+	snmpTimeTicks  = 0x43
+	snmpCounter64  = 0x46
+	snmpNoSuchObj  = 0x80
+	snmpNoSuchInst = 0x81
+	snmpEndOfView  = 0x82
+	snmpGetRequest = 0xa0
+	snmpGetNext    = 0xa1
+	snmpResponse   = 0xa2
+)
+
+// snmpValue is a raw varbind value
+type snmpValue struct {
+	Type  byte
+	Bytes []byte
+}
+
+// missing reports the v2c exceptions for absent objects
+func (v snmpValue) missing() bool {
+	return v.Type == snmpNoSuchObj || v.Type == snmpNoSuchInst || v.Type == snmpEndOfView
+}
+
+// Uint decodes integer-like values
+func (v snmpValue) Uint() uint64 {
+	var n uint64
+	for _, b := range v.Bytes {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func (v snmpValue) String() string {
+	switch v.Type {
+	case berOctetString:
+		return string(v.Bytes)
+	case snmpIPAddress:
+		if len(v.Bytes) == 4 {
+			return net.IP(v.Bytes).String()
+		}
+	case berInteger, snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case berOID:
+		return decodeOID(v.Bytes)
+	}
+	return ""
+}
+
+// snmpVarbind is one OID and its value
+type snmpVarbind struct {
+	OID   string
+	Value snmpValue
+}
+
+func berLength(n int) []byte {
+	switch {
+	case n < 0x80:
+		return []byte{byte(n)}
+	case n < 0x100:
+		return []byte{0x81, byte(n)}
+	default:
+		return []byte{0x82, byte(n >> 8), byte(n)}
+	}
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+func berInt(n int64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(n))
+	// Strip redundant leading bytes while keeping the sign
+	for len(b) > 1 && ((b[0] == 0 && b[1]&0x80 == 0) || (b[0] == 0xff && b[1]&0x80 != 0)) {
+		b = b[1:]
+	}
+	return berTLV(berInteger, b)
+}
+
+// encodeOID encodes a dotted OID
+func encodeOID(oid string) []byte {
+	var arcs []uint64
+	for _, part := range strings.Split(oid, ".") {
+		n, _ := strconv.ParseUint(part, 10, 64)
+		arcs = append(arcs, n)
+	}
+	if len(arcs) < 2 {
+		return berTLV(berOID)
+	}
+
+	out := []byte{byte(arcs[0]*40 + arcs[1])}
+	for _, arc := range arcs[2:] {
+		var chunk []byte
+		chunk = append(chunk, byte(arc&0x7f))
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			chunk = append([]byte{byte(arc&0x7f) | 0x80}, chunk...)
+		}
+		out = append(out, chunk...)
+	}
+	return berTLV(berOID, out)
+}
+
+// decodeOID renders the content of an OID as dotted text
+func decodeOID(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	parts := []string{strconv.Itoa(int(b[0]) / 40), strconv.Itoa(int(b[0]) % 40)}
+	var arc uint64
+	for _, c := range b[1:] {
+		arc = arc<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			parts = append(parts, strconv.FormatUint(arc, 10))
+			arc = 0
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// berRead splits the first TLV off b
+func berRead(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	tag = b[0]
+	length := int(b[1])
+	offset := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(b) < 2+n {
+			return 0, nil, nil, errors.New("bad BER length")
+		}
+		length = 0
+		for _, c := range b[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		offset += n
+	}
+	if len(b) < offset+length {
+		return 0, nil, nil, errors.New("truncated BER")
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
+
+// snmpClient speaks SNMPv2c over UDP
+type snmpClient struct {
+	env       *probeEnv
+	addr      *net.UDPAddr
+	community string
+	timeout   time.Duration
+}
+
+// newSNMPClient resolves target, adding the default port 161
+func newSNMPClient(env *probeEnv, target, community string, timeout time.Duration) (*snmpClient, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "161")
+	}
+	addr, err := net.ResolveUDPAddr("udp4", target)
+	if err != nil {
+		return nil, err
+	}
+	return &snmpClient{env: env, addr: addr, community: community, timeout: timeout}, nil
+}
+
+// request sends one PDU and returns the response varbinds
+func (c *snmpClient) request(pduType byte, oids []string) ([]snmpVarbind, error) {
+	idBytes := make([]byte, 4)
+	rand.Read(idBytes)
+	reqID := int64(binary.BigEndian.Uint32(idBytes) & 0x7fffffff)
+
+	var binds [][]byte
+	for _, oid := range oids {
+		binds = append(binds, berTLV(berSequence, encodeOID(oid), berTLV(berNull)))
+	}
+	pdu := berTLV(pduType, berInt(reqID), berInt(0), berInt(0), berTLV(berSequence, binds...))
+	msg := berTLV(berSequence, berInt(1), berTLV(berOctetString, []byte(c.community)), pdu)
+
+	conn, err := c.env.dialUDP(nil, c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt < 2; attempt++ {
+		conn.Write(msg)
+		conn.SetReadDeadline(time.Now().Add(c.timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			binds, id, err := parseSNMPResponse(buf[:n])
+			if err != nil || id != reqID {
+				continue
+			}
+			return binds, nil
+		}
+	}
+	return nil, errors.New("no SNMP response from " + c.addr.String())
+}
+
+// parseSNMPResponse decodes a v2c response message
+func parseSNMPResponse(b []byte) ([]snmpVarbind, int64, error) {
+	_, msg, _, err := berRead(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, _, msg, err = berRead(msg) // version
+	if err != nil {
+		return nil, 0, err
+	}
+	_, _, msg, err = berRead(msg) // community
+	if err != nil {
+		return nil, 0, err
+	}
+	tag, pdu, _, err := berRead(msg)
+	if err != nil || tag != snmpResponse {
+		return nil, 0, errors.New("not an SNMP response")
+	}
+
+	var fields [3]snmpValue
+	for i := range fields {
+		var content []byte
+		fields[i].Type, content, pdu, err = berRead(pdu)
+		if err != nil {
+			return nil, 0, err
+		}
+		fields[i].Bytes = content
+	}
+	id := int64(fields[0].Uint())
+	if status := fields[1].Uint(); status != 0 {
+		return nil, id, errors.New("SNMP error status " + strconv.FormatUint(status, 10))
+	}
+
+	_, list, _, err := berRead(pdu)
+	if err != nil {
+		return nil, id, err
+	}
+	var binds []snmpVarbind
+	for len(list) > 0 {
+		var bind []byte
+		_, bind, list, err = berRead(list)
+		if err != nil {
+			return nil, id, err
+		}
+		_, oid, rest, err := berRead(bind)
+		if err != nil {
+			return nil, id, err
+		}
+		tag, value, _, err := berRead(rest)
+		if err != nil {
+			return nil, id, err
+		}
+		binds = append(binds, snmpVarbind{OID: decodeOID(oid), Value: snmpValue{Type: tag, Bytes: value}})
+	}
+	return binds, id, nil
+}
+
+// get fetches single objects
+func (c *snmpClient) get(oids ...string) (map[string]snmpValue, error) {
+	binds, err := c.request(snmpGetRequest, oids)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]snmpValue)
+	for _, b := range binds {
+		if !b.Value.missing() {
+			values[b.OID] = b.Value
+		}
+	}
+	return values, nil
+}
+
+// walk follows GETNEXT through a subtree, stopping after limit objects
+func (c *snmpClient) walk(prefix string, limit int) ([]snmpVarbind, error) {
+	var out []snmpVarbind
+	oid := prefix
+	for len(out) < limit {
+		binds, err := c.request(snmpGetNext, []string{oid})
+		if err != nil {
+			return out, err
+		}
+		if len(binds) == 0 || binds[0].Value.missing() || !strings.HasPrefix(binds[0].OID, prefix+".") {
+			break
+		}
+		out = append(out, binds[0])
+		oid = binds[0].OID
+	}
+	return out, nil
+}
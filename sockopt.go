@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sockOption is one integer socket option
+type sockOption struct {
+	Name  string
+	Level int
+	Opt   int
+	Value int
+}
+
+// sockoptFlag collects --sockopt settings; it may be repeated and each use
+// may hold a comma-separated list. A key is a name from sockoptNames or a
+// raw LEVEL:OPTION pair of numbers for anything else the platform supports.
+type sockoptFlag []sockOption
+
+func (f *sockoptFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, o := range *f {
+		parts[i] = o.Name + "=" + strconv.Itoa(o.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *sockoptFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || val == "" {
+			return errors.New("expected key=value, got " + item)
+		}
+		n, err := strconv.ParseInt(val, 0, 32)
+		if err != nil {
+			return errors.New("invalid value for " + key + ": " + val)
+		}
+		o := sockOption{Name: key, Value: int(n)}
+		if known, ok := sockoptNames[strings.ToLower(key)]; ok {
+			o.Level, o.Opt = known[0], known[1]
+		} else if level, opt, ok := strings.Cut(key, ":"); ok {
+			l, err1 := strconv.Atoi(level)
+			v, err2 := strconv.Atoi(opt)
+			if err1 != nil || err2 != nil {
+				return errors.New("invalid socket option " + key + " (expected LEVEL:OPTION numbers)")
+			}
+			o.Level, o.Opt = l, v
+		} else {
+			names := make([]string, 0, len(sockoptNames))
+			for name := range sockoptNames {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			return errors.New("unknown socket option " + key + " (expected one of " + strings.Join(names, ", ") + ", or LEVEL:OPTION)")
+		}
+		*f = append(*f, o)
+	}
+	return nil
+}
+
+// control applies --fwmark, --vrf and --sockopt to a socket before it
+// binds
+func (e *probeEnv) control(network, address string, c syscall.RawConn) error {
+	if e.mark == 0 && e.device == "" && len(e.sockopts) == 0 {
+		return nil
+	}
+	var opErr error
+	if err := c.Control(func(fd uintptr) { opErr = e.applySocketOptions(fd) }); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// listenUDP opens a UDP socket at laddr with the socket options applied
+// and kernel receive timestamps enabled
+func (e *probeEnv) listenUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: e.control}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	enableTimestamps(conn.(*net.UDPConn))
+	return conn.(*net.UDPConn), nil
+}
+
+// dialUDP connects a UDP socket from laddr to raddr with the socket
+// options applied and kernel receive timestamps enabled
+func (e *probeEnv) dialUDP(laddr, raddr *net.UDPAddr) (*net.UDPConn, error) {
+	dialer := net.Dialer{Control: e.control}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	conn, err := dialer.Dial("udp4", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	enableTimestamps(conn.(*net.UDPConn))
+	return conn.(*net.UDPConn), nil
+}
+
+// tcpDialer returns a dialer for TCP streams from the interface, if any,
+// with the socket options applied
+func (e *probeEnv) tcpDialer(timeout time.Duration) (*net.Dialer, error) {
+	dialer := &net.Dialer{Timeout: timeout, Control: e.control}
+	if e.iface != "" {
+		ip, err := interfaceIPv4(e.iface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// sockoptNames maps --sockopt names to their level and option
+var sockoptNames = map[string][2]int{
+	"ttl":          {syscall.IPPROTO_IP, syscall.IP_TTL},
+	"tos":          {syscall.IPPROTO_IP, syscall.IP_TOS},
+	"recvtos":      {syscall.IPPROTO_IP, syscall.IP_RECVTOS},
+	"recvttl":      {syscall.IPPROTO_IP, syscall.IP_RECVTTL},
+	"mtu-discover": {syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER},
+	"rcvbuf":       {syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+	"sndbuf":       {syscall.SOL_SOCKET, syscall.SO_SNDBUF},
+	"reuseaddr":    {syscall.SOL_SOCKET, syscall.SO_REUSEADDR},
+	"broadcast":    {syscall.SOL_SOCKET, syscall.SO_BROADCAST},
+	"priority":     {syscall.SOL_SOCKET, syscall.SO_PRIORITY},
+}
+
+// applySocketOptions sets the fwmark, the bound device and the --sockopt
+// options. The mark needs CAP_NET_ADMIN, binding to a device CAP_NET_RAW.
+func (e *probeEnv) applySocketOptions(fd uintptr) error {
+	if e.mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, e.mark); err != nil {
+			return errors.New("setting fwmark: " + err.Error())
+		}
+	}
+	if e.device != "" {
+		if err := syscall.BindToDevice(int(fd), e.device); err != nil {
+			return errors.New("binding to " + e.device + ": " + err.Error())
+		}
+	}
+	for _, o := range e.sockopts {
+		if err := syscall.SetsockoptInt(int(fd), o.Level, o.Opt, o.Value); err != nil {
+			return errors.New("setting " + o.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+import "errors"
+
+// sockoptNames is empty where sockets cannot be configured
+var sockoptNames = map[string][2]int{}
+
+// applySocketOptions refuses any setting this platform cannot apply
+func (e *probeEnv) applySocketOptions(fd uintptr) error {
+	return errors.New("socket options are not supported on this platform")
+}
@@ -0,0 +1,29 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// sockoptNames maps --sockopt names to their level and option
+var sockoptNames = map[string][2]int{
+	"ttl":       {syscall.IPPROTO_IP, syscall.IP_TTL},
+	"tos":       {syscall.IPPROTO_IP, syscall.IP_TOS},
+	"rcvbuf":    {syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+	"sndbuf":    {syscall.SOL_SOCKET, syscall.SO_SNDBUF},
+	"reuseaddr": {syscall.SOL_SOCKET, syscall.SO_REUSEADDR},
+	"broadcast": {syscall.SOL_SOCKET, syscall.SO_BROADCAST},
+}
+
+// applySocketOptions sets the --sockopt options; --fwmark and --vrf are
+// rejected before any socket is opened
+func (e *probeEnv) applySocketOptions(fd uintptr) error {
+	for _, o := range e.sockopts {
+		if err := syscall.SetsockoptInt(int(fd), o.Level, o.Opt, o.Value); err != nil {
+			return errors.New("setting " + o.Name + ": " + err.Error())
+		}
+	}
+	return nil
+}
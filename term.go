@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ANSI escape sequences used by the interactive views
+const (
+	ansiAltScreen  = "\x1b[?1049h"
+	ansiMainScreen = "\x1b[?1049l"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiCursorHome = "\x1b[H"
+	ansiClearToEOL = "\x1b[K"
+	ansiClearToEOS = "\x1b[J"
+	ansiBold       = "\x1b[1m"
+	ansiReset      = "\x1b[0m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+)
+
+// isTerminal reports whether f is attached to a character device
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorEnabled reports whether colored output should be written to f,
+// honoring the NO_COLOR convention (https://no-color.org)
+func colorEnabled(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// enableRawInput switches the terminal to unbuffered, no-echo input so single
+// key presses reach the program, and returns a func restoring the previous
+// settings. It relies on stty, so it fails where stty is unavailable.
+func enableRawInput() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return func() {}, err
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return func() {}, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+// stty runs stty against the controlling terminal on stdin
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
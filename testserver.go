@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"time"
+)
+
+// LevelShould is RFC 2119 SHOULD, which server requirements use more often
+// than the NAT ones
+const LevelShould = "SHOULD"
+
+// Attributes test-server uses to provoke the unknown-attribute handling of
+// RFC 5389 section 7.3.1: 0x7F01 is comprehension-required, 0xC0FF
+// comprehension-optional, and neither is assigned
+const (
+	AttrUnknownAttributes = 0x000A
+	attrTestRequired      = 0x7F01
+	attrTestOptional      = 0xC0FF
+
+	// testUnknownMethod is an unassigned method (0x0AB) in the request class
+	testUnknownMethod = 0x024B
+)
+
+// serverReply is one response received by test-server
+type serverReply struct {
+	msg  *StunMessage
+	raw  []byte
+	from *net.UDPAddr
+}
+
+// isError reports whether the reply is in the error response class
+func (r *serverReply) isError() bool {
+	return r.msg.Type&0x0110 == 0x0110
+}
+
+// errorCode returns the ERROR-CODE number, or 0 if absent or malformed
+func (r *serverReply) errorCode() int {
+	v, ok := findAttribute(r.msg, AttrErrorCode)
+	if !ok || len(v) < 4 {
+		return 0
+	}
+	return int(v[2]&0x07)*100 + int(v[3])
+}
+
+// mapped decodes the first attribute of the given address type
+func (r *serverReply) mapped(attrType uint16) *StunResult {
+	v, ok := findAttribute(r.msg, attrType)
+	if !ok {
+		return nil
+	}
+	if attrType == AttrXorMappedAddress {
+		return decodeAddress(v, r.raw[4:20])
+	}
+	return decodeAddress(v, nil)
+}
+
+// exchangeRaw sends req to server and returns the first datagram carrying its
+// transaction ID, from any source, retransmitting until timeout
+func exchangeRaw(conn *net.UDPConn, server *net.UDPAddr, req []byte, timeout time.Duration) (*serverReply, error) {
+	tid := req[4:20]
+	if binary.BigEndian.Uint32(req[4:8]) == MagicCookie {
+		tid = req[8:20]
+	}
+	deadline := time.Now().Add(timeout)
+	retransmit := 200 * time.Millisecond
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(req, server); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(minTime(time.Now().Add(retransmit), deadline))
+		retransmit *= 2
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			raw := append([]byte(nil), buf[:n]...)
+			msg, err := decodeStunMessage(raw)
+			if err != nil || !bytes.Equal(msg.TransactionID, tid) {
+				continue
+			}
+			return &serverReply{msg: msg, raw: raw, from: from}, nil
+		}
+	}
+	return nil, errors.New("no response")
+}
+
+// minTime returns the earlier of a and b
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// newTestRequest builds a binding request with the given attributes; legacy
+// omits the magic cookie as an RFC 3489 client would
+func newTestRequest(msgType uint16, legacy bool, attributes ...Attribute) []byte {
+	tid := make([]byte, 16)
+	rand.Read(tid)
+	if legacy {
+		msg := encodeStunMessage(msgType, tid[4:], attributes)
+		copy(msg[4:20], tid)
+		return msg
+	}
+	return encodeStunMessage(msgType, tid[:12], attributes)
+}
+
+// validFingerprint checks a message's FINGERPRINT, which must be its last
+// attribute. It reports present=false when there is none.
+func validFingerprint(raw []byte) (present, valid bool) {
+	if len(raw) < HeaderLength+8 || binary.BigEndian.Uint16(raw[len(raw)-8:]) != AttrFingerprint {
+		return false, false
+	}
+	want := binary.BigEndian.Uint32(raw[len(raw)-4:])
+	return true, crc32.ChecksumIEEE(raw[:len(raw)-8])^fingerprintXor == want
+}
+
+// testServer exercises a STUN server for RFC 5389 and RFC 5780 compliance
+// and returns one graded item per behavior
+func testServer(server *net.UDPAddr, timeout time.Duration) ([]ComplianceItem, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	item := func(rfc, section, level, title string) *ComplianceItem {
+		return &ComplianceItem{RFC: rfc, Req: section, Level: level, Title: title, Grade: GradeUntested}
+	}
+	var items []ComplianceItem
+	var errorReplies []*serverReply
+
+	// Plain RFC 5389 binding, which every later check builds on
+	printProgress("Sending a binding request...")
+	xor := item("5389", "15.2", LevelMust, "XOR-MAPPED-ADDRESS in binding responses")
+	basic, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, false), timeout)
+	if err != nil {
+		return nil, errors.New("no response to a plain binding request from " + server.String())
+	}
+	if basic.isError() {
+		errorReplies = append(errorReplies, basic)
+		xor.Grade, xor.Detail = GradeFail, "binding request rejected with "+strconv.Itoa(basic.errorCode())
+	} else if addr := basic.mapped(AttrXorMappedAddress); addr == nil {
+		xor.Grade, xor.Detail = GradeFail, "no XOR-MAPPED-ADDRESS"
+	} else {
+		xor.Grade, xor.Detail = GradePass, addr.AddrPort().String()
+		if plain := basic.mapped(AttrMappedAddress); plain != nil && (plain.IP != addr.IP || plain.Port != addr.Port) {
+			xor.Grade = GradeFail
+			xor.Detail += ", but MAPPED-ADDRESS says " + plain.AddrPort().String()
+		}
+	}
+	items = append(items, *xor)
+
+	printProgress("Sending an RFC 3489 request...")
+	legacy := item("5389", "12.2", LevelShould, "MAPPED-ADDRESS for RFC 3489 clients")
+	if reply, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, true), timeout); err != nil {
+		legacy.Grade, legacy.Detail = GradeFail, "no response to a request without the magic cookie"
+	} else if addr := reply.mapped(AttrMappedAddress); addr == nil || reply.isError() {
+		legacy.Grade, legacy.Detail = GradeFail, "response carries no MAPPED-ADDRESS"
+	} else {
+		legacy.Grade, legacy.Detail = GradePass, addr.AddrPort().String()
+	}
+	items = append(items, *legacy)
+
+	printProgress("Checking FINGERPRINT...")
+	fp := item("5389", "15.5", LevelMust, "FINGERPRINT, when sent, is valid")
+	if reply, err := exchangeRaw(conn, server, appendFingerprint(newTestRequest(BindingRequest, false)), timeout); err != nil {
+		fp.Grade, fp.Detail = GradeFail, "no response to a request carrying FINGERPRINT"
+	} else if present, valid := validFingerprint(reply.raw); !present {
+		fp.Grade, fp.Detail = GradeNA, "server does not add FINGERPRINT"
+	} else if !valid {
+		fp.Grade, fp.Detail = GradeFail, "CRC does not match the message"
+	} else {
+		fp.Grade = GradePass
+	}
+	items = append(items, *fp)
+
+	printProgress("Sending unknown attributes...")
+	required := item("5389", "7.3.1", LevelMust, "Unknown comprehension-required attribute rejected with 420")
+	reply, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, false, Attribute{Type: attrTestRequired, Value: []byte{1, 2, 3, 4}}), timeout)
+	switch {
+	case err != nil:
+		required.Grade, required.Detail = GradeFail, "request was dropped"
+	case !reply.isError():
+		required.Grade, required.Detail = GradeFail, "request was answered as if the attribute were understood"
+	case reply.errorCode() != 420:
+		errorReplies = append(errorReplies, reply)
+		required.Grade, required.Detail = GradeFail, "rejected with "+strconv.Itoa(reply.errorCode())
+	default:
+		errorReplies = append(errorReplies, reply)
+		required.Grade = GradePass
+		if v, ok := findAttribute(reply.msg, AttrUnknownAttributes); !ok || !bytes.Contains(v, []byte{0x7F, 0x01}) {
+			required.Grade, required.Detail = GradeFail, "UNKNOWN-ATTRIBUTES does not list 0x7F01"
+		}
+	}
+	items = append(items, *required)
+
+	optional := item("5389", "7.3.1", LevelMust, "Unknown comprehension-optional attribute ignored")
+	if reply, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, false, Attribute{Type: attrTestOptional, Value: []byte{1, 2, 3, 4}}), timeout); err != nil {
+		optional.Grade, optional.Detail = GradeFail, "request was dropped"
+	} else if reply.isError() {
+		errorReplies = append(errorReplies, reply)
+		optional.Grade, optional.Detail = GradeFail, "rejected with "+strconv.Itoa(reply.errorCode())
+	} else {
+		optional.Grade = GradePass
+	}
+	items = append(items, *optional)
+
+	printProgress("Sending an unknown method...")
+	method := item("5389", "7.3", LevelShould, "Request with an unknown method rejected with 400")
+	if reply, err := exchangeRaw(conn, server, newTestRequest(testUnknownMethod, false), timeout); err != nil {
+		method.Grade, method.Detail = GradeFail, "request was dropped"
+	} else if !reply.isError() {
+		method.Grade, method.Detail = GradeFail, "answered with a success response"
+	} else {
+		errorReplies = append(errorReplies, reply)
+		method.Grade = GradePass
+		if code := reply.errorCode(); code != 400 {
+			method.Grade, method.Detail = GradeFail, "rejected with "+strconv.Itoa(code)
+		}
+	}
+	items = append(items, *method)
+
+	codes := item("5389", "15.6", LevelMust, "Error responses carry a valid ERROR-CODE")
+	if len(errorReplies) > 0 {
+		codes.Grade = GradePass
+		for _, r := range errorReplies {
+			if code := r.errorCode(); code < 300 || code > 699 {
+				codes.Grade, codes.Detail = GradeFail, "missing or out-of-range ERROR-CODE in a 0x"+strconv.FormatUint(uint64(r.msg.Type), 16)+" response"
+				break
+			}
+		}
+	}
+	items = append(items, *codes)
+
+	// RFC 5780: the alternate address and CHANGE-REQUEST
+	other := basic.mapped(AttrOtherAddress)
+	if other == nil {
+		other = basic.mapped(AttrChangedAddress)
+	}
+	advertised := item("5780", "7.2", LevelShould, "OTHER-ADDRESS advertised")
+	changePort := item("5780", "7.2", LevelMust, "CHANGE-REQUEST change-port answered from the other port")
+	changeBoth := item("5780", "7.2", LevelMust, "CHANGE-REQUEST change-IP-and-port answered from the other address")
+	if other == nil {
+		advertised.Grade, advertised.Detail = GradeNA, "no OTHER-ADDRESS; the server does not support NAT behavior discovery"
+		// Without RFC 5780 support CHANGE-REQUEST is just an unknown
+		// comprehension-required attribute, and ignoring it makes clients
+		// misclassify their NAT
+		changePort.Title = "CHANGE-REQUEST rejected by a server without RFC 5780 support"
+		reply, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, false, Attribute{Type: AttrChangeRequest, Value: []byte{0, 0, 0, 2}}), timeout)
+		switch {
+		case err != nil:
+			changePort.Detail = "no response, which may be a NAT on this side filtering an answer from another port"
+		case reply.isError():
+			changePort.Grade, changePort.Detail = GradePass, "rejected with "+strconv.Itoa(reply.errorCode())
+		default:
+			changePort.Grade, changePort.Detail = GradeFail, "answered from "+reply.from.String()+" despite ignoring the change"
+		}
+		changeBoth.Grade = GradeNA
+	} else {
+		advertised.Grade, advertised.Detail = GradePass, other.AddrPort().String()
+		printProgress("Testing CHANGE-REQUEST...")
+		gradeChange(conn, server, 0x02, timeout, changePort, func(from *net.UDPAddr) bool {
+			return from.IP.Equal(server.IP) && from.Port != server.Port
+		})
+		gradeChange(conn, server, 0x06, timeout, changeBoth, func(from *net.UDPAddr) bool {
+			return !from.IP.Equal(server.IP) && from.Port != server.Port
+		})
+	}
+	items = append(items, *advertised, *changePort, *changeBoth)
+	return items, nil
+}
+
+// gradeChange sends a CHANGE-REQUEST with flags and grades where the answer
+// came from. Unlike detection it reads the first answer from any source, so
+// a server replying from the wrong address fails rather than timing out.
+func gradeChange(conn *net.UDPConn, server *net.UDPAddr, flags byte, timeout time.Duration, it *ComplianceItem, ok func(from *net.UDPAddr) bool) {
+	reply, err := exchangeRaw(conn, server, newTestRequest(BindingRequest, false, Attribute{Type: AttrChangeRequest, Value: []byte{0, 0, 0, flags}}), timeout)
+	switch {
+	case err != nil:
+		it.Grade, it.Detail = GradeFail, "no response (or filtered by a NAT on this side)"
+	case reply.isError():
+		it.Grade, it.Detail = GradeFail, "rejected with "+strconv.Itoa(reply.errorCode())
+	case !ok(reply.from):
+		it.Grade, it.Detail = GradeFail, "answered from "+reply.from.String()
+	default:
+		it.Grade, it.Detail = GradePass, "answered from "+reply.from.String()
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// UDP callback frames: the client asks the responder to send one packet back
+// after a delay, which only arrives if the NAT still holds the mapping
+const (
+	frameCallbackReq = 0xe6 // id, delay seconds
+	frameCallback    = 0xe7 // id
+)
+
+// Responder-side limits on pending callbacks
+const (
+	maxCallbackDelay   = 2 * time.Hour
+	maxPendingCallback = 1000
+)
+
+// idleLadder is the set of idle periods tested in parallel
+var idleLadder = []time.Duration{
+	15 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+}
+
+// IdleProbe is the outcome of one connection left idle for a set period
+type IdleProbe struct {
+	Protocol string        `json:"protocol"`
+	Idle     time.Duration `json:"idle"`
+	Alive    bool          `json:"alive"`
+	Failure  string        `json:"failure,omitempty"`
+}
+
+// IdleTimeout brackets a NAT idle timeout between the longest period that
+// survived and the shortest that did not
+type IdleTimeout struct {
+	Protocol   string        `json:"protocol"`
+	AtLeast    time.Duration `json:"at_least,omitempty"`
+	AtMost     time.Duration `json:"at_most,omitempty"`
+	Probes     []IdleProbe   `json:"probes"`
+	Incomplete bool          `json:"incomplete,omitempty"`
+}
+
+// bracketTimeout summarizes the probes of one protocol
+func bracketTimeout(protocol string, probes []IdleProbe) IdleTimeout {
+	t := IdleTimeout{Protocol: protocol}
+	for _, p := range probes {
+		if p.Protocol != protocol {
+			continue
+		}
+		t.Probes = append(t.Probes, p)
+		if p.Alive && p.Idle > t.AtLeast {
+			t.AtLeast = p.Idle
+		}
+		if !p.Alive && (t.AtMost == 0 || p.Idle < t.AtMost) {
+			t.AtMost = p.Idle
+		}
+	}
+	// A longer period surviving a shorter failure means something other than
+	// the idle timer dropped the shorter one
+	t.Incomplete = t.AtMost != 0 && t.AtLeast > t.AtMost
+	return t
+}
+
+// callbackReflector is the responder side of the UDP idle test
+type callbackReflector struct {
+	conn    *net.UDPConn
+	clock   natinfo.Clock
+	mu      sync.Mutex
+	pending int
+}
+
+// isCallbackFrame reports whether a datagram is a callback request
+func isCallbackFrame(buf []byte) bool {
+	return len(buf) >= 9 && buf[0] == frameCallbackReq
+}
+
+// handle schedules the callback a request asks for
+func (c *callbackReflector) handle(buf []byte, from *net.UDPAddr) {
+	delay := time.Duration(binary.BigEndian.Uint32(buf[5:9])) * time.Second
+	if delay > maxCallbackDelay {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending >= maxPendingCallback {
+		return
+	}
+	c.pending++
+
+	reply := append([]byte{frameCallback}, buf[1:5]...)
+	c.clock.AfterFunc(delay, func() {
+		c.conn.WriteToUDP(reply, from)
+		c.mu.Lock()
+		c.pending--
+		c.mu.Unlock()
+	})
+}
+
+// serveTCPEcho echoes lines on idle-test connections. Keepalives stay off:
+// they would refresh the NAT entry the test is timing.
+func serveTCPEcho(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: -1}
+	ln, err := lc.Listen(context.Background(), "tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					conn.Write(line)
+				}
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// probeUDPIdle registers a callback and waits for it
+func probeUDPIdle(target *net.UDPAddr, env *probeEnv, idle time.Duration) IdleProbe {
+	probe := IdleProbe{Protocol: "udp", Idle: idle}
+	conn, _, err := env.listenLocal()
+	if err != nil {
+		probe.Failure = err.Error()
+		return probe
+	}
+	defer conn.Close()
+
+	id := make([]byte, 4)
+	rand.Read(id)
+	req := append([]byte{frameCallbackReq}, id...)
+	req = binary.BigEndian.AppendUint32(req, uint32(idle/time.Second))
+	if _, err := conn.WriteToUDP(req, target); err != nil {
+		probe.Failure = err.Error()
+		return probe
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(idle + 5*time.Second))
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			probe.Failure = "callback never arrived"
+			return probe
+		}
+		if n == 5 && buf[0] == frameCallback && string(buf[1:5]) == string(id) && from.IP.Equal(target.IP) {
+			probe.Alive = true
+			return probe
+		}
+	}
+}
+
+// probeTCPIdle idles an echo connection, then checks it still carries data
+func probeTCPIdle(target string, env *probeEnv, idle time.Duration) IdleProbe {
+	probe := IdleProbe{Protocol: "tcp", Idle: idle}
+	fail := func(reason string) IdleProbe {
+		probe.Failure = reason
+		return probe
+	}
+
+	dialer := net.Dialer{KeepAlive: -1, Timeout: 5 * time.Second, Control: env.control}
+	if env.iface != "" {
+		ip, err := interfaceIPv4(env.iface)
+		if err != nil {
+			return fail(err.Error())
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	conn, err := dialer.Dial("tcp4", target)
+	if err != nil {
+		return fail(err.Error())
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	echo := func() error {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			return err
+		}
+		_, err := r.ReadString('\n')
+		return err
+	}
+	if err := echo(); err != nil {
+		return fail("initial echo failed: " + err.Error())
+	}
+
+	natinfo.Sleep(env.clock, idle)
+
+	err = echo()
+	switch {
+	case err == nil:
+		probe.Alive = true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF):
+		probe.Failure = "reset"
+	default:
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			probe.Failure = "blackholed"
+		} else {
+			probe.Failure = err.Error()
+		}
+	}
+	return probe
+}
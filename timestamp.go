@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// receivedAt returns when a datagram reached the host: its kernel receive
+// timestamp when there is a plausible one, otherwise the time it was read.
+// Kernel timestamps keep Go scheduler and GC delays out of RTTs. They are
+// wall-clock times, so an injected Clock always uses the read time.
+func (e *probeEnv) receivedAt(stamp, sent time.Time) time.Time {
+	now := e.clock.Now()
+	if _, system := e.clock.(natinfo.SystemClock); !system || stamp.IsZero() || stamp.Before(sent) || stamp.After(now) {
+		return now
+	}
+	return stamp
+}
+
+// arrival is when a datagram read with the control messages oob reached
+// the host: its kernel timestamp, or now. Packets read in one batch would
+// otherwise all seem to arrive at once.
+func arrival(oob []byte) time.Time {
+	if stamp := stampOf(oob); !stamp.IsZero() {
+		return stamp
+	}
+	return time.Now()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+)
+
+// enableTimestamps asks the kernel to stamp every received datagram with
+// its arrival time in nanoseconds
+func enableTimestamps(conn *net.UDPConn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+}
+
+// readStamped reads a datagram and returns its kernel receive timestamp,
+// or the zero time when there is none
+func readStamped(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, time.Time, error) {
+	var oob [128]byte
+	n, oobn, _, from, err := conn.ReadMsgUDP(buf, oob[:])
+	if err != nil {
+		return n, from, time.Time{}, err
+	}
+	return n, from, stampOf(oob[:oobn]), nil
+}
+
+// stampOf finds the receive timestamp among a datagram's control messages
+func stampOf(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SCM_TIMESTAMPNS {
+			continue
+		}
+		// struct timespec is two longs
+		switch len(m.Data) {
+		case 16:
+			sec := int64(binary.NativeEndian.Uint64(m.Data[0:8]))
+			nsec := int64(binary.NativeEndian.Uint64(m.Data[8:16]))
+			return time.Unix(sec, nsec)
+		case 8:
+			sec := int64(int32(binary.NativeEndian.Uint32(m.Data[0:4])))
+			nsec := int64(int32(binary.NativeEndian.Uint32(m.Data[4:8])))
+			return time.Unix(sec, nsec)
+		}
+	}
+	return time.Time{}
+}
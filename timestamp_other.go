@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// enableTimestamps is a no-op where kernel receive timestamps are not wired up
+func enableTimestamps(conn *net.UDPConn) {}
+
+// readStamped reads a datagram; it never has a kernel timestamp here
+func readStamped(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, time.Time, error) {
+	n, from, err := conn.ReadFromUDP(buf)
+	return n, from, time.Time{}, err
+}
+
+// stampOf never finds a receive timestamp here
+func stampOf(oob []byte) time.Time {
+	return time.Time{}
+}
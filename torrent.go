@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// DefaultTorrentPort is the traditional BitTorrent listen port
+const DefaultTorrentPort = 6881
+
+// BitTorrent preflight verdicts
+const (
+	// TorrentConnectable: peers and DHT nodes can reach the listen port
+	// over TCP and UDP
+	TorrentConnectable = "connectable"
+	// TorrentPartial: only one of TCP and UDP (µTP and DHT) gets in
+	TorrentPartial = "partial"
+	// TorrentMappable: the gateway maps the port; reachability was not
+	// tested
+	TorrentMappable = "mappable"
+	// TorrentFirewalled: nothing gets in, so the client only connects to
+	// peers that are themselves connectable and its DHT node is read-only
+	TorrentFirewalled = "firewalled"
+)
+
+// TorrentCheck is the outcome of the BitTorrent/DHT preflight
+type TorrentCheck struct {
+	ListenPort int `json:"listen_port"`
+	// UDP is the mapping of the listen port, which µTP and the DHT share;
+	// PortBound is false when the client held the port and a random one
+	// stood in
+	UDP       LocalMapping  `json:"udp"`
+	PortBound bool          `json:"port_bound"`
+	Ports     []InboundPort `json:"ports"`
+	PortMap   *PortMapCheck `json:"port_map,omitempty"`
+	ScanError string        `json:"scan_error,omitempty"`
+	NAT       *NatResult    `json:"nat,omitempty"`
+	// Flows is how the NAT coped with opening new flows at a DHT-like rate
+	Flows   *StressResult `json:"flows,omitempty"`
+	Rate    int           `json:"rate,omitempty"`
+	Verdict string        `json:"verdict"`
+	Notes   []string      `json:"notes"`
+}
+
+// checkTorrent runs the BitTorrent preflight: the UDP mapping of the listen
+// port, inbound TCP and UDP through the gateway, and optionally how many
+// new flows per second the NAT sustains
+func checkTorrent(opts DetectOptions, port int, gateway net.IP, order []string, responder string, flows, rate int) *TorrentCheck {
+	check := &TorrentCheck{ListenPort: port}
+	timeout := opts.PrimaryTimeout
+	env := opts.probeEnv()
+
+	printProgress("Probing the listen port's UDP mapping...")
+	if servers, err := mappingServers(opts); err != nil {
+		check.UDP = LocalMapping{Local: port, Error: err.Error()}
+	} else {
+		conn, _, err := env.bindPort(port)
+		if err == nil {
+			check.PortBound = true
+		} else {
+			conn, _, err = env.listenLocal()
+		}
+		if err != nil {
+			check.UDP = LocalMapping{Local: port, Error: err.Error()}
+		} else {
+			check.UDP = probeLocalMapping(env, conn, servers, timeout)
+			conn.Close()
+		}
+	}
+
+	printProgress("Detecting NAT behavior...")
+	if result, err := detectNATType(opts); err == nil {
+		check.NAT = result
+	}
+
+	printProgress("Asking the gateway to map the listen port...")
+	check.Ports = []InboundPort{{Protocol: "tcp", Port: port}, {Protocol: "udp", Port: port}}
+	pm, scanErr := openInbound(env, check.Ports, gateway, order, responder, timeout)
+	check.PortMap, check.ScanError = &pm, scanErr
+
+	// Without UDP at all every flow fails, which says nothing about the NAT
+	if flows > 0 && check.UDP.Public != nil {
+		printProgress("Opening " + strconv.Itoa(flows) + " flows at " + strconv.Itoa(rate) + " per second, as DHT lookups do...")
+		if result, err := stressFlows(opts, flows, rate); err == nil {
+			check.Flows, check.Rate = result, rate
+		} else {
+			check.Notes = append(check.Notes, "The flow rate test could not run: "+err.Error())
+		}
+	}
+
+	check.Verdict = torrentVerdict(check)
+	return check
+}
+
+// torrentVerdict sets the verdict and explains it in BitTorrent terms
+func torrentVerdict(c *TorrentCheck) string {
+	var tcp, udp InboundPort
+	for _, p := range c.Ports {
+		if p.Protocol == "tcp" {
+			tcp = p
+		} else {
+			udp = p
+		}
+	}
+	mapped := func(p InboundPort) bool { return p.Mapping != nil && p.Mapping.Error == "" }
+	portName := strconv.Itoa(c.ListenPort)
+
+	verdict := TorrentFirewalled
+	switch {
+	case tcp.State == PortOpen && udp.State == PortOpen:
+		verdict = TorrentConnectable
+		if mapped(tcp) || mapped(udp) {
+			c.Notes = append(c.Notes, "The port was reachable while nat-info mapped it: enable UPnP or NAT-PMP in the client, or forward TCP and UDP "+portName+" permanently.")
+		}
+	case tcp.State == PortOpen:
+		verdict = TorrentPartial
+		c.Notes = append(c.Notes, "TCP gets in but UDP does not: incoming µTP connections and DHT queries are lost. Forward UDP "+portName+" as well.")
+	case udp.State == PortOpen:
+		verdict = TorrentPartial
+		c.Notes = append(c.Notes, "UDP gets in but TCP does not: peers that only speak TCP cannot connect. Forward TCP "+portName+" as well.")
+	case tcp.State != "":
+		c.Notes = append(c.Notes, "Nothing reaches the listen port from outside: the client can only connect to peers that are themselves connectable, and its DHT node cannot answer queries. Forward TCP and UDP "+portName+" to this host, or enable UPnP/NAT-PMP on the router.")
+	case mapped(tcp) && mapped(udp):
+		verdict = TorrentMappable
+		c.Notes = append(c.Notes, "The router maps the listen port automatically; add --responder to confirm peers can reach it.")
+	default:
+		c.Notes = append(c.Notes, "Nothing maps the listen port automatically; forward TCP and UDP "+portName+" to this host, then add --responder to confirm peers can reach it.")
+	}
+	if c.ScanError != "" {
+		c.Notes = append(c.Notes, "The outside check failed: "+c.ScanError)
+	}
+
+	switch m := c.UDP; {
+	case m.Public == nil:
+		c.Notes = append(c.Notes, "UDP from the listen port got no answer: µTP and the DHT cannot work, leaving TCP peers from trackers only.")
+	case m.Second != nil && !m.Consistent:
+		c.Notes = append(c.Notes, "The listen port's UDP mapping differs per destination (symmetric NAT): DHT nodes each see a different port, so none can reach this node, and µTP hole punching between firewalled peers fails.")
+	case !m.Preserved:
+		c.Notes = append(c.Notes, "The NAT rewrites the listen port ("+strconv.Itoa(m.Local)+" leaves as "+strconv.Itoa(m.Public.Port)+"): peers learn the wrong port unless the client announces the one UPnP or NAT-PMP mapped.")
+	}
+	if !c.PortBound {
+		c.Notes = append(c.Notes, "Port "+portName+" is held by a running program, likely the client itself; the UDP mapping was probed from another port.")
+	}
+	if c.NAT != nil && c.NAT.Filtering == BehaviorEndpointIndependent {
+		c.Notes = append(c.Notes, "The NAT accepts packets from anyone once the client has sent (endpoint-independent filtering), so DHT nodes it has contacted can reach it even without a forward.")
+	}
+
+	if f := c.Flows; f != nil {
+		rate := f.rateText() + " new flows per second"
+		switch {
+		// A few losses are the network's; more than one in twenty is the NAT
+		case f.Stopped != "" || (f.Opened-f.Succeeded)*20 > f.Opened:
+			at := strconv.Itoa(f.FirstFailure - 1)
+			c.Notes = append(c.Notes, "The NAT started dropping new flows after "+at+" at "+rate+": a busy DHT and many peers will exhaust it, slowing every device on the network. Lower the client's global connection limit and DHT and half-open connection rates.")
+		case f.Recycled+f.Expired > 0:
+			c.Notes = append(c.Notes, "At "+rate+" the NAT recycled or expired "+strconv.Itoa(f.Recycled+f.Expired)+" earlier mappings: long-lived peer connections may drop while the DHT is busy. Lower the client's connection limit.")
+		default:
+			c.Notes = append(c.Notes, "The NAT kept up with "+strconv.Itoa(f.Succeeded)+" new flows at "+rate+", enough for DHT participation.")
+		}
+	}
+	return verdict
+}
+
+// defaultTorrentRate is the flow test's default rate: 30 new flows per
+// second, a fraction of what a busy client opens
+const defaultTorrentRate = 30
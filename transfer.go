@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Transfer frame types. STUN messages start with two zero bits, so these
+// cannot be confused with late connectivity checks.
+const (
+	frameData = 0xd1
+	frameAck  = 0xd2
+)
+
+const (
+	transferChunk  = 1100 // payload bytes per datagram, clear of common MTUs
+	transferWindow = 64   // unacknowledged datagrams in flight
+	transferRTO    = 250 * time.Millisecond
+	transferIdle   = 10 * time.Second
+)
+
+// TransferStats summarizes a file transfer over the direct path
+type TransferStats struct {
+	Bytes       int64         `json:"bytes"`
+	Elapsed     time.Duration `json:"elapsed"`
+	Retransmits int           `json:"retransmits"`
+}
+
+// Goodput returns the payload rate in bits per second
+func (s TransferStats) Goodput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) * 8 / s.Elapsed.Seconds()
+}
+
+func dataFrame(seq uint32, payload []byte) []byte {
+	frame := []byte{frameData}
+	frame = binary.BigEndian.AppendUint32(frame, seq)
+	return append(frame, payload...)
+}
+
+func ackFrame(next uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{frameAck}, next)
+}
+
+// sendFile streams r to peer with go-back-N over a fixed window. An empty
+// data frame marks the end of the file.
+func sendFile(conn *net.UDPConn, peer *net.UDPAddr, r io.Reader) (TransferStats, error) {
+	var stats TransferStats
+	var base, next uint32
+	var window [][]byte // chunks base..next-1, kept for retransmission
+	eof := false
+	finSeq := uint32(0)
+
+	start := time.Now()
+	progress := start
+	buf := make([]byte, 2048)
+
+	for {
+		for !eof && next < base+transferWindow {
+			chunk := make([]byte, transferChunk)
+			n, err := io.ReadFull(r, chunk)
+			chunk = chunk[:n]
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if n > 0 {
+					window = append(window, chunk)
+					conn.WriteToUDP(dataFrame(next, chunk), peer)
+					stats.Bytes += int64(n)
+					next++
+				}
+				eof = true
+				finSeq = next
+				window = append(window, nil)
+				conn.WriteToUDP(dataFrame(next, nil), peer)
+				next++
+				break
+			}
+			if err != nil {
+				return stats, err
+			}
+			window = append(window, chunk)
+			conn.WriteToUDP(dataFrame(next, chunk), peer)
+			stats.Bytes += int64(n)
+			next++
+		}
+
+		conn.SetReadDeadline(time.Now().Add(transferRTO))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				return stats, err
+			}
+			if time.Since(progress) > transferIdle {
+				return stats, errors.New("peer stopped acknowledging")
+			}
+			// Go back N: resend everything unacknowledged
+			for i, chunk := range window {
+				conn.WriteToUDP(dataFrame(base+uint32(i), chunk), peer)
+				stats.Retransmits++
+			}
+			continue
+		}
+		if n != 5 || buf[0] != frameAck || !from.IP.Equal(peer.IP) || from.Port != peer.Port {
+			continue
+		}
+
+		ack := binary.BigEndian.Uint32(buf[1:5])
+		if ack > base && ack <= next {
+			window = window[ack-base:]
+			base = ack
+			progress = time.Now()
+		}
+		if eof && base > finSeq {
+			stats.Elapsed = time.Since(start)
+			return stats, nil
+		}
+	}
+}
+
+// receiveFile writes the in-order payload from peer to w, acknowledging
+// cumulatively, until the end-of-file frame arrives
+func receiveFile(conn *net.UDPConn, peer *net.UDPAddr, w io.Writer) (TransferStats, error) {
+	var stats TransferStats
+	var expected uint32
+	var start time.Time
+	buf := make([]byte, 2048)
+	done := false
+	var lingerUntil time.Time
+
+	conn.SetReadDeadline(time.Now().Add(transferIdle))
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if done && errors.As(err, &netErr) && netErr.Timeout() {
+				return stats, nil
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return stats, errors.New("no data from peer for " + transferIdle.String())
+			}
+			return stats, err
+		}
+		if n < 5 || buf[0] != frameData || !from.IP.Equal(peer.IP) || from.Port != peer.Port {
+			continue
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		seq := binary.BigEndian.Uint32(buf[1:5])
+		if seq == expected && !done {
+			payload := buf[5:n]
+			if len(payload) == 0 {
+				done = true
+				stats.Elapsed = time.Since(start)
+				// Keep acknowledging in case the final ack is lost
+				lingerUntil = time.Now().Add(time.Second)
+			} else if _, err := w.Write(payload); err != nil {
+				return stats, err
+			} else {
+				stats.Bytes += int64(len(payload))
+			}
+			expected++
+		}
+		conn.WriteToUDP(ackFrame(expected), peer)
+
+		if done {
+			conn.SetReadDeadline(lingerUntil)
+		} else {
+			conn.SetReadDeadline(time.Now().Add(transferIdle))
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TURN methods and attributes (RFC 8656)
+const (
+	AllocateRequest         = 0x0003
+	AllocateResponse        = 0x0103
+	RefreshRequest          = 0x0004
+	CreatePermissionRequest = 0x0008
+	SendIndication          = 0x0016
+	DataIndication          = 0x0017
+
+	AttrLifetime           = 0x000D
+	AttrXorPeerAddress     = 0x0012
+	AttrData               = 0x0013
+	AttrRealm              = 0x0014
+	AttrNonce              = 0x0015
+	AttrXorRelayedAddress  = 0x0016
+	AttrRequestedTransport = 0x0019
+)
+
+// turnInitialRTO is the first retransmission interval of a TURN request
+// over UDP; it doubles after every send
+const turnInitialRTO = 500 * time.Millisecond
+
+// turnConn carries STUN messages to one TURN server, over a UDP socket or a
+// TCP or TLS stream
+type turnConn struct {
+	udp    *net.UDPConn
+	server *net.UDPAddr
+	stream net.Conn
+}
+
+// dialTurn connects to a TURN or STUN server from e's interface with its
+// socket options. transport is udp, tcp or tls; serverName verifies a TLS
+// server's certificate.
+func (e *probeEnv) dialTurn(transport, addr, serverName string, timeout time.Duration) (*turnConn, error) {
+	if transport != "udp" && transport != "tcp" && transport != "tls" {
+		return nil, errors.New("unknown transport " + transport)
+	}
+	endpoints, err := e.resolveServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	server := endpoints[0].Addr
+	if transport == "udp" {
+		conn, _, err := e.listenLocal()
+		if err != nil {
+			return nil, err
+		}
+		return &turnConn{udp: conn, server: server}, nil
+	}
+
+	dialer, err := e.tcpDialer(timeout)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if transport == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp4", server.String(), &tls.Config{ServerName: serverName})
+	} else {
+		conn, err = dialer.Dial("tcp4", server.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &turnConn{stream: conn}, nil
+}
+
+func (c *turnConn) Close() error {
+	if c.udp != nil {
+		return c.udp.Close()
+	}
+	return c.stream.Close()
+}
+
+func (c *turnConn) send(msg []byte) error {
+	if c.udp != nil {
+		_, err := c.udp.WriteToUDP(msg, c.server)
+		return err
+	}
+	_, err := c.stream.Write(msg)
+	return err
+}
+
+// recv reads the next STUN message from the server until deadline. Over
+// UDP, datagrams from anyone else are skipped; over a stream, messages are
+// delimited by their length field.
+func (c *turnConn) recv(deadline time.Time) ([]byte, error) {
+	if c.udp != nil {
+		c.udp.SetReadDeadline(deadline)
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := c.udp.ReadFromUDP(buf)
+			if err != nil {
+				return nil, err
+			}
+			if from.IP.Equal(c.server.IP) && from.Port == c.server.Port {
+				return buf[:n], nil
+			}
+		}
+	}
+	c.stream.SetReadDeadline(deadline)
+	header := make([]byte, HeaderLength)
+	if _, err := io.ReadFull(c.stream, header); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, HeaderLength+int(binary.BigEndian.Uint16(header[2:4])))
+	copy(msg, header)
+	if _, err := io.ReadFull(c.stream, msg[HeaderLength:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// roundTrip sends a request and returns the response with its transaction
+// ID, retransmitting over UDP until timeout. Indications that arrive in
+// between are handed to onIndication when set.
+func (c *turnConn) roundTrip(msg []byte, timeout time.Duration, onIndication func(*StunMessage, []byte)) (*StunMessage, []byte, time.Duration, error) {
+	tid := msg[8:20]
+	start := time.Now()
+	deadline := start.Add(timeout)
+	rto := turnInitialRTO
+	for {
+		if err := c.send(msg); err != nil {
+			return nil, nil, 0, err
+		}
+		wait := deadline
+		if c.udp != nil && time.Now().Add(rto).Before(deadline) {
+			wait = time.Now().Add(rto)
+		}
+		for {
+			buf, err := c.recv(wait)
+			if err != nil {
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() && time.Now().Before(deadline) {
+					break
+				}
+				return nil, nil, 0, err
+			}
+			resp, err := decodeStunMessage(buf)
+			if err != nil || resp.Cookie != MagicCookie {
+				continue
+			}
+			if string(resp.TransactionID) != string(tid) {
+				if resp.Type&0x0110 == 0x0010 && onIndication != nil {
+					onIndication(resp, buf)
+				}
+				continue
+			}
+			return resp, buf, time.Since(start), nil
+		}
+		rto *= 2
+	}
+}
+
+// turnClient holds a TURN allocation authenticated with the long-term
+// credential mechanism
+type turnClient struct {
+	conn     *turnConn
+	username string
+	password string
+	timeout  time.Duration
+
+	realm, nonce []byte
+	key          []byte
+
+	// data receives the payloads of Data indications
+	data chan turnData
+}
+
+// turnData is a datagram a peer sent to the relayed address
+type turnData struct {
+	from    *StunResult
+	payload []byte
+}
+
+// TurnAllocation is the outcome of a successful Allocate
+type TurnAllocation struct {
+	Relayed  *StunResult   `json:"relayed"`
+	Mapped   *StunResult   `json:"mapped,omitempty"`
+	Lifetime time.Duration `json:"lifetime"`
+	RTT      time.Duration `json:"rtt"`
+}
+
+// turnError is an error response from a TURN server
+type turnError struct {
+	Code   int
+	Reason string
+}
+
+func (e *turnError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+// responseError returns the ERROR-CODE of an error response, if any
+func responseError(msg *StunMessage) *turnError {
+	if msg.Type&0x0110 != 0x0110 {
+		return nil
+	}
+	e := &turnError{Code: 0, Reason: "error response"}
+	if v, ok := findAttribute(msg, AttrErrorCode); ok && len(v) >= 4 {
+		e.Code = int(v[2]&0x7)*100 + int(v[3])
+		e.Reason = string(v[4:])
+	}
+	return e
+}
+
+func newTurnClient(conn *turnConn, username, password string, timeout time.Duration) *turnClient {
+	return &turnClient{conn: conn, username: username, password: password, timeout: timeout, data: make(chan turnData, 8)}
+}
+
+// request sends an authenticated request once the realm and nonce are
+// known, retrying once with a fresh nonce on 438 Stale Nonce and learning
+// them from a 401 on the first request
+func (t *turnClient) request(method uint16, attrs []Attribute) (*StunMessage, []byte, time.Duration, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		tid := make([]byte, 12)
+		rand.Read(tid)
+		msg := encodeStunMessage(method, tid, attrs)
+		if t.key != nil {
+			msg = appendAttribute(msg, AttrUsername, []byte(t.username))
+			msg = appendAttribute(msg, AttrRealm, t.realm)
+			msg = appendAttribute(msg, AttrNonce, t.nonce)
+			msg = appendIntegrity(msg, t.key)
+		}
+		msg = appendFingerprint(msg)
+
+		resp, buf, rtt, err := t.conn.roundTrip(msg, t.timeout, t.indication)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		terr := responseError(resp)
+		if terr == nil {
+			return resp, buf, rtt, nil
+		}
+		switch {
+		case terr.Code == 401 && t.key == nil, terr.Code == 438:
+			realm, _ := findAttribute(resp, AttrRealm)
+			nonce, ok := findAttribute(resp, AttrNonce)
+			if !ok {
+				return nil, nil, 0, terr
+			}
+			if realm != nil {
+				t.realm = append([]byte(nil), realm...)
+			}
+			t.nonce = append([]byte(nil), nonce...)
+			if t.username == "" {
+				return nil, nil, 0, errors.New("server requires credentials (401 Unauthorized)")
+			}
+			sum := md5.Sum([]byte(t.username + ":" + string(t.realm) + ":" + t.password))
+			t.key = sum[:]
+			continue
+		}
+		return nil, nil, 0, terr
+	}
+	return nil, nil, 0, errors.New("server kept rejecting the credentials")
+}
+
+// indication passes Data indications on to t.data, dropping them when
+// nobody is reading
+func (t *turnClient) indication(msg *StunMessage, buf []byte) {
+	if msg.Type != DataIndication {
+		return
+	}
+	peer, _ := findAttribute(msg, AttrXorPeerAddress)
+	payload, ok := findAttribute(msg, AttrData)
+	if !ok {
+		return
+	}
+	d := turnData{from: decodeAddress(peer, buf[4:20]), payload: append([]byte(nil), payload...)}
+	select {
+	case t.data <- d:
+	default:
+	}
+}
+
+// allocate requests a UDP relayed address
+func (t *turnClient) allocate() (*TurnAllocation, error) {
+	resp, buf, rtt, err := t.request(AllocateRequest, []Attribute{{Type: AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}})
+	if err != nil {
+		return nil, err
+	}
+	relayed, ok := findAttribute(resp, AttrXorRelayedAddress)
+	if !ok {
+		return nil, errors.New("allocate response has no XOR-RELAYED-ADDRESS")
+	}
+	a := &TurnAllocation{Relayed: decodeAddress(relayed, buf[4:20]), RTT: rtt}
+	if a.Relayed == nil {
+		return nil, errors.New("allocate response has a malformed XOR-RELAYED-ADDRESS")
+	}
+	if mapped, ok := findAttribute(resp, AttrXorMappedAddress); ok {
+		a.Mapped = decodeAddress(mapped, buf[4:20])
+	}
+	if v, ok := findAttribute(resp, AttrLifetime); ok && len(v) == 4 {
+		a.Lifetime = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return a, nil
+}
+
+// permit installs a permission for peer's IP on the allocation
+func (t *turnClient) permit(peer *net.UDPAddr) error {
+	// An IPv6 XOR-PEER-ADDRESS is keyed by the transaction ID, which
+	// request picks per attempt
+	if peer.IP.To4() == nil {
+		return errors.New("permissions are only supported for IPv4 peers")
+	}
+	_, _, _, err := t.request(CreatePermissionRequest, []Attribute{{Type: AttrXorPeerAddress, Value: appendXorAddress(nil, peer, nil)}})
+	return err
+}
+
+// release deletes the allocation; errors are ignored since the server
+// frees it after its lifetime anyway
+func (t *turnClient) release() {
+	t.request(RefreshRequest, []Attribute{{Type: AttrLifetime, Value: []byte{0, 0, 0, 0}}})
+}
+
+// await reads indications until a peer's payload arrives or timeout passes
+func (t *turnClient) await(payload []byte, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		buf, err := t.conn.recv(deadline)
+		if err != nil {
+			return false
+		}
+		if msg, err := decodeStunMessage(buf); err == nil {
+			t.indication(msg, buf)
+		}
+		select {
+		case d := <-t.data:
+			if string(d.payload) == string(payload) {
+				return true
+			}
+		default:
+		}
+	}
+	return false
+}
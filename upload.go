@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// UploadTimeout bounds one result upload to a collect server
+const UploadTimeout = 15 * time.Second
+
+// What --report-redact can remove from an uploaded result
+const (
+	RedactPublicIP = "public-ip"
+	RedactLocal    = "local"
+	RedactHostname = "hostname"
+)
+
+// reportFlags configure sending results to a `nat-info collect` server
+type reportFlags struct {
+	url    *string
+	token  *string
+	ca     *string
+	redact *string
+}
+
+func addReportFlags(fs *flag.FlagSet) *reportFlags {
+	return &reportFlags{
+		url:    fs.String("report-to", "", "upload each result to this nat-info collect endpoint, e.g. https://collector:8443/upload?site=hq"),
+		token:  fs.String("report-token", "", "bearer token for --report-to"),
+		ca:     fs.String("report-ca", "", "PEM file of CA certificates to verify the --report-to server with instead of the system pool"),
+		redact: fs.String("report-redact", RedactPublicIP+","+RedactLocal, "comma-separated parts to strip from uploads: public-ip (salted stand-ins), local (addresses, routes, interface, Wi-Fi identity), hostname (salted hash), or none"),
+	}
+}
+
+// resultUploader posts results to a collect server
+type resultUploader struct {
+	url    string
+	token  string
+	salt   string
+	redact map[string]bool
+	client *http.Client
+}
+
+// uploader validates the flags and returns nil when --report-to is unset.
+// salt keys the stand-ins, so hosts given the same --fingerprint-salt
+// hash an address to the same value.
+func (f *reportFlags) uploader(salt string) (*resultUploader, error) {
+	if *f.url == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(*f.url)
+	if err != nil {
+		return nil, errors.New("invalid --report-to: " + err.Error())
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && isLoopbackHost(u.Hostname()):
+	default:
+		return nil, errors.New("invalid --report-to: the token needs https, except to a loopback address")
+	}
+	if *f.token == "" {
+		return nil, errors.New("--report-to needs --report-token")
+	}
+
+	up := &resultUploader{url: *f.url, token: *f.token, salt: salt, redact: make(map[string]bool)}
+	for _, part := range strings.Split(*f.redact, ",") {
+		switch part = strings.TrimSpace(part); part {
+		case RedactPublicIP, RedactLocal, RedactHostname:
+			up.redact[part] = true
+		case "none", "":
+		default:
+			return nil, errors.New("invalid --report-redact: " + part + " (expected public-ip, local, hostname or none)")
+		}
+	}
+	if up.salt == "" {
+		up.salt = installSalt()
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *f.ca != "" {
+		pem, err := os.ReadFile(*f.ca)
+		if err != nil {
+			return nil, errors.New("invalid --report-ca: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in --report-ca " + *f.ca)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	up.client = &http.Client{Transport: transport, Timeout: UploadTimeout}
+	return up, nil
+}
+
+// isLoopbackHost reports whether host names the local machine
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// upload sends one redacted result
+func (u *resultUploader) upload(result *NatResult) error {
+	body, err := u.redacted(result)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), UploadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+u.token)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector answered " + resp.Status)
+	}
+	return nil
+}
+
+// handle uploads each successful watch result
+func (u *resultUploader) handle(ev WatchEvent) {
+	if ev.Result == nil {
+		return
+	}
+	if err := u.upload(ev.Result); err != nil {
+		printProgress("Upload to " + u.url + " failed: " + err.Error())
+	}
+}
+
+// redacted encodes a copy of result with the chosen parts removed. The
+// NAT type, behaviors, confidence and share code are always kept; they
+// are what the collector aggregates.
+func (u *resultUploader) redacted(result *NatResult) ([]byte, error) {
+	data, err := json.Marshal(result)
+	if err != nil || len(u.redact) == 0 {
+		return data, err
+	}
+	var r NatResult
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	if u.redact[RedactLocal] {
+		r.LocalIP = ""
+		r.LocalPort = 0
+		r.Routes = nil
+		r.Conntrack = nil
+		if r.Run != nil {
+			r.Run.Interface = ""
+		}
+		if r.Link != nil {
+			r.Link.Interface, r.Link.SSID, r.Link.BSSID, r.Link.APN = "", "", "", ""
+		}
+		if r.Gateway != nil {
+			r.Gateway.Target = ""
+		}
+	}
+	if u.redact[RedactHostname] && r.Run != nil && r.Run.Hostname != "" {
+		r.Run.Hostname = u.digest("host", r.Run.Hostname)
+	}
+
+	var public []string
+	if u.redact[RedactPublicIP] {
+		// Reverse DNS names usually spell out the address
+		if a := r.Access; a != nil && a.PTR != "" {
+			for i, hint := range a.Hints {
+				a.Hints[i] = strings.ReplaceAll(hint, a.PTR, "(redacted)")
+			}
+			a.PTR = ""
+		}
+		public = publicIPsOf(&r)
+	}
+
+	data, err = json.Marshal(&r)
+	if err != nil || len(public) == 0 {
+		return data, err
+	}
+	standIns := make(map[string]string, len(public))
+	for _, ip := range public {
+		standIns[ip] = u.standIn(ip)
+	}
+	// Whole addresses only, so 1.2.3.4 does not clip 11.2.3.45
+	return addrToken.ReplaceAllFunc(data, func(ip []byte) []byte {
+		if s, ok := standIns[string(ip)]; ok {
+			return []byte(s)
+		}
+		return ip
+	}), nil
+}
+
+// publicIPsOf lists the reflexive addresses a result reports
+func publicIPsOf(r *NatResult) []string {
+	seen := make(map[string]bool)
+	add := func(ip netip.Addr) {
+		if ip.Is4() && !ip.IsLoopback() && !ip.IsPrivate() {
+			seen[ip.String()] = true
+		}
+	}
+	if r.Public != nil {
+		add(r.Public.IP)
+	}
+	for _, e := range r.Evidence {
+		if e.Mapped != nil {
+			add(e.Mapped.IP)
+		}
+	}
+	for _, o := range r.ObservedIPs {
+		ip, _ := netip.ParseAddr(o.IP)
+		add(ip)
+	}
+	if p := r.Proxy; p != nil {
+		for _, a := range []ReflectorAnswer{p.UDP, p.TCP} {
+			for _, s := range []string{a.Mapped, a.Plain} {
+				ap, _ := netip.ParseAddrPort(s)
+				add(ap.Addr())
+			}
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for ip := range seen {
+		out = append(out, ip)
+	}
+	return out
+}
+
+// standIn maps a public IPv4 address to a salted stand-in in the reserved
+// 240.0.0.0/4 block, which keeps the JSON valid and lets a collector count
+// distinct addresses without learning them
+func (u *resultUploader) standIn(ip string) string {
+	sum, _ := hex.DecodeString(u.digest("ip", ip))
+	v := binary.BigEndian.Uint32(sum)&0x0fffffff | 0xf0000000
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b).String()
+}
+
+// digest is a short salted hash of value, kept apart per kind
+func (u *resultUploader) digest(kind, value string) string {
+	mac := hmac.New(sha256.New, []byte(u.salt))
+	mac.Write([]byte(kind + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
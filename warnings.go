@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// WarningCode is a machine-readable caveat about a detection result
+type WarningCode string
+
+const (
+	WarnServerUnresolved      WarningCode = "server-unresolved"
+	WarnPrivateServerAddress  WarningCode = "private-server-address"
+	WarnChangeRequestIgnored  WarningCode = "change-request-ignored"
+	WarnSingleFilteringServer WarningCode = "single-filtering-server"
+	WarnMappingUntested       WarningCode = "mapping-untested"
+	WarnFilteringUntested     WarningCode = "filtering-untested"
+	WarnDuplicatedPackets     WarningCode = "duplicated-packets"
+)
+
+// Warning is a caveat found during detection. The type and confidence
+// summarize the result; warnings say what it may have missed.
+type Warning struct {
+	Code    WarningCode `json:"code"`
+	Server  string      `json:"server,omitempty"`
+	Message string      `json:"message"`
+}
+
+// warn records a warning once per code and server
+func (r *NatResult) warn(code WarningCode, server, message string) {
+	for _, w := range r.Warnings {
+		if w.Code == code && w.Server == server {
+			return
+		}
+	}
+	r.Warnings = append(r.Warnings, Warning{Code: code, Server: server, Message: message})
+}
+
+// collectWarnings derives the warnings that follow from the recorded
+// evidence once the type is settled
+func (r *NatResult) collectWarnings() {
+	// A hostname that resolves into private or loopback space is usually a
+	// captive portal, DNS filter or split-horizon resolver, not the server
+	for _, e := range r.Evidence {
+		if net.ParseIP(e.Server) != nil {
+			continue
+		}
+		addr, err := netip.ParseAddrPort(e.Addr)
+		if err != nil {
+			continue
+		}
+		if ip := addr.Addr(); ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			r.warn(WarnPrivateServerAddress, e.Server, "DNS returned the non-public address "+ip.String()+" for "+e.Server)
+		}
+	}
+
+	// Duplication hurts media streams even when every test passes
+	if c := r.Responses; c != nil && c.Duplicates > 0 {
+		r.warn(WarnDuplicatedPackets, "", strconv.Itoa(c.Duplicates)+" duplicate STUN answers arrived over "+strconv.Itoa(c.Answered)+" transactions: the NAT or the path duplicates packets, which media streams feel")
+	}
+
+	switch r.Type {
+	case NATFullCone, NATRestrictedCone, NATPortRestricted:
+		if r.countPassed(TestMapping) == 0 {
+			r.warn(WarnMappingUntested, "", "no second server answered, so endpoint-independent mapping is assumed rather than measured")
+		}
+	}
+
+	// Full and Restricted Cone rest on an answer getting through; the
+	// stricter types only on answers that did not
+	switch r.Type {
+	case NATOpen, NATFullCone, NATRestrictedCone, NATPortRestricted, NATSymmetricFirewall:
+		// Servers that ignored CHANGE-REQUEST tested nothing
+		n := r.filteringServers()
+		for _, w := range r.Warnings {
+			if w.Code == WarnChangeRequestIgnored {
+				n--
+			}
+		}
+		switch {
+		case n == 0:
+			r.warn(WarnFilteringUntested, "", "no RFC 3489 or RESPONSE-PORT server could test filtering, so the filtering subtype is a guess")
+		case n == 1 && (r.Type == NATPortRestricted || r.Type == NATSymmetricFirewall):
+			r.warn(WarnSingleFilteringServer, "", "only one RFC 3489 server tested filtering, so the subtype rests on a single server")
+		}
+	}
+}
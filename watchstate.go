@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchState is what watch keeps on disk so a restart picks up change
+// detection where it left off instead of reporting every property as new
+type watchState struct {
+	Saved time.Time  `json:"saved"`
+	Last  *NatResult `json:"last,omitempty"`
+
+	// DDNSHostname and DDNSPublished remember the last successful record
+	// update, so a restart does not push the same address again
+	DDNSHostname  string `json:"ddns_hostname,omitempty"`
+	DDNSPublished string `json:"ddns_published,omitempty"`
+}
+
+// defaultStatePath returns where watch keeps its state, next to the
+// fingerprint salt in the user's config directory, or "" without one
+func defaultStatePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "nat-info", "watch-state.json")
+}
+
+// loadWatchState reads the state file. A missing file is a first start and
+// not an error.
+func loadWatchState(path string) (watchState, error) {
+	var st watchState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// saveWatchState replaces the state file through a rename, so a crash or
+// power loss mid-write leaves the previous state rather than a torn file
+func saveWatchState(path string, st watchState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// restoreState seeds the watcher from its state file
+func (w *watcher) restoreState() {
+	if w.statePath == "" {
+		return
+	}
+	st, err := loadWatchState(w.statePath)
+	if err != nil {
+		printProgress("Ignoring watch state " + w.statePath + ": " + err.Error())
+		return
+	}
+	w.last = st.Last
+	if w.ddns != nil && st.DDNSHostname == w.ddns.hostname {
+		w.ddns.published = st.DDNSPublished
+	}
+}
+
+// saveState writes the watcher's change-detection context to its state file
+func (w *watcher) saveState() {
+	if w.statePath == "" {
+		return
+	}
+	st := watchState{Saved: time.Now(), Last: w.last}
+	if w.ddns != nil {
+		st.DDNSHostname = w.ddns.hostname
+		st.DDNSPublished = w.ddns.published
+	}
+	if err := saveWatchState(w.statePath, st); err != nil {
+		printProgress("Error saving watch state: " + err.Error())
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rahulshinde11/nat-info/natinfo"
+)
+
+// ICEServer is one entry of an RTCConfiguration's iceServers list. URLs
+// may be a single string or a list, as browsers accept both.
+type ICEServer struct {
+	URLs       iceURLs `json:"urls"`
+	Username   string  `json:"username,omitempty"`
+	Credential string  `json:"credential,omitempty"`
+}
+
+type iceURLs []string
+
+func (u *iceURLs) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*u = iceURLs{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("urls must be a string or a list of strings")
+	}
+	*u = many
+	return nil
+}
+
+// loadICEServers reads an RTCConfiguration ({"iceServers": [...]}) or a
+// bare iceServers list
+func loadICEServers(path string) ([]ICEServer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		var cfg struct {
+			ICEServers []ICEServer `json:"iceServers"`
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+		servers = cfg.ICEServers
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no ICE servers configured")
+	}
+	return servers, nil
+}
+
+// iceURL is a parsed stun:, stuns:, turn: or turns: URI (RFC 7064, 7065)
+type iceURL struct {
+	Raw       string
+	Scheme    string
+	Host      string
+	Port      int
+	Transport string // udp, tcp or tls
+}
+
+func (u iceURL) turn() bool {
+	return u.Scheme == "turn" || u.Scheme == "turns"
+}
+
+func (u iceURL) addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// parseICEURL parses an ICE server URI, defaulting the port by scheme and
+// the transport to UDP, or TLS for the secure schemes
+func parseICEURL(raw string) (iceURL, error) {
+	u := iceURL{Raw: raw}
+	scheme, rest, ok := strings.Cut(raw, ":")
+	if !ok {
+		return u, errors.New("missing scheme")
+	}
+	u.Scheme = strings.ToLower(scheme)
+	switch u.Scheme {
+	case "stun", "turn":
+		u.Port, u.Transport = 3478, "udp"
+	case "stuns", "turns":
+		u.Port, u.Transport = 5349, "tls"
+	default:
+		return u, errors.New("unsupported scheme " + scheme)
+	}
+
+	hostport, query, _ := strings.Cut(rest, "?")
+	if query != "" {
+		key, value, _ := strings.Cut(query, "=")
+		if key != "transport" || !u.turn() {
+			return u, errors.New("unsupported query " + query)
+		}
+		switch value {
+		case "udp":
+			if u.Scheme == "turns" {
+				return u, errors.New("turns: runs over TCP")
+			}
+		case "tcp":
+			if u.Scheme == "turns" {
+				value = "tls"
+			}
+		default:
+			return u, errors.New("unsupported transport " + value)
+		}
+		u.Transport = value
+	}
+
+	u.Host = hostport
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return u, errors.New("invalid port " + port)
+		}
+		u.Host, u.Port = host, p
+	}
+	u.Host = strings.Trim(u.Host, "[]")
+	if u.Host == "" {
+		return u, errors.New("missing host")
+	}
+	// A reg-name may carry an internationalized name percent-encoded
+	// (RFC 3986); dialing and TLS verification need its A-label form
+	host, err := url.PathUnescape(u.Host)
+	if err != nil {
+		return u, errors.New("invalid host " + u.Host)
+	}
+	if u.Host, err = natinfo.NormalizeHost(host); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// ICEServerCheck is what one configured URL did during the preflight
+type ICEServerCheck struct {
+	URL       string          `json:"url"`
+	Transport string          `json:"transport"`
+	OK        bool            `json:"ok"`
+	RTT       time.Duration   `json:"rtt,omitempty"`
+	Mapped    *StunResult     `json:"mapped,omitempty"`
+	Relay     *TurnAllocation `json:"relay,omitempty"`
+	// RelayVerified is set when a datagram sent to the relayed address from
+	// another socket came back through the server
+	RelayVerified bool   `json:"relay_verified,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ICECandidate is a gathered candidate in the terms of an SDP a=candidate line
+type ICECandidate struct {
+	Type      string `json:"type"` // host, srflx or relay
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	RelAddr   string `json:"related_address,omitempty"`
+	RelPort   int    `json:"related_port,omitempty"`
+	Server    string `json:"server,omitempty"`
+	Transport string `json:"transport"`
+}
+
+// sdp renders the candidate as an a=candidate attribute
+func (c ICECandidate) sdp(foundation int) string {
+	line := "a=candidate:" + strconv.Itoa(foundation) + " 1 udp " + strconv.FormatUint(uint64(iceCandidatePriority(c.Type)), 10) +
+		" " + c.Address + " " + strconv.Itoa(c.Port) + " typ " + c.Type
+	if c.RelAddr != "" {
+		line += " raddr " + c.RelAddr + " rport " + strconv.Itoa(c.RelPort)
+	}
+	return line
+}
+
+// iceCandidatePriority extends candidatePriority with relayed candidates
+func iceCandidatePriority(typ string) uint32 {
+	if typ == "relay" {
+		return 65535<<8 | 255
+	}
+	return candidatePriority(typ)
+}
+
+// WebRTC preflight verdicts
+const (
+	// WebRTCReady: reflexive and relayed candidates were gathered and the
+	// relay carried a datagram, so calls connect directly or through TURN
+	WebRTCReady = "ready"
+	// WebRTCRelayOnly: only TURN works, so every call is relayed
+	WebRTCRelayOnly = "relay-only"
+	// WebRTCNoRelay: STUN works but no TURN relay does, so calls with peers
+	// behind symmetric NATs or strict firewalls will fail
+	WebRTCNoRelay = "no-relay"
+	// WebRTCBlocked: no configured server could be reached
+	WebRTCBlocked = "blocked"
+)
+
+// WebRTCPreflight is the result of webrtc-preflight
+type WebRTCPreflight struct {
+	Time       time.Time        `json:"time"`
+	Version    string           `json:"version"`
+	Servers    []ICEServerCheck `json:"servers"`
+	Candidates []ICECandidate   `json:"candidates"`
+	NAT        *NatResult       `json:"nat,omitempty"`
+	Verdict    string           `json:"verdict"`
+	Notes      []string         `json:"notes,omitempty"`
+}
+
+// webrtcPreflight gathers candidates from every configured URL the way a
+// browser would, with one UDP socket for all STUN servers and its own
+// allocation per TURN URL, then checks each relay carries traffic. opts
+// gives the interface and socket settings; its servers and timeouts are
+// replaced.
+func webrtcPreflight(servers []ICEServer, opts DetectOptions, timeout time.Duration) (*WebRTCPreflight, error) {
+	env := opts.probeEnv()
+	conn, localIP, err := env.listenLocal()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+
+	p := &WebRTCPreflight{Time: time.Now(), Version: version}
+	p.Candidates = append(p.Candidates, ICECandidate{Type: "host", Address: localIP, Port: localPort, Transport: "udp"})
+
+	for _, server := range servers {
+		for _, raw := range server.URLs {
+			check := ICEServerCheck{URL: raw}
+			u, err := parseICEURL(raw)
+			if err != nil {
+				check.Error = "invalid URL: " + err.Error()
+				p.Servers = append(p.Servers, check)
+				continue
+			}
+			check.Transport = u.Transport
+			printProgress("Checking " + raw + "...")
+			if u.turn() {
+				p.checkTURN(&check, u, server, env, timeout)
+			} else {
+				p.checkSTUN(&check, u, env, conn, localIP, localPort, timeout)
+			}
+			p.Servers = append(p.Servers, check)
+		}
+	}
+
+	// NAT behavior against the configured STUN servers, so the verdict
+	// speaks about the servers the product actually uses
+	opts.PrimaryTimeout, opts.MappingTimeout, opts.ProbeTimeout = timeout, timeout, timeout
+	opts.Servers = nil
+	for _, check := range p.Servers {
+		if u, err := parseICEURL(check.URL); err == nil && !u.turn() && u.Transport == "udp" {
+			opts.Servers = append(opts.Servers, u.addr())
+		}
+	}
+	if len(opts.Servers) > 0 {
+		printProgress("Detecting NAT behavior...")
+		if result, err := detectNATType(opts); err == nil {
+			p.NAT = result
+		} else {
+			p.Notes = append(p.Notes, "NAT detection failed: "+err.Error())
+		}
+	}
+
+	p.judge()
+	return p, nil
+}
+
+// checkSTUN sends a binding request like ICE gathering does; over UDP it
+// comes from the shared socket and yields a server-reflexive candidate
+func (p *WebRTCPreflight) checkSTUN(check *ICEServerCheck, u iceURL, env *probeEnv, conn *net.UDPConn, localIP string, localPort int, timeout time.Duration) {
+	if u.Transport == "udp" {
+		endpoints, err := env.resolveServer(u.addr())
+		if err != nil {
+			check.Error = err.Error()
+			return
+		}
+		res, err := env.makeStunRequest(conn, endpoints[0].Addr, nil, timeout, true, 0)
+		if err != nil {
+			check.Error = err.Error()
+			return
+		}
+		check.OK, check.Mapped, check.RTT = true, res, res.RTT
+		p.addCandidate(ICECandidate{Type: "srflx", Address: res.IP.String(), Port: res.Port, RelAddr: localIP, RelPort: localPort, Server: u.Raw, Transport: "udp"})
+		return
+	}
+
+	// stuns: only shows the server is reachable; browsers gather no
+	// candidates from it
+	tc, err := env.dialTurn(u.Transport, u.addr(), u.Host, timeout)
+	if err != nil {
+		check.Error = err.Error()
+		return
+	}
+	defer tc.Close()
+	tid := make([]byte, 12)
+	rand.Read(tid)
+	resp, buf, rtt, err := tc.roundTrip(encodeStunMessage(BindingRequest, tid, nil), timeout, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return
+	}
+	if terr := responseError(resp); terr != nil {
+		check.Error = terr.Error()
+		return
+	}
+	check.OK, check.RTT = true, rtt
+	if v, ok := findAttribute(resp, AttrXorMappedAddress); ok {
+		check.Mapped = decodeAddress(v, buf[4:20])
+	}
+}
+
+// checkTURN allocates a relay with the server's credentials and checks it
+// by sending a datagram to the relayed address from another socket
+func (p *WebRTCPreflight) checkTURN(check *ICEServerCheck, u iceURL, server ICEServer, env *probeEnv, timeout time.Duration) {
+	tc, err := env.dialTurn(u.Transport, u.addr(), u.Host, timeout)
+	if err != nil {
+		check.Error = err.Error()
+		return
+	}
+	defer tc.Close()
+
+	client := newTurnClient(tc, server.Username, server.Credential, timeout)
+	alloc, err := client.allocate()
+	if err != nil {
+		var terr *turnError
+		if errors.As(err, &terr) && terr.Code == 401 {
+			check.Error = "credentials rejected (" + terr.Error() + ")"
+		} else {
+			check.Error = err.Error()
+		}
+		return
+	}
+	defer client.release()
+	check.OK, check.Relay, check.RTT = true, alloc, alloc.RTT
+	check.Mapped = alloc.Mapped
+
+	rel := ICECandidate{Type: "relay", Address: alloc.Relayed.IP.String(), Port: alloc.Relayed.Port, Server: u.Raw, Transport: u.Transport}
+	if alloc.Mapped != nil {
+		rel.RelAddr, rel.RelPort = alloc.Mapped.IP.String(), alloc.Mapped.Port
+	}
+	p.addCandidate(rel)
+
+	verified, err := verifyRelay(client, alloc, u, env, timeout)
+	if err != nil {
+		check.Error = "relay check: " + err.Error()
+	}
+	check.RelayVerified = verified
+}
+
+// verifyRelay sends a datagram from a fresh socket to the relayed address
+// and waits for the server to deliver it as a Data indication, which is
+// what a remote peer's media does
+func verifyRelay(client *turnClient, alloc *TurnAllocation, u iceURL, env *probeEnv, timeout time.Duration) (bool, error) {
+	probe, _, err := env.listenLocal()
+	if err != nil {
+		return false, err
+	}
+	defer probe.Close()
+
+	// The permission must name the probe's public address, which the TURN
+	// server reports for a binding request over UDP
+	endpoints, err := env.resolveServer(u.addr())
+	if err != nil {
+		return false, err
+	}
+	mapped, err := env.makeStunRequest(probe, endpoints[0].Addr, nil, timeout, true, 0)
+	if err != nil {
+		return false, errors.New("no public address for the probe socket: " + err.Error())
+	}
+	peer := &net.UDPAddr{IP: mapped.IP.AsSlice(), Port: mapped.Port}
+	if err := client.permit(peer); err != nil {
+		return false, errors.New("CreatePermission failed: " + err.Error())
+	}
+
+	payload := make([]byte, 16)
+	rand.Read(payload)
+	relayed := &net.UDPAddr{IP: alloc.Relayed.IP.AsSlice(), Port: alloc.Relayed.Port}
+	for i := 0; i < 3; i++ {
+		if _, err := probe.WriteToUDP(payload, relayed); err != nil {
+			return false, err
+		}
+		if client.await(payload, timeout/3) {
+			return true, nil
+		}
+	}
+	return false, errors.New("nothing arrived through the relay")
+}
+
+// addCandidate adds a candidate unless an identical one was gathered
+// already, as browsers do when two servers report the same mapping
+func (p *WebRTCPreflight) addCandidate(c ICECandidate) {
+	for _, have := range p.Candidates {
+		if have.Type == c.Type && have.Address == c.Address && have.Port == c.Port {
+			return
+		}
+	}
+	p.Candidates = append(p.Candidates, c)
+}
+
+// judge sets the verdict and the notes explaining it
+func (p *WebRTCPreflight) judge() {
+	var stunOK, turnConfigured, turnOK, relayOK, authFailed bool
+	for _, check := range p.Servers {
+		u, err := parseICEURL(check.URL)
+		if err != nil {
+			continue
+		}
+		switch {
+		case u.turn():
+			turnConfigured = true
+			turnOK = turnOK || check.OK
+			relayOK = relayOK || check.RelayVerified
+			authFailed = authFailed || strings.HasPrefix(check.Error, "credentials rejected")
+		case check.OK:
+			stunOK = true
+		}
+	}
+
+	switch {
+	case !stunOK && !turnOK:
+		p.Verdict = WebRTCBlocked
+		p.Notes = append(p.Notes, "No configured ICE server answered; calls cannot connect from this network. Check that outbound UDP 3478 and TCP/TLS to the TURN servers are allowed.")
+	case !turnOK:
+		p.Verdict = WebRTCNoRelay
+		if turnConfigured {
+			p.Notes = append(p.Notes, "No TURN server produced a relay, so calls with peers behind symmetric NATs or strict firewalls will fail.")
+		} else {
+			p.Notes = append(p.Notes, "No TURN server is configured, so calls with peers behind symmetric NATs or strict firewalls will fail.")
+		}
+	case !stunOK:
+		p.Verdict = WebRTCRelayOnly
+		p.Notes = append(p.Notes, "STUN gathered no reflexive candidate, so every call will go through TURN; expect higher latency and relay bandwidth costs.")
+	case !relayOK:
+		p.Verdict = WebRTCNoRelay
+		p.Notes = append(p.Notes, "A relay was allocated but carried no test datagram; calls that need TURN may fail.")
+	default:
+		p.Verdict = WebRTCReady
+	}
+	if authFailed {
+		p.Notes = append(p.Notes, "A TURN server rejected the configured credentials; they may have expired (time-limited TURN REST credentials often last only hours).")
+	}
+	if p.NAT != nil && p.NAT.Type == NATSymmetric && stunOK {
+		p.Notes = append(p.Notes, "This network's NAT is symmetric, so direct calls often fail and rely on TURN.")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency bounds the batch modes unless --concurrency says otherwise
+const DefaultConcurrency = 16
+
+// forEachLimit calls fn for every index in [0, n) from at most workers
+// goroutines, so batch modes can probe hundreds of targets without opening
+// hundreds of sockets at once
+func forEachLimit(n, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// sharedSocket runs many binding transactions on one socket at once. A
+// single reader hands each response to the transaction whose ID it carries;
+// makeStunRequest cannot be used concurrently since each call would read,
+// and drop, the others' responses.
+type sharedSocket struct {
+	env     *probeEnv
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	waiting map[[12]byte]pendingBind
+}
+
+// pendingBind is a transaction waiting for its response
+type pendingBind struct {
+	to *net.UDPAddr
+	ch chan stampedPacket
+}
+
+// stampedPacket is a response and its kernel receive timestamp, if any
+type stampedPacket struct {
+	data  []byte
+	stamp time.Time
+}
+
+// newSharedSocket starts reading conn; it stops when conn is closed
+func newSharedSocket(env *probeEnv, conn *net.UDPConn) *sharedSocket {
+	s := &sharedSocket{env: env, conn: conn, waiting: make(map[[12]byte]pendingBind)}
+	go s.serve()
+	return s
+}
+
+func (s *sharedSocket) serve() {
+	batch := newPacketBatch(s.conn, batchSize, 2048)
+	for {
+		n, err := batch.read()
+		if err != nil {
+			return
+		}
+		for _, m := range batch.msgs[:n] {
+			if m.N < HeaderLength {
+				continue
+			}
+			tid := [12]byte(m.Buf[8:20])
+			s.mu.Lock()
+			p, ok := s.waiting[tid]
+			// A spoofed answer must not use up the slot of the real one
+			if ok && s.env.strictSource && (!m.Addr.IP.Equal(p.to.IP) || m.Addr.Port != p.to.Port) {
+				ok = false
+			}
+			if ok {
+				delete(s.waiting, tid)
+			}
+			s.mu.Unlock()
+			if ok {
+				p.ch <- stampedPacket{append([]byte(nil), m.Buf[:m.N]...), stampOf(m.OOB[:m.OOBN])}
+			}
+		}
+	}
+}
+
+// bind runs one RFC 5389 binding transaction against addr, retransmitting
+// on the same schedule as makeStunRequest and sharing its RTO estimates
+func (s *sharedSocket) bind(addr *net.UDPAddr, timeout time.Duration) (*StunResult, error) {
+	statTransactions.Add(1)
+	var tid [12]byte
+	if _, err := rand.Read(tid[:]); err != nil {
+		return nil, err
+	}
+	req := make([]byte, HeaderLength)
+	binary.BigEndian.PutUint16(req[0:2], BindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], MagicCookie)
+	copy(req[8:20], tid[:])
+
+	ch := make(chan stampedPacket, 1)
+	s.mu.Lock()
+	s.waiting[tid] = pendingBind{to: addr, ch: ch}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiting, tid)
+		s.mu.Unlock()
+	}()
+
+	deadline := s.env.clock.Now().Add(timeout)
+	local := s.conn.LocalAddr()
+	retransmit := s.env.rto.initial(local, addr)
+	for attempt := 0; s.env.clock.Now().Before(deadline); attempt++ {
+		if attempt > 0 {
+			statRetransmits.Add(1)
+		}
+		if _, err := s.conn.WriteToUDP(req, addr); err != nil {
+			return nil, err
+		}
+		sent := s.env.clock.Now()
+		wait := min(retransmit, deadline.Sub(sent))
+		retransmit *= 2
+
+		timer := make(chan struct{})
+		t := s.env.clock.AfterFunc(wait, func() { close(timer) })
+		select {
+		case resp := <-ch:
+			t.Stop()
+			result, err := parseStunResponse(resp.data)
+			if err != nil {
+				statParseErrors.Add(1)
+				return nil, err
+			}
+			result.RTT = s.env.receivedAt(resp.stamp, sent).Sub(sent)
+			if attempt == 0 {
+				s.env.rto.sample(local, addr, result.RTT)
+			} else {
+				s.env.rto.backoff(local, addr, retransmit/2)
+			}
+			return result, nil
+		case <-timer:
+		}
+	}
+	statTimeouts.Add(1)
+	s.env.rto.backoff(local, addr, retransmit/2)
+	return nil, errors.New("STUN request timeout")
+}